@@ -0,0 +1,166 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/geekp2p/p2p-chat-go/internal/backup"
+	"github.com/geekp2p/p2p-chat-go/internal/storage"
+	"github.com/geekp2p/p2p-chat-go/internal/updater"
+)
+
+// configVars are the settings bundled into a backup; secrets are left out
+var configVars = []string{"CHAT_TOPIC", "ROOM_OWNER", "RETENTION", "DB_KEYFILE"}
+
+// backupPassphrase returns the secret that encrypts the identity in backups
+func backupPassphrase() string {
+	if p := os.Getenv("BACKUP_PASSPHRASE"); p != "" {
+		return p
+	}
+	return os.Getenv("IDENTITY_PASSPHRASE")
+}
+
+// backupOptions builds the options of a backup of dataDir
+func backupOptions(dataDir string, incremental, noIdentity bool) (backup.Options, error) {
+	opts := backup.Options{
+		DataDir:     dataDir,
+		Incremental: incremental,
+		Config:      make(map[string]string),
+		AppVersion:  updater.Version,
+	}
+	for _, name := range configVars {
+		if v := os.Getenv(name); v != "" {
+			opts.Config[name] = v
+		}
+	}
+
+	if !noIdentity {
+		opts.Passphrase = backupPassphrase()
+		if opts.Passphrase == "" {
+			return opts, fmt.Errorf("set BACKUP_PASSPHRASE to encrypt the identity key, or pass --no-identity")
+		}
+	}
+	return opts, nil
+}
+
+// runBackup handles `p2p-chat backup` and returns the exit code
+// The chat must not be running; use /backup inside the chat for an online backup
+func runBackup(args []string) int {
+	chatTopic, dataDir := envConfig()
+
+	fs := flag.NewFlagSet("backup", flag.ContinueOnError)
+	incremental := fs.Bool("incremental", false, "Only back up changes since the last backup")
+	noIdentity := fs.Bool("no-identity", false, "Leave the identity key out of the archive")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: p2p-chat backup [--incremental] [--no-identity] <file>")
+		return 2
+	}
+
+	opts, err := backupOptions(dataDir, *incremental, *noIdentity)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 2
+	}
+
+	store, err := storage.NewMessageStore(dataDir, storage.Options{
+		DefaultRoom:    chatTopic,
+		SkipMigrations: true,
+		Encryption:     keySource(),
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to open message store at %s: %v\n", dataDir, err)
+		return 1
+	}
+	defer store.Close()
+
+	m, err := backup.Create(store, fs.Arg(0), opts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "❌ Backup failed: %v\n", err)
+		return 1
+	}
+
+	fmt.Printf("✓ Backed up %d message(s) and %d contact(s) to %s\n", m.Messages, m.Contacts, fs.Arg(0))
+	if m.Incremental() {
+		fmt.Printf("  Incremental: changes after version %d, up to %d\n", m.Since, m.Version)
+	}
+	if opts.Passphrase == "" {
+		fmt.Println("  The identity key is not included.")
+	}
+	return 0
+}
+
+// runRestore handles `p2p-chat restore` and returns the exit code
+// A full backup restores into an empty DATA_DIR; an incremental one is applied
+// on top of the restore or backup it continues
+func runRestore(args []string) int {
+	_, dataDir := envConfig()
+
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: p2p-chat restore <file>")
+		return 2
+	}
+
+	archive, err := backup.Open(args[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "❌ Cannot restore %s: %v\n", args[0], err)
+		return 1
+	}
+	defer archive.Close()
+	m := archive.Manifest
+
+	if m.Incremental() {
+		w, err := backup.ReadWatermark(dataDir)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "❌ %v\n", err)
+			return 1
+		}
+		if !storage.HasStore(dataDir) || w == nil {
+			fmt.Fprintf(os.Stderr, "❌ %s is incremental: restore the full backup it builds on first\n", args[0])
+			return 1
+		}
+		if m.Since > w.Version {
+			fmt.Fprintf(os.Stderr, "❌ %s continues from version %d but %s only reaches %d: restore the backups in between first\n",
+				args[0], m.Since, dataDir, w.Version)
+			return 1
+		}
+	} else if storage.HasStore(dataDir) {
+		fmt.Fprintf(os.Stderr, "❌ %s already holds a message store; restore into an empty DATA_DIR\n", dataDir)
+		return 1
+	}
+
+	if err := archive.InstallKeys(dataDir, backupPassphrase()); err != nil {
+		fmt.Fprintf(os.Stderr, "❌ %v\n", err)
+		return 1
+	}
+
+	store, err := storage.NewMessageStore(dataDir, storage.Options{
+		SkipMigrations: true,
+		Encryption:     keySource(),
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to open message store at %s: %v\n", dataDir, err)
+		return 1
+	}
+	defer store.Close()
+
+	if err := archive.Load(store, dataDir); err != nil {
+		fmt.Fprintf(os.Stderr, "❌ %v\n", err)
+		return 1
+	}
+
+	fmt.Printf("✓ Restored %s (%d message(s), %d contact(s), created %s)\n",
+		args[0], m.Messages, m.Contacts, m.Created.Local().Format("2006-01-02 15:04"))
+	if archive.HasIdentity() && !m.Incremental() {
+		fmt.Println("  Identity key restored")
+	}
+	if path, err := archive.RestoreConfig(dataDir); err != nil {
+		fmt.Fprintf(os.Stderr, "⚠️  Failed to write the archived config: %v\n", err)
+	} else if path != "" {
+		fmt.Printf("  Archived settings written to %s\n", path)
+	}
+	return 0
+}
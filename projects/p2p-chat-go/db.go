@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/geekp2p/p2p-chat-go/internal/storage"
+)
+
+// runDB handles `p2p-chat db <command>` and returns the exit code
+// The chat must not be running: badger allows one process per data directory
+func runDB(args []string) int {
+	if len(args) == 2 && args[0] == "keyfile" {
+		return runKeyFile(args[1])
+	}
+	if len(args) != 1 {
+		return dbUsage()
+	}
+
+	chatTopic, dataDir := envConfig()
+
+	switch args[0] {
+	case "migrate", "status":
+	case "rotate-key":
+		return runRotateKey(dataDir)
+	case "rekey":
+		return runRekey(dataDir)
+	default:
+		return dbUsage()
+	}
+
+	store, err := storage.NewMessageStore(dataDir, storage.Options{
+		SkipMigrations: true,
+		Encryption:     keySource(),
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to open message store at %s: %v\n", dataDir, err)
+		return 1
+	}
+	defer store.Close()
+
+	if args[0] == "migrate" {
+		applied, err := store.Migrate(chatTopic, printMigrationProgress)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "❌ %v\n", err)
+			fmt.Fprintln(os.Stderr, "Run `p2p-chat db migrate` again to resume.")
+			return 1
+		}
+		if len(applied) == 0 {
+			fmt.Println("✓ Message store is up to date")
+		} else {
+			fmt.Printf("✓ Applied %d migration(s)\n", len(applied))
+		}
+	}
+
+	status, err := store.SchemaStatus()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read schema status: %v\n", err)
+		return 1
+	}
+
+	fmt.Printf("\n=== Message Store (%s) ===\n", dataDir)
+	fmt.Printf("Schema version: v%d (latest: v%d)\n", status.Version, status.Latest)
+	fmt.Printf("Messages: %d in %d room(s)\n", status.Messages, len(status.Rooms))
+	if status.Encrypted {
+		fmt.Println("Encryption: on")
+	} else {
+		fmt.Println("Encryption: off (set IDENTITY_PASSPHRASE or DB_KEYFILE to enable)")
+	}
+	if status.Resuming != 0 {
+		fmt.Printf("⚠️  Migration v%d was interrupted and will resume on the next start\n", status.Resuming)
+	}
+	if len(status.Pending) == 0 {
+		fmt.Println("Pending migrations: none")
+	} else {
+		fmt.Println("Pending migrations:")
+		for _, m := range status.Pending {
+			fmt.Printf("  v%d  %s\n", m.Version, m.Description)
+		}
+	}
+	if status.LastBackup != "" {
+		fmt.Printf("Last pre-migration backup: %s\n", status.LastBackup)
+	}
+	fmt.Println()
+
+	return 0
+}
+
+// dbUsage prints the db subcommands and returns the usage exit code
+func dbUsage() int {
+	fmt.Fprintln(os.Stderr, "Usage: p2p-chat db migrate|status|rotate-key|rekey|keyfile <path>")
+	fmt.Fprintln(os.Stderr, "  migrate         Back up the message store and upgrade it to the latest schema")
+	fmt.Fprintln(os.Stderr, "  status          Show the schema version and pending migrations")
+	fmt.Fprintln(os.Stderr, "  rotate-key      Replace the database encryption key")
+	fmt.Fprintln(os.Stderr, "  rekey           Protect the database key with NEW_IDENTITY_PASSPHRASE or NEW_DB_KEYFILE")
+	fmt.Fprintln(os.Stderr, "  keyfile <path>  Generate a random keyfile for DB_KEYFILE")
+	return 2
+}
+
+// runRotateKey replaces the data key of an encrypted store
+func runRotateKey(dataDir string) int {
+	if err := storage.RotateDataKey(dataDir, keySource()); err != nil {
+		fmt.Fprintf(os.Stderr, "❌ Failed to rotate key: %v\n", err)
+		return 1
+	}
+	fmt.Println("✓ Database key rotated")
+	fmt.Println("  Backups made before the rotation still need the old key.")
+	return 0
+}
+
+// runRekey wraps the data key with a new passphrase or keyfile
+func runRekey(dataDir string) int {
+	next := storage.KeySource{
+		Passphrase: os.Getenv("NEW_IDENTITY_PASSPHRASE"),
+		KeyFile:    os.Getenv("NEW_DB_KEYFILE"),
+	}
+	if !next.Enabled() {
+		fmt.Fprintln(os.Stderr, "Set NEW_IDENTITY_PASSPHRASE or NEW_DB_KEYFILE to the new secret")
+		return 2
+	}
+
+	if err := storage.RewrapDataKey(dataDir, keySource(), next); err != nil {
+		fmt.Fprintf(os.Stderr, "❌ Failed to change the database secret: %v\n", err)
+		return 1
+	}
+	fmt.Println("✓ Database key is now protected by the new secret")
+	fmt.Println("  Update IDENTITY_PASSPHRASE / DB_KEYFILE before the next start.")
+	return 0
+}
+
+// runKeyFile writes a new random keyfile
+func runKeyFile(path string) int {
+	if err := storage.GenerateKeyFile(path); err != nil {
+		fmt.Fprintf(os.Stderr, "❌ Failed to create keyfile: %v\n", err)
+		return 1
+	}
+	fmt.Printf("✓ Keyfile written to %s\n", path)
+	fmt.Println("  Keep a copy somewhere safe: without it the message store cannot be read.")
+	return 0
+}
+
+// printMigrationProgress reports schema migration progress on the terminal
+func printMigrationProgress(p storage.MigrationProgress) {
+	switch {
+	case p.Done == 0 && p.Total == 0:
+		fmt.Printf("🔧 Migrating message store to v%d: %s...\n", p.Version, p.Description)
+	case p.Total > 0:
+		fmt.Printf("   %d/%d (%d%%)\n", p.Done, p.Total, p.Done*100/p.Total)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/geekp2p/p2p-chat-go/internal/storage"
+	"github.com/geekp2p/p2p-chat-go/internal/transcript"
+)
+
+// runExport handles `p2p-chat export` and returns the exit code
+func runExport(args []string) int {
+	chatTopic, dataDir := envConfig()
+
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	room := fs.String("room", chatTopic, "Room to export (empty for all rooms)")
+	since := fs.String("since", "", "Export messages since a time (e.g. 24h, 7d, 2006-01-02)")
+	until := fs.String("until", "", "Export messages before a time")
+	format := fs.String("format", "jsonl", "Output format: jsonl, md or html")
+	output := fs.String("o", "", "Output file (default: stdout)")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	f, err := transcript.ParseFormat(*format)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 2
+	}
+	opts := transcript.ExportOptions{Room: *room, Format: f}
+
+	now := time.Now()
+	if *since != "" {
+		if opts.Since, err = storage.ParseTime(*since, now); err != nil {
+			fmt.Fprintf(os.Stderr, "--since: %v\n", err)
+			return 2
+		}
+	}
+	if *until != "" {
+		if opts.Until, err = storage.ParseTime(*until, now); err != nil {
+			fmt.Fprintf(os.Stderr, "--until: %v\n", err)
+			return 2
+		}
+	}
+
+	// Stay quiet on stdout, which may carry the transcript
+	store, err := storage.NewMessageStore(dataDir, storage.Options{
+		DefaultRoom: chatTopic,
+		Encryption:  keySource(),
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to open message store at %s: %v\n", dataDir, err)
+		return 1
+	}
+	defer store.Close()
+
+	var w io.Writer = os.Stdout
+	if *output != "" {
+		file, err := os.Create(*output)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to create %s: %v\n", *output, err)
+			return 1
+		}
+		defer file.Close()
+		w = file
+	}
+
+	count, err := transcript.Export(store, w, opts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "❌ Export failed after %d message(s): %v\n", count, err)
+		return 1
+	}
+	if *output != "" {
+		fmt.Printf("✓ Exported %d message(s) to %s\n", count, *output)
+	}
+	return 0
+}
+
+// runImport handles `p2p-chat import` and returns the exit code
+func runImport(args []string) int {
+	chatTopic, dataDir := envConfig()
+
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	room := fs.String("room", chatTopic, "Room for imported messages that do not name one")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: p2p-chat import [--room X] <file.jsonl|->")
+		return 2
+	}
+
+	var r io.Reader = os.Stdin
+	if path := fs.Arg(0); path != "-" {
+		file, err := os.Open(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to open %s: %v\n", path, err)
+			return 1
+		}
+		defer file.Close()
+		r = file
+	}
+
+	store, err := storage.NewMessageStore(dataDir, storage.Options{
+		DefaultRoom: chatTopic,
+		Progress:    printMigrationProgress,
+		Encryption:  keySource(),
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to open message store at %s: %v\n", dataDir, err)
+		return 1
+	}
+	defer store.Close()
+
+	result, err := transcript.Import(store, r, *room)
+	if result != nil {
+		fmt.Printf("Imported %d new message(s), skipped %d duplicate(s)", result.Imported, result.Duplicate)
+		if result.Invalid > 0 {
+			fmt.Printf(", ignored %d invalid line(s)", result.Invalid)
+		}
+		fmt.Println()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "❌ %v\n", err)
+		return 1
+	}
+	return 0
+}
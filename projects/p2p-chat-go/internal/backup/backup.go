@@ -0,0 +1,612 @@
+package backup
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/geekp2p/p2p-chat-go/internal/identity"
+	"github.com/geekp2p/p2p-chat-go/internal/storage"
+	"golang.org/x/crypto/argon2"
+)
+
+// Archive layout: a gzipped tar holding these files, manifest first
+const (
+	manifestFile = "manifest.json"
+	messagesFile = "messages.db"       // badger backup stream, sealed if the store is encrypted
+	dbKeyFile    = storage.KeyFileName // Wrapped data key of an encrypted store
+	identityFile = "identity.key.enc"  // Peer identity, encrypted with the backup passphrase
+	configFile   = "config.env"        // Non-secret settings the node ran with
+)
+
+// FormatVersion is the archive format written by this build
+const FormatVersion = 1
+
+// WatermarkFile records the newest version backed up, inside the data dir
+const WatermarkFile = "backup-watermark.json"
+
+// RestoredConfigFile receives the config of a restored archive, inside the data dir
+const RestoredConfigFile = "restored-config.env"
+
+// Manifest describes a backup archive
+type Manifest struct {
+	Format        int       `json:"format"`
+	Created       time.Time `json:"created"`
+	AppVersion    string    `json:"app_version"`
+	Since         uint64    `json:"since"`   // Only changes after this version; 0 for a full backup
+	Version       uint64    `json:"version"` // Highest database version included
+	Encrypted     bool      `json:"encrypted"`
+	SchemaVersion int       `json:"schema_version"`
+	Messages      int       `json:"messages"`
+	Contacts      int       `json:"contacts"`
+	Files         []File    `json:"files"`
+}
+
+// Incremental reports whether the archive only holds changes since a watermark
+func (m *Manifest) Incremental() bool {
+	return m.Since > 0
+}
+
+// File is an archive member and its checksum
+type File struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// Source is a message store that can be backed up
+type Source interface {
+	Backup(w io.Writer, since uint64) (uint64, error)
+	Encrypted() bool
+	SchemaStatus() (*storage.SchemaStatus, error)
+	GetContacts() ([]*storage.Contact, error)
+}
+
+// Target is a message store a backup can be loaded into
+type Target interface {
+	Load(r io.Reader, sealed bool) error
+}
+
+// Options configures a backup
+type Options struct {
+	DataDir     string
+	Incremental bool              // Only include changes since the saved watermark
+	Passphrase  string            // Encrypts the identity key; empty leaves it out
+	Config      map[string]string // Settings to bundle, e.g. CHAT_TOPIC
+	AppVersion  string
+}
+
+// Watermark is the newest database version covered by a backup
+type Watermark struct {
+	Version uint64    `json:"version"`
+	Created time.Time `json:"created"`
+	Archive string    `json:"archive"`
+}
+
+// ReadWatermark returns the saved watermark of a data dir, or nil if there is none
+func ReadWatermark(dataDir string) (*Watermark, error) {
+	data, err := os.ReadFile(filepath.Join(dataDir, WatermarkFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var w Watermark
+	if err := json.Unmarshal(data, &w); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", WatermarkFile, err)
+	}
+	return &w, nil
+}
+
+// saveWatermark records the version a backup or restore reached
+func saveWatermark(dataDir string, w *Watermark) error {
+	data, err := json.MarshalIndent(w, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dataDir, WatermarkFile)
+	if err := os.WriteFile(path+".tmp", data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// Create writes a backup archive of the store and data dir to path
+// It returns the manifest of the new archive
+func Create(src Source, path string, opts Options) (*Manifest, error) {
+	if _, err := os.Stat(path); err == nil {
+		return nil, fmt.Errorf("%s already exists", path)
+	}
+
+	m := &Manifest{
+		Format:     FormatVersion,
+		Created:    time.Now().UTC(),
+		AppVersion: opts.AppVersion,
+		Encrypted:  src.Encrypted(),
+	}
+
+	if opts.Incremental {
+		w, err := ReadWatermark(opts.DataDir)
+		if err != nil {
+			return nil, err
+		}
+		if w == nil {
+			return nil, fmt.Errorf("no previous backup recorded in %s; make a full backup first", opts.DataDir)
+		}
+		m.Since = w.Version
+	}
+
+	status, err := src.SchemaStatus()
+	if err != nil {
+		return nil, err
+	}
+	m.SchemaVersion, m.Messages = status.Version, status.Messages
+	contacts, err := src.GetContacts()
+	if err != nil {
+		return nil, err
+	}
+	m.Contacts = len(contacts)
+
+	// Members are staged first: tar headers need their size
+	staging, err := os.MkdirTemp(filepath.Dir(path), ".p2p-chat-backup-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(staging)
+
+	err = stage(staging, messagesFile, func(w io.Writer) error {
+		m.Version, err = src.Backup(w, m.Since)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to back up messages: %w", err)
+	}
+	if m.Version < m.Since {
+		m.Version = m.Since // Nothing changed since the last backup
+	}
+
+	if m.Encrypted {
+		data, err := os.ReadFile(filepath.Join(opts.DataDir, dbKeyFile))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read database key: %w", err)
+		}
+		if err := stageBytes(staging, dbKeyFile, data); err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.Passphrase != "" {
+		key, err := os.ReadFile(filepath.Join(opts.DataDir, identity.DefaultIdentityFile))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("failed to read identity: %w", err)
+		}
+		if err == nil {
+			sealed, err := sealSecret(opts.Passphrase, key)
+			if err != nil {
+				return nil, err
+			}
+			if err := stageBytes(staging, identityFile, sealed); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if len(opts.Config) > 0 {
+		if err := stageBytes(staging, configFile, []byte(formatConfig(opts.Config))); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, name := range []string{messagesFile, dbKeyFile, identityFile, configFile} {
+		f, err := checksum(filepath.Join(staging, name))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		f.Name = name
+		m.Files = append(m.Files, *f)
+	}
+
+	if err := writeArchive(path, staging, m); err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+
+	err = saveWatermark(opts.DataDir, &Watermark{Version: m.Version, Created: m.Created, Archive: path})
+	return m, err
+}
+
+// stage writes one archive member into the staging dir
+func stage(dir, name string, write func(w io.Writer) error) error {
+	f, err := os.OpenFile(filepath.Join(dir, name), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if err := write(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// stageBytes stages a member with fixed content
+func stageBytes(dir, name string, data []byte) error {
+	return stage(dir, name, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+// checksum returns the size and SHA-256 of a file
+func checksum(path string) (*File, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return nil, err
+	}
+	return &File{Size: n, SHA256: hex.EncodeToString(h.Sum(nil))}, nil
+}
+
+// writeArchive writes the manifest and staged members to path
+func writeArchive(path, staging string, m *Manifest) error {
+	out, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	gz := gzip.NewWriter(out)
+	tw := tar.NewWriter(gz)
+
+	manifest, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeMember(tw, manifestFile, int64(len(manifest)), strings.NewReader(string(manifest))); err != nil {
+		return err
+	}
+
+	for _, file := range m.Files {
+		f, err := os.Open(filepath.Join(staging, file.Name))
+		if err != nil {
+			return err
+		}
+		err = writeMember(tw, file.Name, file.Size, f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+// writeMember appends one file to the archive
+func writeMember(tw *tar.Writer, name string, size int64, r io.Reader) error {
+	hdr := &tar.Header{
+		Name:    name,
+		Mode:    0600,
+		Size:    size,
+		ModTime: time.Now(),
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err := io.Copy(tw, r)
+	return err
+}
+
+// Archive is an extracted and verified backup
+type Archive struct {
+	Manifest *Manifest
+	dir      string
+}
+
+// maxMemberSize bounds members other than the message stream
+const maxMemberSize = 1 << 20
+
+// Open extracts an archive to a temporary directory and verifies every
+// member against the manifest; call Close to remove the extracted files
+func Open(path string) (*Archive, error) {
+	in, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+
+	gz, err := gzip.NewReader(in)
+	if err != nil {
+		return nil, fmt.Errorf("not a backup archive: %w", err)
+	}
+	defer gz.Close()
+
+	dir, err := os.MkdirTemp("", "p2p-chat-restore-")
+	if err != nil {
+		return nil, err
+	}
+	a := &Archive{dir: dir}
+
+	tr := tar.NewReader(gz)
+	seen := make(map[string]bool)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			a.Close()
+			return nil, fmt.Errorf("failed to read archive: %w", err)
+		}
+
+		name := hdr.Name
+		if !knownMember(name) || seen[name] {
+			a.Close()
+			return nil, fmt.Errorf("unexpected archive member %q", name)
+		}
+		seen[name] = true
+		if name != messagesFile && hdr.Size > maxMemberSize {
+			a.Close()
+			return nil, fmt.Errorf("archive member %s is too large", name)
+		}
+
+		if err := stage(dir, name, func(w io.Writer) error {
+			_, err := io.Copy(w, tr)
+			return err
+		}); err != nil {
+			a.Close()
+			return nil, err
+		}
+	}
+
+	if err := a.verify(); err != nil {
+		a.Close()
+		return nil, err
+	}
+	return a, nil
+}
+
+// knownMember reports whether name belongs in an archive
+func knownMember(name string) bool {
+	switch name {
+	case manifestFile, messagesFile, dbKeyFile, identityFile, configFile:
+		return true
+	}
+	return false
+}
+
+// verify loads the manifest and checks every listed member
+func (a *Archive) verify() error {
+	data, err := os.ReadFile(filepath.Join(a.dir, manifestFile))
+	if err != nil {
+		return fmt.Errorf("archive has no manifest")
+	}
+	var m Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return fmt.Errorf("failed to parse manifest: %w", err)
+	}
+	if m.Format > FormatVersion {
+		return fmt.Errorf("archive format v%d is newer than this build (v%d); please update", m.Format, FormatVersion)
+	}
+
+	hasMessages := false
+	for _, file := range m.Files {
+		if !knownMember(file.Name) || file.Name == manifestFile {
+			return fmt.Errorf("manifest lists unexpected file %q", file.Name)
+		}
+		got, err := checksum(filepath.Join(a.dir, file.Name))
+		if err != nil {
+			return fmt.Errorf("archive is missing %s", file.Name)
+		}
+		if got.Size != file.Size || got.SHA256 != file.SHA256 {
+			return fmt.Errorf("checksum mismatch for %s: archive is corrupt", file.Name)
+		}
+		hasMessages = hasMessages || file.Name == messagesFile
+	}
+	if !hasMessages {
+		return fmt.Errorf("archive has no message database")
+	}
+
+	a.Manifest = &m
+	return nil
+}
+
+// Close removes the extracted files
+func (a *Archive) Close() error {
+	return os.RemoveAll(a.dir)
+}
+
+// has reports whether the archive holds a member
+func (a *Archive) has(name string) bool {
+	for _, f := range a.Manifest.Files {
+		if f.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// HasIdentity reports whether the archive holds the encrypted identity key
+func (a *Archive) HasIdentity() bool {
+	return a.has(identityFile)
+}
+
+// InstallKeys puts the database key and identity of the archive into dataDir
+// Existing files are kept; an identity that differs from the archived one is
+// an error, so a restore never silently changes the peer ID
+func (a *Archive) InstallKeys(dataDir, passphrase string) error {
+	if err := os.MkdirAll(dataDir, 0700); err != nil {
+		return err
+	}
+
+	if a.has(dbKeyFile) {
+		dst := filepath.Join(dataDir, dbKeyFile)
+		if _, err := os.Stat(dst); os.IsNotExist(err) {
+			data, err := os.ReadFile(filepath.Join(a.dir, dbKeyFile))
+			if err != nil {
+				return err
+			}
+			if err := os.WriteFile(dst, data, 0600); err != nil {
+				return err
+			}
+		}
+	}
+
+	if !a.has(identityFile) {
+		return nil
+	}
+	if passphrase == "" {
+		return fmt.Errorf("the archived identity is encrypted; set BACKUP_PASSPHRASE")
+	}
+	sealed, err := os.ReadFile(filepath.Join(a.dir, identityFile))
+	if err != nil {
+		return err
+	}
+	key, err := openSecret(passphrase, sealed)
+	if err != nil {
+		return err
+	}
+
+	dst := filepath.Join(dataDir, identity.DefaultIdentityFile)
+	existing, err := os.ReadFile(dst)
+	if err == nil {
+		if string(existing) != string(key) {
+			return fmt.Errorf("%s already holds a different identity", dst)
+		}
+		return nil
+	}
+	return os.WriteFile(dst, key, 0600)
+}
+
+// Load applies the archived messages to the store and records the watermark
+func (a *Archive) Load(t Target, dataDir string) error {
+	f, err := os.Open(filepath.Join(a.dir, messagesFile))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := t.Load(f, a.Manifest.Encrypted); err != nil {
+		return fmt.Errorf("failed to load messages: %w", err)
+	}
+	return saveWatermark(dataDir, &Watermark{Version: a.Manifest.Version, Created: time.Now().UTC(), Archive: "restored"})
+}
+
+// RestoreConfig writes the archived settings to dataDir for review
+// It returns the path written, or "" if the archive holds no config
+func (a *Archive) RestoreConfig(dataDir string) (string, error) {
+	if !a.has(configFile) {
+		return "", nil
+	}
+	data, err := os.ReadFile(filepath.Join(a.dir, configFile))
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(dataDir, RestoredConfigFile)
+	return path, os.WriteFile(path, data, 0600)
+}
+
+// formatConfig renders settings as sorted KEY=value lines
+func formatConfig(config map[string]string) string {
+	keys := make([]string, 0, len(config))
+	for k := range config {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	for _, k := range keys {
+		fmt.Fprintf(&b, "%s=%s\n", k, config[k])
+	}
+	return b.String()
+}
+
+// sealedSecret is a secret encrypted with a passphrase
+type sealedSecret struct {
+	KDF     string `json:"kdf"`
+	Salt    []byte `json:"salt"`
+	Time    uint32 `json:"time"`
+	Memory  uint32 `json:"memory"`
+	Threads uint8  `json:"threads"`
+	Data    []byte `json:"data"` // nonce || AES-256-GCM ciphertext
+}
+
+// sealSecret encrypts data with a key derived from passphrase (argon2id)
+func sealSecret(passphrase string, data []byte) ([]byte, error) {
+	s := sealedSecret{KDF: "argon2id", Salt: make([]byte, 16), Time: 3, Memory: 64 * 1024, Threads: 4}
+	if _, err := rand.Read(s.Salt); err != nil {
+		return nil, err
+	}
+
+	aead, err := s.aead(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	s.Data = aead.Seal(nonce, nonce, data, []byte(identityFile))
+	return json.Marshal(&s)
+}
+
+// openSecret decrypts a secret sealed by sealSecret
+func openSecret(passphrase string, sealed []byte) ([]byte, error) {
+	var s sealedSecret
+	if err := json.Unmarshal(sealed, &s); err != nil || s.KDF != "argon2id" {
+		return nil, fmt.Errorf("archived identity is corrupt")
+	}
+
+	aead, err := s.aead(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	if len(s.Data) < aead.NonceSize() {
+		return nil, fmt.Errorf("archived identity is corrupt")
+	}
+	data, err := aead.Open(nil, s.Data[:aead.NonceSize()], s.Data[aead.NonceSize():], []byte(identityFile))
+	if err != nil {
+		return nil, fmt.Errorf("wrong backup passphrase")
+	}
+	return data, nil
+}
+
+// aead derives the cipher of a sealed secret from the passphrase
+func (s *sealedSecret) aead(passphrase string) (cipher.AEAD, error) {
+	key := argon2.IDKey([]byte(passphrase), s.Salt, s.Time, s.Memory, s.Threads, 32)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,376 @@
+package backup
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/geekp2p/p2p-chat-go/internal/identity"
+	"github.com/geekp2p/p2p-chat-go/internal/storage"
+)
+
+const testRoom = "test-room"
+
+// openStore opens a message store in dir
+func openStore(t *testing.T, dir string, enc storage.KeySource) *storage.MessageStore {
+	t.Helper()
+	s, err := storage.NewMessageStore(dir, storage.Options{DefaultRoom: testRoom, Encryption: enc})
+	if err != nil {
+		t.Fatalf("NewMessageStore: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// fill saves n messages to a store
+func fill(t *testing.T, s storage.Store, n int) {
+	t.Helper()
+	for i := 1; i <= n; i++ {
+		msg := &storage.Message{
+			ID:        fmt.Sprintf("m%02d", i),
+			Type:      "message",
+			Content:   fmt.Sprintf("message %d", i),
+			Username:  "alice",
+			Timestamp: int64(1000 + i),
+			From:      "peer-alice",
+			Room:      testRoom,
+		}
+		if err := s.SaveMessage(msg); err != nil {
+			t.Fatalf("SaveMessage: %v", err)
+		}
+	}
+}
+
+// count returns the number of messages in the test room of a store
+func count(t *testing.T, s storage.Store) int {
+	t.Helper()
+	refs, err := s.GetMessageRefs(testRoom, 0)
+	if err != nil {
+		t.Fatalf("GetMessageRefs: %v", err)
+	}
+	return len(refs)
+}
+
+// create backs up a store with three messages and returns the archive path
+func create(t *testing.T, opts Options) string {
+	t.Helper()
+	src := openStore(t, opts.DataDir, storage.KeySource{})
+	fill(t, src, 3)
+
+	path := filepath.Join(t.TempDir(), "backup.tar.gz")
+	if _, err := Create(src, path, opts); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	return path
+}
+
+// member is one file of an archive
+type member struct {
+	name string
+	data []byte
+}
+
+// readMembers returns the files of an archive in order
+func readMembers(t *testing.T, path string) []member {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatalf("gzip: %v", err)
+	}
+
+	var members []member
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return members
+		}
+		if err != nil {
+			t.Fatalf("tar: %v", err)
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatalf("tar: %v", err)
+		}
+		members = append(members, member{hdr.Name, data})
+	}
+}
+
+// writeMembers writes files as a new archive and returns its path
+func writeMembers(t *testing.T, members []member) string {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, m := range members {
+		if err := writeMember(tw, m.name, int64(len(m.data)), bytes.NewReader(m.data)); err != nil {
+			t.Fatalf("writeMember: %v", err)
+		}
+	}
+	tw.Close()
+	gz.Close()
+
+	path := filepath.Join(t.TempDir(), "tampered.tar.gz")
+	if err := os.WriteFile(path, buf.Bytes(), 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	return path
+}
+
+// editManifest applies edit to the manifest member of an archive
+func editManifest(t *testing.T, members []member, edit func(m *Manifest)) []member {
+	t.Helper()
+	var m Manifest
+	if err := json.Unmarshal(members[0].data, &m); err != nil {
+		t.Fatalf("failed to parse manifest: %v", err)
+	}
+	edit(&m)
+	data, err := json.Marshal(&m)
+	if err != nil {
+		t.Fatalf("failed to marshal manifest: %v", err)
+	}
+	members[0].data = data
+	return members
+}
+
+func TestBackupRoundTrip(t *testing.T) {
+	dataDir := t.TempDir()
+	path := create(t, Options{DataDir: dataDir, Config: map[string]string{"CHAT_TOPIC": testRoom}})
+
+	a, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer a.Close()
+	if a.Manifest.Messages != 3 || a.Manifest.Incremental() {
+		t.Errorf("manifest = %+v, want a full backup of 3 messages", a.Manifest)
+	}
+
+	restoreDir := t.TempDir()
+	dst := openStore(t, restoreDir, storage.KeySource{})
+	if err := a.Load(dst, restoreDir); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if n := count(t, dst); n != 3 {
+		t.Errorf("restored %d message(s), want 3", n)
+	}
+
+	config, err := a.RestoreConfig(restoreDir)
+	if err != nil {
+		t.Fatalf("RestoreConfig: %v", err)
+	}
+	if data, _ := os.ReadFile(config); string(data) != "CHAT_TOPIC="+testRoom+"\n" {
+		t.Errorf("restored config = %q", data)
+	}
+	if w, _ := ReadWatermark(restoreDir); w == nil || w.Version != a.Manifest.Version {
+		t.Errorf("watermark after restore = %+v, want version %d", w, a.Manifest.Version)
+	}
+}
+
+func TestOpenRejectsTamperedArchives(t *testing.T) {
+	tests := []struct {
+		name   string
+		tamper func(members []member) []member
+	}{
+		{
+			name: "messages changed",
+			tamper: func(members []member) []member {
+				members[1].data[len(members[1].data)/2] ^= 1
+				return members
+			},
+		},
+		{
+			name: "messages truncated",
+			tamper: func(members []member) []member {
+				members[1].data = members[1].data[:len(members[1].data)-1]
+				return members
+			},
+		},
+		{
+			name: "messages removed",
+			tamper: func(members []member) []member {
+				return members[:1]
+			},
+		},
+		{
+			name: "messages not listed",
+			tamper: func(members []member) []member {
+				return editManifest(t, members[:1], func(m *Manifest) { m.Files = nil })
+			},
+		},
+		{
+			name: "manifest removed",
+			tamper: func(members []member) []member {
+				return members[1:]
+			},
+		},
+		{
+			name: "unexpected member",
+			tamper: func(members []member) []member {
+				return append(members, member{"../../etc/passwd", []byte("x")})
+			},
+		},
+		{
+			name: "duplicate member",
+			tamper: func(members []member) []member {
+				return append(members, member{messagesFile, members[1].data})
+			},
+		},
+		{
+			name: "oversized member",
+			tamper: func(members []member) []member {
+				return append(members, member{configFile, make([]byte, maxMemberSize+1)})
+			},
+		},
+		{
+			name: "manifest lists an unknown file",
+			tamper: func(members []member) []member {
+				return editManifest(t, members, func(m *Manifest) {
+					m.Files = append(m.Files, File{Name: "extra"})
+				})
+			},
+		},
+		{
+			name: "newer format",
+			tamper: func(members []member) []member {
+				return editManifest(t, members, func(m *Manifest) { m.Format = FormatVersion + 1 })
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := create(t, Options{DataDir: t.TempDir()})
+			members := readMembers(t, path)
+			if members[0].name != manifestFile || members[1].name != messagesFile {
+				t.Fatalf("unexpected archive layout")
+			}
+
+			a, err := Open(writeMembers(t, tt.tamper(members)))
+			if err == nil {
+				a.Close()
+				t.Fatal("tampered archive was opened")
+			}
+		})
+	}
+}
+
+func TestOpenRejectsNonArchives(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "backup.tar.gz")
+	if err := os.WriteFile(path, []byte("not an archive"), 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if _, err := Open(path); err == nil {
+		t.Error("opened a file that is not an archive")
+	}
+}
+
+func TestIncrementalBackupNeedsWatermark(t *testing.T) {
+	dataDir := t.TempDir()
+	src := openStore(t, dataDir, storage.KeySource{})
+	fill(t, src, 3)
+
+	dir := t.TempDir()
+	if _, err := Create(src, filepath.Join(dir, "inc.tar.gz"), Options{DataDir: dataDir, Incremental: true}); err == nil {
+		t.Fatal("incremental backup without a full one succeeded")
+	}
+
+	full, err := Create(src, filepath.Join(dir, "full.tar.gz"), Options{DataDir: dataDir})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	inc, err := Create(src, filepath.Join(dir, "inc.tar.gz"), Options{DataDir: dataDir, Incremental: true})
+	if err != nil {
+		t.Fatalf("Create incremental: %v", err)
+	}
+	if !inc.Incremental() || inc.Since != full.Version {
+		t.Errorf("incremental since %d, want the full backup's version %d", inc.Since, full.Version)
+	}
+}
+
+func TestArchivedIdentityNeedsThePassphrase(t *testing.T) {
+	dataDir := t.TempDir()
+	key := []byte("identity key bytes")
+	if err := os.WriteFile(filepath.Join(dataDir, identity.DefaultIdentityFile), key, 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	path := create(t, Options{DataDir: dataDir, Passphrase: "correct horse"})
+
+	a, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer a.Close()
+	if !a.HasIdentity() {
+		t.Fatal("archive holds no identity")
+	}
+
+	if err := a.InstallKeys(t.TempDir(), "wrong"); err == nil {
+		t.Error("installed the identity with the wrong passphrase")
+	}
+
+	restoreDir := t.TempDir()
+	if err := a.InstallKeys(restoreDir, "correct horse"); err != nil {
+		t.Fatalf("InstallKeys: %v", err)
+	}
+	if got, _ := os.ReadFile(filepath.Join(restoreDir, identity.DefaultIdentityFile)); !bytes.Equal(got, key) {
+		t.Error("installed identity differs from the archived one")
+	}
+
+	// A restore never replaces another identity
+	other := t.TempDir()
+	if err := os.WriteFile(filepath.Join(other, identity.DefaultIdentityFile), []byte("another key"), 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if err := a.InstallKeys(other, "correct horse"); err == nil {
+		t.Error("replaced a different identity")
+	}
+}
+
+func TestEncryptedBackupNeedsTheDataKey(t *testing.T) {
+	enc := storage.KeySource{Passphrase: "secret"}
+	dataDir := t.TempDir()
+	src := openStore(t, dataDir, enc)
+	fill(t, src, 3)
+
+	path := filepath.Join(t.TempDir(), "backup.tar.gz")
+	if _, err := Create(src, path, Options{DataDir: dataDir}); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	a, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer a.Close()
+	if !a.Manifest.Encrypted {
+		t.Fatal("backup of an encrypted store is not marked encrypted")
+	}
+
+	plainDir := t.TempDir()
+	if err := a.Load(openStore(t, plainDir, storage.KeySource{}), plainDir); err == nil {
+		t.Error("loaded a sealed backup into a store without its key")
+	}
+
+	restoreDir := t.TempDir()
+	if err := a.InstallKeys(restoreDir, ""); err != nil {
+		t.Fatalf("InstallKeys: %v", err)
+	}
+	dst := openStore(t, restoreDir, enc)
+	if err := a.Load(dst, restoreDir); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if n := count(t, dst); n != 3 {
+		t.Errorf("restored %d message(s), want 3", n)
+	}
+}
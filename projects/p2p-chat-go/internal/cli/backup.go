@@ -0,0 +1,67 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/geekp2p/p2p-chat-go/internal/backup"
+)
+
+// BackupFunc writes a backup archive of the running node to path
+type BackupFunc func(path string, incremental bool) (*backup.Manifest, error)
+
+// SetBackup enables /backup; archives without an explicit path go to dir
+func (c *ChatCLI) SetBackup(dir string, fn BackupFunc) {
+	c.backupDir = dir
+	c.backup = fn
+}
+
+// backupNow writes an online backup while the chat keeps running
+// Usage: /backup [--incremental] [file]
+func (c *ChatCLI) backupNow(parts []string) {
+	if c.backup == nil {
+		fmt.Println("Backup not available (ephemeral mode keeps nothing to back up)")
+		return
+	}
+
+	incremental := false
+	path := ""
+	for _, arg := range parts[1:] {
+		switch {
+		case arg == "--incremental" || arg == "-i":
+			incremental = true
+		case path == "":
+			path = arg
+		default:
+			fmt.Println("Usage: /backup [--incremental] [file]")
+			return
+		}
+	}
+
+	if path == "" {
+		if err := os.MkdirAll(c.backupDir, 0700); err != nil {
+			fmt.Printf("❌ Backup failed: %v\n\n", err)
+			return
+		}
+		kind := "full"
+		if incremental {
+			kind = "incr"
+		}
+		name := fmt.Sprintf("p2p-chat-%s-%s.tar.gz", time.Now().Format("20060102-150405"), kind)
+		path = filepath.Join(c.backupDir, name)
+	}
+
+	m, err := c.backup(path, incremental)
+	if err != nil {
+		fmt.Printf("❌ Backup failed: %v\n\n", err)
+		return
+	}
+
+	fmt.Printf("✓ Backed up %d message(s) and %d contact(s) to %s\n", m.Messages, m.Contacts, path)
+	if m.Incremental() {
+		fmt.Printf("  Incremental: changes after version %d, up to %d\n", m.Since, m.Version)
+	}
+	fmt.Println()
+}
@@ -7,10 +7,20 @@ import (
 	"math/rand"
 	"os"
 	"runtime"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/geekp2p/p2p-chat-go/internal/dag"
+	"github.com/geekp2p/p2p-chat-go/internal/history"
+	"github.com/geekp2p/p2p-chat-go/internal/janitor"
+	"github.com/geekp2p/p2p-chat-go/internal/mailbox"
 	"github.com/geekp2p/p2p-chat-go/internal/messaging"
+	"github.com/geekp2p/p2p-chat-go/internal/moderation"
+	"github.com/geekp2p/p2p-chat-go/internal/outbox"
+	"github.com/geekp2p/p2p-chat-go/internal/roommeta"
 	"github.com/geekp2p/p2p-chat-go/internal/storage"
 	"github.com/geekp2p/p2p-chat-go/internal/updater"
 	"github.com/libp2p/go-libp2p/core/host"
@@ -22,17 +32,32 @@ import (
 type ChatCLI struct {
 	host         host.Host
 	messaging    *messaging.P2PMessaging
-	store        *storage.MessageStore
+	store        storage.Store
 	username     string
 	displayNames map[peer.ID]string
+	namesLock    sync.RWMutex
 	verboseMode  *bool       // Pointer to P2PNode's Verbose flag
 	router       interface{} // SmartRouter instance
 	relaySvc     interface{} // RelayService instance
 	dhtStorage   interface{} // DHTStorage instance
+	moderation   *moderation.Manager
+	mailbox      *mailbox.Client
+	mailboxSrv   *mailbox.Server // Set when this node holds mail for others
+	historySync  *history.Service
+	outbox       *outbox.Outbox
+	ephemeral    time.Duration // TTL for our own messages set with /ephemeral
+	roomTTL      time.Duration // Room-wide maximum message lifetime (0 = keep)
+	exportDir    string        // Where /export writes transcripts
+	janitor      *janitor.Janitor
+	backup       BackupFunc // Set unless the store is in memory
+	backupDir    string     // Where /backup writes archives by default
+	dag          *dag.Log   // Hash-linked history of the room
+	dagRepairing atomic.Bool
+	roomMeta     *roommeta.Manager
 }
 
 // NewChatCLI creates a new CLI instance
-func NewChatCLI(h host.Host, msg *messaging.P2PMessaging, store *storage.MessageStore, verboseMode *bool) *ChatCLI {
+func NewChatCLI(h host.Host, msg *messaging.P2PMessaging, store storage.Store, verboseMode *bool) *ChatCLI {
 	return &ChatCLI{
 		host:         h,
 		messaging:    msg,
@@ -61,6 +86,37 @@ func (c *ChatCLI) SetDHTStorage(storage interface{}) {
 	c.dhtStorage = storage
 }
 
+// SetModeration sets the room moderation manager
+func (c *ChatCLI) SetModeration(mgr *moderation.Manager) {
+	c.moderation = mgr
+}
+
+// SetMailbox sets the mailbox client and, if this node runs one, the server
+func (c *ChatCLI) SetMailbox(client *mailbox.Client, server *mailbox.Server) {
+	c.mailbox = client
+	c.mailboxSrv = server
+}
+
+// SetHistorySync sets the history synchronisation service
+func (c *ChatCLI) SetHistorySync(svc *history.Service) {
+	c.historySync = svc
+}
+
+// SetOutbox sets the outbox used to queue messages while the mesh is empty
+func (c *ChatCLI) SetOutbox(o *outbox.Outbox) {
+	c.outbox = o
+	o.SetDeliveredFunc(func(msg *messaging.Message) {
+		fmt.Printf("\n✓ Delivered pending message: %s\n", msg.Content)
+		fmt.Print("> ")
+	})
+}
+
+// SetRoomTTL sets the room-wide maximum lifetime of messages
+// Every message sent or received is stored for at most this long
+func (c *ChatCLI) SetRoomTTL(ttl time.Duration) {
+	c.roomTTL = ttl
+}
+
 // generateUsername creates a random username
 func generateUsername() string {
 	rand.Seed(time.Now().UnixNano())
@@ -72,15 +128,35 @@ func (c *ChatCLI) Start() error {
 	// Display welcome message
 	c.printWelcome()
 
+	// Nicks of peers seen in earlier sessions
+	c.loadContacts()
+
 	// Show recent message history
-	c.showHistory()
+	c.showHistory(nil)
+
+	// Catch up on messages sent while we were away
+	if c.historySync != nil {
+		c.historySync.SetMergedFunc(c.linkMessages)
+		go c.syncHistory(false)
+	}
+	go c.recoverFromIndex()
+	go c.refreshRoomMeta(false)
+
+	// Drain mailboxes holding messages sent while we were offline
+	if c.mailbox != nil {
+		c.mailbox.SetDeliverFunc(c.deliverMailbox)
+		if err := c.mailbox.Start(); err != nil {
+			fmt.Printf("Warning: mailbox client not started: %v\n", err)
+		}
+	}
 
 	// Send join notification
-	if err := c.messaging.PublishMessage("join", fmt.Sprintf("%s joined the chat", c.username), c.username); err != nil {
+	if _, err := c.messaging.PublishMessage("join", fmt.Sprintf("%s joined the chat", c.username), c.username); err != nil {
 		return fmt.Errorf("failed to send join message: %w", err)
 	}
 
 	// Start message listener
+	c.messaging.AddHandler(c.recordPublished)
 	go c.listenForMessages()
 
 	// Start input loop
@@ -96,10 +172,21 @@ func (c *ChatCLI) printWelcome() {
 	fmt.Printf("Your Peer ID: %s\n", c.host.ID())
 	fmt.Printf("Listening on: %s\n", c.host.Addrs()[0])
 	fmt.Printf("Username: %s\n", c.username)
+	if c.roomMeta != nil {
+		if meta := c.roomMeta.Current(); meta != nil {
+			fmt.Println()
+			c.printRoomMeta(meta)
+		}
+	}
 	fmt.Printf("\nNetwork peers: %d | Chat mesh peers: %d\n", len(networkPeers), len(meshPeers))
 	if len(meshPeers) == 0 {
 		fmt.Println("⚠ No peers in chat mesh yet - use /mesh to check status")
 	}
+	if c.outbox != nil {
+		if pending, err := c.outbox.Pending(); err == nil && len(pending) > 0 {
+			fmt.Printf("⏳ %d message(s) pending in outbox (use /outbox)\n", len(pending))
+		}
+	}
 	fmt.Println("Type /help for commands")
 	fmt.Println()
 }
@@ -109,16 +196,40 @@ func (c *ChatCLI) listenForMessages() {
 	msgChan := c.messaging.ReadMessages()
 
 	for msg := range msgChan {
-		// Save message to store
-		storeMsg := &storage.Message{
-			Type:      msg.Type,
-			Content:   msg.Content,
-			Username:  msg.Username,
-			Timestamp: msg.Timestamp,
-			From:      msg.From,
-		}
-		if err := c.store.SaveMessage(storeMsg); err != nil {
+		// Remember display names so commands can refer to peers by nick
+		if msg.From != "" && msg.Username != "" {
+			if id, err := peer.Decode(msg.From); err == nil {
+				c.rememberName(id, msg.Username)
+			}
+		}
+
+		// Moderation events update room state and are not chat history
+		if msg.Type == "moderation" {
+			c.handleModerationMessage(msg)
+			continue
+		}
+		if msg.Type == roommeta.MessageType {
+			c.handleRoomMetaMessage(msg)
+			continue
+		}
+
+		// Honour disappearing messages and the room's retention limit
+		c.capExpiry(msg)
+		if msg.Expired(time.Now()) {
+			continue
+		}
+
+		// Save message to store and link it into the room's history; the
+		// first copy of an ID wins, so a peer cannot overwrite stored messages
+		stored := c.toStoreMessage(msg)
+		saved, err := c.store.ImportMessage(stored)
+		if err != nil {
 			fmt.Printf("Error saving message: %v\n", err)
+		} else if !saved {
+			continue // Already have it, e.g. from history sync or the mailbox
+		} else if author, err := peer.Decode(msg.From); err == nil {
+			c.linkMessage(stored, author)
+			c.indexInDHT(stored)
 		}
 
 		// Display message
@@ -126,19 +237,101 @@ func (c *ChatCLI) listenForMessages() {
 	}
 }
 
-// displayMessage displays a single message
+// recordPublished stores the signed record of a message we published, so
+// peers that sync it from us can verify that we wrote it, and mirrors the
+// message into the DHT if the room asks for it
+// It runs once the message is actually published, not while it waits in
+// the outbox
+func (c *ChatCLI) recordPublished(msg *messaging.Message) {
+	if msg.Type != "message" || msg.From != c.host.ID().String() {
+		return
+	}
+	go func() {
+		stored := c.toStoreMessage(msg)
+		if err := c.store.SaveMessage(stored); err != nil {
+			if c.verboseMode != nil && *c.verboseMode {
+				fmt.Printf("Failed to store record of message %s: %v\n", msg.ID, err)
+			}
+			return
+		}
+		c.mirrorToDHT(stored)
+	}()
+}
+
+// toStoreMessage converts a network message into its stored form
+func (c *ChatCLI) toStoreMessage(msg *messaging.Message) *storage.Message {
+	return &storage.Message{
+		ID:        msg.ID,
+		Type:      msg.Type,
+		Content:   msg.Content,
+		Username:  msg.Username,
+		Timestamp: msg.Timestamp,
+		From:      msg.From,
+		Room:      c.messaging.Topic(),
+		Thread:    msg.Thread,
+		Expires:   msg.Expires,
+		Parents:   msg.Parents,
+		Record:    msg.Record,
+	}
+}
+
+// fromStoreMessage converts a stored message back into its network form
+func fromStoreMessage(msg *storage.Message) *messaging.Message {
+	return &messaging.Message{
+		ID:        msg.ID,
+		Type:      msg.Type,
+		Content:   msg.Content,
+		Username:  msg.Username,
+		Timestamp: msg.Timestamp,
+		From:      msg.From,
+		Thread:    msg.Thread,
+		Expires:   msg.Expires,
+		Parents:   msg.Parents,
+		Record:    msg.Record,
+	}
+}
+
+// displayMessage displays a single message followed by the prompt
 func (c *ChatCLI) displayMessage(msg *messaging.Message) {
+	c.printMessage(msg)
+	fmt.Print("> ")
+}
+
+// printMessage prints a single message without the prompt
+func (c *ChatCLI) printMessage(msg *messaging.Message) {
 	timestamp := storage.FormatTimestamp(msg.Timestamp)
 
 	switch msg.Type {
 	case "message":
-		fmt.Printf("[%s] %s: %s\n", timestamp, msg.Username, msg.Content)
+		fmt.Printf("[%s] %s: %s%s%s\n", timestamp, msg.Username, msg.Content, expiryMarker(msg.Expires), cidMarker(msg))
 	case "join":
 		fmt.Printf("*** %s (at %s)\n", msg.Content, timestamp)
 	case "leave":
 		fmt.Printf("*** %s (at %s)\n", msg.Content, timestamp)
 	}
-	fmt.Print("> ")
+}
+
+// expiryMarker marks disappearing messages with their remaining lifetime
+func expiryMarker(expires int64) string {
+	if expires == 0 {
+		return ""
+	}
+	remaining := time.Until(time.Unix(expires, 0)).Round(time.Second)
+	if remaining < 0 {
+		remaining = 0
+	}
+	return fmt.Sprintf(" 🔥 %s", remaining)
+}
+
+// capExpiry limits a message's lifetime to the room's retention limit
+func (c *ChatCLI) capExpiry(msg *messaging.Message) {
+	if c.roomTTL <= 0 {
+		return
+	}
+	limit := time.Unix(msg.Timestamp, 0).Add(c.roomTTL).Unix()
+	if msg.Expires == 0 || msg.Expires > limit {
+		msg.Expires = limit
+	}
 }
 
 // inputLoop handles user input
@@ -158,23 +351,31 @@ func (c *ChatCLI) inputLoop() error {
 		if strings.HasPrefix(input, "/") {
 			c.handleCommand(input)
 		} else {
-			// Send regular message
-			if err := c.messaging.PublishMessage("message", input, c.username); err != nil {
+			if c.moderation != nil && c.moderation.IsMuted(c.host.ID()) {
+				fmt.Println("⚠ You are muted in this room; your message was not sent")
+				fmt.Print("> ")
+				continue
+			}
+
+			// Send regular message (queued in the outbox if nobody is listening)
+			sent, pending, err := c.sendMessage(input)
+			if err != nil {
 				fmt.Printf("Error sending message: %v\n", err)
 			} else {
 				// Display own message
-				fmt.Printf("[%s] %s: %s\n", storage.FormatTimestamp(time.Now().Unix()), c.username, input)
-
-				// Save to store
-				msg := &storage.Message{
-					Type:      "message",
-					Content:   input,
-					Username:  c.username,
-					Timestamp: time.Now().Unix(),
-					From:      c.host.ID().String(),
+				marker := expiryMarker(sent.Expires) + cidMarker(sent)
+				if pending {
+					fmt.Printf("[%s] %s: %s%s (⏳ pending - no mesh peers yet)\n", storage.FormatTimestamp(sent.Timestamp), c.username, input, marker)
+				} else {
+					fmt.Printf("[%s] %s: %s%s\n", storage.FormatTimestamp(sent.Timestamp), c.username, input, marker)
 				}
-				if err := c.store.SaveMessage(msg); err != nil {
+
+				// Save to store, unless recordPublished got there first
+				stored := c.toStoreMessage(sent)
+				if _, err := c.store.ImportMessage(stored); err != nil {
 					fmt.Printf("Error saving message: %v\n", err)
+				} else {
+					c.linkMessage(stored, "")
 				}
 			}
 		}
@@ -189,6 +390,61 @@ func (c *ChatCLI) inputLoop() error {
 	return nil
 }
 
+// sendMessage publishes a chat message, through the outbox when available
+func (c *ChatCLI) sendMessage(content string) (*messaging.Message, bool, error) {
+	msg := c.messaging.NewMessage("message", content, c.username)
+	if c.ephemeral > 0 {
+		msg.Expires = time.Now().Add(c.ephemeral).Unix()
+	}
+	c.capExpiry(msg)
+
+	// Reference the heads we have seen to extend the room's history DAG
+	if c.dag != nil {
+		parents, err := c.dag.Parents()
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to read DAG heads: %w", err)
+		}
+		msg.Parents = parents
+	}
+
+	if c.outbox != nil {
+		pending, err := c.outbox.Send(msg)
+		return msg, pending, err
+	}
+	return msg, false, c.messaging.Publish(msg)
+}
+
+// setEphemeral sets or clears the lifetime of our own messages
+func (c *ChatCLI) setEphemeral(parts []string) {
+	if len(parts) < 2 {
+		if c.ephemeral > 0 {
+			fmt.Printf("\nEphemeral mode: your messages disappear after %s\n", c.ephemeral)
+		} else {
+			fmt.Println("\nEphemeral mode is off")
+		}
+		if c.roomTTL > 0 {
+			fmt.Printf("Room policy: all messages disappear after %s\n", c.roomTTL)
+		}
+		fmt.Print("Usage: /ephemeral <duration> (e.g. 30s, 5m, 1h) or /ephemeral off\n\n")
+		return
+	}
+
+	if parts[1] == "off" {
+		c.ephemeral = 0
+		fmt.Print("✓ Ephemeral mode off - new messages are kept\n\n")
+		return
+	}
+
+	ttl, err := time.ParseDuration(parts[1])
+	if err != nil || ttl <= 0 {
+		fmt.Printf("Invalid duration: %s\n\n", parts[1])
+		return
+	}
+
+	c.ephemeral = ttl
+	fmt.Printf("✓ Ephemeral mode on - your messages disappear from every peer after %s 🔥\n\n", ttl)
+}
+
 // handleCommand processes CLI commands
 func (c *ChatCLI) handleCommand(cmd string) {
 	parts := strings.Fields(cmd)
@@ -204,9 +460,23 @@ func (c *ChatCLI) handleCommand(cmd string) {
 	case "/mesh":
 		c.showMeshPeers()
 	case "/history":
-		c.showHistory()
+		c.showHistory(parts[1:])
+	case "/search":
+		c.search(cmd)
+	case "/export":
+		c.exportHistory(parts)
+	case "/sync":
+		c.syncHistory(true)
+	case "/dag":
+		c.dagCommand(parts)
+	case "/ephemeral":
+		c.setEphemeral(parts)
 	case "/clear":
 		c.clearMessages(parts)
+	case "/retention":
+		c.showRetention()
+	case "/backup":
+		c.backupNow(parts)
 	case "/add":
 		c.addPeer(parts)
 	case "/verbose":
@@ -220,9 +490,23 @@ func (c *ChatCLI) handleCommand(cmd string) {
 	case "/relay":
 		c.showRelayInfo()
 	case "/dht":
-		c.showDHTStats()
+		c.dhtCommand(parts)
 	case "/conn":
 		c.showConnectionTypes()
+	case "/op", "/deop", "/ban", "/unban", "/mute", "/unmute", "/kick":
+		c.moderate(parts)
+	case "/topic":
+		c.topicCommand(cmd, parts)
+	case "/pin", "/unpin":
+		c.pinCommand(parts)
+	case "/pins":
+		c.showPins()
+	case "/modlog":
+		c.showModLog()
+	case "/mailbox":
+		c.showMailbox()
+	case "/outbox":
+		c.showOutbox()
 	case "/quit", "/exit":
 		fmt.Println("Goodbye!")
 		os.Exit(0)
@@ -237,9 +521,16 @@ func (c *ChatCLI) showHelp() {
 	fmt.Println("  /help           - Show this help message")
 	fmt.Println("  /peers          - List all connected network peers")
 	fmt.Println("  /mesh           - List peers in the chat topic mesh (actual chat participants)")
-	fmt.Println("  /history        - Show recent message history")
+	fmt.Println("  /history [N]    - Show recent messages (--before id, --since 2h, --from nick)")
+	fmt.Println("  /search <query> - Search messages (words, \"phrase\", from:, room:, since:, until:)")
+	fmt.Println("  /export [fmt] [since] - Save a transcript (md, html or jsonl) to DATA_DIR/exports")
+	fmt.Println("  /sync           - Fetch missed messages from mesh peers")
+	fmt.Println("  /dag [repair|log N] - Show the message DAG, fill its gaps or list it in DAG order")
+	fmt.Println("  /ephemeral <d>  - Make your messages disappear after d (e.g. 5m), or 'off'")
 	fmt.Println("  /clear          - Clear all messages from local database")
 	fmt.Println("  /clear <N>      - Clear messages older than N days")
+	fmt.Println("  /retention      - Show the retention policy and cleanup statistics")
+	fmt.Println("  /backup [file]  - Back up history, contacts and identity (--incremental for changes only)")
 	fmt.Println("  /add <peer-id>  - Manually connect to a peer by their ID")
 	fmt.Println("  /verbose        - Toggle verbose mode (show connection logs)")
 	fmt.Println("  /version        - Show version information")
@@ -247,9 +538,60 @@ func (c *ChatCLI) showHelp() {
 	fmt.Println("\nP2P Network Commands:")
 	fmt.Println("  /routing        - Show smart routing statistics")
 	fmt.Println("  /relay          - Show relay service information")
-	fmt.Println("  /dht            - Show DHT storage statistics")
+	fmt.Println("  /dht [stats]    - Show DHT storage statistics")
+	fmt.Println("  /dht get <cid>  - Look up a message in the DHT (full CID or the #tail shown)")
+	fmt.Println("  /dht put <cid>  - Store one of this room's messages in the DHT")
+	fmt.Println("  /dht providers <cid> - List peers that provide a message")
+	fmt.Println("  /dht reprovide  - Re-announce all provided content to the DHT now")
 	fmt.Println("  /conn           - Show connection types (direct/relay)")
+	fmt.Println("  /mailbox        - Show store-and-forward mailbox status")
+	fmt.Println("  /outbox         - Show messages waiting for mesh peers")
 	fmt.Println("  /quit           - Exit the chat")
+	fmt.Println("\nModeration Commands:")
+	fmt.Println("  /op <peer>                  - Grant admin rights (owner only)")
+	fmt.Println("  /deop <peer>                - Revoke admin rights")
+	fmt.Println("  /ban <peer> [dur] [reason]  - Ban a peer (permanent unless dur, e.g. 1h)")
+	fmt.Println("  /unban <peer>               - Lift a ban")
+	fmt.Println("  /mute <peer> [dur] [reason] - Mute a peer (default 10m)")
+	fmt.Println("  /unmute <peer>              - Lift a mute")
+	fmt.Println("  /kick <peer> [reason]       - Disconnect a peer from the room")
+	fmt.Println("  /modlog                     - Show the room moderation log")
+	fmt.Println("\nRoom Commands:")
+	fmt.Println("  /topic                      - Show the room topic, description, rules and pins")
+	fmt.Println("  /topic <title>              - Set the room topic (admins)")
+	fmt.Println("  /topic desc|rules <text>    - Set the description or rules (\\n for a new line)")
+	fmt.Println("  /topic clear <field>        - Remove the title, desc or rules")
+	fmt.Println("  /topic refresh              - Look up the latest metadata in the DHT")
+	fmt.Println("  /topic mirror [on|off]      - Show or set whether members mirror messages into the DHT")
+	fmt.Println("  /pin <cid>                  - Pin a message (the #tail shown works too)")
+	fmt.Println("  /unpin <cid>                - Unpin a message")
+	fmt.Println("  /pins                       - List the pinned messages")
+	fmt.Println()
+}
+
+// showOutbox displays messages queued until mesh peers appear
+func (c *ChatCLI) showOutbox() {
+	if c.outbox == nil {
+		fmt.Println("Outbox not available")
+		return
+	}
+
+	pending, err := c.outbox.Pending()
+	if err != nil {
+		fmt.Printf("Error reading outbox: %v\n", err)
+		return
+	}
+
+	if len(pending) == 0 {
+		fmt.Print("\nOutbox is empty - all messages delivered.\n\n")
+		return
+	}
+
+	fmt.Printf("\nPending messages (%d):\n", len(pending))
+	for _, msg := range pending {
+		fmt.Printf("  ⏳ [%s] %s\n", storage.FormatTimestamp(msg.Timestamp), msg.Content)
+	}
+	fmt.Println("They will be sent automatically once a mesh peer is available.")
 	fmt.Println()
 }
 
@@ -280,32 +622,104 @@ func (c *ChatCLI) showMeshPeers() {
 	fmt.Println()
 }
 
-// showHistory displays recent message history
-func (c *ChatCLI) showHistory() {
-	messages, err := c.store.GetRecentMessages(10)
+// showHistory pages through the message history of this room
+// Usage: /history [N] [--before id|time] [--after id|time] [--since time] [--from nick] [--type t]
+func (c *ChatCLI) showHistory(args []string) {
+	q, err := parseHistoryArgs(args, time.Now())
+	if err != nil {
+		fmt.Printf("❌ %v\n", err)
+		fmt.Print("Usage: /history [N] [--before id|time] [--after id|time] [--since 2h] [--from nick] [--type message|join|leave]\n\n")
+		return
+	}
+	q.Room = c.messaging.Topic()
+
+	page, err := c.store.GetHistory(q)
 	if err != nil {
 		fmt.Printf("Error retrieving history: %v\n", err)
 		return
 	}
 
-	if len(messages) == 0 {
+	if len(page.Messages) == 0 {
 		fmt.Println("No message history yet.")
 		return
 	}
 
 	fmt.Println("\nRecent messages:")
-	for _, msg := range messages {
+	for _, msg := range page.Messages {
 		timestamp := storage.FormatTimestamp(msg.Timestamp)
 		switch msg.Type {
 		case "message":
-			fmt.Printf("[%s] %s: %s\n", timestamp, msg.Username, msg.Content)
+			fmt.Printf("[%s] %s: %s%s\n", timestamp, msg.Username, msg.Content, expiryMarker(msg.Expires))
 		case "join", "leave":
 			fmt.Printf("*** %s (at %s)\n", msg.Content, timestamp)
 		}
 	}
+
+	first, last := page.Messages[0], page.Messages[len(page.Messages)-1]
+	if q.After == "" && page.HasMore {
+		fmt.Printf("Older: /history %d --before %s\n", q.Limit, first.ID)
+	}
+	if q.After != "" || q.Before != "" || q.Until != 0 {
+		if q.After == "" || page.HasMore {
+			fmt.Printf("Newer: /history %d --after %s\n", q.Limit, last.ID)
+		}
+	}
 	fmt.Println()
 }
 
+// parseHistoryArgs parses the arguments of /history into a query
+// --before and --after take a message ID or a time (2h, 3d, 2024-01-31)
+func parseHistoryArgs(args []string, now time.Time) (storage.HistoryQuery, error) {
+	q := storage.HistoryQuery{Limit: 10}
+
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if !strings.HasPrefix(arg, "--") {
+			n, err := strconv.Atoi(arg)
+			if err != nil || n <= 0 {
+				return q, fmt.Errorf("invalid message count: %s", arg)
+			}
+			q.Limit = n
+			continue
+		}
+
+		if i+1 >= len(args) {
+			return q, fmt.Errorf("%s needs a value", arg)
+		}
+		i++
+		value := args[i]
+
+		switch arg {
+		case "--before":
+			if t, err := storage.ParseTime(value, now); err == nil {
+				q.Until = t
+			} else {
+				q.Before = value
+			}
+		case "--after":
+			if t, err := storage.ParseTime(value, now); err == nil {
+				q.Since = t
+			} else {
+				q.After = value
+			}
+		case "--since":
+			t, err := storage.ParseTime(value, now)
+			if err != nil {
+				return q, err
+			}
+			q.Since = t
+		case "--from":
+			q.Author = value
+		case "--type":
+			q.Types = append(q.Types, value)
+		default:
+			return q, fmt.Errorf("unknown option: %s", arg)
+		}
+	}
+
+	return q, nil
+}
+
 // toggleVerbose toggles verbose mode on/off
 func (c *ChatCLI) toggleVerbose() {
 	if c.verboseMode == nil {
@@ -385,7 +799,7 @@ func (c *ChatCLI) performUpdate() {
 	response = strings.ToLower(strings.TrimSpace(response))
 
 	if response != "y" && response != "yes" {
-		fmt.Println("Update cancelled.\n")
+		fmt.Print("Update cancelled.\n\n")
 		return
 	}
 
@@ -424,7 +838,7 @@ func (c *ChatCLI) clearMessages(parts []string) {
 	}
 
 	if count == 0 {
-		fmt.Println("\nNo messages to clear.\n")
+		fmt.Print("\nNo messages to clear.\n\n")
 		return
 	}
 
@@ -436,12 +850,12 @@ func (c *ChatCLI) clearMessages(parts []string) {
 		if err != nil {
 			fmt.Printf("Invalid number of days: %s\n", parts[1])
 			fmt.Println("Usage: /clear <days>")
-			fmt.Println("Example: /clear 7  (clears messages older than 7 days)\n")
+			fmt.Print("Example: /clear 7  (clears messages older than 7 days)\n\n")
 			return
 		}
 
 		if days <= 0 {
-			fmt.Println("Number of days must be greater than 0\n")
+			fmt.Print("Number of days must be greater than 0\n\n")
 			return
 		}
 
@@ -455,7 +869,7 @@ func (c *ChatCLI) clearMessages(parts []string) {
 		response = strings.ToLower(strings.TrimSpace(response))
 
 		if response != "y" && response != "yes" {
-			fmt.Println("Cancelled.\n")
+			fmt.Print("Cancelled.\n\n")
 			return
 		}
 
@@ -471,6 +885,7 @@ func (c *ChatCLI) clearMessages(parts []string) {
 		} else {
 			fmt.Printf("✓ Deleted %d message(s) older than %d days.\n", deleted, days)
 			fmt.Printf("Remaining messages: %d\n\n", count-deleted)
+			c.reclaimSpace()
 		}
 	} else {
 		// Clear all messages
@@ -483,7 +898,7 @@ func (c *ChatCLI) clearMessages(parts []string) {
 		response = strings.ToLower(strings.TrimSpace(response))
 
 		if response != "y" && response != "yes" {
-			fmt.Println("Cancelled.\n")
+			fmt.Print("Cancelled.\n\n")
 			return
 		}
 
@@ -495,6 +910,7 @@ func (c *ChatCLI) clearMessages(parts []string) {
 		}
 
 		fmt.Printf("✓ Successfully deleted %d message(s).\n\n", deleted)
+		c.reclaimSpace()
 	}
 }
 
@@ -526,19 +942,6 @@ func (c *ChatCLI) showRelayInfo() {
 	fmt.Println()
 }
 
-// showDHTStats displays DHT storage statistics
-func (c *ChatCLI) showDHTStats() {
-	if c.dhtStorage == nil {
-		fmt.Println("DHT storage not available")
-		return
-	}
-
-	fmt.Println("\n=== DHT Storage Statistics ===")
-	fmt.Println("Distributed storage is active")
-	fmt.Println("Messages are cached with TTL expiration")
-	fmt.Println()
-}
-
 // showConnectionTypes shows connection types for all peers
 func (c *ChatCLI) showConnectionTypes() {
 	peers := c.host.Network().Peers()
@@ -592,7 +995,7 @@ func (c *ChatCLI) addPeer(parts []string) {
 		fmt.Println("Example:")
 		fmt.Println("  /add 12D3KooWBgB3txXxL2qj6iLZBtZCDK885zWKYGNVCj4RaEWwqFkN")
 		fmt.Println("  /add /ip4/192.168.1.100/tcp/4001/p2p/12D3KooW...")
-		fmt.Println("\nTip: Get peer info from other nodes using /peers command\n")
+		fmt.Print("\nTip: Get peer info from other nodes using /peers command\n\n")
 		return
 	}
 
@@ -610,7 +1013,7 @@ func (c *ChatCLI) addPeer(parts []string) {
 	peerID, err := peer.Decode(peerStr)
 	if err != nil {
 		fmt.Printf("❌ Invalid peer ID: %v\n", err)
-		fmt.Println("Peer ID should look like: 12D3KooW...\n")
+		fmt.Print("Peer ID should look like: 12D3KooW...\n\n")
 		return
 	}
 
@@ -641,7 +1044,7 @@ func (c *ChatCLI) addPeer(parts []string) {
 		}
 
 		fmt.Printf("✓ Successfully connected to peer: %s\n", peerID.ShortString())
-		fmt.Println("  Use /mesh to verify they joined the chat mesh\n")
+		fmt.Print("  Use /mesh to verify they joined the chat mesh\n\n")
 		return
 	}
 
@@ -650,7 +1053,7 @@ func (c *ChatCLI) addPeer(parts []string) {
 	fmt.Println("Tip: You may need to:")
 	fmt.Println("  1. Use full multiaddr with /add /ip4/.../p2p/...")
 	fmt.Println("  2. Wait for peer discovery to find this peer")
-	fmt.Println("  3. Ensure both peers are on the same network/topic\n")
+	fmt.Print("  3. Ensure both peers are on the same network/topic\n\n")
 }
 
 // connectToMultiaddr connects to a peer using a full multiaddr
@@ -684,6 +1087,6 @@ func (c *ChatCLI) connectToMultiaddr(addrStr string) error {
 	}
 
 	fmt.Printf("✓ Successfully connected to peer: %s\n", peerInfo.ID.ShortString())
-	fmt.Println("  Use /mesh to verify they joined the chat mesh\n")
+	fmt.Print("  Use /mesh to verify they joined the chat mesh\n\n")
 	return nil
 }
@@ -0,0 +1,44 @@
+package cli
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/geekp2p/p2p-chat-go/internal/storage"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// loadContacts restores the display names of peers seen in earlier sessions
+func (c *ChatCLI) loadContacts() {
+	contacts, err := c.store.GetContacts()
+	if err != nil {
+		fmt.Printf("Warning: failed to load contacts: %v\n", err)
+		return
+	}
+
+	c.namesLock.Lock()
+	defer c.namesLock.Unlock()
+	for _, contact := range contacts {
+		if id, err := peer.Decode(contact.PeerID); err == nil {
+			c.displayNames[id] = contact.Name
+		}
+	}
+}
+
+// rememberName records the display name a peer uses
+// The contact is only written when the name changes
+func (c *ChatCLI) rememberName(id peer.ID, name string) {
+	c.namesLock.Lock()
+	known := c.displayNames[id] == name
+	c.displayNames[id] = name
+	c.namesLock.Unlock()
+
+	if known {
+		return
+	}
+
+	contact := &storage.Contact{PeerID: id.String(), Name: name, Updated: time.Now().Unix()}
+	if err := c.store.SaveContact(contact); err != nil && c.verboseMode != nil && *c.verboseMode {
+		fmt.Printf("Failed to save contact %s: %v\n", id.ShortString(), err)
+	}
+}
@@ -0,0 +1,225 @@
+package cli
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/geekp2p/p2p-chat-go/internal/dag"
+	"github.com/geekp2p/p2p-chat-go/internal/storage"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// defaultDAGLogLimit is how many messages /dag log shows by default
+const defaultDAGLogLimit = 20
+
+// maxShownHeads bounds the heads listed by /dag
+const maxShownHeads = 8
+
+// SetDAG sets the room's message DAG
+func (c *ChatCLI) SetDAG(l *dag.Log) {
+	c.dag = l
+}
+
+// linkMessage adds a stored message to the room DAG
+// If its parents are unknown, the gap is repaired in the background, asking
+// from first (usually the author) before the other mesh peers
+func (c *ChatCLI) linkMessage(msg *storage.Message, from peer.ID) {
+	if c.dag == nil {
+		return
+	}
+	_, missing, err := c.dag.Add(msg)
+	if err != nil {
+		if c.verboseMode != nil && *c.verboseMode {
+			fmt.Printf("DAG: cannot link message %s: %v\n", msg.ID, err)
+		}
+		return
+	}
+	if len(missing) > 0 {
+		go c.repairDAG(false, from)
+	}
+}
+
+// linkMessages adds a batch of stored messages, such as a sync result, to the
+// room DAG and repairs any gaps left once the whole batch is linked
+func (c *ChatCLI) linkMessages(msgs []*storage.Message) {
+	if c.dag == nil {
+		return
+	}
+	for _, msg := range msgs {
+		if _, _, err := c.dag.Add(msg); err != nil && c.verboseMode != nil && *c.verboseMode {
+			fmt.Printf("DAG: cannot link message %s: %v\n", msg.ID, err)
+		}
+	}
+	if missing, err := c.dag.Missing(); err == nil && len(missing) > 0 {
+		go c.repairDAG(false, "")
+	}
+}
+
+// repairDAG fetches missing parents from first and the mesh peers
+// When interactive is false only a successful repair is reported, and a
+// repair already in progress is not repeated
+func (c *ChatCLI) repairDAG(interactive bool, first peer.ID) {
+	if !c.dagRepairing.CompareAndSwap(false, true) {
+		if interactive {
+			fmt.Println("A DAG repair is already running")
+		}
+		return
+	}
+	defer c.dagRepairing.Store(false)
+
+	var peers []peer.ID
+	if first != "" && first != c.host.ID() {
+		peers = append(peers, first)
+	}
+	for _, p := range c.messaging.GetTopicPeers() {
+		if p != first {
+			peers = append(peers, p)
+		}
+	}
+
+	fetched, err := c.dag.Repair(peers)
+	if err != nil {
+		fmt.Printf("\n❌ DAG repair failed: %v\n", err)
+		if !interactive {
+			fmt.Print("> ")
+		}
+		return
+	}
+
+	if len(fetched) > 0 {
+		fmt.Printf("\n🧩 %d earlier message(s) filled gaps in the history:\n", len(fetched))
+		for _, msg := range fetched {
+			c.printMessage(fromStoreMessage(msg))
+		}
+		if !interactive {
+			fmt.Print("> ")
+		}
+	}
+	if interactive {
+		missing, _ := c.dag.Missing()
+		fmt.Printf("Repair complete: %d message(s) fetched, %d gap(s) left\n\n", len(fetched), len(missing))
+	}
+}
+
+// dagCommand handles /dag, /dag repair and /dag log [N]
+func (c *ChatCLI) dagCommand(parts []string) {
+	if c.dag == nil {
+		fmt.Println("Message DAG not available")
+		return
+	}
+
+	if len(parts) < 2 {
+		c.showDAG()
+		return
+	}
+	switch parts[1] {
+	case "repair":
+		fmt.Println()
+		c.repairDAG(true, "")
+	case "log":
+		limit := defaultDAGLogLimit
+		if len(parts) > 2 {
+			n, err := strconv.Atoi(parts[2])
+			if err != nil || n <= 0 {
+				fmt.Println("Usage: /dag log [N]")
+				return
+			}
+			limit = n
+		}
+		c.showDAGLog(limit)
+	default:
+		fmt.Println("Usage: /dag [repair | log [N]]")
+	}
+}
+
+// showDAG displays the heads and gaps of the room DAG
+func (c *ChatCLI) showDAG() {
+	heads, err := c.dag.Heads()
+	if err != nil {
+		fmt.Printf("Error reading DAG heads: %v\n", err)
+		return
+	}
+	missing, err := c.dag.Missing()
+	if err != nil {
+		fmt.Printf("Error reading DAG gaps: %v\n", err)
+		return
+	}
+	ordered, err := c.dag.Ordered()
+	if err != nil {
+		fmt.Printf("Error reading DAG: %v\n", err)
+		return
+	}
+
+	deleted := 0
+	for _, n := range ordered {
+		if n.IsTombstone() {
+			deleted++
+		}
+	}
+
+	fmt.Printf("\n=== Message DAG (%s) ===\n", c.dag.Room())
+	fmt.Printf("Messages linked: %d (%d deleted)\n", len(ordered), deleted)
+	fmt.Printf("Heads:           %d\n", len(heads))
+	for i, h := range heads {
+		if i == maxShownHeads {
+			fmt.Printf("  ... and %d more\n", len(heads)-i)
+			break
+		}
+		fmt.Printf("  %s\n", h)
+	}
+	if len(missing) == 0 {
+		fmt.Println("Gaps:            none - history is complete")
+	} else {
+		fmt.Printf("Gaps:            %d missing parent(s) (/dag repair to fetch them)\n", len(missing))
+	}
+	fmt.Println()
+}
+
+// showDAGLog prints the last messages of the room in DAG order
+func (c *ChatCLI) showDAGLog(limit int) {
+	ordered, err := c.dag.Ordered()
+	if err != nil {
+		fmt.Printf("Error reading DAG: %v\n", err)
+		return
+	}
+	if len(ordered) > limit {
+		ordered = ordered[len(ordered)-limit:]
+	}
+
+	ids := make([]string, len(ordered))
+	for i, n := range ordered {
+		ids[i] = n.MessageID
+	}
+	msgs, err := c.store.GetMessagesByID(c.dag.Room(), ids)
+	if err != nil {
+		fmt.Printf("Error loading messages: %v\n", err)
+		return
+	}
+	byID := make(map[string]*storage.Message, len(msgs))
+	for _, msg := range msgs {
+		byID[msg.ID] = msg
+	}
+
+	fmt.Printf("\n=== Last %d message(s) in DAG order ===\n", len(ordered))
+	for _, n := range ordered {
+		msg, ok := byID[n.MessageID]
+		if !ok {
+			fmt.Printf("(deleted message #%s)\n", shortCID(n.CID))
+			continue
+		}
+		c.printMessage(fromStoreMessage(msg))
+	}
+	fmt.Println()
+}
+
+// shortCIDLen is how many trailing characters of a CID are shown
+const shortCIDLen = 10
+
+// shortCID abbreviates a CID for display
+// CIDs of the same kind share their prefix, so the tail is shown
+func shortCID(c string) string {
+	if len(c) <= shortCIDLen {
+		return c
+	}
+	return c[len(c)-shortCIDLen:]
+}
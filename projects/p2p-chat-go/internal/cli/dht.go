@@ -0,0 +1,370 @@
+package cli
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/geekp2p/p2p-chat-go/internal/dag"
+	dhtstorage "github.com/geekp2p/p2p-chat-go/internal/dht"
+	"github.com/geekp2p/p2p-chat-go/internal/messaging"
+	"github.com/geekp2p/p2p-chat-go/internal/storage"
+	"github.com/ipfs/go-cid"
+)
+
+// indexFetchLimit is how many messages are recovered from the room index on join
+const indexFetchLimit = 50
+
+// maxProviders is how many providers /dht providers looks for
+const maxProviders = 20
+
+// distributedStorage returns the DHT storage, if there is one
+func (c *ChatCLI) distributedStorage() (*dhtstorage.DistributedStorage, bool) {
+	ds, ok := c.dhtStorage.(*dhtstorage.DistributedStorage)
+	return ds, ok && ds != nil
+}
+
+// recoverFromIndex imports the room's recent history from its DHT index,
+// so a peer can catch up even when no mesh peer is online to sync with
+// Recovered messages pass the same checks as synced ones
+func (c *ChatCLI) recoverFromIndex() {
+	ds, ok := c.distributedStorage()
+	if !ok || c.historySync == nil {
+		return
+	}
+
+	// Only the indexes of the room owner and admins are trusted
+	if c.moderation == nil {
+		return
+	}
+	publishers := c.moderation.Admins()
+	if len(publishers) == 0 {
+		return
+	}
+
+	room := c.messaging.Topic()
+	found, err := ds.FetchRoomHistory(room, publishers, indexFetchLimit)
+	if err != nil {
+		if c.verboseMode != nil && *c.verboseMode {
+			fmt.Printf("Room index not available: %v\n", err)
+		}
+		return
+	}
+
+	var recovered []*storage.Message
+	for _, m := range found {
+		msg := m.Message(room)
+		if !c.historySync.Admits(msg) {
+			continue
+		}
+		stored, err := c.store.ImportMessage(msg)
+		if err != nil {
+			fmt.Printf("Warning: failed to store recovered message: %v\n", err)
+			return
+		}
+		if stored {
+			recovered = append(recovered, msg)
+		}
+		c.linkMessage(msg, "")
+	}
+
+	if len(recovered) == 0 {
+		return
+	}
+	fmt.Printf("\n📚 %d message(s) recovered from the DHT room index:\n", len(recovered))
+	for _, msg := range recovered {
+		c.printMessage(fromStoreMessage(msg))
+	}
+	fmt.Print("> ")
+}
+
+// roomMirrors reports whether the room metadata asks members to mirror the
+// messages they send into the DHT
+func (c *ChatCLI) roomMirrors() bool {
+	if c.roomMeta == nil {
+		return false
+	}
+	meta := c.roomMeta.Current()
+	return meta != nil && meta.Mirror
+}
+
+// mirrorToDHT stores a message we published in the DHT and adds it to the
+// room's index in the background, when the room mirrors its messages
+func (c *ChatCLI) mirrorToDHT(msg *storage.Message) {
+	ds, ok := c.distributedStorage()
+	if !ok || !c.roomMirrors() || msg.Type != dag.MessageType {
+		return
+	}
+	go func() {
+		if err := c.publishToDHT(ds, msg); err != nil && c.verboseMode != nil && *c.verboseMode {
+			fmt.Printf("DHT mirror: %v\n", err)
+		}
+	}()
+}
+
+// indexInDHT adds a message mirrored by its author to the room's index in
+// the background, when we keep one of the indexes readers trust
+func (c *ChatCLI) indexInDHT(msg *storage.Message) {
+	ds, ok := c.distributedStorage()
+	if !ok || !c.roomMirrors() || msg.Type != dag.MessageType || !c.keepsIndex() {
+		return
+	}
+	go func() {
+		if err := c.appendToIndex(ds, dhtstorage.NewStorageMessage(msg)); err != nil && c.verboseMode != nil && *c.verboseMode {
+			fmt.Printf("DHT index: %v\n", err)
+		}
+	}()
+}
+
+// keepsIndex reports whether this node maintains a room index readers trust:
+// only the indexes of the room owner and admins are read
+func (c *ChatCLI) keepsIndex() bool {
+	return c.moderation != nil && c.moderation.IsAdmin(c.host.ID())
+}
+
+// publishToDHT stores a message in the DHT and, if we keep a room index,
+// adds it there
+func (c *ChatCLI) publishToDHT(ds *dhtstorage.DistributedStorage, msg *storage.Message) error {
+	if msg.Expires != 0 && msg.Expires <= time.Now().Unix() {
+		return fmt.Errorf("message %s has expired", msg.ID)
+	}
+
+	dm := dhtstorage.NewStorageMessage(msg)
+	if err := ds.PutMessage(dm); err != nil {
+		return err
+	}
+	if !c.keepsIndex() {
+		return nil
+	}
+	return c.appendToIndex(ds, dm)
+}
+
+// appendToIndex adds a message to our index of the room
+func (c *ChatCLI) appendToIndex(ds *dhtstorage.DistributedStorage, dm *dhtstorage.StorageMessage) error {
+	entry, err := dhtstorage.NewIndexEntry(dm)
+	if err != nil {
+		return err
+	}
+	if err := ds.AppendToIndex(c.messaging.Topic(), entry); err != nil {
+		return fmt.Errorf("failed to update the room index: %w", err)
+	}
+	return nil
+}
+
+// cidMarker tags a chat message with the tail of its content ID
+func cidMarker(msg *messaging.Message) string {
+	if msg.Type != dag.MessageType {
+		return ""
+	}
+	c, err := dag.CID(&storage.Message{
+		ID:        msg.ID,
+		Type:      msg.Type,
+		Content:   msg.Content,
+		Username:  msg.Username,
+		Timestamp: msg.Timestamp,
+		From:      msg.From,
+		Thread:    msg.Thread,
+		Parents:   msg.Parents,
+	})
+	if err != nil {
+		return ""
+	}
+	return " #" + shortCID(c.String())
+}
+
+// resolveCID expands a CID, or the tail shown next to a message, to a full CID
+func (c *ChatCLI) resolveCID(s string) (string, error) {
+	s = strings.TrimPrefix(s, "#")
+	if _, err := cid.Decode(s); err == nil {
+		return s, nil
+	}
+	if c.dag == nil {
+		return "", fmt.Errorf("invalid CID %q", s)
+	}
+
+	nodes, err := c.dag.Ordered()
+	if err != nil {
+		return "", err
+	}
+	var match string
+	for _, n := range nodes {
+		if !n.IsTombstone() && strings.HasSuffix(n.CID, s) {
+			if match != "" {
+				return "", fmt.Errorf("%q matches more than one message", s)
+			}
+			match = n.CID
+		}
+	}
+	if match == "" {
+		return "", fmt.Errorf("no message with CID %q in this room", s)
+	}
+	return match, nil
+}
+
+// dhtCommand handles /dht [stats], get, put, providers and reprovide
+func (c *ChatCLI) dhtCommand(parts []string) {
+	ds, ok := c.distributedStorage()
+	if !ok {
+		fmt.Println("DHT storage not available")
+		return
+	}
+
+	if len(parts) < 2 || parts[1] == "stats" {
+		c.showDHTStats(ds)
+		return
+	}
+
+	switch parts[1] {
+	case "get", "put", "providers":
+		if len(parts) != 3 {
+			fmt.Printf("Usage: /dht %s <cid>\n", parts[1])
+			return
+		}
+		id, err := c.resolveCID(parts[2])
+		if err != nil {
+			fmt.Printf("❌ %v\n", err)
+			return
+		}
+		switch parts[1] {
+		case "get":
+			c.dhtGet(ds, id)
+		case "put":
+			c.dhtPut(ds, id)
+		default:
+			c.dhtProviders(ds, id)
+		}
+	case "reprovide":
+		r := ds.Reprovider()
+		if r == nil {
+			fmt.Println("DHT reprovider not available")
+			return
+		}
+		r.Reprovide(true)
+		fmt.Printf("✓ Re-announcing %d tracked CID(s) in the background (progress in /dht stats)\n", r.Stats().Tracked)
+	default:
+		fmt.Println("Usage: /dht [stats | get <cid> | put <cid> | providers <cid> | reprovide]")
+	}
+}
+
+// showDHTStats displays DHT storage statistics
+func (c *ChatCLI) showDHTStats(ds *dhtstorage.DistributedStorage) {
+	stats := ds.GetCacheStats()
+	providers, records := ds.RoutingTableSizes()
+
+	limit := func(n int64, unit string) string {
+		if n <= 0 {
+			return "no limit"
+		}
+		return fmt.Sprintf("max %d%s", n, unit)
+	}
+
+	fmt.Println("\n=== DHT Storage Statistics ===")
+	fmt.Printf("Routing table:  %d peer(s) (records: %d)\n", providers, records)
+	fmt.Printf("Cached:         %d message(s) (%s)\n", stats.Entries, limit(int64(stats.MaxEntries), ""))
+	fmt.Printf("Cache size:     %d KB (%s)\n", stats.Bytes>>10, limit(stats.MaxBytes>>20, " MB"))
+	fmt.Printf("Lookups:        %d hit(s), %d miss(es), %.0f%% hit rate\n", stats.Hits, stats.Misses, stats.HitRate()*100)
+	fmt.Printf("Dropped:        %d evicted, %d expired\n", stats.Evictions, stats.Expirations)
+	if stats.Persistent {
+		fmt.Println("Persistence:    kept in the message store across restarts")
+	} else {
+		fmt.Println("Persistence:    memory only")
+	}
+	if r := ds.Reprovider(); r != nil {
+		c.showReproviderStats(r.Stats())
+	}
+	if c.roomMirrors() {
+		fmt.Println("Mirroring:      on - the room stores sent messages in the DHT")
+	} else {
+		fmt.Println("Mirroring:      off (/topic mirror on, admins only)")
+	}
+	fmt.Println()
+}
+
+// showReproviderStats displays the progress of the DHT reprovider
+func (c *ChatCLI) showReproviderStats(s dhtstorage.ReproviderStats) {
+	fmt.Printf("Reproviding:    %d CID(s) tracked, %d pinned, %d failing\n", s.Tracked, s.Pinned, s.Failing)
+	switch {
+	case s.Running:
+		fmt.Printf("                pass in progress: %d of %d announced\n", s.Done, s.Total)
+	case !s.LastRun.IsZero():
+		fmt.Printf("                last pass %s: %d announced, %d failed in %s\n",
+			s.LastRun.Format("15:04:05"), s.Provided, s.Failed, s.LastTook.Round(time.Second))
+	}
+	if s.Interval > 0 && !s.Running && !s.NextRun.IsZero() {
+		fmt.Printf("                next pass %s (every %s)\n", s.NextRun.Format("15:04:05"), s.Interval)
+	} else if s.Interval == 0 {
+		fmt.Println("                automatic passes off (/dht reprovide)")
+	}
+}
+
+// dhtGet looks a message up in the DHT and shows it
+func (c *ChatCLI) dhtGet(ds *dhtstorage.DistributedStorage, id string) {
+	fmt.Printf("Looking up %s...\n", id)
+	m, err := ds.GetMessage(id)
+	if err != nil {
+		fmt.Printf("❌ %v\n\n", err)
+		return
+	}
+
+	msg := fromStoreMessage(m.Message(""))
+	fmt.Println()
+	c.printMessage(msg)
+	fmt.Printf("  Author:  %s\n", m.From)
+	fmt.Printf("  Expires: %s\n", time.Unix(m.TTL, 0).Format(time.RFC3339))
+	if len(m.Parents) > 0 {
+		fmt.Printf("  Parents: %s\n", strings.Join(m.Parents, ", "))
+	}
+	fmt.Println()
+}
+
+// dhtPut stores a message of this room in the DHT
+func (c *ChatCLI) dhtPut(ds *dhtstorage.DistributedStorage, id string) {
+	node, err := c.store.GetDAGNode(c.messaging.Topic(), id)
+	if err != nil {
+		fmt.Printf("❌ %v\n", err)
+		return
+	}
+	if node == nil {
+		fmt.Println("❌ That message is not stored here")
+		return
+	}
+	msgs, err := c.store.GetMessagesByID(c.messaging.Topic(), []string{node.MessageID})
+	if err != nil || len(msgs) == 0 {
+		fmt.Println("❌ That message is no longer stored here")
+		return
+	}
+
+	if err := c.publishToDHT(ds, msgs[0]); err != nil {
+		fmt.Printf("❌ %v\n", err)
+		return
+	}
+	if msgs[0].From == c.host.ID().String() {
+		fmt.Printf("✓ Stored %s in the DHT\n", id)
+	} else {
+		fmt.Printf("✓ Announced %s as a provider (only its author can store a signed record)\n", id)
+	}
+	if c.keepsIndex() {
+		fmt.Printf("✓ Added %s to your room index\n", id)
+	}
+}
+
+// dhtProviders lists the peers that announced a message
+func (c *ChatCLI) dhtProviders(ds *dhtstorage.DistributedStorage, id string) {
+	fmt.Printf("Finding providers of %s...\n", id)
+	providers, err := ds.FindProviders(id, maxProviders)
+	if err != nil {
+		fmt.Printf("❌ %v\n\n", err)
+		return
+	}
+	if len(providers) == 0 {
+		fmt.Println("No other peer provides this message")
+		fmt.Println()
+		return
+	}
+
+	fmt.Printf("\n%d provider(s):\n", len(providers))
+	for _, p := range providers {
+		fmt.Printf("  %s - %d address(es)\n", c.peerName(p.ID), len(p.Addrs))
+	}
+	fmt.Println()
+}
@@ -0,0 +1,69 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/geekp2p/p2p-chat-go/internal/storage"
+	"github.com/geekp2p/p2p-chat-go/internal/transcript"
+)
+
+// SetExportDir sets where /export writes transcripts
+func (c *ChatCLI) SetExportDir(dir string) {
+	c.exportDir = dir
+}
+
+// exportHistory writes a transcript of this room to the export directory
+// Usage: /export [jsonl|md|html] [since]
+func (c *ChatCLI) exportHistory(parts []string) {
+	if c.exportDir == "" {
+		fmt.Println("Export not available")
+		return
+	}
+
+	format := transcript.FormatMarkdown
+	var since int64
+	for _, arg := range parts[1:] {
+		if f, err := transcript.ParseFormat(arg); err == nil {
+			format = f
+			continue
+		}
+		t, err := storage.ParseTime(arg, time.Now())
+		if err != nil {
+			fmt.Println("Usage: /export [jsonl|md|html] [since]")
+			fmt.Print("Example: /export html 24h\n\n")
+			return
+		}
+		since = t
+	}
+
+	if err := os.MkdirAll(c.exportDir, 0700); err != nil {
+		fmt.Printf("❌ Export failed: %v\n\n", err)
+		return
+	}
+
+	room := c.messaging.Topic()
+	name := fmt.Sprintf("%s-%s.%s", room, time.Now().Format("20060102-150405"), format.Ext())
+	path := filepath.Join(c.exportDir, filepath.Base(name))
+
+	file, err := os.Create(path)
+	if err != nil {
+		fmt.Printf("❌ Export failed: %v\n\n", err)
+		return
+	}
+	defer file.Close()
+
+	count, err := transcript.Export(c.store, file, transcript.ExportOptions{
+		Room:   room,
+		Since:  since,
+		Format: format,
+	})
+	if err != nil {
+		fmt.Printf("❌ Export failed after %d message(s): %v\n\n", count, err)
+		return
+	}
+
+	fmt.Printf("✓ Exported %d message(s) to %s\n\n", count, path)
+}
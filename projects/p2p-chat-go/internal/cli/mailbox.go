@@ -0,0 +1,59 @@
+package cli
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/geekp2p/p2p-chat-go/internal/messaging"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// deliverMailbox stores and displays messages drained from a mailbox
+func (c *ChatCLI) deliverMailbox(from peer.ID, msgs []*messaging.Message) {
+	fmt.Printf("\n📬 %d message(s) delivered by mailbox %s while you were away:\n", len(msgs), from.ShortString())
+
+	for _, msg := range msgs {
+		c.capExpiry(msg)
+		stored := c.toStoreMessage(msg)
+		saved, err := c.store.ImportMessage(stored)
+		if err != nil {
+			fmt.Printf("Error saving message: %v\n", err)
+		} else if !saved {
+			continue // Already received
+		} else {
+			c.linkMessage(stored, from)
+		}
+		c.printMessage(msg)
+	}
+	fmt.Print("> ")
+}
+
+// showMailbox displays mailbox client and server status
+func (c *ChatCLI) showMailbox() {
+	fmt.Println("\n=== Mailbox ===")
+
+	if c.mailboxSrv != nil {
+		members, waiting, held, dropped := c.mailboxSrv.Stats()
+		fmt.Println("This node is a mailbox for offline members")
+		fmt.Printf("  Registered members: %d\n", members)
+		fmt.Printf("  Messages waiting:   %d\n", waiting)
+		fmt.Printf("  Held since start:   %d (refused over quota: %d)\n", held, dropped)
+	}
+
+	if c.mailbox == nil {
+		fmt.Println("Mailbox client not available")
+		fmt.Println()
+		return
+	}
+
+	boxes := c.mailbox.Mailboxes()
+	if len(boxes) == 0 {
+		fmt.Println("No mailbox peers found yet (run a peer with --mailbox)")
+	} else {
+		fmt.Printf("Registered with %d mailbox peer(s):\n", len(boxes))
+		for p, last := range boxes {
+			fmt.Printf("  - %s (last drained %s ago)\n", p.ShortString(), time.Since(last).Round(time.Second))
+		}
+	}
+	fmt.Println()
+}
@@ -0,0 +1,188 @@
+package cli
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/geekp2p/p2p-chat-go/internal/messaging"
+	"github.com/geekp2p/p2p-chat-go/internal/moderation"
+	"github.com/geekp2p/p2p-chat-go/internal/storage"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// defaultMuteDuration is used when /mute is given no duration
+const defaultMuteDuration = 10 * time.Minute
+
+// handleModerationMessage applies and announces received moderation events
+func (c *ChatCLI) handleModerationMessage(msg *messaging.Message) {
+	if c.moderation == nil {
+		return
+	}
+
+	applied, err := c.moderation.HandleMessage(msg)
+	if err != nil {
+		fmt.Printf("Error handling moderation event: %v\n", err)
+		return
+	}
+
+	for _, ev := range applied {
+		fmt.Printf("*** %s\n", c.describeEvent(ev))
+	}
+	if len(applied) > 0 {
+		fmt.Print("> ")
+	}
+}
+
+// moderate handles /op, /deop, /ban, /unban, /mute, /unmute and /kick
+func (c *ChatCLI) moderate(parts []string) {
+	if c.moderation == nil {
+		fmt.Println("Moderation not available")
+		return
+	}
+
+	action := strings.TrimPrefix(parts[0], "/")
+	if len(parts) < 2 {
+		fmt.Printf("\nUsage: /%s <peer-id|nick>", action)
+		switch action {
+		case moderation.ActionBan, moderation.ActionMute:
+			fmt.Print(" [duration] [reason]")
+		case moderation.ActionKick:
+			fmt.Print(" [reason]")
+		}
+		fmt.Print("\n\n")
+		return
+	}
+
+	target, err := c.resolvePeer(parts[1])
+	if err != nil {
+		fmt.Printf("❌ %v\n\n", err)
+		return
+	}
+
+	// Optional duration (ban/mute) followed by a free-form reason
+	var duration time.Duration
+	rest := parts[2:]
+	if action == moderation.ActionBan || action == moderation.ActionMute {
+		if len(rest) > 0 {
+			if d, err := time.ParseDuration(rest[0]); err == nil && d > 0 {
+				duration = d
+				rest = rest[1:]
+			}
+		}
+		if action == moderation.ActionMute && duration == 0 {
+			duration = defaultMuteDuration
+		}
+	}
+	var reason string
+	if action == moderation.ActionBan || action == moderation.ActionMute || action == moderation.ActionKick {
+		reason = strings.Join(rest, " ")
+	}
+
+	ev, err := c.moderation.Act(action, target, reason, duration)
+	if err != nil {
+		if ev == nil {
+			fmt.Printf("❌ %v\n\n", err)
+			return
+		}
+		fmt.Printf("⚠ Applied locally but failed to publish: %v\n", err)
+	}
+
+	fmt.Printf("✓ %s\n\n", c.describeEvent(ev))
+}
+
+// showModLog displays the room moderation log and current roles
+func (c *ChatCLI) showModLog() {
+	if c.moderation == nil {
+		fmt.Println("Moderation not available")
+		return
+	}
+
+	owner := c.moderation.Owner()
+	fmt.Println("\n=== Moderation Log ===")
+	if owner == "" {
+		fmt.Printf("%v\n", moderation.ErrNoOwner)
+		fmt.Println()
+		return
+	}
+
+	fmt.Printf("Owner: %s\n", c.peerName(owner))
+	var admins []string
+	for _, p := range c.moderation.Admins() {
+		if p != owner {
+			admins = append(admins, c.peerName(p))
+		}
+	}
+	if len(admins) > 0 {
+		fmt.Printf("Admins: %s\n", strings.Join(admins, ", "))
+	}
+
+	fmt.Println()
+	for _, ev := range c.moderation.Log() {
+		fmt.Printf("[%s] %s\n", storage.FormatTimestamp(ev.Timestamp), c.describeEvent(ev))
+	}
+	fmt.Println()
+}
+
+// describeEvent renders a moderation event for display
+func (c *ChatCLI) describeEvent(ev *moderation.Event) string {
+	actor := c.peerName(ev.ActorID())
+	verbs := map[string]string{
+		moderation.ActionOp:     "made %s an admin",
+		moderation.ActionDeop:   "removed admin rights from %s",
+		moderation.ActionBan:    "banned %s",
+		moderation.ActionUnban:  "unbanned %s",
+		moderation.ActionMute:   "muted %s",
+		moderation.ActionUnmute: "unmuted %s",
+		moderation.ActionKick:   "kicked %s",
+	}
+
+	text := fmt.Sprintf("%s "+verbs[ev.Action], actor, c.peerName(ev.TargetID()))
+	if ev.Expires != 0 {
+		text += fmt.Sprintf(" until %s", storage.FormatTimestamp(ev.Expires))
+	}
+	if ev.Reason != "" {
+		text += fmt.Sprintf(" (%s)", ev.Reason)
+	}
+	return text
+}
+
+// resolvePeer parses a peer ID or looks up a known display name
+func (c *ChatCLI) resolvePeer(s string) (peer.ID, error) {
+	if id, err := peer.Decode(s); err == nil {
+		return id, nil
+	}
+
+	c.namesLock.RLock()
+	defer c.namesLock.RUnlock()
+
+	var matches []peer.ID
+	for id, name := range c.displayNames {
+		if name == s {
+			matches = append(matches, id)
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return "", fmt.Errorf("unknown peer: %s", s)
+	case 1:
+		return matches[0], nil
+	default:
+		return "", fmt.Errorf("nick %s is ambiguous, use the peer ID", s)
+	}
+}
+
+// peerName returns a short display form of a peer, with nick if known
+func (c *ChatCLI) peerName(id peer.ID) string {
+	if id == c.host.ID() {
+		return "you"
+	}
+	c.namesLock.RLock()
+	name, ok := c.displayNames[id]
+	c.namesLock.RUnlock()
+	if ok {
+		return fmt.Sprintf("%s (%s)", name, id.ShortString())
+	}
+	return id.ShortString()
+}
@@ -0,0 +1,52 @@
+package cli
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/geekp2p/p2p-chat-go/internal/janitor"
+)
+
+// SetJanitor sets the janitor that enforces retention in the background
+func (c *ChatCLI) SetJanitor(j *janitor.Janitor) {
+	c.janitor = j
+}
+
+// showRetention displays the retention policy of this room and what the
+// janitor has cleaned up
+func (c *ChatCLI) showRetention() {
+	if c.janitor == nil {
+		fmt.Println("Retention is not available")
+		return
+	}
+
+	retention := c.janitor.Retention()
+	stats := c.janitor.Stats()
+
+	fmt.Println("\n=== Retention ===")
+	fmt.Printf("This room: %s\n", retention.For(c.messaging.Topic()))
+	if !retention.IsZero() {
+		fmt.Printf("Policies:  %s\n", retention)
+	}
+	fmt.Printf("Deleted by retention:   %d (last run %s)\n", stats.Retained, formatLastRun(stats.LastRetention))
+	fmt.Printf("Disappearing purged:    %d\n", stats.Expired)
+	fmt.Printf("Value log files reclaimed: %d (last GC %s)\n", stats.GCRewrites, formatLastRun(stats.LastGC))
+	fmt.Println()
+}
+
+// reclaimSpace runs value log GC after a manual clear so the disk shrinks now
+func (c *ChatCLI) reclaimSpace() {
+	if c.janitor != nil {
+		c.janitor.CollectGarbage()
+		return
+	}
+	c.store.CollectGarbage()
+}
+
+// formatLastRun describes when a background task last ran
+func formatLastRun(t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	return time.Since(t).Truncate(time.Second).String() + " ago"
+}
@@ -0,0 +1,382 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/geekp2p/p2p-chat-go/internal/dag"
+	dhtstorage "github.com/geekp2p/p2p-chat-go/internal/dht"
+	"github.com/geekp2p/p2p-chat-go/internal/messaging"
+	"github.com/geekp2p/p2p-chat-go/internal/moderation"
+	"github.com/geekp2p/p2p-chat-go/internal/roommeta"
+	"github.com/geekp2p/p2p-chat-go/internal/storage"
+)
+
+// SetRoomMeta sets the room metadata manager
+func (c *ChatCLI) SetRoomMeta(mgr *roommeta.Manager) {
+	c.roomMeta = mgr
+}
+
+// handleRoomMetaMessage applies room metadata received on the topic
+func (c *ChatCLI) handleRoomMetaMessage(msg *messaging.Message) {
+	if c.roomMeta == nil {
+		return
+	}
+
+	old := c.roomMeta.Current()
+	meta, err := c.roomMeta.HandleMessage(msg)
+	if err != nil {
+		if c.verboseMode != nil && *c.verboseMode {
+			fmt.Printf("Ignoring room metadata: %v\n", err)
+		}
+		return
+	}
+	if meta == nil {
+		return // Already known
+	}
+
+	c.pinInReprovider(old, meta)
+	changes := c.describeMetaChange(old, meta)
+	for _, change := range changes {
+		fmt.Printf("*** %s\n", change)
+	}
+	if len(changes) > 0 {
+		fmt.Print("> ")
+	}
+}
+
+// refreshRoomMeta looks up metadata published to the DHT while we were away
+// When interactive is false only newer metadata is reported
+func (c *ChatCLI) refreshRoomMeta(interactive bool) {
+	if c.roomMeta == nil {
+		return
+	}
+
+	old := c.roomMeta.Current()
+	changed, err := c.roomMeta.Refresh()
+	if err != nil {
+		if interactive || (c.verboseMode != nil && *c.verboseMode) {
+			fmt.Printf("Room metadata not available: %v\n", err)
+		}
+		return
+	}
+	if !changed {
+		if interactive {
+			fmt.Print("Room metadata is up to date\n\n")
+		}
+		return
+	}
+
+	meta := c.roomMeta.Current()
+	c.pinInReprovider(old, meta)
+	fmt.Println("\n📋 Room metadata updated from the DHT:")
+	c.printRoomMeta(meta)
+	if interactive {
+		fmt.Println()
+	} else {
+		fmt.Print("> ")
+	}
+}
+
+// printRoomMeta shows the title, description, rules and pins of the room
+func (c *ChatCLI) printRoomMeta(meta *dhtstorage.RoomMeta) {
+	if meta.Title != "" {
+		fmt.Printf("📌 Topic: %s\n", meta.Title)
+	}
+	if meta.Description != "" {
+		fmt.Printf("   %s\n", meta.Description)
+	}
+	if meta.Rules != "" {
+		fmt.Println("   Rules:")
+		for _, line := range strings.Split(meta.Rules, "\n") {
+			fmt.Printf("     %s\n", line)
+		}
+	}
+	if len(meta.Pinned) > 0 {
+		fmt.Printf("   %d pinned message(s) (use /pins)\n", len(meta.Pinned))
+	}
+	if meta.Mirror {
+		fmt.Println("   Messages are mirrored into the DHT")
+	}
+}
+
+// describeMetaChange renders what changed between two versions of the
+// room metadata
+func (c *ChatCLI) describeMetaChange(old, meta *dhtstorage.RoomMeta) []string {
+	if old == nil {
+		old = &dhtstorage.RoomMeta{}
+	}
+	who := c.peerName(meta.PublisherID())
+
+	var changes []string
+	field := func(name, before, after string) {
+		switch {
+		case before == after:
+		case after == "":
+			changes = append(changes, fmt.Sprintf("%s cleared the room %s", who, name))
+		default:
+			changes = append(changes, fmt.Sprintf("%s set the room %s to: %s", who, name, after))
+		}
+	}
+	field("topic", old.Title, meta.Title)
+	field("description", old.Description, meta.Description)
+	if old.Rules != meta.Rules {
+		if meta.Rules == "" {
+			changes = append(changes, fmt.Sprintf("%s cleared the room rules", who))
+		} else {
+			changes = append(changes, fmt.Sprintf("%s changed the room rules (use /topic to read them)", who))
+		}
+	}
+	if old.Mirror != meta.Mirror {
+		if meta.Mirror {
+			changes = append(changes, fmt.Sprintf("%s turned on DHT mirroring: messages you send are stored in the DHT", who))
+		} else {
+			changes = append(changes, fmt.Sprintf("%s turned off DHT mirroring", who))
+		}
+	}
+	for _, p := range meta.Pinned {
+		if !old.IsPinned(p) {
+			changes = append(changes, fmt.Sprintf("%s pinned message #%s", who, shortCID(p)))
+		}
+	}
+	for _, p := range old.Pinned {
+		if !meta.IsPinned(p) {
+			changes = append(changes, fmt.Sprintf("%s unpinned message #%s", who, shortCID(p)))
+		}
+	}
+	return changes
+}
+
+// pinInReprovider keeps pinned messages announced to the DHT ahead of the
+// rest, and lets unpinned ones age out again
+func (c *ChatCLI) pinInReprovider(old, meta *dhtstorage.RoomMeta) {
+	ds, ok := c.distributedStorage()
+	if !ok || ds.Reprovider() == nil {
+		return
+	}
+	r := ds.Reprovider()
+	if old != nil {
+		for _, p := range old.Pinned {
+			if meta == nil || !meta.IsPinned(p) {
+				r.Pin(p, false)
+			}
+		}
+	}
+	if meta != nil {
+		for _, p := range meta.Pinned {
+			r.Pin(p, true)
+		}
+	}
+}
+
+// topicCommand handles /topic [text], /topic desc|rules <text>,
+// /topic clear <field>, /topic mirror [on|off] and /topic refresh
+func (c *ChatCLI) topicCommand(cmd string, parts []string) {
+	if c.roomMeta == nil {
+		fmt.Println("Room metadata not available")
+		return
+	}
+
+	if len(parts) < 2 {
+		c.showTopic()
+		return
+	}
+
+	var edit func(meta *dhtstorage.RoomMeta) error
+	switch parts[1] {
+	case "refresh":
+		fmt.Println("Looking up room metadata in the DHT...")
+		c.refreshRoomMeta(true)
+		return
+	case "desc", "rules":
+		text := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(strings.TrimPrefix(cmd, parts[0])), parts[1]))
+		if text == "" {
+			fmt.Printf("Usage: /topic %s <text> (/topic clear %s to remove it)\n", parts[1], parts[1])
+			return
+		}
+		text = strings.ReplaceAll(text, `\n`, "\n")
+		if parts[1] == "desc" {
+			edit = func(meta *dhtstorage.RoomMeta) error { meta.Description = text; return nil }
+		} else {
+			edit = func(meta *dhtstorage.RoomMeta) error { meta.Rules = text; return nil }
+		}
+	case "mirror":
+		if len(parts) == 2 {
+			if c.roomMirrors() {
+				fmt.Print("Members mirror the messages they send into the DHT\n\n")
+			} else {
+				fmt.Print("Messages are not mirrored into the DHT (/topic mirror on)\n\n")
+			}
+			return
+		}
+		if len(parts) != 3 || (parts[2] != "on" && parts[2] != "off") {
+			fmt.Println("Usage: /topic mirror [on|off]")
+			return
+		}
+		on := parts[2] == "on"
+		edit = func(meta *dhtstorage.RoomMeta) error { meta.Mirror = on; return nil }
+	case "clear":
+		if len(parts) != 3 {
+			fmt.Println("Usage: /topic clear <title|desc|rules>")
+			return
+		}
+		switch parts[2] {
+		case "title":
+			edit = func(meta *dhtstorage.RoomMeta) error { meta.Title = ""; return nil }
+		case "desc":
+			edit = func(meta *dhtstorage.RoomMeta) error { meta.Description = ""; return nil }
+		case "rules":
+			edit = func(meta *dhtstorage.RoomMeta) error { meta.Rules = ""; return nil }
+		default:
+			fmt.Println("Usage: /topic clear <title|desc|rules>")
+			return
+		}
+	default:
+		title := strings.TrimSpace(strings.TrimPrefix(cmd, parts[0]))
+		edit = func(meta *dhtstorage.RoomMeta) error { meta.Title = title; return nil }
+	}
+
+	old := c.roomMeta.Current()
+	meta, err := c.roomMeta.Update(edit)
+	if err != nil {
+		c.printMetaError(err)
+		if meta == nil {
+			return
+		}
+	}
+	for _, change := range c.describeMetaChange(old, meta) {
+		fmt.Printf("✓ %s\n", change)
+	}
+	fmt.Println()
+}
+
+// showTopic displays the full room metadata
+func (c *ChatCLI) showTopic() {
+	meta := c.roomMeta.Current()
+	fmt.Printf("\n=== Room %s ===\n", c.messaging.Topic())
+	if meta == nil {
+		fmt.Println("No topic, description or rules set")
+	} else {
+		c.printRoomMeta(meta)
+		fmt.Printf("Version %d by %s at %s\n", meta.Seq, c.peerName(meta.PublisherID()), storage.FormatTimestamp(meta.Published))
+	}
+	if c.roomMeta.CanEdit() {
+		fmt.Println("Change it with /topic <title>, /topic desc <text> or /topic rules <text>")
+	}
+	fmt.Println()
+}
+
+// printMetaError explains why the metadata could not be changed
+func (c *ChatCLI) printMetaError(err error) {
+	if errors.Is(err, roommeta.ErrNotAuthorized) && c.moderation != nil && c.moderation.Owner() == "" {
+		fmt.Printf("❌ %v\n", moderation.ErrNoOwner)
+		return
+	}
+	fmt.Printf("❌ %v\n", err)
+}
+
+// pinCommand handles /pin <cid> and /unpin <cid>
+func (c *ChatCLI) pinCommand(parts []string) {
+	if c.roomMeta == nil {
+		fmt.Println("Room metadata not available")
+		return
+	}
+
+	pin := parts[0] == "/pin"
+	if len(parts) != 2 {
+		fmt.Printf("Usage: %s <cid> (the #tail shown next to a message works too)\n", parts[0])
+		return
+	}
+	id, err := c.resolveCID(parts[1])
+	if err != nil {
+		fmt.Printf("❌ %v\n", err)
+		return
+	}
+
+	old := c.roomMeta.Current()
+	meta, err := c.roomMeta.Update(func(meta *dhtstorage.RoomMeta) error {
+		if pin {
+			if meta.IsPinned(id) {
+				return fmt.Errorf("message #%s is already pinned", shortCID(id))
+			}
+			if len(meta.Pinned) >= dhtstorage.MaxPinned {
+				return fmt.Errorf("a room can pin at most %d messages (/unpin one first)", dhtstorage.MaxPinned)
+			}
+			meta.Pinned = append(meta.Pinned, id)
+			return nil
+		}
+		for i, p := range meta.Pinned {
+			if p == id {
+				meta.Pinned = append(meta.Pinned[:i], meta.Pinned[i+1:]...)
+				return nil
+			}
+		}
+		return fmt.Errorf("message #%s is not pinned", shortCID(id))
+	})
+	if err != nil {
+		c.printMetaError(err)
+		if meta == nil {
+			return
+		}
+	}
+
+	// Announce a pinned message we hold even if we never provided it
+	if ds, ok := c.distributedStorage(); ok && pin && ds.Reprovider() != nil {
+		if node, err := c.store.GetDAGNode(c.messaging.Topic(), id); err == nil && node != nil {
+			if !ds.Reprovider().Pin(id, true) {
+				ds.Reprovider().Track(id, dhtstorage.KindMessage, 0, false)
+				ds.Reprovider().Reprovide(false)
+			}
+		}
+	}
+	c.pinInReprovider(old, meta)
+
+	for _, change := range c.describeMetaChange(old, meta) {
+		fmt.Printf("✓ %s\n", change)
+	}
+	fmt.Println()
+}
+
+// showPins lists the pinned messages of the room, looking up in the DHT
+// those that are not stored here
+func (c *ChatCLI) showPins() {
+	if c.roomMeta == nil {
+		fmt.Println("Room metadata not available")
+		return
+	}
+	meta := c.roomMeta.Current()
+	if meta == nil || len(meta.Pinned) == 0 {
+		fmt.Print("\nNo pinned messages (pin one with /pin <cid>)\n\n")
+		return
+	}
+
+	room := c.messaging.Topic()
+	fmt.Printf("\n=== %d pinned message(s) ===\n", len(meta.Pinned))
+	for _, id := range meta.Pinned {
+		if msg := c.pinnedMessage(room, id); msg != nil {
+			c.printMessage(msg)
+		} else {
+			fmt.Printf("(message #%s is not available)\n", shortCID(id))
+		}
+	}
+	fmt.Println()
+}
+
+// pinnedMessage returns a pinned message from the store or the DHT
+func (c *ChatCLI) pinnedMessage(room, id string) *messaging.Message {
+	if node, err := c.store.GetDAGNode(room, id); err == nil && node != nil {
+		if msgs, err := c.store.GetMessagesByID(room, []string{node.MessageID}); err == nil && len(msgs) > 0 {
+			return fromStoreMessage(msgs[0])
+		}
+	}
+	ds, ok := c.distributedStorage()
+	if !ok {
+		return nil
+	}
+	m, err := ds.GetMessage(id)
+	if err != nil || m.Type != dag.MessageType {
+		return nil
+	}
+	return fromStoreMessage(m.Message(room))
+}
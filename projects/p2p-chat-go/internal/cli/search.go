@@ -0,0 +1,47 @@
+package cli
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/geekp2p/p2p-chat-go/internal/storage"
+)
+
+// search runs a full-text query against the message store
+func (c *ChatCLI) search(cmd string) {
+	input := strings.TrimSpace(strings.TrimPrefix(cmd, "/search"))
+	if input == "" {
+		fmt.Println("\nUsage: /search <words> [\"exact phrase\"] [from:<nick>] [room:<room>] [since:<2h|3d|date>] [until:<...>] [limit:<n>]")
+		fmt.Print("Example: /search deploy \"release notes\" from:alice since:1w\n\n")
+		return
+	}
+
+	q, err := storage.ParseSearchQuery(input, time.Now())
+	if err != nil {
+		fmt.Printf("❌ %v\n\n", err)
+		return
+	}
+
+	results, err := c.store.Search(q)
+	if err != nil {
+		fmt.Printf("❌ Search failed: %v\n\n", err)
+		return
+	}
+
+	if len(results) == 0 {
+		fmt.Print("\nNo messages found\n\n")
+		return
+	}
+
+	fmt.Printf("\n=== %d result(s) for: %s ===\n", len(results), input)
+	for _, r := range results {
+		msg := r.Message
+		room := ""
+		if msg.Room != "" && msg.Room != c.messaging.Topic() {
+			room = fmt.Sprintf(" #%s", msg.Room)
+		}
+		fmt.Printf("[%s]%s %s: %s%s\n", storage.FormatTimestamp(msg.Timestamp), room, msg.Username, msg.Content, expiryMarker(msg.Expires))
+	}
+	fmt.Println()
+}
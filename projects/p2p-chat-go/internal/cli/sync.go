@@ -0,0 +1,61 @@
+package cli
+
+import (
+	"fmt"
+)
+
+// maxSyncPeers is how many mesh peers are asked for missed history
+const maxSyncPeers = 3
+
+// syncHistory reconciles history with mesh peers and shows what was missed
+// When interactive is false only peers that had something new are reported
+func (c *ChatCLI) syncHistory(interactive bool) {
+	if c.historySync == nil {
+		fmt.Println("History sync not available")
+		return
+	}
+
+	var candidates int
+	received := 0
+	for _, p := range c.messaging.GetTopicPeers() {
+		if candidates >= maxSyncPeers {
+			break
+		}
+		if !c.historySync.Supports(p) {
+			continue
+		}
+		candidates++
+
+		result, err := c.historySync.Sync(p)
+		if err != nil {
+			if interactive {
+				fmt.Printf("❌ Sync with %s failed: %v\n", p.ShortString(), err)
+			}
+			continue
+		}
+		if len(result.Received) == 0 {
+			if interactive {
+				fmt.Printf("✓ In sync with %s (%d round(s), sent %d)\n", p.ShortString(), result.Rounds, result.Sent)
+			}
+			continue
+		}
+
+		received += len(result.Received)
+		fmt.Printf("\n🔄 %d missed message(s) from %s:\n", len(result.Received), p.ShortString())
+		for _, msg := range result.Received {
+			c.printMessage(fromStoreMessage(msg))
+		}
+		if !interactive {
+			fmt.Print("> ")
+		}
+	}
+
+	if interactive {
+		if candidates == 0 {
+			fmt.Println("No mesh peers support history sync yet")
+		} else {
+			fmt.Printf("Sync complete: %d new message(s) from %d peer(s)\n", received, candidates)
+		}
+		fmt.Println()
+	}
+}
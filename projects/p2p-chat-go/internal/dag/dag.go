@@ -0,0 +1,151 @@
+// Package dag links the messages of a room into a hash-linked DAG
+//
+// Every message names the CIDs of the room heads its author had seen when
+// sending it, like OrbitDB entries or Matrix events. A message whose parents
+// are unknown reveals a gap that can be filled from peers, and every node
+// that holds the same messages derives the same total order from the links.
+package dag
+
+import (
+	"container/heap"
+	"encoding/json"
+	"fmt"
+
+	"github.com/geekp2p/p2p-chat-go/internal/messaging"
+	"github.com/geekp2p/p2p-chat-go/internal/storage"
+	"github.com/ipfs/go-cid"
+	mh "github.com/multiformats/go-multihash"
+)
+
+// MessageType is the only message type linked into the DAG
+// Join and leave notices are local to a session and carry no parents
+const MessageType = "message"
+
+// MaxParents bounds the parents a message may reference
+const MaxParents = messaging.MaxParents
+
+// content is the part of a message covered by its CID
+// The expiry is left out: receivers cap it to their room's retention limit,
+// which must not change the identity of the message
+type content struct {
+	ID        string   `json:"id"`
+	Type      string   `json:"type"`
+	Content   string   `json:"content"`
+	Username  string   `json:"username"`
+	Timestamp int64    `json:"timestamp"`
+	From      string   `json:"from"`
+	Thread    string   `json:"thread,omitempty"`
+	Parents   []string `json:"parents,omitempty"`
+}
+
+// CID returns the content ID of a message
+func CID(msg *storage.Message) (cid.Cid, error) {
+	data, err := json.Marshal(content{
+		ID:        msg.ID,
+		Type:      msg.Type,
+		Content:   msg.Content,
+		Username:  msg.Username,
+		Timestamp: msg.Timestamp,
+		From:      msg.From,
+		Thread:    msg.Thread,
+		Parents:   msg.Parents,
+	})
+	if err != nil {
+		return cid.Undef, fmt.Errorf("failed to marshal message: %w", err)
+	}
+
+	hash, err := mh.Sum(data, mh.SHA2_256, -1)
+	if err != nil {
+		return cid.Undef, err
+	}
+	return cid.NewCidV1(cid.Raw, hash), nil
+}
+
+// NewNode returns the DAG node of a message
+func NewNode(msg *storage.Message) (*storage.DAGNode, error) {
+	if len(msg.Parents) > MaxParents {
+		return nil, fmt.Errorf("message has %d parents, at most %d allowed", len(msg.Parents), MaxParents)
+	}
+	for _, p := range msg.Parents {
+		if _, err := cid.Decode(p); err != nil {
+			return nil, fmt.Errorf("invalid parent %q: %w", p, err)
+		}
+	}
+
+	c, err := CID(msg)
+	if err != nil {
+		return nil, err
+	}
+	return &storage.DAGNode{
+		CID:       c.String(),
+		MessageID: msg.ID,
+		Parents:   msg.Parents,
+		Timestamp: msg.Timestamp,
+		From:      msg.From,
+	}, nil
+}
+
+// Order sorts nodes into the DAG's deterministic total order
+// Parents come before their children; nodes that are concurrent are ordered
+// by timestamp, then CID. Parents missing from nodes are treated as already
+// delivered, so a log with gaps still orders everything it holds
+func Order(nodes []*storage.DAGNode) []*storage.DAGNode {
+	byCID := make(map[string]*storage.DAGNode, len(nodes))
+	for _, n := range nodes {
+		byCID[n.CID] = n
+	}
+
+	pending := make(map[string]int, len(nodes)) // Unordered parents per node
+	children := make(map[string][]*storage.DAGNode, len(nodes))
+	ready := &nodeHeap{}
+	for _, n := range byCID {
+		seen := make(map[string]bool, len(n.Parents))
+		for _, p := range n.Parents {
+			if _, ok := byCID[p]; !ok || seen[p] || p == n.CID {
+				continue
+			}
+			seen[p] = true
+			pending[n.CID]++
+			children[p] = append(children[p], n)
+		}
+		if pending[n.CID] == 0 {
+			*ready = append(*ready, n)
+		}
+	}
+	heap.Init(ready)
+
+	ordered := make([]*storage.DAGNode, 0, len(byCID))
+	for ready.Len() > 0 {
+		n := heap.Pop(ready).(*storage.DAGNode)
+		ordered = append(ordered, n)
+		for _, child := range children[n.CID] {
+			if pending[child.CID]--; pending[child.CID] == 0 {
+				heap.Push(ready, child)
+			}
+		}
+	}
+	return ordered
+}
+
+// nodeHeap yields nodes by timestamp, then CID
+type nodeHeap []*storage.DAGNode
+
+func (h nodeHeap) Len() int { return len(h) }
+
+func (h nodeHeap) Less(i, j int) bool {
+	if h[i].Timestamp != h[j].Timestamp {
+		return h[i].Timestamp < h[j].Timestamp
+	}
+	return h[i].CID < h[j].CID
+}
+
+func (h nodeHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *nodeHeap) Push(x interface{}) { *h = append(*h, x.(*storage.DAGNode)) }
+
+func (h *nodeHeap) Pop() interface{} {
+	old := *h
+	n := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return n
+}
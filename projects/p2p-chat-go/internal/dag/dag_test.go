@@ -0,0 +1,141 @@
+package dag
+
+import (
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/geekp2p/p2p-chat-go/internal/storage"
+)
+
+// node returns the DAG node of a message stamped ts
+func node(t *testing.T, id string, ts int64, parents ...*storage.DAGNode) *storage.DAGNode {
+	t.Helper()
+	msg := message(id, "peer-alice")
+	msg.Timestamp = ts
+	for _, p := range parents {
+		msg.Parents = append(msg.Parents, p.CID)
+	}
+	n, err := NewNode(msg)
+	if err != nil {
+		t.Fatalf("NewNode(%s): %v", id, err)
+	}
+	return n
+}
+
+// messageIDs returns the message IDs of nodes, in order
+func messageIDs(nodes []*storage.DAGNode) string {
+	ids := make([]string, len(nodes))
+	for i, n := range nodes {
+		ids[i] = n.MessageID
+	}
+	return strings.Join(ids, ",")
+}
+
+func TestOrderPutsParentsFirst(t *testing.T) {
+	// b and c were sent concurrently after a; d merges them. Clocks are
+	// skewed: c and d claim to predate the messages they answer
+	a := node(t, "a", 100)
+	b := node(t, "b", 110, a)
+	c := node(t, "c", 50, a)
+	d := node(t, "d", 10, b, c)
+
+	got := messageIDs(Order([]*storage.DAGNode{d, c, b, a}))
+	if got != "a,c,b,d" {
+		t.Errorf("order = %s, want a,c,b,d", got)
+	}
+}
+
+func TestOrderIsDeterministic(t *testing.T) {
+	root := node(t, "root", 1)
+	nodes := []*storage.DAGNode{root}
+	for i := 0; i < 20; i++ {
+		// Many concurrent children, some with equal timestamps
+		child := node(t, string(rune('a'+i)), int64(2+i%3), root)
+		nodes = append(nodes, child, node(t, string(rune('A'+i)), int64(i), child))
+	}
+
+	want := messageIDs(Order(nodes))
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 20; i++ {
+		shuffled := append([]*storage.DAGNode(nil), nodes...)
+		rng.Shuffle(len(shuffled), func(i, j int) { shuffled[i], shuffled[j] = shuffled[j], shuffled[i] })
+		if got := messageIDs(Order(shuffled)); got != want {
+			t.Fatalf("order depends on input order:\n got %s\nwant %s", got, want)
+		}
+	}
+}
+
+func TestOrderBreaksTiesByTimestampThenCID(t *testing.T) {
+	root := node(t, "root", 1)
+	late := node(t, "late", 20, root)
+	x := node(t, "x", 10, root)
+	y := node(t, "y", 10, root)
+
+	first, second := x, y
+	if y.CID < x.CID {
+		first, second = y, x
+	}
+	want := "root," + first.MessageID + "," + second.MessageID + ",late"
+	if got := messageIDs(Order([]*storage.DAGNode{late, y, x, root})); got != want {
+		t.Errorf("order = %s, want %s", got, want)
+	}
+}
+
+func TestOrderKeepsNodesWithGaps(t *testing.T) {
+	missing := node(t, "missing", 1)
+	a := node(t, "a", 5)
+	b := node(t, "b", 3, missing)
+	c := node(t, "c", 4, b, a)
+
+	if got := messageIDs(Order([]*storage.DAGNode{c, b, a})); got != "b,a,c" {
+		t.Errorf("order = %s, want b,a,c", got)
+	}
+}
+
+func TestOrderIgnoresDuplicateAndSelfLinks(t *testing.T) {
+	a := node(t, "a", 1)
+	b := node(t, "b", 2, a, a)
+	loop := &storage.DAGNode{CID: "loop", MessageID: "loop", Parents: []string{"loop"}, Timestamp: 3}
+
+	if got := messageIDs(Order([]*storage.DAGNode{loop, b, a, b})); got != "a,b,loop" {
+		t.Errorf("order = %s, want a,b,loop", got)
+	}
+}
+
+func TestCIDCoversContentButNotExpiry(t *testing.T) {
+	msg := message("m1", "peer-alice")
+	base, err := CID(msg)
+	if err != nil {
+		t.Fatalf("CID: %v", err)
+	}
+
+	capped := *msg
+	capped.Expires = msg.Timestamp + 60
+	if c, _ := CID(&capped); !c.Equals(base) {
+		t.Error("capping the expiry changed the CID")
+	}
+
+	tampered := *msg
+	tampered.Content = "something else"
+	if c, _ := CID(&tampered); c.Equals(base) {
+		t.Error("changing the content kept the CID")
+	}
+}
+
+func TestNewNodeRejectsInvalidParents(t *testing.T) {
+	parent := node(t, "parent", 1)
+
+	bad := message("m1", "peer-alice", "not-a-cid")
+	if _, err := NewNode(bad); err == nil {
+		t.Error("accepted a parent that is not a CID")
+	}
+
+	many := message("m2", "peer-alice")
+	for i := 0; i <= MaxParents; i++ {
+		many.Parents = append(many.Parents, parent.CID)
+	}
+	if _, err := NewNode(many); err == nil {
+		t.Errorf("accepted %d parents", len(many.Parents))
+	}
+}
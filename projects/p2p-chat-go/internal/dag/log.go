@@ -0,0 +1,485 @@
+package dag
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/geekp2p/p2p-chat-go/internal/messaging"
+	"github.com/geekp2p/p2p-chat-go/internal/storage"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+// ProtocolID is the stream protocol for fetching missing DAG nodes
+const ProtocolID = protocol.ID("/p2p-chat/dag/1.0.0")
+
+const (
+	// maxWant bounds the messages asked for in one request
+	maxWant = 64
+	// maxServe bounds the messages, wanted ones and ancestors, in one response
+	maxServe = 256
+	// maxRepairRounds bounds how far back one repair follows missing parents
+	maxRepairRounds = 16
+	// requestTimeout bounds a single fetch from a peer
+	requestTimeout = 20 * time.Second
+	// maxFutureSkew rejects fetched messages stamped too far in the future
+	maxFutureSkew = 5 * time.Minute
+)
+
+// Store is the part of the message store used by the DAG log
+type Store interface {
+	storage.DAG
+	GetMessagesByID(room string, ids []string) ([]*storage.Message, error)
+	ImportMessage(msg *storage.Message) (bool, error)
+}
+
+// Verifier checks the signed pubsub record of a fetched message and returns
+// the message as its author published it
+type Verifier func(record []byte) (*messaging.Message, error)
+
+// request asks a peer for the messages with the given CIDs
+// The peer answers with as many of their ancestors as fit in one response
+type request struct {
+	Room string   `json:"room"`
+	Want []string `json:"want"`
+}
+
+// response carries the requested messages a peer still holds
+type response struct {
+	Messages []*storage.Message `json:"messages,omitempty"`
+	Error    string             `json:"error,omitempty"`
+}
+
+// Log is the message DAG of a room
+type Log struct {
+	ctx     context.Context
+	host    host.Host
+	store   Store
+	room    string
+	verbose bool
+
+	// verify authenticates messages fetched from peers; without it nothing
+	// peers serve is stored
+	verify Verifier
+	// filter decides whether a fetched message may be stored (optional)
+	filter func(msg *storage.Message) bool
+	// fetch looks a message up by CID outside the mesh, e.g. in the DHT (optional)
+	fetch func(cid string) (*storage.Message, error)
+
+	repairMu sync.Mutex // Serialises repairs
+}
+
+// New registers the DAG protocol handler for a room
+func New(ctx context.Context, h host.Host, store Store, room string, verbose bool) *Log {
+	l := &Log{
+		ctx:     ctx,
+		host:    h,
+		store:   store,
+		room:    room,
+		verbose: verbose,
+	}
+
+	h.SetStreamHandler(ProtocolID, l.handleStream)
+
+	return l
+}
+
+// SetVerifier sets how messages fetched from peers are authenticated
+// A hash link only proves that some message named the fetched one as its
+// parent, and any member can name a parent they made up
+func (l *Log) SetVerifier(v Verifier) {
+	l.verify = v
+}
+
+// SetFilter sets a predicate that fetched messages must pass to be stored
+func (l *Log) SetFilter(f func(msg *storage.Message) bool) {
+	l.filter = f
+}
+
+// SetFetcher sets a fallback that looks up messages no peer could serve
+// It must only return messages whose author's signature it checked
+func (l *Log) SetFetcher(f func(cid string) (*storage.Message, error)) {
+	l.fetch = f
+}
+
+// Room returns the room whose DAG this is
+func (l *Log) Room() string {
+	return l.room
+}
+
+// Parents returns the heads a new message should reference
+// When there are more heads than a message may name, the newest are chosen
+func (l *Log) Parents() ([]string, error) {
+	heads, err := l.store.DAGHeads(l.room)
+	if err != nil {
+		return nil, err
+	}
+	if len(heads) <= MaxParents {
+		return heads, nil
+	}
+
+	nodes := make([]*storage.DAGNode, 0, len(heads))
+	for _, h := range heads {
+		n, err := l.store.GetDAGNode(l.room, h)
+		if err != nil {
+			return nil, err
+		}
+		if n != nil {
+			nodes = append(nodes, n)
+		}
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		if nodes[i].Timestamp != nodes[j].Timestamp {
+			return nodes[i].Timestamp > nodes[j].Timestamp
+		}
+		return nodes[i].CID > nodes[j].CID
+	})
+	if len(nodes) > MaxParents {
+		nodes = nodes[:MaxParents]
+	}
+
+	parents := make([]string, len(nodes))
+	for i, n := range nodes {
+		parents[i] = n.CID
+	}
+	sort.Strings(parents)
+	return parents, nil
+}
+
+// Heads returns the CIDs of the room's latest messages
+func (l *Log) Heads() ([]string, error) {
+	return l.store.DAGHeads(l.room)
+}
+
+// Missing returns the CIDs of parents that were referenced but never received
+func (l *Log) Missing() ([]string, error) {
+	return l.store.DAGMissing(l.room)
+}
+
+// Add links a stored message into the DAG and returns its node
+// It returns nil for message types that are not linked. missing lists the
+// parents of the message that are not stored yet
+func (l *Log) Add(msg *storage.Message) (node *storage.DAGNode, missing []string, err error) {
+	if msg.Type != MessageType {
+		return nil, nil, nil
+	}
+
+	if node, err = NewNode(msg); err != nil {
+		return nil, nil, err
+	}
+	if _, err := l.store.AddDAGNode(l.room, node); err != nil {
+		return nil, nil, fmt.Errorf("failed to add DAG node: %w", err)
+	}
+
+	for _, p := range node.Parents {
+		n, err := l.store.GetDAGNode(l.room, p)
+		if err != nil {
+			return nil, nil, err
+		}
+		if n == nil {
+			missing = append(missing, p)
+		}
+	}
+	return node, missing, nil
+}
+
+// Ordered returns every node of the room in the DAG's total order
+func (l *Log) Ordered() ([]*storage.DAGNode, error) {
+	nodes, err := l.store.GetDAGNodes(l.room)
+	if err != nil {
+		return nil, err
+	}
+	return Order(nodes), nil
+}
+
+// Repair fetches missing parents from peers, following the chain back until
+// the DAG has no gaps or nobody can fill them. It returns the messages it
+// stored, oldest first
+func (l *Log) Repair(peers []peer.ID) ([]*storage.Message, error) {
+	l.repairMu.Lock()
+	defer l.repairMu.Unlock()
+
+	var fetched []*storage.Message
+	unavailable := make(map[string]bool) // Gaps nobody could fill this time
+
+	for round := 0; round < maxRepairRounds; round++ {
+		missing, err := l.store.DAGMissing(l.room)
+		if err != nil {
+			return fetched, err
+		}
+
+		var want []string
+		for _, c := range missing {
+			if !unavailable[c] {
+				want = append(want, c)
+			}
+			if len(want) == maxWant {
+				break
+			}
+		}
+		if len(want) == 0 {
+			break
+		}
+
+		got := make(map[string]*storage.Message, len(want))
+		for _, p := range peers {
+			if len(got) == len(want) {
+				break
+			}
+			msgs, err := l.request(p, remaining(want, got))
+			if err != nil {
+				if l.verbose {
+					fmt.Printf("DAG repair from %s failed: %v\n", p.ShortString(), err)
+				}
+				continue
+			}
+			for c, msg := range msgs {
+				got[c] = msg
+			}
+		}
+		if l.fetch != nil {
+			for _, c := range remaining(want, got) {
+				if msg, err := l.fetch(c); err == nil && verify(c, msg) {
+					got[c] = msg
+				}
+			}
+		}
+
+		for _, c := range want {
+			if _, ok := got[c]; !ok {
+				unavailable[c] = true
+			}
+		}
+		for c, msg := range got {
+			stored, err := l.keep(msg)
+			if err != nil {
+				return fetched, err
+			}
+			if !stored {
+				unavailable[c] = true
+				continue
+			}
+			if msg.Expires == 0 || msg.Expires > time.Now().Unix() {
+				fetched = append(fetched, msg)
+			}
+		}
+	}
+
+	sort.SliceStable(fetched, func(i, j int) bool { return fetched[i].Timestamp < fetched[j].Timestamp })
+	return fetched, nil
+}
+
+// keep saves a fetched message and links it into the DAG
+// It returns false if the message was rejected
+func (l *Log) keep(msg *storage.Message) (bool, error) {
+	now := time.Now()
+	if msg.ID == "" || msg.Timestamp > now.Add(maxFutureSkew).Unix() {
+		return false, nil
+	}
+	if l.filter != nil && !l.filter(msg) {
+		return false, nil
+	}
+
+	// An expired message is not kept, but its tombstone still closes the gap
+	msg.Room = l.room
+	if msg.Expires != 0 && msg.Expires <= now.Unix() {
+		node, err := NewNode(msg)
+		if err != nil {
+			return false, err
+		}
+		if _, err := l.store.AddDAGNode(l.room, node.Tombstone(now.Unix())); err != nil {
+			return false, fmt.Errorf("failed to add DAG node: %w", err)
+		}
+		return true, nil
+	}
+
+	if _, err := l.store.ImportMessage(msg); err != nil {
+		return false, fmt.Errorf("failed to store message: %w", err)
+	}
+	if _, _, err := l.Add(msg); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// request asks a peer for messages by CID and returns the genuine ones
+// Every message must carry its author's signed record and is rebuilt from
+// it. Ancestors sent along are accepted only when a hash link from a wanted
+// message leads to them
+func (l *Log) request(p peer.ID, want []string) (map[string]*storage.Message, error) {
+	ctx, cancel := context.WithTimeout(l.ctx, requestTimeout)
+	defer cancel()
+
+	stream, err := l.host.NewStream(ctx, p, ProtocolID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open DAG stream: %w", err)
+	}
+	defer stream.Close()
+	stream.SetDeadline(time.Now().Add(requestTimeout))
+
+	if err := json.NewEncoder(stream).Encode(&request{Room: l.room, Want: want}); err != nil {
+		return nil, fmt.Errorf("failed to send request: %w", err)
+	}
+	var resp response
+	if err := json.NewDecoder(stream).Decode(&resp); err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+	if resp.Error != "" {
+		return nil, fmt.Errorf("peer error: %s", resp.Error)
+	}
+
+	byCID := make(map[string]*storage.Message, len(resp.Messages))
+	for _, served := range resp.Messages {
+		msg, err := l.authenticate(served)
+		if err != nil {
+			if l.verbose && served != nil {
+				fmt.Printf("DAG: dropping message %s from %s: %v\n", served.ID, p.ShortString(), err)
+			}
+			continue
+		}
+		if c, err := CID(msg); err == nil {
+			byCID[c.String()] = msg
+		}
+	}
+
+	// Follow the links from what we asked for; anything else was not asked
+	// for or was altered on the way
+	got := make(map[string]*storage.Message, len(byCID))
+	queue := append([]string(nil), want...)
+	for len(queue) > 0 {
+		c := queue[0]
+		queue = queue[1:]
+		msg, ok := byCID[c]
+		if !ok || got[c] != nil {
+			continue
+		}
+		got[c] = msg
+		queue = append(queue, msg.Parents...)
+	}
+	return got, nil
+}
+
+// authenticate checks the signed record of a served message and returns the
+// message rebuilt from it
+// A message whose ID or author differs from its record is rejected, and so
+// is one whose expiry was stripped or pushed back: the expiry is not part of
+// the CID, so the hash links cannot catch that
+func (l *Log) authenticate(served *storage.Message) (*storage.Message, error) {
+	if served == nil || served.Type != MessageType {
+		return nil, fmt.Errorf("not a chat message")
+	}
+	if l.verify == nil || len(served.Record) == 0 {
+		return nil, fmt.Errorf("no signed record")
+	}
+
+	msg, err := l.verify(served.Record)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case msg.ID != served.ID:
+		return nil, fmt.Errorf("record carries message %s", msg.ID)
+	case msg.From != served.From:
+		return nil, fmt.Errorf("record is signed by %s", msg.From)
+	case msg.Expires != 0 && (served.Expires == 0 || served.Expires > msg.Expires):
+		return nil, fmt.Errorf("expiry does not match the record")
+	}
+
+	return &storage.Message{
+		ID:        msg.ID,
+		Type:      msg.Type,
+		Content:   msg.Content,
+		Username:  msg.Username,
+		Timestamp: msg.Timestamp,
+		From:      msg.From,
+		Room:      l.room,
+		Thread:    msg.Thread,
+		Expires:   msg.Expires,
+		Parents:   msg.Parents,
+		Record:    msg.Record,
+	}, nil
+}
+
+// handleStream serves the messages a peer is missing
+func (l *Log) handleStream(stream network.Stream) {
+	defer stream.Close()
+	stream.SetDeadline(time.Now().Add(requestTimeout))
+
+	enc := json.NewEncoder(stream)
+	var req request
+	if err := json.NewDecoder(stream).Decode(&req); err != nil {
+		stream.Reset()
+		return
+	}
+	if req.Room != l.room {
+		enc.Encode(&response{Error: fmt.Sprintf("room %q is not served here", req.Room)})
+		return
+	}
+	if len(req.Want) > maxWant {
+		req.Want = req.Want[:maxWant]
+	}
+
+	// Walk back from the wanted messages so a long gap closes in few requests
+	var ids []string
+	seen := make(map[string]bool)
+	queue := req.Want
+	for len(queue) > 0 && len(ids) < maxServe {
+		c := queue[0]
+		queue = queue[1:]
+		if seen[c] {
+			continue
+		}
+		seen[c] = true
+
+		n, err := l.store.GetDAGNode(l.room, c)
+		if err != nil {
+			enc.Encode(&response{Error: err.Error()})
+			return
+		}
+		if n != nil {
+			if !n.IsTombstone() {
+				ids = append(ids, n.MessageID)
+			}
+			queue = append(queue, n.Parents...)
+		}
+	}
+	msgs, err := l.store.GetMessagesByID(l.room, ids)
+	if err != nil {
+		enc.Encode(&response{Error: err.Error()})
+		return
+	}
+
+	if err := enc.Encode(&response{Messages: msgs}); err != nil {
+		stream.Reset()
+		return
+	}
+	if l.verbose && len(msgs) > 0 {
+		fmt.Printf("DAG: sent %d message(s) to %s\n", len(msgs), stream.Conn().RemotePeer().ShortString())
+	}
+}
+
+// verify reports whether msg is the message with content ID c
+func verify(c string, msg *storage.Message) bool {
+	if msg == nil || msg.Type != MessageType {
+		return false
+	}
+	got, err := CID(msg)
+	return err == nil && got.String() == c
+}
+
+// remaining returns the CIDs in want that are not in got
+func remaining(want []string, got map[string]*storage.Message) []string {
+	var rest []string
+	for _, c := range want {
+		if _, ok := got[c]; !ok {
+			rest = append(rest, c)
+		}
+	}
+	return rest
+}
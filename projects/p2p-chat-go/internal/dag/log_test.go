@@ -0,0 +1,259 @@
+package dag
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/geekp2p/p2p-chat-go/internal/messaging"
+	"github.com/geekp2p/p2p-chat-go/internal/storage"
+	"github.com/libp2p/go-libp2p/core/peer"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+)
+
+const testRoom = "test-room"
+
+// signer stands in for pubsub signatures: only records it signed verify
+type signer map[string]bool
+
+// sign returns the record of msg as its author would publish it
+func (s signer) sign(t *testing.T, msg *storage.Message) []byte {
+	t.Helper()
+	record, err := json.Marshal(&messaging.Message{
+		ID:        msg.ID,
+		Type:      msg.Type,
+		Content:   msg.Content,
+		Username:  msg.Username,
+		Timestamp: msg.Timestamp,
+		From:      msg.From,
+		Thread:    msg.Thread,
+		Expires:   msg.Expires,
+		Parents:   msg.Parents,
+	})
+	if err != nil {
+		t.Fatalf("failed to marshal record: %v", err)
+	}
+	s[string(record)] = true
+	return record
+}
+
+// verify is a Verifier that accepts the records s signed
+func (s signer) verify(record []byte) (*messaging.Message, error) {
+	if !s[string(record)] {
+		return nil, errors.New("invalid record signature")
+	}
+	var msg messaging.Message
+	if err := json.Unmarshal(record, &msg); err != nil {
+		return nil, err
+	}
+	msg.Record = record
+	return &msg, nil
+}
+
+// testNet is a peer holding a room's history and a peer missing part of it
+type testNet struct {
+	server, client       *Log
+	serverStore, clStore storage.Store
+	serverID             peer.ID
+}
+
+// newTestNet connects two DAG logs over a mock network
+func newTestNet(t *testing.T, s signer) *testNet {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	mn := mocknet.New()
+	t.Cleanup(func() {
+		cancel()
+		mn.Close()
+	})
+
+	a, err := mn.GenPeer()
+	if err != nil {
+		t.Fatalf("GenPeer: %v", err)
+	}
+	b, err := mn.GenPeer()
+	if err != nil {
+		t.Fatalf("GenPeer: %v", err)
+	}
+	if err := mn.LinkAll(); err != nil {
+		t.Fatalf("LinkAll: %v", err)
+	}
+	if err := mn.ConnectAllButSelf(); err != nil {
+		t.Fatalf("ConnectAllButSelf: %v", err)
+	}
+
+	n := &testNet{
+		serverStore: storage.NewMemoryStore(),
+		clStore:     storage.NewMemoryStore(),
+		serverID:    a.ID(),
+	}
+	n.server = New(ctx, a, n.serverStore, testRoom, false)
+	n.client = New(ctx, b, n.clStore, testRoom, false)
+	n.client.SetVerifier(s.verify)
+	return n
+}
+
+// message returns a chat message of the test room
+func message(id, from string, parents ...string) *storage.Message {
+	return &storage.Message{
+		ID:        id,
+		Type:      MessageType,
+		Content:   "content of " + id,
+		Username:  from,
+		Timestamp: time.Now().Unix(),
+		From:      from,
+		Room:      testRoom,
+		Parents:   parents,
+	}
+}
+
+// add stores a message and links it into a log
+func add(t *testing.T, l *Log, st storage.Store, msg *storage.Message) string {
+	t.Helper()
+	if _, err := st.ImportMessage(msg); err != nil {
+		t.Fatalf("ImportMessage: %v", err)
+	}
+	node, _, err := l.Add(msg)
+	if err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	return node.CID
+}
+
+func TestRepairFetchesSignedParents(t *testing.T) {
+	s := signer{}
+	n := newTestNet(t, s)
+
+	parent := message("m1", "peer-alice")
+	parent.Record = s.sign(t, parent)
+	parentCID := add(t, n.server, n.serverStore, parent)
+
+	child := message("m2", "peer-bob", parentCID)
+	child.Record = s.sign(t, child)
+	add(t, n.server, n.serverStore, child)
+	add(t, n.client, n.clStore, child)
+
+	fetched, err := n.client.Repair([]peer.ID{n.serverID})
+	if err != nil {
+		t.Fatalf("Repair: %v", err)
+	}
+	if len(fetched) != 1 || fetched[0].ID != "m1" {
+		t.Fatalf("fetched %d message(s), want m1", len(fetched))
+	}
+	if missing, _ := n.client.Missing(); len(missing) != 0 {
+		t.Errorf("gaps left after repair: %v", missing)
+	}
+}
+
+func TestRepairRejectsForgedParents(t *testing.T) {
+	tests := []struct {
+		name  string
+		forge func(s signer, msg *storage.Message)
+	}{
+		{
+			name:  "no record",
+			forge: func(s signer, msg *storage.Message) {},
+		},
+		{
+			name: "unsigned record",
+			forge: func(s signer, msg *storage.Message) {
+				msg.Record, _ = json.Marshal(msg)
+			},
+		},
+		{
+			name: "record of another message",
+			forge: func(s signer, msg *storage.Message) {
+				other := message("other", msg.From)
+				msg.Record = s.sign(t, other)
+			},
+		},
+		{
+			name: "record by another author",
+			forge: func(s signer, msg *storage.Message) {
+				signed := *msg
+				signed.From = "peer-mallory"
+				msg.Record = s.sign(t, &signed)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := signer{}
+			n := newTestNet(t, s)
+
+			// Mallory names a message alice never sent as a parent
+			forged := message("m1", "peer-alice")
+			tt.forge(s, forged)
+			forgedCID := add(t, n.server, n.serverStore, forged)
+
+			child := message("m2", "peer-mallory", forgedCID)
+			child.Record = s.sign(t, child)
+			add(t, n.server, n.serverStore, child)
+			add(t, n.client, n.clStore, child)
+
+			fetched, err := n.client.Repair([]peer.ID{n.serverID})
+			if err != nil {
+				t.Fatalf("Repair: %v", err)
+			}
+			if len(fetched) != 0 {
+				t.Fatalf("stored %d forged message(s)", len(fetched))
+			}
+			if msgs, _ := n.clStore.GetMessagesByID(testRoom, []string{"m1"}); len(msgs) != 0 {
+				t.Errorf("forged message was stored")
+			}
+			if missing, _ := n.client.Missing(); len(missing) != 1 || missing[0] != forgedCID {
+				t.Errorf("gaps = %v, want the forged parent", missing)
+			}
+		})
+	}
+}
+
+func TestRepairChecksExpiry(t *testing.T) {
+	expires := time.Now().Add(time.Hour).Unix()
+
+	tests := []struct {
+		name   string
+		served int64 // Expiry the serving peer claims
+		stored bool
+	}{
+		{"unchanged", expires, true},
+		{"capped by the server's room limit", expires - 60, true},
+		{"stripped", 0, false},
+		{"pushed back", expires + 3600, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := signer{}
+			n := newTestNet(t, s)
+
+			parent := message("m1", "peer-alice")
+			parent.Expires = expires
+			parent.Record = s.sign(t, parent)
+			parent.Expires = tt.served
+			parentCID := add(t, n.server, n.serverStore, parent)
+
+			child := message("m2", "peer-bob", parentCID)
+			child.Record = s.sign(t, child)
+			add(t, n.server, n.serverStore, child)
+			add(t, n.client, n.clStore, child)
+
+			if _, err := n.client.Repair([]peer.ID{n.serverID}); err != nil {
+				t.Fatalf("Repair: %v", err)
+			}
+			msgs, err := n.clStore.GetMessagesByID(testRoom, []string{"m1"})
+			if err != nil {
+				t.Fatalf("GetMessagesByID: %v", err)
+			}
+			if stored := len(msgs) == 1; stored != tt.stored {
+				t.Fatalf("stored = %v, want %v", stored, tt.stored)
+			}
+			if tt.stored && msgs[0].Expires != expires {
+				t.Errorf("stored expiry = %d, want the author's %d", msgs[0].Expires, expires)
+			}
+		})
+	}
+}
@@ -0,0 +1,308 @@
+package dht
+
+import (
+	"container/list"
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+)
+
+// CacheConfig bounds the local message cache; zero fields mean no limit
+type CacheConfig struct {
+	MaxEntries int   // Most messages kept
+	MaxBytes   int64 // Most bytes kept, counted as encoded JSON
+}
+
+// DefaultCacheConfig returns the cache bounds used unless configured otherwise
+func DefaultCacheConfig() CacheConfig {
+	return CacheConfig{
+		MaxEntries: 10000,
+		MaxBytes:   32 << 20, // 32 MB
+	}
+}
+
+// CacheStore persists cache entries so they survive restarts
+// storage.MessageStore implements it on top of badger
+type CacheStore interface {
+	SaveCacheEntry(id string, data []byte, ttl time.Duration) error
+	GetCacheEntries() ([][]byte, error)
+	DeleteCacheEntries(ids []string) error
+}
+
+// CacheStats describes the local message cache
+type CacheStats struct {
+	Entries     int
+	Bytes       int64
+	MaxEntries  int
+	MaxBytes    int64
+	Hits        uint64
+	Misses      uint64
+	Evictions   uint64 // Dropped to stay within the bounds
+	Expirations uint64 // Dropped because their TTL passed
+	Persistent  bool
+}
+
+// HitRate returns the share of lookups served from the cache
+func (s CacheStats) HitRate() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+// cacheEntry is one cached message, keyed by content ID
+type cacheEntry struct {
+	cid  string
+	msg  *StorageMessage
+	size int64
+}
+
+// persistedEntry is the stored form of a cache entry
+type persistedEntry struct {
+	CID     string          `json:"cid"`
+	Message *StorageMessage `json:"message"`
+}
+
+// messageCache is a least-recently-used cache of DHT messages with TTL expiry
+// It is safe for concurrent use
+type messageCache struct {
+	mu    sync.Mutex
+	cfg   CacheConfig
+	ll    *list.List // Front is the most recently used
+	items map[string]*list.Element
+	bytes int64
+	store CacheStore // nil unless persistence is enabled
+	stats CacheStats
+}
+
+// newMessageCache creates an empty cache
+func newMessageCache(cfg CacheConfig) *messageCache {
+	return &messageCache{
+		cfg:   cfg,
+		ll:    list.New(),
+		items: make(map[string]*list.Element),
+	}
+}
+
+// configure changes the bounds and evicts what no longer fits
+func (c *messageCache) configure(cfg CacheConfig) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cfg = cfg
+	return c.evict()
+}
+
+// persist loads the entries saved in store and writes every later change to it
+// It returns the number of entries loaded
+func (c *messageCache) persist(store CacheStore, now time.Time) (int, error) {
+	values, err := store.GetCacheEntries()
+	if err != nil {
+		return 0, err
+	}
+
+	var entries []persistedEntry
+	for _, data := range values {
+		var e persistedEntry
+		if err := json.Unmarshal(data, &e); err != nil || e.Message == nil {
+			continue // Skip unreadable entries
+		}
+		if now.Unix() <= e.Message.TTL {
+			entries = append(entries, e)
+		}
+	}
+
+	// Load oldest first so the newest messages end up most recently used
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Message.Timestamp < entries[j].Message.Timestamp
+	})
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, e := range entries {
+		c.insert(e.CID, e.Message)
+	}
+	c.store = store
+	c.stats.Persistent = true
+	return len(entries), c.evict()
+}
+
+// put adds or replaces a message; messages already expired are ignored
+func (c *messageCache) put(cid string, msg *StorageMessage) error {
+	ttl := time.Until(time.Unix(msg.TTL, 0))
+	if ttl <= 0 {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.insert(cid, msg)
+	if c.store != nil {
+		data, err := json.Marshal(&persistedEntry{CID: cid, Message: msg})
+		if err != nil {
+			return err
+		}
+		if err := c.store.SaveCacheEntry(cid, data, ttl); err != nil {
+			return err
+		}
+	}
+	return c.evict()
+}
+
+// get returns an unexpired message and marks it recently used
+func (c *messageCache) get(cid string, now time.Time) (*StorageMessage, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[cid]
+	if !ok {
+		c.stats.Misses++
+		return nil, false
+	}
+
+	e := el.Value.(*cacheEntry)
+	if now.Unix() > e.msg.TTL {
+		c.removeElements(el)
+		c.stats.Expirations++
+		c.stats.Misses++
+		return nil, false
+	}
+
+	c.ll.MoveToFront(el)
+	c.stats.Hits++
+	return e.msg, true
+}
+
+// recent returns up to limit unexpired messages, newest first
+func (c *messageCache) recent(limit int, now time.Time) []*StorageMessage {
+	c.mu.Lock()
+	messages := make([]*StorageMessage, 0, c.ll.Len())
+	for el := c.ll.Front(); el != nil; el = el.Next() {
+		if msg := el.Value.(*cacheEntry).msg; now.Unix() <= msg.TTL {
+			messages = append(messages, msg)
+		}
+	}
+	c.mu.Unlock()
+
+	sort.Slice(messages, func(i, j int) bool {
+		return messages[i].Timestamp > messages[j].Timestamp
+	})
+	if limit > 0 && len(messages) > limit {
+		messages = messages[:limit]
+	}
+	return messages
+}
+
+// removeFunc drops every message for which drop returns true
+// It returns the number of messages removed
+func (c *messageCache) removeFunc(drop func(msg *StorageMessage) bool) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var doomed []*list.Element
+	for el := c.ll.Front(); el != nil; el = el.Next() {
+		if drop(el.Value.(*cacheEntry).msg) {
+			doomed = append(doomed, el)
+		}
+	}
+	c.removeElements(doomed...)
+	return len(doomed)
+}
+
+// purgeExpired drops every message whose TTL has passed
+func (c *messageCache) purgeExpired(now time.Time) int {
+	removed := c.removeFunc(func(msg *StorageMessage) bool {
+		return now.Unix() > msg.TTL
+	})
+
+	c.mu.Lock()
+	c.stats.Expirations += uint64(removed)
+	c.mu.Unlock()
+	return removed
+}
+
+// snapshot returns the current statistics
+func (c *messageCache) snapshot() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stats := c.stats
+	stats.Entries = c.ll.Len()
+	stats.Bytes = c.bytes
+	stats.MaxEntries = c.cfg.MaxEntries
+	stats.MaxBytes = c.cfg.MaxBytes
+	return stats
+}
+
+// clear empties the cache in memory; persisted entries are kept
+func (c *messageCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.ll.Init()
+	c.items = make(map[string]*list.Element)
+	c.bytes = 0
+	c.store = nil
+}
+
+// insert adds a message at the front; the caller holds the lock
+func (c *messageCache) insert(cid string, msg *StorageMessage) {
+	var size int64
+	if data, err := json.Marshal(msg); err == nil {
+		size = int64(len(data))
+	}
+
+	if el, ok := c.items[cid]; ok {
+		e := el.Value.(*cacheEntry)
+		c.bytes += size - e.size
+		e.msg, e.size = msg, size
+		c.ll.MoveToFront(el)
+		return
+	}
+
+	c.items[cid] = c.ll.PushFront(&cacheEntry{cid: cid, msg: msg, size: size})
+	c.bytes += size
+}
+
+// evict drops least recently used messages until the cache fits its bounds
+// The caller holds the lock
+func (c *messageCache) evict() error {
+	var doomed []*list.Element
+	entries, bytes := c.ll.Len(), c.bytes
+	for el := c.ll.Back(); el != nil; el = el.Prev() {
+		overEntries := c.cfg.MaxEntries > 0 && entries > c.cfg.MaxEntries
+		overBytes := c.cfg.MaxBytes > 0 && bytes > c.cfg.MaxBytes
+		if !overEntries && !overBytes {
+			break
+		}
+		doomed = append(doomed, el)
+		entries--
+		bytes -= el.Value.(*cacheEntry).size
+	}
+
+	c.stats.Evictions += uint64(len(doomed))
+	return c.removeElements(doomed...)
+}
+
+// removeElements unlinks entries and deletes their persisted copies
+// The caller holds the lock
+func (c *messageCache) removeElements(els ...*list.Element) error {
+	if len(els) == 0 {
+		return nil
+	}
+
+	ids := make([]string, 0, len(els))
+	for _, el := range els {
+		e := el.Value.(*cacheEntry)
+		c.ll.Remove(el)
+		delete(c.items, e.cid)
+		c.bytes -= e.size
+		ids = append(ids, e.cid)
+	}
+
+	if c.store == nil {
+		return nil
+	}
+	return c.store.DeleteCacheEntries(ids)
+}
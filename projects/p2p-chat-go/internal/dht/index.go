@@ -0,0 +1,508 @@
+package dht
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	record "github.com/libp2p/go-libp2p-record"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/routing"
+	mh "github.com/multiformats/go-multihash"
+)
+
+// IndexNamespace is the DHT key namespace of room history indexes
+//
+//	/roomlog/head-<sha256(room)>-<peer ID>  mutable head signed by that peer
+//	/roomlog/chunk-<cid>                    immutable chunk of older CIDs
+//
+// A head holds up to HeadSize entries; when it overflows, its oldest
+// ChunkSize entries move into a chunk that the head links to, so the index
+// forms an append-only list that can be walked back from the head.
+//
+// Like room metadata, every publisher has its own head that only it can
+// sign. The room owner and admins maintain them; readers only walk theirs.
+const IndexNamespace = "roomlog"
+
+// Index layout limits
+const (
+	HeadSize  = 64 // Most entries in a head record
+	ChunkSize = 32 // Entries moved into each chunk
+
+	// MaxSeqJump is the most entries a head may gain between two reads;
+	// a bigger jump, or a chain that does not lead back to the head read
+	// before, is ignored
+	MaxSeqJump = 1024
+)
+
+// IndexEntry points at a message record in the DHT
+type IndexEntry struct {
+	CID       string `json:"cid"`
+	From      string `json:"from"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+// IndexChunk is an immutable part of a room index
+type IndexChunk struct {
+	Room    string       `json:"room"`
+	Entries []IndexEntry `json:"entries"`        // Oldest first
+	Prev    string       `json:"prev,omitempty"` // CID of the previous chunk
+}
+
+// IndexHead is the newest part of a publisher's room index
+type IndexHead struct {
+	Room      string       `json:"room"`
+	Seq       uint64       `json:"seq"`            // Entries appended so far; the highest wins
+	Entries   []IndexEntry `json:"entries"`        // Oldest first
+	Prev      string       `json:"prev,omitempty"` // CID of the newest chunk
+	Publisher string       `json:"publisher"`
+	Published int64        `json:"published"`
+	Signature []byte       `json:"signature"`
+}
+
+// NewIndexEntry returns the index entry of a message
+func NewIndexEntry(msg *StorageMessage) (IndexEntry, error) {
+	c, err := contentID(msg)
+	if err != nil {
+		return IndexEntry{}, err
+	}
+	return IndexEntry{CID: c.String(), From: msg.From, Timestamp: msg.Timestamp}, nil
+}
+
+// headKey returns the DHT key of a publisher's index head for a room
+func headKey(room string, publisher peer.ID) string {
+	sum := sha256.Sum256([]byte(room))
+	return "/" + IndexNamespace + "/head-" + hex.EncodeToString(sum[:]) + "-" + publisher.String()
+}
+
+// chunkKey returns the DHT key of an index chunk
+func chunkKey(chunkID string) string {
+	return "/" + IndexNamespace + "/chunk-" + chunkID
+}
+
+// chunkID returns the content ID of an encoded chunk
+func chunkID(data []byte) (cid.Cid, error) {
+	hash, err := mh.Sum(data, mh.SHA2_256, -1)
+	if err != nil {
+		return cid.Undef, err
+	}
+	return cid.NewCidV1(cid.Raw, hash), nil
+}
+
+// sign signs the head as priv's peer
+func (h *IndexHead) sign(priv crypto.PrivKey) error {
+	publisher, err := peer.IDFromPrivateKey(priv)
+	if err != nil {
+		return fmt.Errorf("failed to derive publisher ID: %w", err)
+	}
+	h.Publisher = publisher.String()
+	h.Published = time.Now().Unix()
+
+	payload, err := h.signingPayload()
+	if err != nil {
+		return err
+	}
+	if h.Signature, err = priv.Sign(payload); err != nil {
+		return fmt.Errorf("failed to sign index: %w", err)
+	}
+	return nil
+}
+
+// verify checks the publisher's signature and the head's limits
+func (h *IndexHead) verify(now time.Time) error {
+	if len(h.Entries) > HeadSize {
+		return fmt.Errorf("index head has more than %d entries", HeadSize)
+	}
+	if h.Published > now.Add(clockSkew).Unix() {
+		return errors.New("index head is published in the future")
+	}
+
+	publisher, err := peer.Decode(h.Publisher)
+	if err != nil {
+		return fmt.Errorf("invalid publisher: %w", err)
+	}
+	pub, err := publisher.ExtractPublicKey()
+	if err != nil {
+		return fmt.Errorf("cannot extract publisher key: %w", err)
+	}
+
+	payload, err := h.signingPayload()
+	if err != nil {
+		return err
+	}
+	ok, err := pub.Verify(payload, h.Signature)
+	if err != nil {
+		return fmt.Errorf("signature verification failed: %w", err)
+	}
+	if !ok {
+		return errors.New("invalid signature")
+	}
+	return nil
+}
+
+// signingPayload returns the canonical bytes covered by the signature
+func (h *IndexHead) signingPayload() ([]byte, error) {
+	unsigned := *h
+	unsigned.Signature = nil
+
+	data, err := json.Marshal(unsigned)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal index: %w", err)
+	}
+	return data, nil
+}
+
+// IndexValidator validates records in the roomlog namespace
+// Register it with dht.NamespacedValidator(IndexNamespace, IndexValidator{})
+type IndexValidator struct{}
+
+var _ record.Validator = IndexValidator{}
+
+// Validate checks heads against their signature and room, and chunks against
+// their content ID
+func (IndexValidator) Validate(key string, value []byte) error {
+	_, err := parseIndexRecord(key, value, time.Now())
+	return err
+}
+
+// Select picks the head with the highest sequence number, then the newest
+// Chunks are immutable, so any valid one will do
+func (IndexValidator) Select(key string, values [][]byte) (int, error) {
+	best := -1
+	var bestHead *IndexHead
+	now := time.Now()
+	for i, value := range values {
+		head, err := parseIndexRecord(key, value, now)
+		if err != nil {
+			continue
+		}
+		if head == nil {
+			return i, nil // Chunk
+		}
+		if best < 0 || head.Seq > bestHead.Seq ||
+			(head.Seq == bestHead.Seq && head.Published > bestHead.Published) {
+			best, bestHead = i, head
+		}
+	}
+	if best < 0 {
+		return 0, errors.New("no valid index record")
+	}
+	return best, nil
+}
+
+// parseIndexRecord validates a head or chunk record
+// It returns the head, or nil for a valid chunk
+func parseIndexRecord(key string, value []byte, now time.Time) (*IndexHead, error) {
+	ns, name, err := record.SplitKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if ns != IndexNamespace || strings.Contains(name, "/") {
+		return nil, fmt.Errorf("invalid index key %q", key)
+	}
+
+	switch {
+	case strings.HasPrefix(name, "chunk-"):
+		want, err := cid.Decode(strings.TrimPrefix(name, "chunk-"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid chunk ID: %w", err)
+		}
+		got, err := chunkID(value)
+		if err != nil {
+			return nil, err
+		}
+		if !got.Equals(want) {
+			return nil, errors.New("chunk does not match its content ID")
+		}
+		var chunk IndexChunk
+		if err := json.Unmarshal(value, &chunk); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal chunk: %w", err)
+		}
+		if len(chunk.Entries) > HeadSize {
+			return nil, fmt.Errorf("index chunk has more than %d entries", HeadSize)
+		}
+		return nil, nil
+
+	case strings.HasPrefix(name, "head-"):
+		var head IndexHead
+		if err := json.Unmarshal(value, &head); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal index head: %w", err)
+		}
+		publisher, err := peer.Decode(head.Publisher)
+		if err != nil {
+			return nil, fmt.Errorf("invalid publisher: %w", err)
+		}
+		if headKey(head.Room, publisher) != key {
+			return nil, errors.New("index head does not match its key")
+		}
+		if err := head.verify(now); err != nil {
+			return nil, err
+		}
+		return &head, nil
+	}
+
+	return nil, fmt.Errorf("invalid index key %q", key)
+}
+
+// AppendToIndex adds messages to our index of the room's history in the DHT
+// Readers only trust the indexes of the room owner and admins
+func (ds *DistributedStorage) AppendToIndex(room string, entries ...IndexEntry) error {
+	ds.indexMu.Lock()
+	defer ds.indexMu.Unlock()
+
+	head, err := ds.fetchHead(room, ds.host.ID())
+	if err != nil && !errors.Is(err, routing.ErrNotFound) {
+		return fmt.Errorf("failed to fetch room index: %w", err)
+	}
+	if head == nil {
+		head = &IndexHead{Room: room}
+	} else {
+		copied := *head
+		head = &copied
+	}
+
+	before := len(head.Entries)
+	head.Entries = mergeEntries(head.Entries, entries)
+	added := len(head.Entries) - before
+	if added == 0 {
+		return nil // Everything is indexed already
+	}
+	for len(head.Entries) > HeadSize {
+		chunk := IndexChunk{Room: room, Entries: head.Entries[:ChunkSize], Prev: head.Prev}
+		id, err := ds.putChunk(&chunk)
+		if err != nil {
+			return fmt.Errorf("failed to store index chunk: %w", err)
+		}
+		head.Prev = id
+		head.Entries = head.Entries[ChunkSize:]
+	}
+
+	head.Seq += uint64(added)
+	if err := head.sign(ds.host.Peerstore().PrivKey(ds.host.ID())); err != nil {
+		return err
+	}
+	data, err := json.Marshal(head)
+	if err != nil {
+		return fmt.Errorf("failed to marshal index: %w", err)
+	}
+	if err := ds.records.PutValue(ds.ctx, headKey(room, ds.host.ID()), data); err != nil {
+		return err
+	}
+	ds.rememberHead(headKey(room, ds.host.ID()), head)
+	return nil
+}
+
+// FetchRoomHistory resolves up to limit of the newest messages in the DHT
+// indexes of the room kept by any of publishers, usually the room owner and
+// admins, oldest first
+// Messages that cannot be found, even after connecting to their providers,
+// are skipped
+func (ds *DistributedStorage) FetchRoomHistory(room string, publishers []peer.ID, limit int) ([]*StorageMessage, error) {
+	var entries []IndexEntry
+	var lastErr error
+	for _, p := range publishers {
+		found, err := ds.indexEntries(room, p, limit)
+		if errors.Is(err, routing.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		entries = mergeEntries(entries, found)
+	}
+	if len(entries) == 0 && lastErr != nil {
+		return nil, lastErr
+	}
+	if len(entries) > limit {
+		entries = entries[len(entries)-limit:]
+	}
+
+	messages := make([]*StorageMessage, 0, len(entries))
+	for _, e := range entries {
+		if msg, err := ds.resolveEntry(e); err == nil {
+			messages = append(messages, msg)
+		} else if ds.verbose {
+			fmt.Printf("Warning: Failed to resolve %s: %v\n", e.CID, err)
+		}
+	}
+	return messages, nil
+}
+
+// resolveEntry fetches an indexed message from its author's signed record,
+// connecting to its providers if the DHT lookup fails so the next lookup
+// can reach them
+func (ds *DistributedStorage) resolveEntry(e IndexEntry) (*StorageMessage, error) {
+	msg, err := ds.GetSignedMessage(e.CID)
+	if err == nil {
+		return msg, nil
+	}
+
+	providers, perr := ds.FindProviders(e.CID, 3)
+	if perr != nil || len(providers) == 0 {
+		return nil, err
+	}
+	for _, p := range providers {
+		ctx, cancel := context.WithTimeout(ds.ctx, 10*time.Second)
+		ds.host.Connect(ctx, p)
+		cancel()
+	}
+	return ds.GetSignedMessage(e.CID)
+}
+
+// indexEntries returns up to about limit of the newest entries in a
+// publisher's index of a room, walking back from its head
+func (ds *DistributedStorage) indexEntries(room string, publisher peer.ID, limit int) ([]IndexEntry, error) {
+	head, err := ds.fetchHead(room, publisher)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := append([]IndexEntry(nil), head.Entries...)
+	prev := head.Prev
+	for walked := 0; len(entries) < limit && prev != "" && walked <= limit/ChunkSize+1; walked++ {
+		chunk, err := ds.fetchChunk(room, prev)
+		if err != nil {
+			if ds.verbose {
+				fmt.Printf("Warning: Failed to fetch index chunk %s: %v\n", prev, err)
+			}
+			break
+		}
+		entries = append(append([]IndexEntry(nil), chunk.Entries...), entries...)
+		prev = chunk.Prev
+	}
+	return entries, nil
+}
+
+// fetchHead returns the current index head of a publisher for a room
+// A head that does not continue the one read before is ignored in favour
+// of the earlier head
+func (ds *DistributedStorage) fetchHead(room string, publisher peer.ID) (*IndexHead, error) {
+	key := headKey(room, publisher)
+	ds.headsMu.Lock()
+	known := ds.heads[key]
+	ds.headsMu.Unlock()
+
+	data, err := ds.records.GetValue(ds.ctx, key)
+	if err != nil {
+		if known != nil {
+			return known, nil
+		}
+		return nil, err
+	}
+	head, err := parseIndexRecord(key, data, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	if head == nil {
+		return nil, errors.New("invalid index head")
+	}
+
+	if known != nil {
+		if head.Seq <= known.Seq {
+			return known, nil // Stale copy, or the head we have
+		}
+		if err := ds.continues(room, known, head); err != nil {
+			if ds.verbose {
+				fmt.Printf("Warning: Ignoring index head of %s: %v\n", publisher.ShortString(), err)
+			}
+			return known, nil
+		}
+	}
+	ds.rememberHead(key, head)
+	return head, nil
+}
+
+// continues checks that head was built by appending to known: it gained at
+// most MaxSeqJump entries, and its chain of chunks leads back to known's
+func (ds *DistributedStorage) continues(room string, known, head *IndexHead) error {
+	jump := head.Seq - known.Seq
+	if jump > MaxSeqJump {
+		return fmt.Errorf("sequence jumps by %d", jump)
+	}
+
+	// Each chunk moves ChunkSize entries out of the head
+	prev := head.Prev
+	for walked := uint64(0); prev != known.Prev; walked++ {
+		if prev == "" || walked > jump/ChunkSize {
+			return errors.New("chunk chain does not continue the previous head")
+		}
+		chunk, err := ds.fetchChunk(room, prev)
+		if err != nil {
+			return fmt.Errorf("failed to fetch index chunk %s: %w", prev, err)
+		}
+		prev = chunk.Prev
+	}
+	return nil
+}
+
+// rememberHead records the latest head accepted for a key
+func (ds *DistributedStorage) rememberHead(key string, head *IndexHead) {
+	ds.headsMu.Lock()
+	defer ds.headsMu.Unlock()
+	ds.heads[key] = head
+}
+
+// fetchChunk returns an index chunk of a room by content ID
+func (ds *DistributedStorage) fetchChunk(room, id string) (*IndexChunk, error) {
+	data, err := ds.records.GetValue(ds.ctx, chunkKey(id))
+	if err != nil {
+		return nil, err
+	}
+	var chunk IndexChunk
+	if err := json.Unmarshal(data, &chunk); err != nil {
+		return nil, err
+	}
+	if chunk.Room != room {
+		return nil, errors.New("chunk belongs to another room")
+	}
+	return &chunk, nil
+}
+
+// putChunk stores an index chunk and returns its content ID
+func (ds *DistributedStorage) putChunk(chunk *IndexChunk) (string, error) {
+	data, err := json.Marshal(chunk)
+	if err != nil {
+		return "", err
+	}
+	id, err := chunkID(data)
+	if err != nil {
+		return "", err
+	}
+	if err := ds.records.PutValue(ds.ctx, chunkKey(id.String()), data); err != nil {
+		return "", err
+	}
+
+	// Chunks never change, so they are announced in the background for as
+	// long as the reprovider keeps them
+	if ds.reprov != nil {
+		ds.reprov.Track(id.String(), KindIndex, 0, false)
+		ds.reprov.Reprovide(false)
+	}
+	return id.String(), nil
+}
+
+// mergeEntries adds entries to an index, dropping duplicates, oldest first
+func mergeEntries(existing, added []IndexEntry) []IndexEntry {
+	seen := make(map[string]bool, len(existing)+len(added))
+	merged := make([]IndexEntry, 0, len(existing)+len(added))
+	for _, e := range append(append([]IndexEntry(nil), existing...), added...) {
+		if !seen[e.CID] {
+			seen[e.CID] = true
+			merged = append(merged, e)
+		}
+	}
+
+	sort.SliceStable(merged, func(i, j int) bool {
+		return merged[i].Timestamp < merged[j].Timestamp
+	})
+	return merged
+}
@@ -0,0 +1,172 @@
+package dht
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+)
+
+const testRoom = "test-room"
+
+// entries returns n index entries stamped from ts
+func entries(n int, ts int64) []IndexEntry {
+	out := make([]IndexEntry, n)
+	for i := range out {
+		out[i] = IndexEntry{CID: fmt.Sprintf("cid-%d", ts+int64(i)), From: "peer-alice", Timestamp: ts + int64(i)}
+	}
+	return out
+}
+
+// signedHead returns a head of n entries with sequence number seq, signed by priv
+func signedHead(t *testing.T, priv crypto.PrivKey, seq uint64, n int) *IndexHead {
+	t.Helper()
+	head := &IndexHead{Room: testRoom, Seq: seq, Entries: entries(n, 1)}
+	if err := head.sign(priv); err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	return head
+}
+
+func TestIndexValidatorAcceptsSignedHeads(t *testing.T) {
+	priv, publisher := newKey(t)
+	head := signedHead(t, priv, 3, 3)
+
+	if err := (IndexValidator{}).Validate(headKey(testRoom, publisher), encode(t, head)); err != nil {
+		t.Errorf("Validate: %v", err)
+	}
+}
+
+func TestIndexValidatorRejectsTamperedHeads(t *testing.T) {
+	priv, publisher := newKey(t)
+	otherPriv, other := newKey(t)
+
+	tests := []struct {
+		name   string
+		tamper func(head *IndexHead) (string, []byte)
+	}{
+		{
+			name: "entries dropped",
+			tamper: func(head *IndexHead) (string, []byte) {
+				head.Entries = head.Entries[1:]
+				return headKey(testRoom, publisher), encode(t, head)
+			},
+		},
+		{
+			name: "sequence raised",
+			tamper: func(head *IndexHead) (string, []byte) {
+				head.Seq = 1 << 62
+				return headKey(testRoom, publisher), encode(t, head)
+			},
+		},
+		{
+			name: "stored under another publisher's key",
+			tamper: func(head *IndexHead) (string, []byte) {
+				return headKey(testRoom, other), encode(t, head)
+			},
+		},
+		{
+			name: "stored under another room's key",
+			tamper: func(head *IndexHead) (string, []byte) {
+				return headKey("other-room", publisher), encode(t, head)
+			},
+		},
+		{
+			name: "claimed by another publisher",
+			tamper: func(head *IndexHead) (string, []byte) {
+				head.Publisher = other.String()
+				return headKey(testRoom, other), encode(t, head)
+			},
+		},
+		{
+			name: "signed by another publisher",
+			tamper: func(head *IndexHead) (string, []byte) {
+				payload, _ := head.signingPayload()
+				head.Signature, _ = otherPriv.Sign(payload)
+				return headKey(testRoom, publisher), encode(t, head)
+			},
+		},
+		{
+			name: "published in the future",
+			tamper: func(head *IndexHead) (string, []byte) {
+				head.Published = time.Now().Add(time.Hour).Unix()
+				payload, _ := head.signingPayload()
+				head.Signature, _ = priv.Sign(payload)
+				return headKey(testRoom, publisher), encode(t, head)
+			},
+		},
+		{
+			name: "too many entries",
+			tamper: func(head *IndexHead) (string, []byte) {
+				head.Entries = entries(HeadSize+1, 1)
+				head.Seq = HeadSize + 1
+				payload, _ := head.signingPayload()
+				head.Signature, _ = priv.Sign(payload)
+				return headKey(testRoom, publisher), encode(t, head)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, value := tt.tamper(signedHead(t, priv, 3, 3))
+			if err := (IndexValidator{}).Validate(key, value); err == nil {
+				t.Error("tampered head was accepted")
+			}
+		})
+	}
+}
+
+func TestIndexValidatorChecksChunkContentID(t *testing.T) {
+	chunk := encode(t, &IndexChunk{Room: testRoom, Entries: entries(ChunkSize, 1)})
+	id, err := chunkID(chunk)
+	if err != nil {
+		t.Fatalf("chunkID: %v", err)
+	}
+	key := chunkKey(id.String())
+
+	if err := (IndexValidator{}).Validate(key, chunk); err != nil {
+		t.Errorf("Validate: %v", err)
+	}
+
+	tampered := encode(t, &IndexChunk{Room: testRoom, Entries: entries(ChunkSize-1, 1)})
+	if err := (IndexValidator{}).Validate(key, tampered); err == nil {
+		t.Error("chunk that does not match its content ID was accepted")
+	}
+	if err := (IndexValidator{}).Validate(chunkKey("not-a-cid"), chunk); err == nil {
+		t.Error("chunk under an invalid key was accepted")
+	}
+}
+
+func TestIndexValidatorSelectsHighestSequence(t *testing.T) {
+	priv, publisher := newKey(t)
+	key := headKey(testRoom, publisher)
+
+	low := signedHead(t, priv, 3, 3)
+	high := signedHead(t, priv, 5, 5)
+	forged := *high
+	forged.Seq = 1 << 62 // Highest, but no longer signed
+
+	best, err := (IndexValidator{}).Select(key, [][]byte{encode(t, low), encode(t, &forged), encode(t, high)})
+	if err != nil {
+		t.Fatalf("Select: %v", err)
+	}
+	if best != 2 {
+		t.Errorf("selected head %d, want the highest signed one (2)", best)
+	}
+}
+
+func TestMergeEntries(t *testing.T) {
+	existing := entries(3, 10)
+	added := append(entries(2, 12), entries(2, 1)...) // One duplicate, two older
+
+	merged := mergeEntries(existing, added)
+	var got []int64
+	for _, e := range merged {
+		got = append(got, e.Timestamp)
+	}
+	if want := []int64{1, 2, 10, 11, 12, 13}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("merged timestamps = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,177 @@
+package dht
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	record "github.com/libp2p/go-libp2p-record"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// Namespace is the DHT key namespace of chat messages: /messages/<cid>
+const Namespace = "messages"
+
+// MaxTTL is the longest a message record may live in the DHT
+const MaxTTL = 24 * time.Hour
+
+// clockSkew is how far ahead of our clock a record's timestamps may be
+const clockSkew = 5 * time.Minute
+
+// SignedRecord is the value stored under /messages/<cid>
+// The key is the content ID of the message, and the record is signed by the
+// message author, so peers can check both without trusting whoever stored it
+type SignedRecord struct {
+	Message   *StorageMessage `json:"message"`
+	Published int64           `json:"published"` // Unix time the record was signed; the newest wins
+	Signature []byte          `json:"signature"`
+}
+
+// messageKey returns the DHT key of a content ID
+func messageKey(contentID string) string {
+	return "/" + Namespace + "/" + contentID
+}
+
+// NewSignedRecord signs a message as its author
+// msg.From must be the peer ID of priv
+func NewSignedRecord(priv crypto.PrivKey, msg *StorageMessage) (*SignedRecord, error) {
+	author, err := peer.IDFromPrivateKey(priv)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive author ID: %w", err)
+	}
+	if msg.From != author.String() {
+		return nil, fmt.Errorf("cannot sign a message from %s", msg.From)
+	}
+
+	rec := &SignedRecord{Message: msg, Published: time.Now().Unix()}
+	payload, err := rec.signingPayload()
+	if err != nil {
+		return nil, err
+	}
+	if rec.Signature, err = priv.Sign(payload); err != nil {
+		return nil, fmt.Errorf("failed to sign record: %w", err)
+	}
+	return rec, nil
+}
+
+// Verify checks the author's signature and the record's timestamps
+func (r *SignedRecord) Verify(now time.Time) error {
+	if r.Message == nil {
+		return errors.New("record has no message")
+	}
+
+	author, err := peer.Decode(r.Message.From)
+	if err != nil {
+		return fmt.Errorf("invalid author: %w", err)
+	}
+	pub, err := author.ExtractPublicKey()
+	if err != nil {
+		return fmt.Errorf("cannot extract author key: %w", err)
+	}
+
+	payload, err := r.signingPayload()
+	if err != nil {
+		return err
+	}
+	ok, err := pub.Verify(payload, r.Signature)
+	if err != nil {
+		return fmt.Errorf("signature verification failed: %w", err)
+	}
+	if !ok {
+		return errors.New("invalid signature")
+	}
+
+	latest := now.Add(clockSkew).Unix()
+	switch {
+	case r.Published > latest:
+		return errors.New("record is published in the future")
+	case now.Unix() > r.Message.TTL:
+		return errors.New("record has expired")
+	case r.Message.TTL > now.Add(MaxTTL+clockSkew).Unix():
+		return fmt.Errorf("record TTL exceeds %s", MaxTTL)
+	}
+	return nil
+}
+
+// signingPayload returns the canonical bytes covered by the signature
+func (r *SignedRecord) signingPayload() ([]byte, error) {
+	unsigned := *r
+	unsigned.Signature = nil
+
+	data, err := json.Marshal(unsigned)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal record: %w", err)
+	}
+	return data, nil
+}
+
+// Validator validates records in the messages namespace
+// Register it with dht.NamespacedValidator(Namespace, Validator{})
+type Validator struct{}
+
+var _ record.Validator = Validator{}
+
+// Validate checks that a record is signed by its author, has not expired and
+// matches the content ID in its key
+func (Validator) Validate(key string, value []byte) error {
+	rec, err := parseRecord(key, value)
+	if err != nil {
+		return err
+	}
+	return rec.Verify(time.Now())
+}
+
+// Select picks the newest valid record
+func (v Validator) Select(key string, values [][]byte) (int, error) {
+	best, newest := -1, int64(0)
+	now := time.Now()
+	for i, value := range values {
+		rec, err := parseRecord(key, value)
+		if err != nil || rec.Verify(now) != nil {
+			continue
+		}
+		if best < 0 || rec.Published > newest {
+			best, newest = i, rec.Published
+		}
+	}
+	if best < 0 {
+		return 0, errors.New("no valid message record")
+	}
+	return best, nil
+}
+
+// parseRecord decodes a record and checks it against the content ID in key
+func parseRecord(key string, value []byte) (*SignedRecord, error) {
+	ns, id, err := record.SplitKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if ns != Namespace || strings.Contains(id, "/") {
+		return nil, fmt.Errorf("invalid message key %q", key)
+	}
+	want, err := cid.Decode(id)
+	if err != nil {
+		return nil, fmt.Errorf("invalid content ID: %w", err)
+	}
+
+	var rec SignedRecord
+	if err := json.Unmarshal(value, &rec); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal record: %w", err)
+	}
+	if rec.Message == nil {
+		return nil, errors.New("record has no message")
+	}
+
+	got, err := contentID(rec.Message)
+	if err != nil {
+		return nil, err
+	}
+	if !got.Equals(want) {
+		return nil, errors.New("message does not match its content ID")
+	}
+	return &rec, nil
+}
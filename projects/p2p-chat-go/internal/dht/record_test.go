@@ -0,0 +1,216 @@
+package dht
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// newKey returns a fresh peer key and its ID
+func newKey(t *testing.T) (crypto.PrivKey, peer.ID) {
+	t.Helper()
+	priv, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateEd25519Key: %v", err)
+	}
+	id, err := peer.IDFromPrivateKey(priv)
+	if err != nil {
+		t.Fatalf("IDFromPrivateKey: %v", err)
+	}
+	return priv, id
+}
+
+// testMessage returns a message by author that lives for an hour
+func testMessage(author peer.ID) *StorageMessage {
+	now := time.Now()
+	return &StorageMessage{
+		ID:        "m1",
+		Type:      "message",
+		Content:   "hello",
+		Username:  "alice",
+		Timestamp: now.Unix(),
+		From:      author.String(),
+		TTL:       now.Add(time.Hour).Unix(),
+	}
+}
+
+// signedRecord returns the key and encoded record of a message signed by priv
+func signedRecord(t *testing.T, priv crypto.PrivKey, msg *StorageMessage) (string, *SignedRecord) {
+	t.Helper()
+	rec, err := NewSignedRecord(priv, msg)
+	if err != nil {
+		t.Fatalf("NewSignedRecord: %v", err)
+	}
+	c, err := contentID(msg)
+	if err != nil {
+		t.Fatalf("contentID: %v", err)
+	}
+	return messageKey(c.String()), rec
+}
+
+// encode marshals a record as it is stored in the DHT
+func encode(t *testing.T, v interface{}) []byte {
+	t.Helper()
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatalf("failed to marshal record: %v", err)
+	}
+	return data
+}
+
+func TestValidatorAcceptsSignedRecords(t *testing.T) {
+	priv, author := newKey(t)
+	key, rec := signedRecord(t, priv, testMessage(author))
+
+	if err := (Validator{}).Validate(key, encode(t, rec)); err != nil {
+		t.Errorf("Validate: %v", err)
+	}
+}
+
+func TestNewSignedRecordRefusesOtherAuthors(t *testing.T) {
+	priv, _ := newKey(t)
+	_, other := newKey(t)
+	if _, err := NewSignedRecord(priv, testMessage(other)); err == nil {
+		t.Error("signed a message from another peer")
+	}
+}
+
+func TestValidatorRejectsTamperedRecords(t *testing.T) {
+	priv, author := newKey(t)
+	otherPriv, other := newKey(t)
+
+	tests := []struct {
+		name   string
+		tamper func(key string, rec *SignedRecord) (string, []byte)
+	}{
+		{
+			name: "content changed",
+			tamper: func(key string, rec *SignedRecord) (string, []byte) {
+				rec.Message.Content = "goodbye"
+				return key, encode(t, rec)
+			},
+		},
+		{
+			name: "stored under another content ID",
+			tamper: func(key string, rec *SignedRecord) (string, []byte) {
+				msg := testMessage(author)
+				msg.ID = "m2"
+				otherKey, _ := signedRecord(t, priv, msg)
+				return otherKey, encode(t, rec)
+			},
+		},
+		{
+			name: "lifetime extended",
+			tamper: func(key string, rec *SignedRecord) (string, []byte) {
+				rec.Message.TTL += 60
+				return key, encode(t, rec)
+			},
+		},
+		{
+			name: "republished later",
+			tamper: func(key string, rec *SignedRecord) (string, []byte) {
+				rec.Published++
+				return key, encode(t, rec)
+			},
+		},
+		{
+			name: "signed by someone else",
+			tamper: func(key string, rec *SignedRecord) (string, []byte) {
+				payload, _ := rec.signingPayload()
+				rec.Signature, _ = otherPriv.Sign(payload)
+				return key, encode(t, rec)
+			},
+		},
+		{
+			name: "claimed by someone else",
+			tamper: func(key string, rec *SignedRecord) (string, []byte) {
+				msg := testMessage(author)
+				msg.From = other.String()
+				forged := &SignedRecord{Message: msg, Published: rec.Published}
+				payload, _ := forged.signingPayload()
+				forged.Signature, _ = priv.Sign(payload)
+				c, _ := contentID(msg)
+				return messageKey(c.String()), encode(t, forged)
+			},
+		},
+		{
+			name: "not a record",
+			tamper: func(key string, rec *SignedRecord) (string, []byte) {
+				return key, []byte("not json")
+			},
+		},
+		{
+			name: "wrong namespace",
+			tamper: func(key string, rec *SignedRecord) (string, []byte) {
+				return "/roomlog/" + key[len("/messages/"):], encode(t, rec)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, rec := signedRecord(t, priv, testMessage(author))
+			key, value := tt.tamper(key, rec)
+			if err := (Validator{}).Validate(key, value); err == nil {
+				t.Error("tampered record was accepted")
+			}
+		})
+	}
+}
+
+func TestSignedRecordChecksLifetime(t *testing.T) {
+	priv, author := newKey(t)
+	now := time.Now()
+
+	tests := []struct {
+		name  string
+		ttl   time.Duration
+		valid bool
+	}{
+		{"within the limit", MaxTTL, true},
+		{"expired", -time.Minute, false},
+		{"longer than MaxTTL", MaxTTL + time.Hour, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := testMessage(author)
+			msg.TTL = now.Add(tt.ttl).Unix()
+			_, rec := signedRecord(t, priv, msg)
+			if err := rec.Verify(now); (err == nil) != tt.valid {
+				t.Errorf("Verify = %v, want valid %v", err, tt.valid)
+			}
+		})
+	}
+}
+
+func TestValidatorSelectsNewestValidRecord(t *testing.T) {
+	priv, author := newKey(t)
+	msg := testMessage(author)
+
+	key, older := signedRecord(t, priv, msg)
+	_, newer := signedRecord(t, priv, msg)
+	newer.Published = older.Published + 10
+	payload, _ := newer.signingPayload()
+	newer.Signature, _ = priv.Sign(payload)
+
+	forged := *newer
+	forged.Published += 10 // Newest, but no longer signed
+
+	values := [][]byte{encode(t, older), encode(t, &forged), encode(t, newer)}
+	best, err := (Validator{}).Select(key, values)
+	if err != nil {
+		t.Fatalf("Select: %v", err)
+	}
+	if best != 2 {
+		t.Errorf("selected record %d, want the newest signed one (2)", best)
+	}
+
+	if _, err := (Validator{}).Select(key, [][]byte{encode(t, &forged)}); err == nil {
+		t.Error("selected a record without a valid signature")
+	}
+}
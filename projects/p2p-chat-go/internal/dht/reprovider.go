@@ -0,0 +1,438 @@
+package dht
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-cid"
+)
+
+// Kinds of content the reprovider announces
+const (
+	KindMessage = "message" // A chat message record
+	KindIndex   = "index"   // A chunk of a room's history index
+)
+
+// ProviderStore persists what the reprovider announces so it survives restarts
+// storage.MessageStore implements it on top of badger
+type ProviderStore interface {
+	SaveProvideEntry(cid string, data []byte) error
+	GetProvideEntries() ([][]byte, error)
+	DeleteProvideEntries(cids []string) error
+}
+
+// Provider announces content to the DHT; *dht.IpfsDHT implements it
+type Provider interface {
+	Provide(ctx context.Context, c cid.Cid, broadcast bool) error
+}
+
+// ReproviderConfig configures when content is re-announced
+type ReproviderConfig struct {
+	Interval       time.Duration // Time between announcements of the same content; 0 = never
+	MaxAge         time.Duration // Unpinned content tracked longer ago is dropped; 0 = keep
+	ProvideTimeout time.Duration // Bound on a single announcement
+}
+
+// DefaultReproviderConfig returns the default schedule
+// Provider records expire after about 24 hours, so content is announced
+// twice within that time
+func DefaultReproviderConfig() ReproviderConfig {
+	return ReproviderConfig{
+		Interval:       12 * time.Hour,
+		MaxAge:         7 * 24 * time.Hour,
+		ProvideTimeout: time.Minute,
+	}
+}
+
+// ProvidedContent is one CID the reprovider announces
+type ProvidedContent struct {
+	CID          string `json:"cid"`
+	Kind         string `json:"kind"`
+	Added        int64  `json:"added"`             // Unix time it was first tracked
+	Expires      int64  `json:"expires,omitempty"` // Unix time after which it is dropped, 0 = never
+	Pinned       bool   `json:"pinned,omitempty"`  // Announced first and never dropped for age
+	LastProvided int64  `json:"last_provided,omitempty"`
+	Failures     int    `json:"failures,omitempty"` // Failed announcements since the last success
+	LastError    string `json:"last_error,omitempty"`
+}
+
+// ReproviderStats describes the reprovider and its latest pass
+type ReproviderStats struct {
+	Tracked  int
+	Pinned   int
+	Failing  int // Content whose latest announcement failed
+	Running  bool
+	Done     int // Announcements attempted in the running pass
+	Total    int // Announcements due in the running pass
+	LastRun  time.Time
+	LastTook time.Duration
+	Provided int // Announced in the last pass
+	Failed   int // Failed in the last pass
+	NextRun  time.Time
+	Interval time.Duration
+}
+
+// Reprovider re-announces tracked content before its provider records expire
+// Pinned content goes first, then the most recently added
+type Reprovider struct {
+	ctx      context.Context
+	provider Provider
+	store    ProviderStore // nil = memory only
+	cfg      ReproviderConfig
+	verbose  bool
+
+	mu      sync.Mutex
+	entries map[string]*ProvidedContent
+	stats   ReproviderStats
+
+	trigger   chan bool // Requests a pass; true re-announces everything
+	done      chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+// NewReprovider creates a reprovider and loads the content saved in store
+// store may be nil to keep nothing across restarts. With a zero interval the
+// reprovider only tracks content and announces it on request
+func NewReprovider(ctx context.Context, provider Provider, store ProviderStore, cfg ReproviderConfig, verbose bool) (*Reprovider, error) {
+	if cfg.Interval < 0 || cfg.MaxAge < 0 {
+		return nil, fmt.Errorf("reprovider interval and max age must not be negative")
+	}
+	if cfg.ProvideTimeout <= 0 {
+		cfg.ProvideTimeout = DefaultReproviderConfig().ProvideTimeout
+	}
+
+	r := &Reprovider{
+		ctx:      ctx,
+		provider: provider,
+		store:    store,
+		cfg:      cfg,
+		verbose:  verbose,
+		entries:  make(map[string]*ProvidedContent),
+		trigger:  make(chan bool, 1),
+		done:     make(chan struct{}),
+	}
+	r.stats.Interval = cfg.Interval
+
+	if store != nil {
+		values, err := store.GetProvideEntries()
+		if err != nil {
+			return nil, fmt.Errorf("failed to load provided content: %w", err)
+		}
+		for _, data := range values {
+			var e ProvidedContent
+			if err := json.Unmarshal(data, &e); err != nil || e.CID == "" {
+				continue // Skip unreadable entries
+			}
+			r.entries[e.CID] = &e
+		}
+	}
+
+	r.wg.Add(1)
+	go r.loop()
+
+	return r, nil
+}
+
+// Track adds content to announce; provided reports whether it was just
+// announced. Tracking known content only updates its expiry
+func (r *Reprovider) Track(c, kind string, expires int64, provided bool) {
+	now := time.Now().Unix()
+
+	r.mu.Lock()
+	e, ok := r.entries[c]
+	if !ok {
+		e = &ProvidedContent{CID: c, Kind: kind, Added: now}
+		r.entries[c] = e
+	}
+	e.Expires = expires
+	if provided {
+		e.LastProvided = now
+		e.Failures, e.LastError = 0, ""
+	}
+	saved := *e
+	r.mu.Unlock()
+
+	r.save(&saved)
+}
+
+// Pin makes content announced first and keeps it past the maximum age
+// It returns false if the content is not tracked
+func (r *Reprovider) Pin(c string, pinned bool) bool {
+	r.mu.Lock()
+	e, ok := r.entries[c]
+	if ok {
+		e.Pinned = pinned
+	}
+	var saved ProvidedContent
+	if ok {
+		saved = *e
+	}
+	r.mu.Unlock()
+
+	if ok {
+		r.save(&saved)
+	}
+	return ok
+}
+
+// Untrack stops announcing content
+func (r *Reprovider) Untrack(cids ...string) {
+	r.mu.Lock()
+	for _, c := range cids {
+		delete(r.entries, c)
+	}
+	r.mu.Unlock()
+
+	r.forget(cids)
+}
+
+// Reprovide requests a pass now; all re-announces every tracked CID, not
+// only those that are due
+func (r *Reprovider) Reprovide(all bool) {
+	select {
+	case r.trigger <- all:
+	default: // A pass is already pending
+	}
+}
+
+// Stats returns the reprovider's statistics
+func (r *Reprovider) Stats() ReproviderStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stats := r.stats
+	stats.Tracked, stats.Pinned, stats.Failing = len(r.entries), 0, 0
+	for _, e := range r.entries {
+		if e.Pinned {
+			stats.Pinned++
+		}
+		if e.Failures > 0 {
+			stats.Failing++
+		}
+	}
+	return stats
+}
+
+// Close stops the reprovider; tracked content stays in the store
+func (r *Reprovider) Close() error {
+	r.closeOnce.Do(func() {
+		close(r.done)
+		r.wg.Wait()
+	})
+	return nil
+}
+
+// loop runs a pass whenever content falls due or one is requested
+func (r *Reprovider) loop() {
+	defer r.wg.Done()
+
+	// Content loaded from the store may be due already; look soon after start
+	// without competing with bootstrap
+	wait := time.Minute
+	for {
+		var timer *time.Timer
+		var fire <-chan time.Time
+		if r.cfg.Interval > 0 {
+			r.mu.Lock()
+			r.stats.NextRun = time.Now().Add(wait)
+			r.mu.Unlock()
+			timer = time.NewTimer(wait)
+			fire = timer.C
+		}
+
+		all := false
+		select {
+		case <-fire:
+		case all = <-r.trigger:
+		case <-r.done:
+		case <-r.ctx.Done():
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		select {
+		case <-r.done:
+			return
+		case <-r.ctx.Done():
+			return
+		default:
+		}
+
+		r.run(all)
+		wait = r.nextDue()
+	}
+}
+
+// nextDue returns how long until the next tracked content falls due
+func (r *Reprovider) nextDue() time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	wait := r.cfg.Interval
+	now := time.Now()
+	for _, e := range r.entries {
+		due := time.Unix(e.LastProvided, 0).Add(r.cfg.Interval)
+		if e.Failures > 0 {
+			due = time.Unix(e.LastProvided, 0).Add(retryDelay(e.Failures))
+		}
+		if d := due.Sub(now); d < wait {
+			wait = d
+		}
+	}
+	if wait < time.Minute {
+		wait = time.Minute // Batch announcements that fall due together
+	}
+	return wait
+}
+
+// retryDelay backs off after repeated failures, up to an hour
+func retryDelay(failures int) time.Duration {
+	d := time.Minute << uint(failures)
+	if failures > 6 || d > time.Hour {
+		d = time.Hour
+	}
+	return d
+}
+
+// run announces the content that is due, pinned and newest first
+func (r *Reprovider) run(all bool) {
+	start := time.Now()
+	due, dropped := r.collect(start, all)
+	r.forget(dropped)
+
+	r.mu.Lock()
+	r.stats.Running, r.stats.Done, r.stats.Total = true, 0, len(due)
+	r.mu.Unlock()
+
+	provided, failed := 0, 0
+	for _, e := range due {
+		select {
+		case <-r.done:
+			return
+		case <-r.ctx.Done():
+			return
+		default:
+		}
+
+		err := r.provide(e.CID)
+		now := time.Now().Unix()
+
+		r.mu.Lock()
+		r.stats.Done++
+		cur, ok := r.entries[e.CID]
+		var saved ProvidedContent
+		if ok {
+			if err != nil {
+				// LastProvided marks the attempt so the retry is backed off
+				cur.Failures++
+				cur.LastError = err.Error()
+				cur.LastProvided = now
+			} else {
+				cur.Failures, cur.LastError = 0, ""
+				cur.LastProvided = now
+			}
+			saved = *cur
+		}
+		r.mu.Unlock()
+
+		if err != nil {
+			failed++
+			if r.verbose {
+				fmt.Printf("Reprovide %s failed: %v\n", e.CID, err)
+			}
+		} else {
+			provided++
+		}
+		if ok {
+			r.save(&saved)
+		}
+	}
+
+	r.mu.Lock()
+	r.stats.Running = false
+	r.stats.LastRun = start
+	r.stats.LastTook = time.Since(start)
+	r.stats.Provided, r.stats.Failed = provided, failed
+	r.mu.Unlock()
+
+	if r.verbose && len(due) > 0 {
+		fmt.Printf("Reprovided %d of %d CID(s) in %s (%d failed)\n", provided, len(due), time.Since(start).Round(time.Second), failed)
+	}
+}
+
+// collect returns the content to announce, in order, and drops content that
+// expired or aged out
+func (r *Reprovider) collect(now time.Time, all bool) (due []ProvidedContent, dropped []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for c, e := range r.entries {
+		expired := e.Expires != 0 && e.Expires <= now.Unix()
+		tooOld := !e.Pinned && r.cfg.MaxAge > 0 && now.Sub(time.Unix(e.Added, 0)) > r.cfg.MaxAge
+		if expired || tooOld {
+			delete(r.entries, c)
+			dropped = append(dropped, c)
+			continue
+		}
+
+		last := time.Unix(e.LastProvided, 0)
+		wait := r.cfg.Interval
+		if e.Failures > 0 {
+			wait = retryDelay(e.Failures)
+		}
+		if all || e.LastProvided == 0 || now.Sub(last) >= wait {
+			due = append(due, *e)
+		}
+	}
+
+	sort.Slice(due, func(i, j int) bool {
+		if due[i].Pinned != due[j].Pinned {
+			return due[i].Pinned
+		}
+		if due[i].Added != due[j].Added {
+			return due[i].Added > due[j].Added
+		}
+		return due[i].CID < due[j].CID
+	})
+	return due, dropped
+}
+
+// provide announces one CID
+func (r *Reprovider) provide(id string) error {
+	c, err := cid.Decode(id)
+	if err != nil {
+		return fmt.Errorf("invalid CID: %w", err)
+	}
+	ctx, cancel := context.WithTimeout(r.ctx, r.cfg.ProvideTimeout)
+	defer cancel()
+	return r.provider.Provide(ctx, c, true)
+}
+
+// save persists an entry
+func (r *Reprovider) save(e *ProvidedContent) {
+	if r.store == nil {
+		return
+	}
+	data, err := json.Marshal(e)
+	if err == nil {
+		err = r.store.SaveProvideEntry(e.CID, data)
+	}
+	if err != nil && r.verbose {
+		fmt.Printf("Warning: failed to save provided content: %v\n", err)
+	}
+}
+
+// forget removes entries from the store
+func (r *Reprovider) forget(cids []string) {
+	if r.store == nil || len(cids) == 0 {
+		return
+	}
+	if err := r.store.DeleteProvideEntries(cids); err != nil && r.verbose {
+		fmt.Printf("Warning: failed to forget provided content: %v\n", err)
+	}
+}
@@ -0,0 +1,266 @@
+package dht
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	record "github.com/libp2p/go-libp2p-record"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/routing"
+)
+
+// MetaNamespace is the DHT key namespace of room metadata
+//
+//	/roommeta/<sha256(room)>-<peer ID>  metadata signed by that peer
+//
+// Like IPNS, every publisher has its own key that only it can sign, so a peer
+// without rights cannot overwrite the record of the room owner. Readers look
+// up the keys of the owner and admins and rank the records by the authority
+// of their publisher; sequence numbers only order the records of one publisher.
+const MetaNamespace = "roommeta"
+
+// Room metadata limits
+const (
+	MaxTitleLen       = 128
+	MaxDescriptionLen = 1024
+	MaxRulesLen       = 4096
+	MaxPinned         = 32
+)
+
+// RoomMeta is the mutable metadata of a room
+type RoomMeta struct {
+	Room        string   `json:"room"`
+	Title       string   `json:"title,omitempty"`
+	Description string   `json:"description,omitempty"`
+	Rules       string   `json:"rules,omitempty"`
+	Pinned      []string `json:"pinned,omitempty"` // CIDs of pinned messages, oldest pin first
+	Mirror      bool     `json:"mirror,omitempty"` // Members store the messages they send in the DHT
+	Seq         uint64   `json:"seq"`              // Incremented on every change by the publisher
+	Publisher   string   `json:"publisher"`
+	Published   int64    `json:"published"`
+	Signature   []byte   `json:"signature"`
+}
+
+// metaKey returns the DHT key of a publisher's metadata for a room
+func metaKey(room string, publisher peer.ID) string {
+	sum := sha256.Sum256([]byte(room))
+	return "/" + MetaNamespace + "/" + hex.EncodeToString(sum[:]) + "-" + publisher.String()
+}
+
+// Newer reports whether m was published after other: from the same
+// publisher the higher sequence number wins, otherwise the later publication
+// Sequence numbers of different publishers are unrelated, so one publisher
+// cannot outrank another by inflating its own
+func (m *RoomMeta) Newer(other *RoomMeta) bool {
+	if other == nil {
+		return true
+	}
+	if m.Publisher == other.Publisher && m.Seq != other.Seq {
+		return m.Seq > other.Seq
+	}
+	return m.Published > other.Published
+}
+
+// IsPinned reports whether a message CID is pinned
+func (m *RoomMeta) IsPinned(c string) bool {
+	for _, p := range m.Pinned {
+		if p == c {
+			return true
+		}
+	}
+	return false
+}
+
+// Sign signs the metadata as priv's peer
+// The caller sets Seq; the publisher and publication time are filled in
+func (m *RoomMeta) Sign(priv crypto.PrivKey) error {
+	publisher, err := peer.IDFromPrivateKey(priv)
+	if err != nil {
+		return fmt.Errorf("failed to derive publisher ID: %w", err)
+	}
+	m.Publisher = publisher.String()
+	m.Published = time.Now().Unix()
+
+	payload, err := m.signingPayload()
+	if err != nil {
+		return err
+	}
+	if m.Signature, err = priv.Sign(payload); err != nil {
+		return fmt.Errorf("failed to sign room metadata: %w", err)
+	}
+	return nil
+}
+
+// Verify checks the publisher's signature and the metadata's limits
+func (m *RoomMeta) Verify(now time.Time) error {
+	switch {
+	case m.Room == "":
+		return errors.New("room metadata has no room")
+	case len(m.Title) > MaxTitleLen:
+		return fmt.Errorf("title is longer than %d bytes", MaxTitleLen)
+	case len(m.Description) > MaxDescriptionLen:
+		return fmt.Errorf("description is longer than %d bytes", MaxDescriptionLen)
+	case len(m.Rules) > MaxRulesLen:
+		return fmt.Errorf("rules are longer than %d bytes", MaxRulesLen)
+	case len(m.Pinned) > MaxPinned:
+		return fmt.Errorf("more than %d pinned messages", MaxPinned)
+	case m.Published > now.Add(clockSkew).Unix():
+		return errors.New("room metadata is published in the future")
+	}
+	for _, p := range m.Pinned {
+		if _, err := cid.Decode(p); err != nil {
+			return fmt.Errorf("invalid pinned CID %q: %w", p, err)
+		}
+	}
+
+	publisher, err := peer.Decode(m.Publisher)
+	if err != nil {
+		return fmt.Errorf("invalid publisher: %w", err)
+	}
+	pub, err := publisher.ExtractPublicKey()
+	if err != nil {
+		return fmt.Errorf("cannot extract publisher key: %w", err)
+	}
+
+	payload, err := m.signingPayload()
+	if err != nil {
+		return err
+	}
+	ok, err := pub.Verify(payload, m.Signature)
+	if err != nil {
+		return fmt.Errorf("signature verification failed: %w", err)
+	}
+	if !ok {
+		return errors.New("invalid signature")
+	}
+	return nil
+}
+
+// PublisherID returns the peer that signed the metadata
+func (m *RoomMeta) PublisherID() peer.ID {
+	id, _ := peer.Decode(m.Publisher)
+	return id
+}
+
+// signingPayload returns the canonical bytes covered by the signature
+func (m *RoomMeta) signingPayload() ([]byte, error) {
+	unsigned := *m
+	unsigned.Signature = nil
+
+	data, err := json.Marshal(unsigned)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal room metadata: %w", err)
+	}
+	return data, nil
+}
+
+// ParseRoomMeta decodes and verifies signed room metadata
+func ParseRoomMeta(data []byte, now time.Time) (*RoomMeta, error) {
+	var m RoomMeta
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal room metadata: %w", err)
+	}
+	if err := m.Verify(now); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// MetaValidator validates records in the roommeta namespace
+// Register it with dht.NamespacedValidator(MetaNamespace, MetaValidator{})
+type MetaValidator struct{}
+
+var _ record.Validator = MetaValidator{}
+
+// Validate checks the signature and that the record is stored under its
+// publisher's key for its room
+func (MetaValidator) Validate(key string, value []byte) error {
+	_, err := parseMetaRecord(key, value, time.Now())
+	return err
+}
+
+// Select picks the newest record; all values of a key share a publisher
+func (MetaValidator) Select(key string, values [][]byte) (int, error) {
+	best := -1
+	var bestMeta *RoomMeta
+	now := time.Now()
+	for i, value := range values {
+		m, err := parseMetaRecord(key, value, now)
+		if err != nil {
+			continue
+		}
+		if best < 0 || m.Newer(bestMeta) {
+			best, bestMeta = i, m
+		}
+	}
+	if best < 0 {
+		return 0, errors.New("no valid room metadata")
+	}
+	return best, nil
+}
+
+// parseMetaRecord validates a metadata record against its key
+func parseMetaRecord(key string, value []byte, now time.Time) (*RoomMeta, error) {
+	ns, name, err := record.SplitKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if ns != MetaNamespace || strings.Contains(name, "/") {
+		return nil, fmt.Errorf("invalid room metadata key %q", key)
+	}
+
+	m, err := ParseRoomMeta(value, now)
+	if err != nil {
+		return nil, err
+	}
+	if metaKey(m.Room, m.PublisherID()) != key {
+		return nil, errors.New("room metadata does not match its key")
+	}
+	return m, nil
+}
+
+// PutRoomMeta stores signed metadata in the DHT under its publisher's key
+func (ds *DistributedStorage) PutRoomMeta(m *RoomMeta) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return fmt.Errorf("failed to marshal room metadata: %w", err)
+	}
+	return ds.records.PutValue(ds.ctx, metaKey(m.Room, m.PublisherID()), data)
+}
+
+// FetchRoomMeta returns the metadata of a room published by each of
+// publishers, usually the room owner and admins, for the caller to rank
+// It returns nothing if none of them published any
+func (ds *DistributedStorage) FetchRoomMeta(room string, publishers []peer.ID) ([]*RoomMeta, error) {
+	var found []*RoomMeta
+	var lastErr error
+	now := time.Now()
+	for _, p := range publishers {
+		key := metaKey(room, p)
+		data, err := ds.records.GetValue(ds.ctx, key)
+		if errors.Is(err, routing.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		m, err := parseMetaRecord(key, data, now)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		found = append(found, m)
+	}
+	if len(found) == 0 && lastErr != nil {
+		return nil, lastErr
+	}
+	return found, nil
+}
@@ -0,0 +1,165 @@
+package dht
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+)
+
+// signedMeta returns room metadata with sequence number seq, signed by priv
+func signedMeta(t *testing.T, priv crypto.PrivKey, seq uint64) *RoomMeta {
+	t.Helper()
+	m := &RoomMeta{Room: testRoom, Title: "Team", Rules: "Be nice", Seq: seq}
+	if err := m.Sign(priv); err != nil {
+		t.Fatalf("Sign: %v", err)
+	}
+	return m
+}
+
+func TestMetaValidatorAcceptsSignedMetadata(t *testing.T) {
+	priv, publisher := newKey(t)
+	m := signedMeta(t, priv, 1)
+
+	if err := (MetaValidator{}).Validate(metaKey(testRoom, publisher), encode(t, m)); err != nil {
+		t.Errorf("Validate: %v", err)
+	}
+}
+
+func TestMetaValidatorRejectsTamperedMetadata(t *testing.T) {
+	priv, publisher := newKey(t)
+	otherPriv, other := newKey(t)
+
+	// resign signs m again as priv after a change to a signed field
+	resign := func(m *RoomMeta) *RoomMeta {
+		payload, _ := m.signingPayload()
+		m.Signature, _ = priv.Sign(payload)
+		return m
+	}
+
+	tests := []struct {
+		name   string
+		tamper func(m *RoomMeta) (string, []byte)
+	}{
+		{
+			name: "title changed",
+			tamper: func(m *RoomMeta) (string, []byte) {
+				m.Title = "Hijacked"
+				return metaKey(testRoom, publisher), encode(t, m)
+			},
+		},
+		{
+			name: "pin added",
+			tamper: func(m *RoomMeta) (string, []byte) {
+				c, _ := contentID(testMessage(publisher))
+				m.Pinned = append(m.Pinned, c.String())
+				return metaKey(testRoom, publisher), encode(t, m)
+			},
+		},
+		{
+			name: "sequence raised",
+			tamper: func(m *RoomMeta) (string, []byte) {
+				m.Seq = 1 << 62
+				return metaKey(testRoom, publisher), encode(t, m)
+			},
+		},
+		{
+			name: "stored under another publisher's key",
+			tamper: func(m *RoomMeta) (string, []byte) {
+				return metaKey(testRoom, other), encode(t, m)
+			},
+		},
+		{
+			name: "stored under another room's key",
+			tamper: func(m *RoomMeta) (string, []byte) {
+				return metaKey("other-room", publisher), encode(t, m)
+			},
+		},
+		{
+			name: "claimed by another publisher",
+			tamper: func(m *RoomMeta) (string, []byte) {
+				m.Publisher = other.String()
+				return metaKey(testRoom, other), encode(t, resign(m))
+			},
+		},
+		{
+			name: "signed by another publisher",
+			tamper: func(m *RoomMeta) (string, []byte) {
+				payload, _ := m.signingPayload()
+				m.Signature, _ = otherPriv.Sign(payload)
+				return metaKey(testRoom, publisher), encode(t, m)
+			},
+		},
+		{
+			name: "published in the future",
+			tamper: func(m *RoomMeta) (string, []byte) {
+				m.Published = time.Now().Add(time.Hour).Unix()
+				return metaKey(testRoom, publisher), encode(t, resign(m))
+			},
+		},
+		{
+			name: "rules too long",
+			tamper: func(m *RoomMeta) (string, []byte) {
+				m.Rules = strings.Repeat("x", MaxRulesLen+1)
+				return metaKey(testRoom, publisher), encode(t, resign(m))
+			},
+		},
+		{
+			name: "invalid pin",
+			tamper: func(m *RoomMeta) (string, []byte) {
+				m.Pinned = []string{"not-a-cid"}
+				return metaKey(testRoom, publisher), encode(t, resign(m))
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, value := tt.tamper(signedMeta(t, priv, 1))
+			if err := (MetaValidator{}).Validate(key, value); err == nil {
+				t.Error("tampered metadata was accepted")
+			}
+		})
+	}
+}
+
+func TestMetaValidatorSelectsNewest(t *testing.T) {
+	priv, publisher := newKey(t)
+	key := metaKey(testRoom, publisher)
+
+	older := signedMeta(t, priv, 1)
+	newer := signedMeta(t, priv, 2)
+	forged := *newer
+	forged.Seq = 1 << 62 // Newest, but no longer signed
+
+	best, err := (MetaValidator{}).Select(key, [][]byte{encode(t, older), encode(t, &forged), encode(t, newer)})
+	if err != nil {
+		t.Fatalf("Select: %v", err)
+	}
+	if best != 2 {
+		t.Errorf("selected record %d, want the newest signed one (2)", best)
+	}
+}
+
+func TestRoomMetaNewer(t *testing.T) {
+	alice, _ := newKey(t)
+	bob, _ := newKey(t)
+
+	first := signedMeta(t, alice, 1)
+	second := signedMeta(t, alice, 2)
+	if !second.Newer(first) || first.Newer(second) {
+		t.Error("a publisher's higher sequence number does not win")
+	}
+	if !first.Newer(nil) {
+		t.Error("metadata is not newer than none")
+	}
+
+	// Across publishers only the publication time counts, so an inflated
+	// sequence number does not outrank a later edit
+	inflated := signedMeta(t, bob, 1<<62)
+	inflated.Published = first.Published - 60
+	if inflated.Newer(first) {
+		t.Error("an inflated sequence number outranked another publisher's later edit")
+	}
+}
@@ -4,52 +4,133 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"sync"
 	"time"
 
+	"github.com/geekp2p/p2p-chat-go/internal/dag"
+	"github.com/geekp2p/p2p-chat-go/internal/storage"
 	"github.com/ipfs/go-cid"
 	dht "github.com/libp2p/go-libp2p-kad-dht"
 	"github.com/libp2p/go-libp2p/core/host"
 	"github.com/libp2p/go-libp2p/core/peer"
-	mh "github.com/multiformats/go-multihash"
+	"github.com/libp2p/go-libp2p/core/routing"
 )
 
 // StorageMessage represents a message stored in DHT
 type StorageMessage struct {
-	Type      string `json:"type"`
-	Content   string `json:"content"`
-	Username  string `json:"username"`
-	Timestamp int64  `json:"timestamp"`
-	From      string `json:"from"`
-	TTL       int64  `json:"ttl"` // Time-to-live in seconds
+	ID        string   `json:"id,omitempty"` // Chat message ID
+	Type      string   `json:"type"`
+	Content   string   `json:"content"`
+	Username  string   `json:"username"`
+	Timestamp int64    `json:"timestamp"`
+	From      string   `json:"from"`
+	Thread    string   `json:"thread,omitempty"`
+	Parents   []string `json:"parents,omitempty"` // DAG parents, part of the content ID
+	Expires   int64    `json:"expires,omitempty"` // Disappearing messages: Unix time the author set
+	TTL       int64    `json:"ttl"`               // Time-to-live in seconds
+}
+
+// Message returns the message in its stored form, as a message of room
+func (m *StorageMessage) Message(room string) *storage.Message {
+	return &storage.Message{
+		ID:        m.ID,
+		Type:      m.Type,
+		Content:   m.Content,
+		Username:  m.Username,
+		Timestamp: m.Timestamp,
+		From:      m.From,
+		Room:      room,
+		Thread:    m.Thread,
+		Expires:   m.Expires,
+		Parents:   m.Parents,
+	}
+}
+
+// NewStorageMessage returns the DHT form of a stored message
+// Its record lives until the message expires, and at most MaxTTL
+func NewStorageMessage(msg *storage.Message) *StorageMessage {
+	ttl := time.Now().Add(MaxTTL).Unix()
+	if msg.Expires != 0 && msg.Expires < ttl {
+		ttl = msg.Expires
+	}
+	return &StorageMessage{
+		ID:        msg.ID,
+		Type:      msg.Type,
+		Content:   msg.Content,
+		Username:  msg.Username,
+		Timestamp: msg.Timestamp,
+		From:      msg.From,
+		Thread:    msg.Thread,
+		Parents:   msg.Parents,
+		Expires:   msg.Expires,
+		TTL:       ttl,
+	}
 }
 
 // DistributedStorage handles DHT-based distributed storage
 type DistributedStorage struct {
 	ctx     context.Context
 	host    host.Host
-	dht     *dht.IpfsDHT
-	cache   map[string]*StorageMessage // Local cache
-	maxTTL  int64                      // Maximum TTL (24 hours default)
+	dht     routing.ContentRouting // Provider records
+	records *dht.IpfsDHT           // Signed message records (/messages namespace)
+	cache   *messageCache          // Local LRU cache, safe for concurrent use
+	reprov  *Reprovider            // Re-announces provided content (optional)
+	maxTTL  int64                  // Maximum TTL (24 hours default)
 	verbose bool
+
+	indexMu sync.Mutex            // Serialises appends to our room indexes
+	headsMu sync.Mutex            // Guards heads
+	heads   map[string]*IndexHead // Latest index head accepted per key
+
+	done      chan struct{} // Closed by Close to stop the cleanup goroutine
+	closeOnce sync.Once
+	wg        sync.WaitGroup
 }
 
 // NewDistributedStorage creates a new distributed storage instance
-func NewDistributedStorage(ctx context.Context, h host.Host, dhtInstance *dht.IpfsDHT, verbose bool) *DistributedStorage {
+// Provider records go to providers, a DHT or several bridged; message records
+// go to recordDHT, which must validate the messages namespace with Validator
+func NewDistributedStorage(ctx context.Context, h host.Host, providers routing.ContentRouting, recordDHT *dht.IpfsDHT, verbose bool) *DistributedStorage {
 	ds := &DistributedStorage{
 		ctx:     ctx,
 		host:    h,
-		dht:     dhtInstance,
-		cache:   make(map[string]*StorageMessage),
-		maxTTL:  24 * 60 * 60, // 24 hours
+		dht:     providers,
+		records: recordDHT,
+		cache:   newMessageCache(DefaultCacheConfig()),
+		heads:   make(map[string]*IndexHead),
+		maxTTL:  int64(MaxTTL / time.Second),
 		verbose: verbose,
+		done:    make(chan struct{}),
 	}
 
 	// Start cache cleanup goroutine
+	ds.wg.Add(1)
 	go ds.cleanupExpiredCache()
 
 	return ds
 }
 
+// SetCacheLimits changes the bounds of the local cache
+func (ds *DistributedStorage) SetCacheLimits(cfg CacheConfig) error {
+	return ds.cache.configure(cfg)
+}
+
+// PersistCache keeps the local cache in store so it survives restarts
+// Entries saved by an earlier run are loaded; it returns how many
+func (ds *DistributedStorage) PersistCache(store CacheStore) (int, error) {
+	return ds.cache.persist(store, time.Now())
+}
+
+// SetReprovider sets the reprovider that keeps provided content announced
+func (ds *DistributedStorage) SetReprovider(r *Reprovider) {
+	ds.reprov = r
+}
+
+// Reprovider returns the reprovider, or nil if there is none
+func (ds *DistributedStorage) Reprovider() *Reprovider {
+	return ds.reprov
+}
+
 // PutMessage stores a message in the DHT network
 // The message will be replicated to multiple peers for redundancy
 func (ds *DistributedStorage) PutMessage(msg *StorageMessage) error {
@@ -64,12 +145,6 @@ func (ds *DistributedStorage) PutMessage(msg *StorageMessage) error {
 		msg.TTL = maxAllowed
 	}
 
-	// Marshal message to JSON
-	data, err := json.Marshal(msg)
-	if err != nil {
-		return fmt.Errorf("failed to marshal message: %w", err)
-	}
-
 	// Create content ID for the message
 	contentID, err := ds.createContentID(msg)
 	if err != nil {
@@ -77,7 +152,9 @@ func (ds *DistributedStorage) PutMessage(msg *StorageMessage) error {
 	}
 
 	// Store in local cache first
-	ds.cache[contentID] = msg
+	if err := ds.cache.put(contentID, msg); err != nil && ds.verbose {
+		fmt.Printf("Warning: Failed to persist cached message: %v\n", err)
+	}
 
 	// Convert contentID string to cid.Cid for DHT operations
 	c, err := cid.Decode(contentID)
@@ -89,7 +166,8 @@ func (ds *DistributedStorage) PutMessage(msg *StorageMessage) error {
 	} else {
 		// Announce to the network that we have this content
 		// This uses DHT provider records - other peers can find us
-		if err := ds.dht.Provide(ds.ctx, c, true); err != nil {
+		err := ds.dht.Provide(ds.ctx, c, true)
+		if err != nil {
 			if ds.verbose {
 				fmt.Printf("Warning: Failed to provide content to DHT: %v\n", err)
 			}
@@ -97,12 +175,28 @@ func (ds *DistributedStorage) PutMessage(msg *StorageMessage) error {
 		} else if ds.verbose {
 			fmt.Printf("✓ Announced message to DHT network (CID: %s)\n", contentID[:12]+"...")
 		}
+
+		// Provider records expire; keep announcing it while the message lives
+		if ds.reprov != nil {
+			ds.reprov.Track(contentID, KindMessage, msg.TTL, err == nil)
+		}
 	}
 
 	// Store the actual data in DHT (optional - for redundancy)
-	// Note: This stores in DHT's datastore, not as provider records
-	key := fmt.Sprintf("/messages/%s", contentID)
-	if err := ds.dht.PutValue(ds.ctx, key, data); err != nil {
+	// Note: This stores in DHT's datastore, not as provider records. Only the
+	// author can sign the record, so messages relayed from others stay local
+	if msg.From != ds.host.ID().String() {
+		return nil
+	}
+	rec, err := NewSignedRecord(ds.host.Peerstore().PrivKey(ds.host.ID()), msg)
+	if err != nil {
+		return fmt.Errorf("failed to sign message: %w", err)
+	}
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("failed to marshal message: %w", err)
+	}
+	if err := ds.records.PutValue(ds.ctx, messageKey(contentID), data); err != nil {
 		if ds.verbose {
 			fmt.Printf("Warning: Failed to store in DHT datastore: %v\n", err)
 		}
@@ -114,38 +208,42 @@ func (ds *DistributedStorage) PutMessage(msg *StorageMessage) error {
 // GetMessage retrieves a message from the DHT network
 // It first checks local cache, then queries the network
 func (ds *DistributedStorage) GetMessage(contentID string) (*StorageMessage, error) {
-	// Check local cache first
-	if msg, exists := ds.cache[contentID]; exists {
-		// Check if expired
-		if time.Now().Unix() > msg.TTL {
-			delete(ds.cache, contentID)
-		} else {
-			return msg, nil
-		}
+	// Check local cache first; expired entries are dropped on lookup
+	if msg, ok := ds.cache.get(contentID, time.Now()); ok {
+		return msg, nil
 	}
 
-	// Query DHT network
-	key := fmt.Sprintf("/messages/%s", contentID)
-	data, err := ds.dht.GetValue(ds.ctx, key)
+	msg, err := ds.GetSignedMessage(contentID)
 	if err != nil {
-		return nil, fmt.Errorf("message not found in DHT: %w", err)
+		return nil, err
 	}
 
-	// Unmarshal the message
-	var msg StorageMessage
-	if err := json.Unmarshal(data, &msg); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal message: %w", err)
+	// Cache it locally
+	if err := ds.cache.put(contentID, msg); err != nil && ds.verbose {
+		fmt.Printf("Warning: Failed to persist cached message: %v\n", err)
 	}
 
-	// Check if expired
-	if time.Now().Unix() > msg.TTL {
-		return nil, fmt.Errorf("message expired")
-	}
+	return msg, nil
+}
 
-	// Cache it locally
-	ds.cache[contentID] = &msg
+// GetSignedMessage retrieves a message from its author's signed record in
+// the DHT, skipping the local cache, whose entries carry no signature
+func (ds *DistributedStorage) GetSignedMessage(contentID string) (*StorageMessage, error) {
+	key := messageKey(contentID)
+	data, err := ds.records.GetValue(ds.ctx, key)
+	if err != nil {
+		return nil, fmt.Errorf("message not found in DHT: %w", err)
+	}
 
-	return &msg, nil
+	// The DHT validated the record, but it may have expired since
+	rec, err := parseRecord(key, data)
+	if err != nil {
+		return nil, err
+	}
+	if err := rec.Verify(time.Now()); err != nil {
+		return nil, fmt.Errorf("invalid message record: %w", err)
+	}
+	return rec.Message, nil
 }
 
 // FindProviders finds peers that have a specific message
@@ -178,96 +276,103 @@ func (ds *DistributedStorage) FindProviders(contentID string, maxPeers int) ([]p
 // QueryRecentMessages queries the network for recent messages
 // This is a best-effort operation - not all messages may be found
 func (ds *DistributedStorage) QueryRecentMessages(limit int) ([]*StorageMessage, error) {
-	// Return messages from local cache
+	// Return messages from local cache, newest first
 	// In a real implementation, you would query specific content IDs
 	// or use a pub/sub topic to discover available messages
-
-	var messages []*StorageMessage
-	now := time.Now().Unix()
-
-	for _, msg := range ds.cache {
-		if now <= msg.TTL {
-			messages = append(messages, msg)
-			if len(messages) >= limit {
-				break
-			}
-		}
-	}
-
-	return messages, nil
+	return ds.cache.recent(limit, time.Now()), nil
 }
 
 // createContentID creates a unique content ID for a message
 // Uses multihash for content addressing (IPFS-style)
 func (ds *DistributedStorage) createContentID(msg *StorageMessage) (string, error) {
-	// Create a unique key from message content
-	key := fmt.Sprintf("%s:%d:%s", msg.From, msg.Timestamp, msg.Content)
-
-	// Create multihash
-	hash, err := mh.Sum([]byte(key), mh.SHA2_256, -1)
+	c, err := contentID(msg)
 	if err != nil {
 		return "", err
 	}
-
-	// Create CID (Content Identifier)
-	c := cid.NewCidV1(cid.Raw, hash)
-
 	return c.String(), nil
 }
 
+// contentID returns the CID of a message in its room's history DAG
+// The validator recomputes it to check records against their keys
+func contentID(msg *StorageMessage) (cid.Cid, error) {
+	return dag.CID(msg.Message(""))
+}
+
 // cleanupExpiredCache periodically removes expired messages from cache
 func (ds *DistributedStorage) cleanupExpiredCache() {
+	defer ds.wg.Done()
+
 	ticker := time.NewTicker(5 * time.Minute)
 	defer ticker.Stop()
 
 	for {
 		select {
 		case <-ticker.C:
-			now := time.Now().Unix()
-			removed := 0
-
-			for id, msg := range ds.cache {
-				if now > msg.TTL {
-					delete(ds.cache, id)
-					removed++
-				}
-			}
+			removed := ds.cache.purgeExpired(time.Now())
 
 			if ds.verbose && removed > 0 {
 				fmt.Printf("🗑️  Cleaned up %d expired messages from cache\n", removed)
 			}
 
+		case <-ds.done:
+			return
 		case <-ds.ctx.Done():
 			return
 		}
 	}
 }
 
-// GetCacheStats returns statistics about the local cache
-func (ds *DistributedStorage) GetCacheStats() map[string]interface{} {
-	now := time.Now().Unix()
-	active := 0
-	expired := 0
-
-	for _, msg := range ds.cache {
-		if now <= msg.TTL {
-			active++
-		} else {
-			expired++
+// ForgetMessages drops cached messages with the given chat message IDs and
+// stops re-announcing them
+// The janitor calls it to purge disappearing messages once they expire; the
+// cache is walked under its own lock, so it is safe alongside lookups
+func (ds *DistributedStorage) ForgetMessages(ids []string) int {
+	forget := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		forget[id] = true
+	}
+
+	var cids []string
+	removed := ds.cache.removeFunc(func(msg *StorageMessage) bool {
+		if msg.ID == "" || !forget[msg.ID] {
+			return false
 		}
+		if c, err := contentID(msg); err == nil {
+			cids = append(cids, c.String())
+		}
+		return true
+	})
+
+	// Stop announcing content we no longer hold
+	if ds.reprov != nil && len(cids) > 0 {
+		ds.reprov.Untrack(cids...)
 	}
+	return removed
+}
+
+// GetCacheStats returns statistics about the local cache
+func (ds *DistributedStorage) GetCacheStats() CacheStats {
+	return ds.cache.snapshot()
+}
 
-	return map[string]interface{}{
-		"total":   len(ds.cache),
-		"active":  active,
-		"expired": expired,
-		"maxTTL":  ds.maxTTL,
+// RoutingTableSizes returns how many peers the provider and record DHTs know
+func (ds *DistributedStorage) RoutingTableSizes() (providers, records int) {
+	switch r := ds.dht.(type) {
+	case *dht.IpfsDHT:
+		providers = r.RoutingTable().Size()
+	case interface{ RoutingTableSize() int }: // Bridged DHTs
+		providers = r.RoutingTableSize()
 	}
+	return providers, ds.records.RoutingTable().Size()
 }
 
-// Close cleans up resources
+// Close stops the cleanup goroutine and empties the in-memory cache
+// Persisted entries are kept for the next start
 func (ds *DistributedStorage) Close() error {
-	// Clear cache
-	ds.cache = nil
+	ds.closeOnce.Do(func() {
+		close(ds.done)
+		ds.wg.Wait()
+		ds.cache.clear()
+	})
 	return nil
 }
@@ -0,0 +1,228 @@
+package history
+
+import (
+	"crypto/sha256"
+	"math"
+	"sort"
+)
+
+const (
+	// branchFactor is how many sub-ranges a mismatching range is split into
+	branchFactor = 16
+	// idListThreshold is the largest range sent as a plain ID list
+	idListThreshold = 32
+)
+
+// Range modes
+const (
+	modeSkip        = "skip"        // Range already matches, nothing to do
+	modeFingerprint = "fingerprint" // Compare fingerprints, split on mismatch
+	modeIDs         = "ids"         // Full ID list; receiver answers with its own
+	modeIDsReply    = "ids-reply"   // Answer to an ID list; receiver just diffs
+)
+
+// Item is a message reference ordered by timestamp, then ID
+type Item struct {
+	Timestamp int64  `json:"ts"`
+	ID        string `json:"id"`
+}
+
+// less orders items by timestamp, then ID
+func (a Item) less(b Item) bool {
+	if a.Timestamp != b.Timestamp {
+		return a.Timestamp < b.Timestamp
+	}
+	return a.ID < b.ID
+}
+
+// maxBound is the exclusive upper bound of the whole keyspace
+var maxBound = Item{Timestamp: math.MaxInt64}
+
+// rangeMsg describes one range [previous upper, Upper) of the keyspace
+type rangeMsg struct {
+	Upper       Item     `json:"upper"`
+	Mode        string   `json:"mode"`
+	Fingerprint []byte   `json:"fp,omitempty"`
+	Count       int      `json:"count,omitempty"`
+	IDs         []string `json:"ids,omitempty"`
+}
+
+// reconciler runs range-based set reconciliation over a sorted item set
+// Both sides run the same reconciler; each round narrows mismatching ranges
+// until they are small enough to exchange as ID lists
+type reconciler struct {
+	items []Item // Sorted ascending
+	ids   map[string]bool
+
+	need map[string]bool // IDs the peer has and we lack
+	have map[string]bool // IDs we have and the peer lacks
+}
+
+// newReconciler creates a reconciler over items (sorted in place)
+func newReconciler(items []Item) *reconciler {
+	sort.Slice(items, func(i, j int) bool { return items[i].less(items[j]) })
+
+	ids := make(map[string]bool, len(items))
+	for _, it := range items {
+		ids[it.ID] = true
+	}
+
+	return &reconciler{
+		items: items,
+		ids:   ids,
+		need:  make(map[string]bool),
+		have:  make(map[string]bool),
+	}
+}
+
+// initial returns the opening ranges covering the whole keyspace
+func (r *reconciler) initial() []rangeMsg {
+	return r.split(Item{}, maxBound)
+}
+
+// process answers the peer's ranges and returns our next ranges
+// An empty result means every range has been resolved
+func (r *reconciler) process(in []rangeMsg) []rangeMsg {
+	var out []rangeMsg
+	lower := Item{}
+
+	for _, rm := range in {
+		upper := rm.Upper
+		local := r.slice(lower, upper)
+
+		switch rm.Mode {
+		case modeFingerprint:
+			if rm.Count == len(local) && string(rm.Fingerprint) == string(fingerprint(local)) {
+				out = append(out, rangeMsg{Upper: upper, Mode: modeSkip})
+			} else {
+				out = append(out, r.split(lower, upper)...)
+			}
+
+		case modeIDs:
+			r.diff(rm.IDs, local)
+			out = append(out, rangeMsg{Upper: upper, Mode: modeIDsReply, IDs: itemIDs(local)})
+
+		case modeIDsReply:
+			r.diff(rm.IDs, local)
+			out = append(out, rangeMsg{Upper: upper, Mode: modeSkip})
+
+		default:
+			out = append(out, rangeMsg{Upper: upper, Mode: modeSkip})
+		}
+
+		lower = upper
+	}
+
+	// Only skips left: the sets are reconciled
+	for _, rm := range out {
+		if rm.Mode != modeSkip {
+			return coalesce(out)
+		}
+	}
+	return nil
+}
+
+// split describes our items in [lower, upper) as ID lists or fingerprinted sub-ranges
+func (r *reconciler) split(lower, upper Item) []rangeMsg {
+	local := r.slice(lower, upper)
+
+	if len(local) <= idListThreshold {
+		return []rangeMsg{{Upper: upper, Mode: modeIDs, IDs: itemIDs(local)}}
+	}
+
+	var out []rangeMsg
+	chunk := (len(local) + branchFactor - 1) / branchFactor
+	for start := 0; start < len(local); start += chunk {
+		end := start + chunk
+		bound := upper
+		if end < len(local) {
+			bound = local[end]
+		} else {
+			end = len(local)
+		}
+		part := local[start:end]
+		out = append(out, rangeMsg{
+			Upper:       bound,
+			Mode:        modeFingerprint,
+			Fingerprint: fingerprint(part),
+			Count:       len(part),
+		})
+	}
+	return out
+}
+
+// slice returns our items in [lower, upper)
+func (r *reconciler) slice(lower, upper Item) []Item {
+	start := sort.Search(len(r.items), func(i int) bool { return !r.items[i].less(lower) })
+	end := sort.Search(len(r.items), func(i int) bool { return !r.items[i].less(upper) })
+	if end < start {
+		return nil
+	}
+	return r.items[start:end]
+}
+
+// diff records differences between the peer's IDs and ours for one range
+func (r *reconciler) diff(theirs []string, ours []Item) {
+	theirSet := make(map[string]bool, len(theirs))
+	for _, id := range theirs {
+		theirSet[id] = true
+		if !r.ids[id] {
+			r.need[id] = true
+		}
+	}
+	for _, it := range ours {
+		if !theirSet[it.ID] {
+			r.have[it.ID] = true
+		}
+	}
+}
+
+// needed returns IDs we should fetch from the peer
+func (r *reconciler) needed() []string {
+	return setKeys(r.need)
+}
+
+// fingerprint summarises a range as the XOR of its item hashes
+// XOR is order-independent, so both sides agree regardless of how items were inserted
+func fingerprint(items []Item) []byte {
+	fp := make([]byte, 16)
+	for _, it := range items {
+		sum := sha256.Sum256([]byte(it.ID))
+		for i := range fp {
+			fp[i] ^= sum[i]
+		}
+	}
+	return fp
+}
+
+// coalesce merges adjacent skip ranges to keep frames small
+func coalesce(ranges []rangeMsg) []rangeMsg {
+	var out []rangeMsg
+	for _, rm := range ranges {
+		if n := len(out); n > 0 && rm.Mode == modeSkip && out[n-1].Mode == modeSkip {
+			out[n-1].Upper = rm.Upper
+			continue
+		}
+		out = append(out, rm)
+	}
+	return out
+}
+
+// itemIDs returns the IDs of items
+func itemIDs(items []Item) []string {
+	ids := make([]string, len(items))
+	for i, it := range items {
+		ids[i] = it.ID
+	}
+	return ids
+}
+
+// setKeys returns the keys of a set, sorted
+func setKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
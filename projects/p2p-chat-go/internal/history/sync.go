@@ -0,0 +1,475 @@
+package history
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/geekp2p/p2p-chat-go/internal/messaging"
+	"github.com/geekp2p/p2p-chat-go/internal/storage"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+// ProtocolID is the stream protocol for history synchronisation
+const ProtocolID = protocol.ID("/p2p-chat/sync/1.0.0")
+
+const (
+	// maxRounds bounds the number of reconciliation round trips
+	maxRounds = 32
+	// syncTimeout bounds a whole sync session
+	syncTimeout = 60 * time.Second
+	// maxFutureSkew rejects synced messages stamped too far in the future
+	maxFutureSkew = 5 * time.Minute
+	// maxFrameSize bounds a single frame, so a peer cannot exhaust memory
+	maxFrameSize = 32 << 20
+)
+
+// Store is the part of the message store used by history sync
+type Store interface {
+	GetMessageRefs(room string, since int64) ([]storage.MessageRef, error)
+	GetMessagesByID(room string, ids []string) ([]*storage.Message, error)
+	ImportMessage(msg *storage.Message) (bool, error)
+}
+
+// Verifier checks the signed pubsub record of a synced message and returns
+// the message as its author published it
+type Verifier func(record []byte) (*messaging.Message, error)
+
+// frame is one message of a sync session
+// Frames with ranges belong to the reconciliation phase; a frame without
+// ranges ends it and starts the exchange of wanted messages
+type frame struct {
+	Room     string             `json:"room,omitempty"`
+	Since    int64              `json:"since,omitempty"`
+	Ranges   []rangeMsg         `json:"ranges,omitempty"`
+	Want     []string           `json:"want,omitempty"`
+	Messages []*storage.Message `json:"messages,omitempty"`
+	Error    string             `json:"error,omitempty"`
+}
+
+// Result summarises a sync session
+type Result struct {
+	Peer     peer.ID
+	Received []*storage.Message // Messages merged into our store, oldest first
+	Sent     int                // Messages sent to the peer
+	Rounds   int
+}
+
+// Service answers sync requests and syncs with peers on demand
+type Service struct {
+	ctx     context.Context
+	host    host.Host
+	store   Store
+	room    string
+	window  time.Duration
+	verbose bool
+
+	// verify authenticates synced messages; without it nothing is merged
+	verify Verifier
+	// retention is the room's retention policy; what it would delete is
+	// neither requested nor stored
+	retention storage.RetentionPolicy
+	// filter is a predicate synced messages must pass to be stored (optional)
+	filter func(msg *storage.Message) bool
+	// merged observes the messages stored by either side of a session (optional)
+	merged func(msgs []*storage.Message)
+}
+
+// NewService registers the sync protocol handler for a room
+// window limits reconciliation to messages newer than now-window
+func NewService(ctx context.Context, h host.Host, store Store, room string, window time.Duration, verbose bool) *Service {
+	s := &Service{
+		ctx:     ctx,
+		host:    h,
+		store:   store,
+		room:    room,
+		window:  window,
+		verbose: verbose,
+	}
+
+	h.SetStreamHandler(ProtocolID, s.handleStream)
+
+	return s
+}
+
+// SetVerifier sets how synced messages are authenticated
+// Only messages whose signed record passes the verifier are stored, so it
+// should also enforce the room's bans and mutes
+func (s *Service) SetVerifier(v Verifier) {
+	s.verify = v
+}
+
+// SetRetention sets the room's retention policy
+func (s *Service) SetRetention(p storage.RetentionPolicy) {
+	s.retention = p
+}
+
+// SetFilter sets a predicate synced messages must pass to be stored, such
+// as the room's bans and mutes as they stand now
+func (s *Service) SetFilter(f func(msg *storage.Message) bool) {
+	s.filter = f
+}
+
+// SetMergedFunc sets a callback that sees every batch of synced messages
+// stored, whichever side opened the session
+func (s *Service) SetMergedFunc(f func(msgs []*storage.Message)) {
+	s.merged = f
+}
+
+// Supports reports whether p speaks the sync protocol
+func (s *Service) Supports(p peer.ID) bool {
+	protos, err := s.host.Peerstore().SupportsProtocols(p, ProtocolID)
+	return err == nil && len(protos) > 0
+}
+
+// Sync reconciles our history with a peer and merges what we were missing
+func (s *Service) Sync(p peer.ID) (*Result, error) {
+	ctx, cancel := context.WithTimeout(s.ctx, syncTimeout)
+	defer cancel()
+
+	stream, err := s.host.NewStream(ctx, p, ProtocolID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open sync stream: %w", err)
+	}
+	defer stream.Close()
+	stream.SetDeadline(time.Now().Add(syncTimeout))
+
+	enc := json.NewEncoder(stream)
+	dec := newFrameReader(stream)
+
+	since := time.Now().Add(-s.window).Unix()
+	cutoff, err := s.retentionCutoff(time.Now())
+	if err != nil {
+		return nil, err
+	}
+	if cutoff > since {
+		since = cutoff
+	}
+	rec, err := s.reconciler(since)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &Result{Peer: p}
+
+	// Reconciliation phase
+	out := rec.initial()
+	for {
+		if result.Rounds >= maxRounds {
+			stream.Reset()
+			return nil, fmt.Errorf("reconciliation did not converge after %d rounds", maxRounds)
+		}
+		result.Rounds++
+
+		f := &frame{Ranges: out}
+		if result.Rounds == 1 {
+			f.Room = s.room
+			f.Since = since
+		}
+		if err := enc.Encode(f); err != nil {
+			return nil, fmt.Errorf("failed to send ranges: %w", err)
+		}
+		if len(out) == 0 {
+			break // We are done; the want request follows
+		}
+
+		in, err := dec.read()
+		if err != nil {
+			return nil, err
+		}
+		if len(in.Ranges) == 0 {
+			// Peer is done; close the phase with an empty range frame
+			if err := enc.Encode(&frame{}); err != nil {
+				return nil, fmt.Errorf("failed to end reconciliation: %w", err)
+			}
+			break
+		}
+		out = rec.process(in.Ranges)
+	}
+
+	// Exchange phase: ask for what we need, receive it plus the peer's wants
+	want := rec.needed()
+	if err := enc.Encode(&frame{Want: want}); err != nil {
+		return nil, fmt.Errorf("failed to send want: %w", err)
+	}
+	reply, err := dec.read()
+	if err != nil {
+		return nil, err
+	}
+	result.Received = s.merge(reply.Messages, want)
+
+	sent, err := s.store.GetMessagesByID(s.room, reply.Want)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load wanted messages: %w", err)
+	}
+	if err := enc.Encode(&frame{Messages: sent}); err != nil {
+		return nil, fmt.Errorf("failed to send messages: %w", err)
+	}
+	result.Sent = len(sent)
+
+	return result, nil
+}
+
+// handleStream answers a sync session opened by a peer
+func (s *Service) handleStream(stream network.Stream) {
+	defer stream.Close()
+	stream.SetDeadline(time.Now().Add(syncTimeout))
+
+	remote := stream.Conn().RemotePeer()
+	enc := json.NewEncoder(stream)
+	dec := newFrameReader(stream)
+
+	var rec *reconciler
+	for round := 0; ; round++ {
+		in, err := dec.read()
+		if err != nil {
+			if s.verbose {
+				fmt.Printf("Sync with %s aborted: %v\n", remote.ShortString(), err)
+			}
+			stream.Reset()
+			return
+		}
+
+		if rec == nil {
+			if in.Room != s.room {
+				enc.Encode(&frame{Error: fmt.Sprintf("room %q is not synced here", in.Room)})
+				return
+			}
+			rec, err = s.reconciler(in.Since)
+			if err != nil {
+				enc.Encode(&frame{Error: err.Error()})
+				return
+			}
+		}
+
+		if len(in.Ranges) == 0 {
+			// Reconciliation is over; the initiator follows an empty
+			// range frame with its want request
+			if in, err = dec.read(); err != nil {
+				stream.Reset()
+				return
+			}
+			s.answerWant(stream, enc, dec, rec, in.Want)
+			return
+		}
+
+		if round >= maxRounds {
+			enc.Encode(&frame{Error: "too many rounds"})
+			return
+		}
+
+		if err := enc.Encode(&frame{Ranges: rec.process(in.Ranges)}); err != nil {
+			stream.Reset()
+			return
+		}
+	}
+}
+
+// answerWant sends the messages a peer asked for and receives the ones we need
+func (s *Service) answerWant(stream network.Stream, enc *json.Encoder, dec *frameReader, rec *reconciler, want []string) {
+	remote := stream.Conn().RemotePeer()
+
+	msgs, err := s.store.GetMessagesByID(s.room, want)
+	if err != nil {
+		enc.Encode(&frame{Error: err.Error()})
+		return
+	}
+	needed := rec.needed()
+	if err := enc.Encode(&frame{Messages: msgs, Want: needed}); err != nil {
+		stream.Reset()
+		return
+	}
+
+	in, err := dec.read()
+	if err != nil {
+		stream.Reset()
+		return
+	}
+	received := s.merge(in.Messages, needed)
+	if s.verbose && (len(received) > 0 || len(msgs) > 0) {
+		fmt.Printf("Sync with %s: sent %d, received %d message(s)\n", remote.ShortString(), len(msgs), len(received))
+	}
+}
+
+// reconciler builds a reconciler over our messages newer than since
+func (s *Service) reconciler(since int64) (*reconciler, error) {
+	refs, err := s.store.GetMessageRefs(s.room, since)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list messages: %w", err)
+	}
+
+	items := make([]Item, 0, len(refs))
+	for _, ref := range refs {
+		items = append(items, Item{Timestamp: ref.Timestamp, ID: ref.ID})
+	}
+	return newReconciler(items), nil
+}
+
+// retentionCutoff returns the timestamp of the oldest message the room's
+// retention policy lets us keep; older ones would only be deleted again
+func (s *Service) retentionCutoff(now time.Time) (int64, error) {
+	var cutoff int64
+	if s.retention.MaxAge > 0 {
+		cutoff = now.Add(-s.retention.MaxAge).Unix()
+	}
+	if s.retention.MaxCount > 0 {
+		refs, err := s.store.GetMessageRefs(s.room, cutoff)
+		if err != nil {
+			return 0, fmt.Errorf("failed to list messages: %w", err)
+		}
+		// Refs are oldest first; anything older than the newest MaxCount goes
+		if n := len(refs); n >= s.retention.MaxCount && refs[n-s.retention.MaxCount].Timestamp > cutoff {
+			cutoff = refs[n-s.retention.MaxCount].Timestamp
+		}
+	}
+	return cutoff, nil
+}
+
+// merge stores the synced messages we asked for and returns those that were
+// accepted
+// Only the author's signed record is trusted; the fields the peer sent
+// alongside it are discarded
+func (s *Service) merge(msgs []*storage.Message, want []string) []*storage.Message {
+	if s.verify == nil {
+		return nil
+	}
+
+	wanted := make(map[string]bool, len(want))
+	for _, id := range want {
+		wanted[id] = true
+	}
+
+	now := time.Now()
+	cutoff, err := s.retentionCutoff(now)
+	if err != nil {
+		if s.verbose {
+			fmt.Printf("Sync: %v\n", err)
+		}
+		return nil
+	}
+
+	var merged []*storage.Message
+	for _, synced := range msgs {
+		if synced == nil || !wanted[synced.ID] || len(synced.Record) == 0 {
+			continue
+		}
+		delete(wanted, synced.ID) // Each wanted ID is accepted once
+
+		msg, err := s.verifyRecord(synced)
+		if err != nil {
+			if s.verbose {
+				fmt.Printf("Sync: dropping message %s: %v\n", synced.ID, err)
+			}
+			continue
+		}
+		if !s.admits(msg, now, cutoff) {
+			continue
+		}
+
+		stored, err := s.store.ImportMessage(msg)
+		if err != nil {
+			if s.verbose {
+				fmt.Printf("Sync: failed to save message %s: %v\n", msg.ID, err)
+			}
+			continue
+		}
+		if stored {
+			merged = append(merged, msg)
+		}
+	}
+	if s.merged != nil && len(merged) > 0 {
+		s.merged(merged)
+	}
+	return merged
+}
+
+// Admits reports whether an authenticated message may be stored in the room
+// It applies the same checks as sync, for messages recovered by other means
+func (s *Service) Admits(msg *storage.Message) bool {
+	now := time.Now()
+	cutoff, err := s.retentionCutoff(now)
+	if err != nil {
+		return false
+	}
+	return s.admits(msg, now, cutoff)
+}
+
+// admits checks a message against the room's filter, retention cutoff and
+// expiry, and rejects types that are not chat history
+func (s *Service) admits(msg *storage.Message, now time.Time, cutoff int64) bool {
+	if msg.Timestamp > now.Add(maxFutureSkew).Unix() || msg.Timestamp < cutoff {
+		return false
+	}
+	if msg.Expires != 0 && msg.Expires <= now.Unix() {
+		return false
+	}
+	switch msg.Type {
+	case "message", "join", "leave":
+	default:
+		return false
+	}
+	return s.filter == nil || s.filter(msg)
+}
+
+// verifyRecord authenticates a synced message and returns it rebuilt from
+// its signed record
+func (s *Service) verifyRecord(synced *storage.Message) (*storage.Message, error) {
+	msg, err := s.verify(synced.Record)
+	if err != nil {
+		return nil, err
+	}
+	if msg.ID != synced.ID {
+		return nil, fmt.Errorf("record carries message %s", msg.ID)
+	}
+	return &storage.Message{
+		ID:        msg.ID,
+		Type:      msg.Type,
+		Content:   msg.Content,
+		Username:  msg.Username,
+		Timestamp: msg.Timestamp,
+		From:      msg.From,
+		Room:      s.room,
+		Thread:    msg.Thread,
+		Expires:   msg.Expires,
+		Parents:   msg.Parents,
+		Record:    msg.Record,
+	}, nil
+}
+
+// frameReader decodes frames from a stream, each at most maxFrameSize bytes
+type frameReader struct {
+	limit *io.LimitedReader
+	dec   *json.Decoder
+}
+
+// newFrameReader reads frames from r
+func newFrameReader(r io.Reader) *frameReader {
+	limit := &io.LimitedReader{R: r, N: maxFrameSize}
+	return &frameReader{limit: limit, dec: json.NewDecoder(limit)}
+}
+
+// read decodes the next frame and surfaces remote errors
+func (fr *frameReader) read() (*frame, error) {
+	// The decoder may already hold the start of this frame
+	fr.limit.N = maxFrameSize
+	if buffered, ok := fr.dec.Buffered().(interface{ Len() int }); ok {
+		fr.limit.N -= int64(buffered.Len())
+	}
+
+	var f frame
+	if err := fr.dec.Decode(&f); err != nil {
+		if fr.limit.N <= 0 {
+			return nil, fmt.Errorf("sync frame exceeds %d bytes", maxFrameSize)
+		}
+		return nil, fmt.Errorf("failed to read sync frame: %w", err)
+	}
+	if f.Error != "" {
+		return nil, fmt.Errorf("peer error: %s", f.Error)
+	}
+	return &f, nil
+}
@@ -0,0 +1,222 @@
+package history
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/geekp2p/p2p-chat-go/internal/messaging"
+	"github.com/geekp2p/p2p-chat-go/internal/storage"
+)
+
+const testRoom = "test-room"
+
+// signer stands in for pubsub signatures: only records it signed verify
+type signer map[string]bool
+
+// sign returns the record of msg as its author would publish it
+func (s signer) sign(t *testing.T, msg *storage.Message) []byte {
+	t.Helper()
+	record, err := json.Marshal(&messaging.Message{
+		ID:        msg.ID,
+		Type:      msg.Type,
+		Content:   msg.Content,
+		Username:  msg.Username,
+		Timestamp: msg.Timestamp,
+		From:      msg.From,
+		Expires:   msg.Expires,
+	})
+	if err != nil {
+		t.Fatalf("failed to marshal record: %v", err)
+	}
+	s[string(record)] = true
+	return record
+}
+
+// verify is a Verifier that accepts the records s signed
+func (s signer) verify(record []byte) (*messaging.Message, error) {
+	if !s[string(record)] {
+		return nil, errors.New("invalid record signature")
+	}
+	var msg messaging.Message
+	if err := json.Unmarshal(record, &msg); err != nil {
+		return nil, err
+	}
+	msg.Record = record
+	return &msg, nil
+}
+
+// signed returns a chat message by from, carrying its signed record
+func signed(t *testing.T, s signer, id, from string) *storage.Message {
+	t.Helper()
+	msg := &storage.Message{
+		ID:        id,
+		Type:      "message",
+		Content:   "content of " + id,
+		Username:  from,
+		Timestamp: time.Now().Unix(),
+		From:      from,
+		Room:      testRoom,
+	}
+	msg.Record = s.sign(t, msg)
+	return msg
+}
+
+// newService returns a sync service over an empty memory store
+func newService(s signer) (*Service, storage.Store) {
+	store := storage.NewMemoryStore()
+	return &Service{store: store, room: testRoom, verify: s.verify}, store
+}
+
+func TestMergeStoresSignedMessages(t *testing.T) {
+	s := signer{}
+	svc, store := newService(s)
+
+	msg := signed(t, s, "m1", "peer-alice")
+	merged := svc.merge([]*storage.Message{msg}, []string{"m1"})
+	if len(merged) != 1 {
+		t.Fatalf("merged %d message(s), want 1", len(merged))
+	}
+	if msgs, _ := store.GetMessagesByID(testRoom, []string{"m1"}); len(msgs) != 1 {
+		t.Error("message was not stored")
+	}
+}
+
+func TestMergeRejectsTamperedMessages(t *testing.T) {
+	tests := []struct {
+		name   string
+		tamper func(t *testing.T, s signer, msg *storage.Message)
+		want   []string // IDs asked for; defaults to the message's
+	}{
+		{
+			name:   "not asked for",
+			tamper: func(t *testing.T, s signer, msg *storage.Message) {},
+			want:   []string{"other"},
+		},
+		{
+			name: "no record",
+			tamper: func(t *testing.T, s signer, msg *storage.Message) {
+				msg.Record = nil
+			},
+		},
+		{
+			name: "unsigned record",
+			tamper: func(t *testing.T, s signer, msg *storage.Message) {
+				msg.Record, _ = json.Marshal(msg)
+			},
+		},
+		{
+			name: "record of another message",
+			tamper: func(t *testing.T, s signer, msg *storage.Message) {
+				msg.Record = signed(t, s, "other", msg.From).Record
+			},
+		},
+		{
+			name: "expired",
+			tamper: func(t *testing.T, s signer, msg *storage.Message) {
+				msg.Expires = time.Now().Add(-time.Minute).Unix()
+				msg.Record = s.sign(t, msg)
+			},
+		},
+		{
+			name: "stamped in the future",
+			tamper: func(t *testing.T, s signer, msg *storage.Message) {
+				msg.Timestamp = time.Now().Add(time.Hour).Unix()
+				msg.Record = s.sign(t, msg)
+			},
+		},
+		{
+			name: "by a banned author",
+			tamper: func(t *testing.T, s signer, msg *storage.Message) {
+				msg.From = "peer-banned"
+				msg.Record = s.sign(t, msg)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := signer{}
+			svc, store := newService(s)
+			svc.SetFilter(func(m *storage.Message) bool { return m.From != "peer-banned" })
+
+			msg := signed(t, s, "m1", "peer-alice")
+			tt.tamper(t, s, msg)
+			want := tt.want
+			if want == nil {
+				want = []string{msg.ID}
+			}
+
+			if merged := svc.merge([]*storage.Message{msg}, want); len(merged) != 0 {
+				t.Fatalf("merged %d tampered message(s)", len(merged))
+			}
+			if msgs, _ := store.GetMessagesByID(testRoom, []string{"m1"}); len(msgs) != 0 {
+				t.Error("tampered message was stored")
+			}
+		})
+	}
+}
+
+func TestMergeKeepsOnlyTheSignedContent(t *testing.T) {
+	s := signer{}
+	svc, store := newService(s)
+
+	msg := signed(t, s, "m1", "peer-alice")
+	msg.Content = "words alice never said"
+	msg.Username = "mallory"
+
+	if merged := svc.merge([]*storage.Message{msg}, []string{"m1"}); len(merged) != 1 {
+		t.Fatalf("merged %d message(s), want 1", len(merged))
+	}
+	msgs, err := store.GetMessagesByID(testRoom, []string{"m1"})
+	if err != nil || len(msgs) != 1 {
+		t.Fatalf("GetMessagesByID: %v", err)
+	}
+	if msgs[0].Content != "content of m1" || msgs[0].Username != "peer-alice" {
+		t.Errorf("stored %q by %q, want the signed content", msgs[0].Content, msgs[0].Username)
+	}
+}
+
+func TestMergeFollowsRetention(t *testing.T) {
+	s := signer{}
+	svc, _ := newService(s)
+	svc.SetRetention(storage.RetentionPolicy{MaxAge: time.Hour})
+
+	old := signed(t, s, "old", "peer-alice")
+	old.Timestamp = time.Now().Add(-2 * time.Hour).Unix()
+	old.Record = s.sign(t, old)
+	recent := signed(t, s, "recent", "peer-alice")
+
+	merged := svc.merge([]*storage.Message{old, recent}, []string{"old", "recent"})
+	if len(merged) != 1 || merged[0].ID != "recent" {
+		t.Errorf("merged %d message(s), want only the recent one", len(merged))
+	}
+}
+
+func TestFrameReaderLimitsFrameSize(t *testing.T) {
+	var buf bytes.Buffer
+	buf.WriteString(`{"room":"a"}` + "\n")
+	buf.WriteString(`{"room":"` + strings.Repeat("x", maxFrameSize-100) + `"}` + "\n")
+	buf.WriteString(`{"room":"` + strings.Repeat("x", maxFrameSize) + `"}`)
+
+	fr := newFrameReader(&buf)
+	if f, err := fr.read(); err != nil || f.Room != "a" {
+		t.Fatalf("read small frame: %v", err)
+	}
+	if _, err := fr.read(); err != nil {
+		t.Fatalf("read frame under the limit: %v", err)
+	}
+	if _, err := fr.read(); err == nil {
+		t.Error("read a frame over the limit")
+	}
+}
+
+func TestFrameReaderSurfacesPeerErrors(t *testing.T) {
+	fr := newFrameReader(strings.NewReader(`{"error":"room is not synced here"}`))
+	if _, err := fr.read(); err == nil || !strings.Contains(err.Error(), "not synced") {
+		t.Errorf("err = %v, want the peer's error", err)
+	}
+}
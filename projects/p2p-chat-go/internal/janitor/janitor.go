@@ -0,0 +1,216 @@
+package janitor
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/geekp2p/p2p-chat-go/internal/storage"
+)
+
+// DefaultInterval is how often the janitor runs by default
+const DefaultInterval = 30 * time.Second
+
+// Retention and value log GC are heavier and run less often
+const (
+	RetentionInterval = 10 * time.Minute
+	GCInterval        = 10 * time.Minute
+)
+
+// Store is the part of the message store the janitor cleans
+type Store interface {
+	PurgeExpiredMessages(now time.Time) ([]string, error)
+	ApplyRetention(r storage.Retention, now time.Time) (int, error)
+	CollectGarbage() (int, error)
+}
+
+// Stats summarises what the janitor has done since it started
+type Stats struct {
+	Expired       int       // Disappearing messages purged
+	Retained      int       // Messages deleted by retention policies
+	GCRewrites    int       // Value log files rewritten
+	LastRetention time.Time // Zero if retention has not run yet
+	LastGC        time.Time
+}
+
+// Cache is a secondary copy of messages that must be purged as well
+type Cache interface {
+	ForgetMessages(ids []string) int
+}
+
+// Queue holds unsent messages that must be dropped once they expire
+type Queue interface {
+	DropExpired(now time.Time) (int, error)
+}
+
+// Janitor deletes disappearing messages from every local copy once they expire
+type Janitor struct {
+	ctx      context.Context
+	store    Store
+	caches   []Cache
+	queues   []Queue
+	interval time.Duration
+	verbose  bool
+
+	mu        sync.Mutex
+	retention storage.Retention
+	stats     Stats
+}
+
+// New creates a janitor; call Start to run it in the background
+func New(ctx context.Context, store Store, interval time.Duration, verbose bool) *Janitor {
+	if interval <= 0 {
+		interval = DefaultInterval
+	}
+	return &Janitor{
+		ctx:      ctx,
+		store:    store,
+		interval: interval,
+		verbose:  verbose,
+	}
+}
+
+// AddCache registers a cache to purge alongside the store
+// Caches and queues must be added before Start
+func (j *Janitor) AddCache(c Cache) {
+	j.caches = append(j.caches, c)
+}
+
+// AddQueue registers a queue of unsent messages to purge alongside the store
+func (j *Janitor) AddQueue(q Queue) {
+	j.queues = append(j.queues, q)
+}
+
+// SetRetention sets the retention policies enforced from now on
+func (j *Janitor) SetRetention(r storage.Retention) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.retention = r
+}
+
+// Retention returns the retention policies being enforced
+func (j *Janitor) Retention() storage.Retention {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.retention
+}
+
+// Stats returns what the janitor has done so far
+func (j *Janitor) Stats() Stats {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.stats
+}
+
+// Start runs the janitor until the context is cancelled
+func (j *Janitor) Start() {
+	go func() {
+		// Purge anything that expired or aged out while we were offline
+		j.RunOnce()
+		j.EnforceRetention()
+
+		ticker := time.NewTicker(j.interval)
+		defer ticker.Stop()
+		retentionTicker := time.NewTicker(RetentionInterval)
+		defer retentionTicker.Stop()
+		gcTicker := time.NewTicker(GCInterval)
+		defer gcTicker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				j.RunOnce()
+			case <-retentionTicker.C:
+				j.EnforceRetention()
+			case <-gcTicker.C:
+				j.CollectGarbage()
+			case <-j.ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// EnforceRetention deletes messages the retention policies no longer allow
+// and returns how many were removed
+func (j *Janitor) EnforceRetention() int {
+	deleted, err := j.store.ApplyRetention(j.Retention(), time.Now())
+
+	j.mu.Lock()
+	j.stats.Retained += deleted
+	j.stats.LastRetention = time.Now()
+	j.mu.Unlock()
+
+	if err != nil {
+		if j.verbose {
+			fmt.Printf("Janitor: failed to apply retention: %v\n", err)
+		}
+		return deleted
+	}
+	if deleted > 0 && j.verbose {
+		fmt.Printf("🗑️  Retention removed %d old message(s)\n", deleted)
+	}
+	return deleted
+}
+
+// CollectGarbage reclaims disk space held by deleted messages
+// It returns the number of value log files rewritten
+func (j *Janitor) CollectGarbage() int {
+	rewritten, err := j.store.CollectGarbage()
+
+	j.mu.Lock()
+	j.stats.GCRewrites += rewritten
+	j.stats.LastGC = time.Now()
+	j.mu.Unlock()
+
+	if err != nil {
+		if j.verbose {
+			fmt.Printf("Janitor: value log GC failed: %v\n", err)
+		}
+		return rewritten
+	}
+	if rewritten > 0 && j.verbose {
+		fmt.Printf("🧹 Value log GC rewrote %d file(s)\n", rewritten)
+	}
+	return rewritten
+}
+
+// RunOnce purges expired messages and returns how many were removed
+func (j *Janitor) RunOnce() int {
+	now := time.Now()
+	purged := 0
+
+	ids, err := j.store.PurgeExpiredMessages(now)
+	if err != nil {
+		if j.verbose {
+			fmt.Printf("Janitor: failed to purge expired messages: %v\n", err)
+		}
+	} else if len(ids) > 0 {
+		for _, c := range j.caches {
+			c.ForgetMessages(ids)
+		}
+		purged += len(ids)
+	}
+
+	for _, q := range j.queues {
+		dropped, err := q.DropExpired(now)
+		if err != nil && j.verbose {
+			fmt.Printf("Janitor: failed to drop expired queued messages: %v\n", err)
+		}
+		purged += dropped
+	}
+
+	if purged == 0 {
+		return 0
+	}
+
+	j.mu.Lock()
+	j.stats.Expired += purged
+	j.mu.Unlock()
+
+	if j.verbose {
+		fmt.Printf("🗑️  Purged %d disappearing message(s)\n", purged)
+	}
+	return purged
+}
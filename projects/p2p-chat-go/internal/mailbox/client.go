@@ -0,0 +1,272 @@
+package mailbox
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/geekp2p/p2p-chat-go/internal/messaging"
+	"github.com/libp2p/go-libp2p/core/event"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// joinWait bounds how long a new mailbox peer has to show up on the room's
+// topic; servers only register peers they see there
+const joinWait = 10 * time.Second
+
+// DeliverFunc receives messages drained from a mailbox, oldest first
+type DeliverFunc func(from peer.ID, msgs []*messaging.Message)
+
+// Client registers this node with mailbox peers and drains held messages
+type Client struct {
+	ctx       context.Context
+	host      host.Host
+	messaging *messaging.P2PMessaging // Verifies drained records
+	room      string
+	pub       *[32]byte
+	secret    *[32]byte
+	verbose   bool
+
+	deliver DeliverFunc
+
+	mu        sync.Mutex
+	mailboxes map[peer.ID]time.Time // Mailbox peers and when we last drained them
+	syncing   map[peer.ID]bool
+}
+
+// NewClient creates a mailbox client for a room
+// Drained messages are delivered only if msg accepts them, as it would on the topic
+func NewClient(ctx context.Context, h host.Host, msg *messaging.P2PMessaging, room string, verbose bool) (*Client, error) {
+	priv := h.Peerstore().PrivKey(h.ID())
+	if priv == nil {
+		return nil, fmt.Errorf("no private key for local peer")
+	}
+
+	pub, secret, err := boxKeys(priv)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive mailbox key: %w", err)
+	}
+
+	return &Client{
+		ctx:       ctx,
+		host:      h,
+		messaging: msg,
+		room:      room,
+		pub:       pub,
+		secret:    secret,
+		verbose:   verbose,
+		mailboxes: make(map[peer.ID]time.Time),
+		syncing:   make(map[peer.ID]bool),
+	}, nil
+}
+
+// SetDeliverFunc sets the callback for drained messages
+func (c *Client) SetDeliverFunc(f DeliverFunc) {
+	c.deliver = f
+}
+
+// Start watches for mailbox peers and drains them as they connect
+func (c *Client) Start() error {
+	sub, err := c.host.EventBus().Subscribe(new(event.EvtPeerIdentificationCompleted))
+	if err != nil {
+		return fmt.Errorf("failed to subscribe to identify events: %w", err)
+	}
+
+	// Peers identified before we subscribed
+	for _, p := range c.host.Network().Peers() {
+		if c.isMailbox(p) {
+			go c.syncPeer(p)
+		}
+	}
+
+	go func() {
+		defer sub.Close()
+
+		// Re-register periodically so memberships do not expire
+		ticker := time.NewTicker(10 * time.Minute)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case e, ok := <-sub.Out():
+				if !ok {
+					return
+				}
+				p := e.(event.EvtPeerIdentificationCompleted).Peer
+				if c.isMailbox(p) {
+					go c.syncPeer(p)
+				}
+			case <-ticker.C:
+				for _, p := range c.host.Network().Peers() {
+					if c.isMailbox(p) {
+						go c.syncPeer(p)
+					}
+				}
+			case <-c.ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+// isMailbox reports whether p serves the mailbox protocol
+func (c *Client) isMailbox(p peer.ID) bool {
+	if p == c.host.ID() {
+		return false
+	}
+	protos, err := c.host.Peerstore().SupportsProtocols(p, ProtocolID)
+	return err == nil && len(protos) > 0
+}
+
+// syncPeer drains a mailbox peer, skipping it if a drain is already running
+func (c *Client) syncPeer(p peer.ID) {
+	c.mu.Lock()
+	if c.syncing[p] {
+		c.mu.Unlock()
+		return
+	}
+	c.syncing[p] = true
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		delete(c.syncing, p)
+		c.mu.Unlock()
+	}()
+
+	if !c.waitForTopicPeer(p) {
+		return
+	}
+
+	if _, err := c.Sync(p); err != nil && c.verbose {
+		fmt.Printf("Mailbox sync with %s failed: %v\n", p.ShortString(), err)
+	}
+}
+
+// waitForTopicPeer waits until p is subscribed to the room's topic
+// Subscriptions are exchanged when peers connect, so once we see p's the
+// mailbox has usually seen ours. It returns false if p never joins the room
+func (c *Client) waitForTopicPeer(p peer.ID) bool {
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+	timeout := time.NewTimer(joinWait)
+	defer timeout.Stop()
+
+	for {
+		for _, member := range c.messaging.GetTopicPeers() {
+			if member == p {
+				return true
+			}
+		}
+		select {
+		case <-ticker.C:
+		case <-timeout.C:
+			return false
+		case <-c.ctx.Done():
+			return false
+		}
+	}
+}
+
+// Sync registers with a mailbox peer and drains the messages it holds for us
+// It returns the number of messages delivered
+func (c *Client) Sync(p peer.ID) (int, error) {
+	ctx, cancel := context.WithTimeout(c.ctx, streamTimeout)
+	defer cancel()
+
+	stream, err := c.host.NewStream(ctx, p, ProtocolID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open stream: %w", err)
+	}
+	defer stream.Close()
+	stream.SetDeadline(time.Now().Add(streamTimeout))
+
+	enc := json.NewEncoder(stream)
+	dec := json.NewDecoder(stream)
+
+	call := func(req *request) (*response, error) {
+		if err := enc.Encode(req); err != nil {
+			return nil, fmt.Errorf("failed to send %s: %w", req.Op, err)
+		}
+		var resp response
+		if err := dec.Decode(&resp); err != nil {
+			return nil, fmt.Errorf("failed to read %s response: %w", req.Op, err)
+		}
+		if !resp.OK {
+			return nil, fmt.Errorf("%s rejected: %s", req.Op, resp.Error)
+		}
+		return &resp, nil
+	}
+
+	if _, err := call(&request{Op: opRegister, Room: c.room, BoxKey: c.pub[:]}); err != nil {
+		return 0, err
+	}
+
+	resp, err := call(&request{Op: opFetch})
+	if err != nil {
+		return 0, err
+	}
+
+	var msgs []*messaging.Message
+	var ids []string
+	for _, env := range resp.Envelopes {
+		ids = append(ids, env.ID)
+		if env.Room != c.room {
+			continue
+		}
+		var msg *messaging.Message
+		record, err := open(env, c.pub, c.secret)
+		if err == nil {
+			msg, err = c.messaging.VerifyRecord(record)
+		}
+		if err != nil {
+			if c.verbose {
+				fmt.Printf("Mailbox: dropping envelope %s: %v\n", env.ID, err)
+			}
+			continue
+		}
+		if msg.Expired(time.Now()) {
+			continue
+		}
+		msgs = append(msgs, msg)
+	}
+
+	sort.Slice(msgs, func(i, j int) bool {
+		return msgs[i].Timestamp < msgs[j].Timestamp
+	})
+
+	if len(msgs) > 0 && c.deliver != nil {
+		c.deliver(p, msgs)
+	}
+
+	// Only acknowledge after the messages were handed over
+	if len(ids) > 0 {
+		if _, err := call(&request{Op: opAck, IDs: ids}); err != nil {
+			return len(msgs), err
+		}
+	}
+
+	c.mu.Lock()
+	c.mailboxes[p] = time.Now()
+	c.mu.Unlock()
+
+	return len(msgs), nil
+}
+
+// Mailboxes returns the mailbox peers we have synced with and when
+func (c *Client) Mailboxes() map[peer.ID]time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	out := make(map[peer.ID]time.Time, len(c.mailboxes))
+	for p, t := range c.mailboxes {
+		out[p] = t
+	}
+	return out
+}
@@ -0,0 +1,94 @@
+package mailbox
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	"golang.org/x/crypto/nacl/box"
+)
+
+// ProtocolID is the stream protocol spoken between mailbox clients and servers
+const ProtocolID = protocol.ID("/p2p-chat/mailbox/1.0.0")
+
+// Request operations
+const (
+	opRegister = "register" // Become a member of the room's mailbox
+	opFetch    = "fetch"    // List envelopes held for the caller
+	opAck      = "ack"      // Delete envelopes the caller has stored
+)
+
+// Envelope is a message held for an offline recipient
+// It seals the signed pubsub record of the message to the recipient's box
+// key, so it is only readable by the recipient while it sits on the
+// mailbox's disk. The mailbox cannot forge it: the recipient checks the
+// author's signature and runs the room's validators before delivering it
+type Envelope struct {
+	ID        string `json:"id"`
+	Room      string `json:"room"`
+	Recipient string `json:"recipient"`
+	Stored    int64  `json:"stored"`
+	Sealed    []byte `json:"sealed"`
+}
+
+// Member is a recipient registered with a mailbox
+type Member struct {
+	Peer     string `json:"peer"`
+	Room     string `json:"room"`
+	BoxKey   []byte `json:"box_key"`
+	LastSeen int64  `json:"last_seen"`
+}
+
+// request is sent by clients over a mailbox stream
+type request struct {
+	Op     string   `json:"op"`
+	Room   string   `json:"room,omitempty"`
+	BoxKey []byte   `json:"box_key,omitempty"`
+	IDs    []string `json:"ids,omitempty"`
+}
+
+// response is returned by servers for every request
+type response struct {
+	OK        bool        `json:"ok"`
+	Error     string      `json:"error,omitempty"`
+	Envelopes []*Envelope `json:"envelopes,omitempty"`
+}
+
+// boxKeys derives this node's mailbox encryption key pair from its identity
+// The derivation is deterministic so the key survives restarts with the identity
+func boxKeys(priv crypto.PrivKey) (pub, secret *[32]byte, err error) {
+	raw, err := priv.Raw()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read identity key: %w", err)
+	}
+
+	hash := sha256.New()
+	hash.Write(raw)
+	hash.Write([]byte("p2p-chat-mailbox-box-key-v1")) // Domain separation
+	seed := hash.Sum(nil)
+
+	return box.GenerateKey(bytes.NewReader(seed))
+}
+
+// seal encrypts a signed message record to a recipient's box key
+func seal(record []byte, recipientKey []byte) ([]byte, error) {
+	if len(recipientKey) != 32 {
+		return nil, fmt.Errorf("invalid box key length %d", len(recipientKey))
+	}
+	var key [32]byte
+	copy(key[:], recipientKey)
+
+	return box.SealAnonymous(nil, record, &key, rand.Reader)
+}
+
+// open decrypts an envelope addressed to us and returns the signed record
+func open(env *Envelope, pub, secret *[32]byte) ([]byte, error) {
+	record, ok := box.OpenAnonymous(nil, env.Sealed, pub, secret)
+	if !ok {
+		return nil, fmt.Errorf("failed to decrypt envelope %s", env.ID)
+	}
+	return record, nil
+}
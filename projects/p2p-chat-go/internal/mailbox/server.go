@@ -0,0 +1,394 @@
+package mailbox
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/geekp2p/p2p-chat-go/internal/messaging"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// streamTimeout bounds a whole mailbox exchange
+const streamTimeout = 30 * time.Second
+
+// Store persists mailbox members and held envelopes
+type Store interface {
+	PutMailboxEnvelope(recipient, id string, data []byte, ttl time.Duration) error
+	GetMailboxEnvelopes(recipient string) ([][]byte, error)
+	DeleteMailboxEnvelopes(recipient string, ids []string) error
+	SaveMailboxMember(room, peerID string, data []byte, ttl time.Duration) error
+	GetMailboxMembers(room string) ([][]byte, error)
+}
+
+// Config controls how much a mailbox holds and for how long
+type Config struct {
+	// TTL is how long an envelope is held before it is dropped
+	TTL time.Duration
+	// MaxMessages is the per-recipient message quota
+	MaxMessages int
+	// MaxBytes is the per-recipient storage quota
+	MaxBytes int64
+	// MaxTotalBytes caps what is held for all recipients together
+	MaxTotalBytes int64
+	// MemberTTL is how long a registration lasts without being refreshed
+	MemberTTL time.Duration
+}
+
+// DefaultConfig returns default mailbox configuration
+func DefaultConfig() *Config {
+	return &Config{
+		TTL:           7 * 24 * time.Hour,
+		MaxMessages:   1000,
+		MaxBytes:      10 * 1024 * 1024,  // 10 MB
+		MaxTotalBytes: 256 * 1024 * 1024, // 256 MB
+		MemberTTL:     30 * 24 * time.Hour,
+	}
+}
+
+// Server holds encrypted room messages for registered members while they are offline
+type Server struct {
+	ctx       context.Context
+	host      host.Host
+	messaging *messaging.P2PMessaging
+	store     Store
+	room      string
+	config    *Config
+	verbose   bool
+
+	allow func(p peer.ID) bool // Optional: peers that may use the mailbox
+
+	holdLock  sync.Mutex // Serialises quota checks with the writes they allow
+	statsLock sync.Mutex
+	held      int // Envelopes stored since start
+	dropped   int // Envelopes refused because of quota
+}
+
+// NewServer starts a mailbox server for a room
+func NewServer(ctx context.Context, h host.Host, msg *messaging.P2PMessaging, store Store, room string, config *Config, verbose bool) *Server {
+	if config == nil {
+		config = DefaultConfig()
+	}
+
+	s := &Server{
+		ctx:       ctx,
+		host:      h,
+		messaging: msg,
+		store:     store,
+		room:      room,
+		config:    config,
+		verbose:   verbose,
+	}
+
+	h.SetStreamHandler(ProtocolID, s.handleStream)
+	msg.AddHandler(func(m *messaging.Message) {
+		go s.deposit(m)
+	})
+
+	return s
+}
+
+// SetMemberFilter sets a predicate peers must pass to register, fetch and
+// have messages held, such as not being banned from the room
+func (s *Server) SetMemberFilter(f func(p peer.ID) bool) {
+	s.allow = f
+}
+
+// allowed reports whether p may use the mailbox
+func (s *Server) allowed(p peer.ID) bool {
+	return s.allow == nil || s.allow(p)
+}
+
+// subscribed reports whether p has joined the room's topic
+func (s *Server) subscribed(p peer.ID) bool {
+	for _, member := range s.messaging.GetTopicPeers() {
+		if member == p {
+			return true
+		}
+	}
+	return false
+}
+
+// deposit seals a room message for every registered member that is offline
+func (s *Server) deposit(msg *messaging.Message) {
+	switch msg.Type {
+	case "message", "join", "leave":
+	default:
+		return
+	}
+	if msg.ID == "" {
+		return
+	}
+
+	members, err := s.members()
+	if err != nil {
+		if s.verbose {
+			fmt.Printf("Mailbox: failed to load members: %v\n", err)
+		}
+		return
+	}
+
+	online := make(map[peer.ID]bool)
+	for _, p := range s.messaging.GetTopicPeers() {
+		online[p] = true
+	}
+
+	// Quotas are checked against what is on disk, so concurrent deposits
+	// must not both pass the check before either one writes
+	s.holdLock.Lock()
+	defer s.holdLock.Unlock()
+
+	total, err := s.totalUsage(members)
+	if err != nil {
+		if s.verbose {
+			fmt.Printf("Mailbox: failed to measure usage: %v\n", err)
+		}
+		return
+	}
+
+	for _, member := range members {
+		id, err := peer.Decode(member.Peer)
+		if err != nil || id == s.host.ID() || member.Peer == msg.From || online[id] || !s.allowed(id) {
+			continue
+		}
+
+		written, err := s.hold(member, msg, total)
+		if err != nil {
+			s.statsLock.Lock()
+			s.dropped++
+			s.statsLock.Unlock()
+			if s.verbose {
+				fmt.Printf("Mailbox: not holding message for %s: %v\n", id.ShortString(), err)
+			}
+			continue
+		}
+
+		total += written
+
+		s.statsLock.Lock()
+		s.held++
+		s.statsLock.Unlock()
+	}
+}
+
+// hold stores a sealed copy of the record of msg for member, enforcing the
+// member's quota and the cap on total, the bytes held for everyone
+// It returns the number of bytes written; the caller holds holdLock
+func (s *Server) hold(member *Member, msg *messaging.Message, total int64) (int64, error) {
+	count, size, err := s.usage(member.Peer)
+	if err != nil {
+		return 0, err
+	}
+	if count >= s.config.MaxMessages || size >= s.config.MaxBytes {
+		return 0, fmt.Errorf("quota exceeded (%d messages, %d bytes)", count, size)
+	}
+
+	sealed, err := seal(msg.Record, member.BoxKey)
+	if err != nil {
+		return 0, err
+	}
+
+	env := &Envelope{
+		ID:        msg.ID,
+		Room:      s.room,
+		Recipient: member.Peer,
+		Stored:    time.Now().Unix(),
+		Sealed:    sealed,
+	}
+	data, err := json.Marshal(env)
+	if err != nil {
+		return 0, fmt.Errorf("failed to marshal envelope: %w", err)
+	}
+	if s.config.MaxTotalBytes > 0 && total+int64(len(data)) > s.config.MaxTotalBytes {
+		return 0, fmt.Errorf("mailbox full (%d bytes held)", total)
+	}
+
+	// Never hold a disappearing message longer than its sender allowed
+	ttl := s.config.TTL
+	if msg.Expires != 0 {
+		if remaining := time.Until(time.Unix(msg.Expires, 0)); remaining < ttl {
+			ttl = remaining
+		}
+		if ttl <= 0 {
+			return 0, nil
+		}
+	}
+
+	if err := s.store.PutMailboxEnvelope(member.Peer, env.ID, data, ttl); err != nil {
+		return 0, err
+	}
+	return int64(len(data)), nil
+}
+
+// totalUsage returns how many bytes are held for all members together
+func (s *Server) totalUsage(members []*Member) (int64, error) {
+	var total int64
+	for _, member := range members {
+		_, size, err := s.usage(member.Peer)
+		if err != nil {
+			return 0, err
+		}
+		total += size
+	}
+	return total, nil
+}
+
+// usage returns how many envelopes and bytes are held for a recipient
+func (s *Server) usage(recipient string) (int, int64, error) {
+	records, err := s.store.GetMailboxEnvelopes(recipient)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var size int64
+	for _, data := range records {
+		size += int64(len(data))
+	}
+	return len(records), size, nil
+}
+
+// members returns the registered members of the room
+func (s *Server) members() ([]*Member, error) {
+	records, err := s.store.GetMailboxMembers(s.room)
+	if err != nil {
+		return nil, err
+	}
+
+	members := make([]*Member, 0, len(records))
+	for _, data := range records {
+		var m Member
+		if err := json.Unmarshal(data, &m); err != nil || m.Room != s.room {
+			continue
+		}
+		members = append(members, &m)
+	}
+	return members, nil
+}
+
+// envelopes returns the envelopes held for a recipient
+func (s *Server) envelopes(recipient string) ([]*Envelope, error) {
+	records, err := s.store.GetMailboxEnvelopes(recipient)
+	if err != nil {
+		return nil, err
+	}
+
+	envs := make([]*Envelope, 0, len(records))
+	for _, data := range records {
+		var env Envelope
+		if err := json.Unmarshal(data, &env); err != nil {
+			continue
+		}
+		envs = append(envs, &env)
+	}
+	return envs, nil
+}
+
+// handleStream serves register, fetch and ack requests from one peer
+// The caller is identified by the authenticated remote peer of the stream,
+// so peers can only register themselves and drain their own mailbox
+func (s *Server) handleStream(stream network.Stream) {
+	defer stream.Close()
+	stream.SetDeadline(time.Now().Add(streamTimeout))
+
+	remote := stream.Conn().RemotePeer()
+	dec := json.NewDecoder(stream)
+	enc := json.NewEncoder(stream)
+
+	for {
+		var req request
+		if err := dec.Decode(&req); err != nil {
+			if err != io.EOF && s.verbose {
+				fmt.Printf("Mailbox: bad request from %s: %v\n", remote.ShortString(), err)
+			}
+			return
+		}
+
+		resp := s.handleRequest(remote, &req)
+		if err := enc.Encode(resp); err != nil {
+			stream.Reset()
+			return
+		}
+	}
+}
+
+// handleRequest executes a single mailbox request
+// Only peers that have joined the room may register, so the mailbox does not
+// hold messages for identities made up to fill its disk
+func (s *Server) handleRequest(remote peer.ID, req *request) *response {
+	if !s.allowed(remote) {
+		return &response{Error: "not allowed in this room"}
+	}
+
+	switch req.Op {
+	case opRegister:
+		if req.Room != s.room {
+			return &response{Error: fmt.Sprintf("room %q is not served here", req.Room)}
+		}
+		if !s.subscribed(remote) {
+			return &response{Error: "not a member of this room"}
+		}
+		if len(req.BoxKey) != 32 {
+			return &response{Error: "invalid box key"}
+		}
+		member := &Member{
+			Peer:     remote.String(),
+			Room:     s.room,
+			BoxKey:   req.BoxKey,
+			LastSeen: time.Now().Unix(),
+		}
+		data, err := json.Marshal(member)
+		if err != nil {
+			return &response{Error: err.Error()}
+		}
+		if err := s.store.SaveMailboxMember(s.room, member.Peer, data, s.config.MemberTTL); err != nil {
+			return &response{Error: err.Error()}
+		}
+		return &response{OK: true}
+
+	case opFetch:
+		envs, err := s.envelopes(remote.String())
+		if err != nil {
+			return &response{Error: err.Error()}
+		}
+		return &response{OK: true, Envelopes: envs}
+
+	case opAck:
+		if err := s.store.DeleteMailboxEnvelopes(remote.String(), req.IDs); err != nil {
+			return &response{Error: err.Error()}
+		}
+		return &response{OK: true}
+
+	default:
+		return &response{Error: fmt.Sprintf("unknown op %q", req.Op)}
+	}
+}
+
+// Stats returns the number of registered members and envelopes currently held,
+// plus the totals stored and refused since start
+func (s *Server) Stats() (members, waiting, held, dropped int) {
+	list, err := s.members()
+	if err == nil {
+		members = len(list)
+		for _, m := range list {
+			count, _, err := s.usage(m.Peer)
+			if err == nil {
+				waiting += count
+			}
+		}
+	}
+
+	s.statsLock.Lock()
+	defer s.statsLock.Unlock()
+	return members, waiting, s.held, s.dropped
+}
+
+// Close stops serving mailbox requests
+func (s *Server) Close() error {
+	s.host.RemoveStreamHandler(ProtocolID)
+	return nil
+}
@@ -2,23 +2,51 @@ package messaging
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"sync"
 	"time"
 
 	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	pb "github.com/libp2p/go-libp2p-pubsub/pb"
+	"github.com/libp2p/go-libp2p/core/crypto"
 	"github.com/libp2p/go-libp2p/core/peer"
 )
 
+// MaxParents bounds how many room heads a message may reference
+const MaxParents = 16
+
 // Message represents a chat message
 type Message struct {
-	Type      string `json:"type"`
-	Content   string `json:"content"`
-	Username  string `json:"username"`
-	Timestamp int64  `json:"timestamp"`
-	From      string `json:"from,omitempty"`
+	ID        string   `json:"id,omitempty"`
+	Type      string   `json:"type"`
+	Content   string   `json:"content"`
+	Username  string   `json:"username"`
+	Timestamp int64    `json:"timestamp"`
+	From      string   `json:"from,omitempty"`
+	Thread    string   `json:"thread,omitempty"`  // ID of the message this one replies to
+	Expires   int64    `json:"expires,omitempty"` // Unix time after which receivers must delete it
+	Parents   []string `json:"parents,omitempty"` // CIDs of the room heads the author had seen
+
+	// Record is the signed pubsub message that carried a delivered message;
+	// it can be relayed and checked with VerifyRecord
+	Record []byte `json:"-"`
 }
 
+// Expired reports whether a disappearing message has passed its expiry
+func (m *Message) Expired(now time.Time) bool {
+	return m.Expires != 0 && now.Unix() >= m.Expires
+}
+
+// Validator inspects an incoming message after its structure has been validated
+// author is the signed originator of the message, not the peer that forwarded it
+type Validator func(author peer.ID, msg *Message) pubsub.ValidationResult
+
+// Handler observes every message delivered on the topic, including our own
+type Handler func(msg *Message)
+
 // P2PMessaging handles pub/sub messaging
 type P2PMessaging struct {
 	ps           *pubsub.PubSub
@@ -26,12 +54,24 @@ type P2PMessaging struct {
 	subscription *pubsub.Subscription
 	ctx          context.Context
 	selfID       peer.ID
+
+	validators     []Validator
+	validatorsLock sync.RWMutex
+
+	handlers     []Handler
+	handlersLock sync.RWMutex
 }
 
 // NewP2PMessaging creates a new messaging instance
 func NewP2PMessaging(ctx context.Context, ps *pubsub.PubSub, topicName string, selfID peer.ID) (*P2PMessaging, error) {
+	m := &P2PMessaging{
+		ps:     ps,
+		ctx:    ctx,
+		selfID: selfID,
+	}
+
 	// Register a topic validator before joining
-	if err := ps.RegisterTopicValidator(topicName, messageValidator); err != nil {
+	if err := ps.RegisterTopicValidator(topicName, m.validate); err != nil {
 		return nil, fmt.Errorf("failed to register topic validator: %w", err)
 	}
 
@@ -47,50 +87,171 @@ func NewP2PMessaging(ctx context.Context, ps *pubsub.PubSub, topicName string, s
 		return nil, fmt.Errorf("failed to subscribe to topic: %w", err)
 	}
 
-	return &P2PMessaging{
-		ps:           ps,
-		topic:        topic,
-		subscription: sub,
-		ctx:          ctx,
-		selfID:       selfID,
-	}, nil
+	m.topic = topic
+	m.subscription = sub
+
+	return m, nil
+}
+
+// AddValidator registers an additional validator for incoming messages
+// Validators run in registration order; the first non-accept result wins
+func (m *P2PMessaging) AddValidator(v Validator) {
+	m.validatorsLock.Lock()
+	defer m.validatorsLock.Unlock()
+	m.validators = append(m.validators, v)
+}
+
+// AddHandler registers a handler that sees every delivered message
+// Handlers run on the ReadMessages goroutine and must not block
+func (m *P2PMessaging) AddHandler(h Handler) {
+	m.handlersLock.Lock()
+	defer m.handlersLock.Unlock()
+	m.handlers = append(m.handlers, h)
 }
 
-// messageValidator validates incoming messages
-func messageValidator(ctx context.Context, id peer.ID, msg *pubsub.Message) pubsub.ValidationResult {
+// validate is the topic validator registered with pubsub
+func (m *P2PMessaging) validate(ctx context.Context, id peer.ID, msg *pubsub.Message) pubsub.ValidationResult {
+	_, result := m.check(msg.GetFrom(), msg.Data)
+	return result
+}
+
+// check validates the data of a message signed by author: its structure,
+// its sender and every registered validator
+func (m *P2PMessaging) check(author peer.ID, data []byte) (*Message, pubsub.ValidationResult) {
+	chatMsg, result := messageValidator(data)
+	if result != pubsub.ValidationAccept {
+		return nil, result
+	}
+
+	// Everything downstream trusts From, so it must be the signed author
+	if chatMsg.From != author.String() {
+		return nil, pubsub.ValidationReject
+	}
+
+	m.validatorsLock.RLock()
+	validators := m.validators
+	m.validatorsLock.RUnlock()
+
+	for _, v := range validators {
+		if result := v(author, chatMsg); result != pubsub.ValidationAccept {
+			return nil, result
+		}
+	}
+
+	return chatMsg, pubsub.ValidationAccept
+}
+
+// VerifyRecord checks a signed pubsub record that reached us outside the
+// topic, e.g. through a mailbox, exactly as if it had arrived on the topic:
+// the author's signature, the topic and every validator
+func (m *P2PMessaging) VerifyRecord(record []byte) (*Message, error) {
+	var rec pb.Message
+	if err := rec.Unmarshal(record); err != nil {
+		return nil, fmt.Errorf("invalid record: %w", err)
+	}
+	if rec.GetTopic() != m.Topic() {
+		return nil, fmt.Errorf("record is for topic %q", rec.GetTopic())
+	}
+
+	author, err := peer.IDFromBytes(rec.GetFrom())
+	if err != nil {
+		return nil, fmt.Errorf("invalid record author: %w", err)
+	}
+	pub, err := author.ExtractPublicKey()
+	if rec.Key != nil {
+		pub, err = crypto.UnmarshalPublicKey(rec.Key)
+		if err == nil && !author.MatchesPublicKey(pub) {
+			err = fmt.Errorf("key does not match %s", author)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("no signing key: %w", err)
+	}
+
+	// The signature covers the record without the signature and key
+	unsigned := rec
+	unsigned.Signature = nil
+	unsigned.Key = nil
+	payload, err := unsigned.Marshal()
+	if err != nil {
+		return nil, fmt.Errorf("invalid record: %w", err)
+	}
+	if ok, err := pub.Verify(append([]byte(pubsub.SignPrefix), payload...), rec.Signature); err != nil || !ok {
+		return nil, fmt.Errorf("invalid record signature")
+	}
+
+	msg, result := m.check(author, rec.Data)
+	if result != pubsub.ValidationAccept {
+		return nil, fmt.Errorf("message rejected by the room validators")
+	}
+	msg.Record = record
+	return msg, nil
+}
+
+// messageValidator validates the structure of incoming messages
+func messageValidator(data []byte) (*Message, pubsub.ValidationResult) {
 	// Try to unmarshal the message to validate structure
 	var chatMsg Message
-	if err := json.Unmarshal(msg.Data, &chatMsg); err != nil {
+	if err := json.Unmarshal(data, &chatMsg); err != nil {
 		// Invalid JSON structure - reject
-		return pubsub.ValidationReject
+		return nil, pubsub.ValidationReject
 	}
 
 	// Validate message fields
-	if chatMsg.Type == "" || chatMsg.Username == "" || chatMsg.Timestamp == 0 {
+	if chatMsg.Type == "" || chatMsg.Timestamp == 0 {
 		// Missing required fields - reject
-		return pubsub.ValidationReject
+		return nil, pubsub.ValidationReject
+	}
+
+	// Parents link the message into the room's history DAG
+	if len(chatMsg.Parents) > MaxParents {
+		return nil, pubsub.ValidationReject
 	}
 
-	// Validate message type
-	if chatMsg.Type != "message" && chatMsg.Type != "join" && chatMsg.Type != "leave" {
+	// Disappearing messages that already expired are not delivered
+	if chatMsg.Expired(time.Now()) {
+		return nil, pubsub.ValidationIgnore
+	}
+
+	// Validate message type (moderation events and room metadata carry no username)
+	switch chatMsg.Type {
+	case "message", "join", "leave":
+		if chatMsg.Username == "" {
+			return nil, pubsub.ValidationReject
+		}
+	case "moderation", "roommeta":
+	default:
 		// Unknown message type - reject
-		return pubsub.ValidationReject
+		return nil, pubsub.ValidationReject
 	}
 
 	// Message is valid - accept
-	return pubsub.ValidationAccept
+	return &chatMsg, pubsub.ValidationAccept
 }
 
-// PublishMessage publishes a message to the topic
-func (m *P2PMessaging) PublishMessage(msgType, content, username string) error {
-	msg := Message{
+// PublishMessage publishes a message to the topic and returns what was sent
+func (m *P2PMessaging) PublishMessage(msgType, content, username string) (*Message, error) {
+	msg := m.NewMessage(msgType, content, username)
+	if err := m.Publish(msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// NewMessage builds a message from this node without publishing it
+func (m *P2PMessaging) NewMessage(msgType, content, username string) *Message {
+	return &Message{
+		ID:        NewMessageID(),
 		Type:      msgType,
 		Content:   content,
 		Username:  username,
 		Timestamp: time.Now().Unix(),
 		From:      m.selfID.String(),
 	}
+}
 
+// Publish publishes a prepared message as-is, keeping its ID and timestamp
+func (m *P2PMessaging) Publish(msg *Message) error {
 	msgBytes, err := json.Marshal(msg)
 	if err != nil {
 		return fmt.Errorf("failed to marshal message: %w", err)
@@ -103,6 +264,15 @@ func (m *P2PMessaging) PublishMessage(msgType, content, username string) error {
 	return nil
 }
 
+// NewMessageID returns a random, globally unique message ID
+func NewMessageID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Sprintf("failed to read random bytes: %v", err))
+	}
+	return hex.EncodeToString(b)
+}
+
 // ReadMessages returns a channel of incoming messages
 func (m *P2PMessaging) ReadMessages() <-chan *Message {
 	msgChan := make(chan *Message)
@@ -117,11 +287,6 @@ func (m *P2PMessaging) ReadMessages() <-chan *Message {
 				return
 			}
 
-			// Skip messages from ourselves
-			if msg.ReceivedFrom == m.selfID {
-				continue
-			}
-
 			// Unmarshal the message
 			var chatMsg Message
 			if err := json.Unmarshal(msg.Data, &chatMsg); err != nil {
@@ -129,6 +294,25 @@ func (m *P2PMessaging) ReadMessages() <-chan *Message {
 				continue
 			}
 
+			// Keep the signed record so the message can be verified later
+			if chatMsg.Record, err = msg.Message.Marshal(); err != nil {
+				fmt.Printf("Error marshaling message record: %v\n", err)
+				continue
+			}
+
+			// Let handlers observe every message, including our own
+			m.handlersLock.RLock()
+			handlers := m.handlers
+			m.handlersLock.RUnlock()
+			for _, h := range handlers {
+				h(&chatMsg)
+			}
+
+			// Skip messages from ourselves
+			if msg.ReceivedFrom == m.selfID {
+				continue
+			}
+
 			// Send to channel
 			select {
 			case msgChan <- &chatMsg:
@@ -141,6 +325,11 @@ func (m *P2PMessaging) ReadMessages() <-chan *Message {
 	return msgChan
 }
 
+// Topic returns the name of the chat topic
+func (m *P2PMessaging) Topic() string {
+	return m.topic.String()
+}
+
 // GetTopicPeers returns the list of peers in the GossipSub mesh for this topic
 func (m *P2PMessaging) GetTopicPeers() []peer.ID {
 	return m.topic.ListPeers()
@@ -0,0 +1,175 @@
+package moderation
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// Moderation actions
+const (
+	ActionOp     = "op"     // Owner grants admin rights
+	ActionDeop   = "deop"   // Owner revokes admin rights
+	ActionBan    = "ban"    // Admin bans a peer from the room
+	ActionUnban  = "unban"  // Admin lifts a ban
+	ActionMute   = "mute"   // Admin mutes a peer (can read, cannot talk)
+	ActionUnmute = "unmute" // Admin lifts a mute
+	ActionKick   = "kick"   // Admin disconnects a peer once
+)
+
+// Event is a signed moderation event
+// Events are content-addressed by ID and signed with the actor's peer key,
+// so any node can relay them without being able to forge them
+type Event struct {
+	ID        string `json:"id"`
+	Room      string `json:"room"`
+	Action    string `json:"action"`
+	Actor     string `json:"actor"`
+	Target    string `json:"target,omitempty"`
+	Reason    string `json:"reason,omitempty"`
+	Timestamp int64  `json:"timestamp"`
+	Expires   int64  `json:"expires,omitempty"` // Unix time, 0 = permanent
+	Signature []byte `json:"signature"`
+}
+
+// NewEvent creates and signs a moderation event
+func NewEvent(priv crypto.PrivKey, room, action string, target peer.ID, reason string, duration time.Duration) (*Event, error) {
+	actor, err := peer.IDFromPrivateKey(priv)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive actor ID: %w", err)
+	}
+
+	ev := &Event{
+		Room:      room,
+		Action:    action,
+		Actor:     actor.String(),
+		Reason:    reason,
+		Timestamp: time.Now().Unix(),
+	}
+	if target != "" {
+		ev.Target = target.String()
+	}
+	if duration > 0 {
+		ev.Expires = time.Now().Add(duration).Unix()
+	}
+
+	payload, err := ev.signingPayload()
+	if err != nil {
+		return nil, err
+	}
+
+	sig, err := priv.Sign(payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign event: %w", err)
+	}
+	ev.Signature = sig
+	ev.ID = eventID(payload)
+
+	return ev, nil
+}
+
+// Verify checks the event signature and content ID
+func (e *Event) Verify() error {
+	if !isKnownAction(e.Action) {
+		return fmt.Errorf("unknown action: %s", e.Action)
+	}
+	if e.Target == "" {
+		return fmt.Errorf("%s event has no target", e.Action)
+	}
+
+	actor, err := peer.Decode(e.Actor)
+	if err != nil {
+		return fmt.Errorf("invalid actor: %w", err)
+	}
+	pub, err := actor.ExtractPublicKey()
+	if err != nil {
+		return fmt.Errorf("cannot extract actor key: %w", err)
+	}
+
+	payload, err := e.signingPayload()
+	if err != nil {
+		return err
+	}
+	if eventID(payload) != e.ID {
+		return fmt.Errorf("event ID does not match content")
+	}
+
+	ok, err := pub.Verify(payload, e.Signature)
+	if err != nil {
+		return fmt.Errorf("signature verification failed: %w", err)
+	}
+	if !ok {
+		return fmt.Errorf("invalid signature")
+	}
+
+	return nil
+}
+
+// ActorID returns the actor as a peer ID
+func (e *Event) ActorID() peer.ID {
+	id, _ := peer.Decode(e.Actor)
+	return id
+}
+
+// TargetID returns the target as a peer ID
+func (e *Event) TargetID() peer.ID {
+	id, _ := peer.Decode(e.Target)
+	return id
+}
+
+// Expired reports whether a time-limited event has run out at the given time
+func (e *Event) Expired(now time.Time) bool {
+	return e.Expires != 0 && now.Unix() >= e.Expires
+}
+
+// signingPayload returns the canonical bytes covered by the signature
+func (e *Event) signingPayload() ([]byte, error) {
+	unsigned := *e
+	unsigned.ID = ""
+	unsigned.Signature = nil
+
+	data, err := json.Marshal(unsigned)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal event: %w", err)
+	}
+	return data, nil
+}
+
+// eventID derives the content ID of an event from its signing payload
+func eventID(payload []byte) string {
+	sum := sha256.Sum256(payload)
+	return hex.EncodeToString(sum[:])
+}
+
+// isKnownAction reports whether action is a supported moderation action
+func isKnownAction(action string) bool {
+	switch action {
+	case ActionOp, ActionDeop, ActionBan, ActionUnban, ActionMute,
+		ActionUnmute, ActionKick:
+		return true
+	}
+	return false
+}
+
+// EncodeEvents encodes a batch of events for transport in a chat message
+func EncodeEvents(events []*Event) (string, error) {
+	data, err := json.Marshal(events)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal events: %w", err)
+	}
+	return string(data), nil
+}
+
+// DecodeEvents decodes a batch of events received in a chat message
+func DecodeEvents(content string) ([]*Event, error) {
+	var events []*Event
+	if err := json.Unmarshal([]byte(content), &events); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal events: %w", err)
+	}
+	return events, nil
+}
@@ -0,0 +1,541 @@
+package moderation
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/geekp2p/p2p-chat-go/internal/messaging"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// kickWindow is how long after its timestamp a kick is still enforced
+// Kicks are rebroadcast with the rest of the log, so old ones must not re-fire
+const kickWindow = 2 * time.Minute
+
+// OwnerSeparator binds a room to its owner's key: the room "team@<peer-id>"
+// is owned by that peer, and no one else can claim it
+const OwnerSeparator = "@"
+
+// ErrNoOwner is returned when moderating a room that has no owner
+var ErrNoOwner = errors.New("room has no owner: set ROOM_OWNER, or use a room named <name>" + OwnerSeparator + "<owner-peer-id>")
+
+// EventStore persists moderation events
+type EventStore interface {
+	SaveModerationEvent(room, id string, data []byte) error
+	GetModerationEvents(room string) ([][]byte, error)
+}
+
+// Manager tracks and enforces the moderation state of a room
+//
+// The owner is fixed by the room name or pinned by configuration, never
+// claimed over the network, since anyone could sign a claim. The rest of the
+// state is derived by replaying every verified event in timestamp order: only
+// the owner may grant or revoke admin rights, and only admins may ban, mute
+// or kick. Actors sign their own timestamps, so an admin's event stamped
+// before a change of their role that this node already knew of when the
+// event arrived is ignored: a demoted admin cannot backdate a ban.
+type Manager struct {
+	ctx       context.Context
+	room      string
+	host      host.Host
+	priv      crypto.PrivKey
+	store     EventStore
+	messaging *messaging.P2PMessaging
+	verbose   bool
+
+	mu       sync.RWMutex
+	owner    peer.ID           // From the room name or configuration; empty = unowned
+	events   map[string]*Event // All verified events by ID
+	received map[string]int64  // When this node first saw each event, Unix nanoseconds
+	lastSeen int64             // Latest receive time handed out
+	state    *roomState
+}
+
+// storedEvent is an event as persisted, with the time this node received it
+// Events persisted before receive times were kept have none, and count as
+// received before everything else
+type storedEvent struct {
+	*Event
+	Received int64 `json:"received,omitempty"`
+}
+
+// roomState is the effective moderation state after replaying the log
+type roomState struct {
+	owner  peer.ID
+	admins map[peer.ID]bool
+	bans   map[peer.ID]*Event
+	mutes  map[peer.ID]*Event
+	log    []*Event // Events that took effect, oldest first
+}
+
+// NewManager creates a moderation manager for a room
+// It loads persisted events, registers a message validator and starts
+// disconnecting banned peers
+func NewManager(ctx context.Context, h host.Host, msg *messaging.P2PMessaging, store EventStore, room string, verbose bool) (*Manager, error) {
+	priv := h.Peerstore().PrivKey(h.ID())
+	if priv == nil {
+		return nil, fmt.Errorf("no private key for local peer")
+	}
+
+	m := &Manager{
+		ctx:       ctx,
+		room:      room,
+		host:      h,
+		priv:      priv,
+		store:     store,
+		messaging: msg,
+		verbose:   verbose,
+		owner:     RoomOwner(room),
+		events:    make(map[string]*Event),
+		received:  make(map[string]int64),
+	}
+
+	if err := m.load(); err != nil {
+		return nil, err
+	}
+
+	msg.AddValidator(m.validate)
+
+	h.Network().Notify(&network.NotifyBundle{
+		ConnectedF: func(n network.Network, conn network.Conn) {
+			if m.IsBanned(conn.RemotePeer()) {
+				go n.ClosePeer(conn.RemotePeer())
+			}
+		},
+	})
+
+	go m.rebroadcastLoop()
+
+	return m, nil
+}
+
+// load restores persisted events for the room
+func (m *Manager) load() error {
+	records, err := m.store.GetModerationEvents(m.room)
+	if err != nil {
+		return fmt.Errorf("failed to load moderation events: %w", err)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, data := range records {
+		var stored storedEvent
+		if err := json.Unmarshal(data, &stored); err != nil || stored.Event == nil {
+			continue
+		}
+		ev := stored.Event
+		if ev.Room != m.room || ev.Verify() != nil {
+			continue
+		}
+		m.events[ev.ID] = ev
+		m.received[ev.ID] = stored.Received
+		if stored.Received > m.lastSeen {
+			m.lastSeen = stored.Received
+		}
+	}
+	m.rebuild()
+
+	return nil
+}
+
+// RoomOwner returns the owner a room name is bound to, or an empty ID
+func RoomOwner(room string) peer.ID {
+	i := strings.LastIndex(room, OwnerSeparator)
+	if i < 0 {
+		return ""
+	}
+	owner, err := peer.Decode(room[i+len(OwnerSeparator):])
+	if err != nil {
+		return ""
+	}
+	return owner
+}
+
+// SetOwner pins the owner of a room whose name does not name one
+func (m *Manager) SetOwner(owner peer.ID) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if bound := RoomOwner(m.room); bound != "" && bound != owner {
+		return fmt.Errorf("room %s is owned by %s", m.room, bound)
+	}
+	m.owner = owner
+	m.rebuild()
+	return nil
+}
+
+// rebuild replays all known events into a fresh state (caller holds lock)
+func (m *Manager) rebuild() {
+	events := make([]*Event, 0, len(m.events))
+	for _, ev := range m.events {
+		events = append(events, ev)
+	}
+	sort.Slice(events, func(i, j int) bool {
+		if events[i].Timestamp != events[j].Timestamp {
+			return events[i].Timestamp < events[j].Timestamp
+		}
+		return events[i].ID < events[j].ID
+	})
+
+	st := &roomState{
+		owner:  m.owner,
+		admins: make(map[peer.ID]bool),
+		bans:   make(map[peer.ID]*Event),
+		mutes:  make(map[peer.ID]*Event),
+	}
+	if st.owner != "" {
+		st.admins[st.owner] = true
+	}
+
+	// Role changes per admin; only the owner's count, as only the owner
+	// may grant or revoke admin rights
+	roleChanges := make(map[peer.ID][]*Event)
+	for _, ev := range events {
+		if (ev.Action == ActionOp || ev.Action == ActionDeop) && ev.ActorID() == st.owner {
+			roleChanges[ev.TargetID()] = append(roleChanges[ev.TargetID()], ev)
+		}
+	}
+
+	for _, ev := range events {
+		actor := ev.ActorID()
+		target := ev.TargetID()
+
+		if err := st.authorize(actor, ev.Action, target); err != nil {
+			continue
+		}
+		if m.backdated(ev, roleChanges[actor]) {
+			continue
+		}
+
+		switch ev.Action {
+		case ActionOp:
+			st.admins[target] = true
+		case ActionDeop:
+			delete(st.admins, target)
+		case ActionBan:
+			st.bans[target] = ev
+		case ActionUnban:
+			delete(st.bans, target)
+		case ActionMute:
+			st.mutes[target] = ev
+		case ActionUnmute:
+			delete(st.mutes, target)
+		}
+		st.log = append(st.log, ev)
+	}
+
+	m.state = st
+}
+
+// backdated reports whether ev is stamped before one of its actor's role
+// changes that this node had already received when ev arrived
+func (m *Manager) backdated(ev *Event, roleChanges []*Event) bool {
+	for _, change := range roleChanges {
+		if m.received[change.ID] < m.received[ev.ID] && ev.Timestamp < change.Timestamp {
+			return true
+		}
+	}
+	return false
+}
+
+// receiveTime returns a receive time later than any handed out before
+// (caller holds lock)
+func (m *Manager) receiveTime() int64 {
+	now := time.Now().UnixNano()
+	if now <= m.lastSeen {
+		now = m.lastSeen + 1
+	}
+	m.lastSeen = now
+	return now
+}
+
+// authorize checks whether actor may apply action to target
+func (st *roomState) authorize(actor peer.ID, action string, target peer.ID) error {
+	if st.owner == "" {
+		return ErrNoOwner
+	}
+	if target == st.owner {
+		return fmt.Errorf("the room owner cannot be moderated")
+	}
+
+	switch action {
+	case ActionOp, ActionDeop:
+		if actor != st.owner {
+			return fmt.Errorf("only the room owner can change admins")
+		}
+	default:
+		if !st.admins[actor] {
+			return fmt.Errorf("only admins can %s", action)
+		}
+		if st.admins[target] && actor != st.owner {
+			return fmt.Errorf("only the room owner can moderate admins")
+		}
+	}
+	return nil
+}
+
+// validate rejects forged moderation events and messages from banned or muted peers
+// Banned peers cannot send anything, moderation events and room metadata
+// included. A batch of events none of whose actors may take them is ignored,
+// so it is neither stored nor relayed
+func (m *Manager) validate(author peer.ID, msg *messaging.Message) pubsub.ValidationResult {
+	if m.IsBanned(author) {
+		return pubsub.ValidationReject
+	}
+
+	if msg.Type == "moderation" {
+		events, err := DecodeEvents(msg.Content)
+		if err != nil || len(events) == 0 {
+			return pubsub.ValidationReject
+		}
+		for _, ev := range events {
+			if ev.Room != m.room || ev.Verify() != nil {
+				return pubsub.ValidationReject
+			}
+		}
+		if len(m.authorized(events)) == 0 {
+			return pubsub.ValidationIgnore
+		}
+		return pubsub.ValidationAccept
+	}
+
+	if msg.Type == "message" && m.IsMuted(author) {
+		return pubsub.ValidationIgnore
+	}
+	return pubsub.ValidationAccept
+}
+
+// authorized returns the events of a batch whose actors may take them now
+// Admin changes made earlier in the batch count, so a rebroadcast log that
+// grants a role and then uses it is accepted as a whole
+func (m *Manager) authorized(events []*Event) []*Event {
+	m.mu.RLock()
+	st := &roomState{owner: m.state.owner, admins: make(map[peer.ID]bool, len(m.state.admins))}
+	for p := range m.state.admins {
+		st.admins[p] = true
+	}
+	m.mu.RUnlock()
+
+	var ok []*Event
+	for _, ev := range events {
+		target := ev.TargetID()
+		if st.authorize(ev.ActorID(), ev.Action, target) != nil {
+			continue
+		}
+		switch ev.Action {
+		case ActionOp:
+			st.admins[target] = true
+		case ActionDeop:
+			delete(st.admins, target)
+		}
+		ok = append(ok, ev)
+	}
+	return ok
+}
+
+// HandleMessage applies the events carried by a received moderation message
+// It returns the events that were new and took effect
+func (m *Manager) HandleMessage(msg *messaging.Message) ([]*Event, error) {
+	events, err := DecodeEvents(msg.Content)
+	if err != nil {
+		return nil, err
+	}
+
+	var applied []*Event
+	for _, ev := range events {
+		ok, err := m.apply(ev)
+		if err != nil {
+			if m.verbose {
+				fmt.Printf("Ignoring moderation event %s: %v\n", ev.ID, err)
+			}
+			continue
+		}
+		if ok {
+			applied = append(applied, ev)
+		}
+	}
+	return applied, nil
+}
+
+// apply verifies, persists and enforces a single event
+// It returns true if the event was new and took effect. Events whose actor
+// may not take them now are neither stored nor persisted, so members without
+// a role cannot grow the log; a legitimate one that arrived too early, before
+// the grant of its actor's role, comes back with the next rebroadcast
+func (m *Manager) apply(ev *Event) (bool, error) {
+	if ev.Room != m.room {
+		return false, fmt.Errorf("event is for room %q", ev.Room)
+	}
+	if err := ev.Verify(); err != nil {
+		return false, err
+	}
+
+	m.mu.Lock()
+	if _, seen := m.events[ev.ID]; seen {
+		m.mu.Unlock()
+		return false, nil
+	}
+	if err := m.state.authorize(ev.ActorID(), ev.Action, ev.TargetID()); err != nil {
+		m.mu.Unlock()
+		return false, err
+	}
+	m.events[ev.ID] = ev
+	m.received[ev.ID] = m.receiveTime()
+	stored := storedEvent{Event: ev, Received: m.received[ev.ID]}
+	m.rebuild()
+	effective := false
+	for _, logged := range m.state.log {
+		if logged.ID == ev.ID {
+			effective = true
+			break
+		}
+	}
+	m.mu.Unlock()
+
+	data, err := json.Marshal(stored)
+	if err != nil {
+		return false, fmt.Errorf("failed to marshal event: %w", err)
+	}
+	if err := m.store.SaveModerationEvent(m.room, ev.ID, data); err != nil {
+		return false, fmt.Errorf("failed to persist event: %w", err)
+	}
+
+	if effective {
+		m.enforce(ev)
+	}
+	return effective, nil
+}
+
+// enforce applies the connection-level effect of an event
+func (m *Manager) enforce(ev *Event) {
+	target := ev.TargetID()
+	if target == "" || target == m.host.ID() {
+		return
+	}
+
+	switch ev.Action {
+	case ActionBan:
+		if m.IsBanned(target) {
+			m.host.Network().ClosePeer(target)
+		}
+	case ActionKick:
+		if time.Since(time.Unix(ev.Timestamp, 0)) < kickWindow {
+			m.host.Network().ClosePeer(target)
+		}
+	}
+}
+
+// Act creates, applies and publishes a moderation event signed by this node
+func (m *Manager) Act(action string, target peer.ID, reason string, duration time.Duration) (*Event, error) {
+	m.mu.RLock()
+	err := m.state.authorize(m.host.ID(), action, target)
+	m.mu.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+
+	ev, err := NewEvent(m.priv, m.room, action, target, reason, duration)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := m.apply(ev); err != nil {
+		return nil, err
+	}
+
+	if err := m.publish([]*Event{ev}); err != nil {
+		return ev, err
+	}
+	return ev, nil
+}
+
+// publish sends a batch of events to the room
+func (m *Manager) publish(events []*Event) error {
+	content, err := EncodeEvents(events)
+	if err != nil {
+		return err
+	}
+	_, err = m.messaging.PublishMessage("moderation", content, "")
+	return err
+}
+
+// rebroadcastLoop periodically republishes the effective log so that
+// peers who joined later learn the current moderation state
+func (m *Manager) rebroadcastLoop() {
+	ticker := time.NewTicker(5 * time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			log := m.Log()
+			if len(log) == 0 || len(m.messaging.GetTopicPeers()) == 0 {
+				continue
+			}
+			if err := m.publish(log); err != nil && m.verbose {
+				fmt.Printf("Failed to rebroadcast moderation log: %v\n", err)
+			}
+		case <-m.ctx.Done():
+			return
+		}
+	}
+}
+
+// Owner returns the room owner, or an empty ID if the room has none
+func (m *Manager) Owner() peer.ID {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.state.owner
+}
+
+// Admins returns the current room admins, including the owner
+func (m *Manager) Admins() []peer.ID {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	admins := make([]peer.ID, 0, len(m.state.admins))
+	for p := range m.state.admins {
+		admins = append(admins, p)
+	}
+	sort.Slice(admins, func(i, j int) bool { return admins[i] < admins[j] })
+	return admins
+}
+
+// IsAdmin reports whether p is an admin of the room
+func (m *Manager) IsAdmin(p peer.ID) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.state.admins[p]
+}
+
+// IsBanned reports whether p is currently banned
+func (m *Manager) IsBanned(p peer.ID) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	ev, ok := m.state.bans[p]
+	return ok && !ev.Expired(time.Now())
+}
+
+// IsMuted reports whether p is currently muted
+func (m *Manager) IsMuted(p peer.ID) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	ev, ok := m.state.mutes[p]
+	return ok && !ev.Expired(time.Now())
+}
+
+// Log returns the events that took effect, oldest first
+func (m *Manager) Log() []*Event {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return append([]*Event(nil), m.state.log...)
+}
@@ -0,0 +1,101 @@
+package node
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/ipfs/go-cid"
+	dht "github.com/libp2p/go-libp2p-kad-dht"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/routing"
+)
+
+// bridgeRouting announces and finds content on several DHTs at once
+// It lets peers on the public DHT and peers on the chat DHT find each other
+// while a network migrates from one to the other
+type bridgeRouting struct {
+	dhts []*dht.IpfsDHT
+}
+
+var _ routing.ContentRouting = (*bridgeRouting)(nil)
+
+// Provide announces c on every DHT; it fails only if all of them fail
+func (b *bridgeRouting) Provide(ctx context.Context, c cid.Cid, broadcast bool) error {
+	errs := make([]error, len(b.dhts))
+	var wg sync.WaitGroup
+	for i, d := range b.dhts {
+		wg.Add(1)
+		go func(i int, d *dht.IpfsDHT) {
+			defer wg.Done()
+			errs[i] = d.Provide(ctx, c, broadcast)
+		}(i, d)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err == nil {
+			return nil
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// FindProvidersAsync merges the providers found on every DHT, up to count
+// (0 = no limit)
+func (b *bridgeRouting) FindProvidersAsync(ctx context.Context, c cid.Cid, count int) <-chan peer.AddrInfo {
+	ctx, cancel := context.WithCancel(ctx)
+	out := make(chan peer.AddrInfo)
+	found := make(chan peer.AddrInfo)
+
+	var wg sync.WaitGroup
+	for _, d := range b.dhts {
+		wg.Add(1)
+		go func(d *dht.IpfsDHT) {
+			defer wg.Done()
+			for p := range d.FindProvidersAsync(ctx, c, count) {
+				select {
+				case found <- p:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}(d)
+	}
+	go func() {
+		wg.Wait()
+		close(found)
+	}()
+
+	go func() {
+		defer close(out)
+		defer cancel()
+		seen := make(map[peer.ID]bool)
+		for p := range found {
+			if seen[p.ID] {
+				continue
+			}
+			seen[p.ID] = true
+			select {
+			case out <- p:
+			case <-ctx.Done():
+				return
+			}
+			if count > 0 && len(seen) >= count {
+				return
+			}
+		}
+	}()
+	return out
+}
+
+// RoutingTableSize returns how many distinct peers the DHTs know
+func (b *bridgeRouting) RoutingTableSize() int {
+	peers := make(map[peer.ID]bool)
+	for _, d := range b.dhts {
+		for _, p := range d.RoutingTable().ListPeers() {
+			peers[p] = true
+		}
+	}
+	return len(peers)
+}
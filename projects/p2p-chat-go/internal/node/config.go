@@ -0,0 +1,306 @@
+package node
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/pnet"
+	"github.com/multiformats/go-multiaddr"
+)
+
+// None turns off a list of addresses, e.g. BOOTSTRAP_PEERS=none
+const None = "none"
+
+// DHT modes
+//
+// The chat DHT (protocol prefix DHTPrefix, /p2p-chat by default) always
+// holds the signed chat records. The mode decides where peers advertise
+// themselves and announce provider records.
+const (
+	DHTPublic   = "public"   // On the public IPFS Amino DHT
+	DHTIsolated = "isolated" // On the chat DHT only; the IPFS DHT is not joined
+	DHTBridge   = "bridge"   // On both, while peers migrate to isolated
+)
+
+// DefaultBootstrapPeers are the public IPFS bootstrap nodes
+var DefaultBootstrapPeers = []string{
+	"/dnsaddr/bootstrap.libp2p.io/p2p/QmNnooDu7bfjPFoTZYxMNLWUQJyrVwtbZg5gBMjTezGAJN",
+	"/dnsaddr/bootstrap.libp2p.io/p2p/QmQCU2EcMqAqQPR2i9bChDtGNJchTbq5TbXJJ16u19uLTa",
+	"/dnsaddr/bootstrap.libp2p.io/p2p/QmbLHAnMoJPWSCR5Zhtx6BHJX9KiKNN6tpvbUcqanj75Nb",
+	"/dnsaddr/bootstrap.libp2p.io/p2p/QmcZf59bWwK5XFi76CZX8cbJ4BhTzzA3gU1ZjYZcYW3dwt",
+}
+
+// DefaultRelays are public circuit relay v2 servers, used as static relays
+// and connected to on start
+var DefaultRelays = []string{
+	// libp2p public relays
+	"/ip4/147.75.83.83/tcp/4001/p2p/QmbLHAnMoJPWSCR5Zhtx6BHJX9KiKNN6tpvbUcqanj75Nb",
+	"/ip4/147.75.77.187/tcp/4001/p2p/QmQCU2EcMqAqQPR2i9bChDtGNJchTbq5TbXJJ16u19uLTa",
+	// DNS-based addresses for automatic failover
+	"/dnsaddr/bootstrap.libp2p.io/p2p/QmbLHAnMoJPWSCR5Zhtx6BHJX9KiKNN6tpvbUcqanj75Nb",
+	"/dnsaddr/bootstrap.libp2p.io/p2p/QmQCU2EcMqAqQPR2i9bChDtGNJchTbq5TbXJJ16u19uLTa",
+	"/dnsaddr/bootstrap.libp2p.io/p2p/QmcZf59bWwK5XFi76CZX8cbJ4BhTzzA3gU1ZjYZcYW3dwt",
+	"/dnsaddr/bootstrap.libp2p.io/p2p/QmNnooDu7bfjPFoTZYxMNLWUQJyrVwtbZg5gBMjTezGAJN",
+}
+
+// defaultListenAddrs listens on TCP and QUIC; %d is the port, 0 = random
+// Private networks only listen on the first, as QUIC cannot use a swarm key
+var defaultListenAddrs = []string{
+	"/ip4/0.0.0.0/tcp/%d",
+	"/ip4/0.0.0.0/udp/%d/quic-v1",
+}
+
+// Listen addresses for browsers and HTTP-only networks, added to the defaults
+// when enabled; %d is the port
+const (
+	webSocketListenAddr    = "/ip4/0.0.0.0/tcp/%d/ws"
+	webSocketTLSListenAddr = "/ip4/0.0.0.0/tcp/%d/tls/ws" // wss://
+	webTransportListenAddr = "/ip4/0.0.0.0/udp/%d/quic-v1/webtransport"
+)
+
+// privateUnsupported are the transports that cannot run in a private network
+var privateUnsupported = []int{
+	multiaddr.P_QUIC,
+	multiaddr.P_QUIC_V1,
+	multiaddr.P_WEBTRANSPORT,
+	multiaddr.P_WEBRTC_DIRECT,
+}
+
+// NetworkConfig configures how the node reaches the network
+//
+// A nil list means the default; an empty list (written "none") means none.
+// It is read from a JSON file and overridden by flags and environment
+// variables; Resolve fills in the defaults and checks every address.
+type NetworkConfig struct {
+	Listen    []string `json:"listen,omitempty"`     // Multiaddrs to listen on
+	Announce  []string `json:"announce,omitempty"`   // Multiaddrs advertised instead of the listen addresses
+	Port      int      `json:"port,omitempty"`       // Fixed TCP and UDP port of the default listen addresses
+	Bootstrap []string `json:"bootstrap,omitempty"`  // Peers to join the DHT through
+	Relays    []string `json:"relays,omitempty"`     // Circuit relays for peers behind NAT
+	DHTMode   string   `json:"dht,omitempty"`        // DHTPublic, DHTIsolated or DHTBridge
+	DHTPrefix string   `json:"dht_prefix,omitempty"` // Protocol prefix of the chat DHT
+	DHTServer bool     `json:"dht_server,omitempty"` // Always answer DHT queries, for well-connected servers
+
+	// WebSocket and WebTransport let browsers, and peers that can only reach
+	// HTTP ports, connect. TLSCert and TLSKey are PEM files that turn the
+	// WebSocket listener into secure WebSocket (wss); WebTransport always
+	// uses its own self-signed certificates
+	WebSocketPort int    `json:"ws_port,omitempty"`      // TCP port of the WebSocket listener, 0 = none
+	WebTransport  bool   `json:"webtransport,omitempty"` // Also accept WebTransport on the QUIC port
+	TLSCert       string `json:"tls_cert,omitempty"`     // Certificate (chain) for wss
+	TLSKey        string `json:"tls_key,omitempty"`      // Private key of TLSCert
+
+	// SwarmKey makes the network private: only peers holding the same
+	// pre-shared key can connect, and the public defaults are not used
+	SwarmKey pnet.PSK `json:"-"`
+}
+
+// LoadNetworkConfig reads a JSON network configuration file
+// A missing file is only an error when required is set
+func LoadNetworkConfig(path string, required bool) (NetworkConfig, error) {
+	var cfg NetworkConfig
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) && !required {
+		return cfg, nil
+	}
+	if err != nil {
+		return cfg, fmt.Errorf("failed to read network config: %w", err)
+	}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return cfg, fmt.Errorf("invalid network config %s: %w", path, err)
+	}
+
+	// A list that is [] or ["none"] turns the default off
+	for _, list := range []*[]string{&cfg.Listen, &cfg.Announce, &cfg.Bootstrap, &cfg.Relays} {
+		if *list != nil && (len(*list) == 0 || (len(*list) == 1 && (*list)[0] == None)) {
+			*list = []string{}
+		}
+	}
+	return cfg, nil
+}
+
+// ParseAddrList parses a comma-separated list of multiaddrs from a flag or
+// environment variable: "" leaves the setting unchanged (nil) and "none"
+// turns it off (an empty list)
+func ParseAddrList(s string) []string {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil
+	}
+	if s == None {
+		return []string{}
+	}
+	var addrs []string
+	for _, a := range strings.Split(s, ",") {
+		if a = strings.TrimSpace(a); a != "" {
+			addrs = append(addrs, a)
+		}
+	}
+	return addrs
+}
+
+// Override returns cfg with every setting of o that is set replacing it
+func (cfg NetworkConfig) Override(o NetworkConfig) NetworkConfig {
+	if o.Listen != nil {
+		cfg.Listen = o.Listen
+	}
+	if o.Announce != nil {
+		cfg.Announce = o.Announce
+	}
+	if o.Port != 0 {
+		cfg.Port = o.Port
+	}
+	if o.Bootstrap != nil {
+		cfg.Bootstrap = o.Bootstrap
+	}
+	if o.Relays != nil {
+		cfg.Relays = o.Relays
+	}
+	if o.DHTMode != "" {
+		cfg.DHTMode = o.DHTMode
+	}
+	if o.DHTPrefix != "" {
+		cfg.DHTPrefix = o.DHTPrefix
+	}
+	if o.DHTServer {
+		cfg.DHTServer = true
+	}
+	if o.WebSocketPort != 0 {
+		cfg.WebSocketPort = o.WebSocketPort
+	}
+	if o.WebTransport {
+		cfg.WebTransport = true
+	}
+	if o.TLSCert != "" {
+		cfg.TLSCert = o.TLSCert
+	}
+	if o.TLSKey != "" {
+		cfg.TLSKey = o.TLSKey
+	}
+	if o.SwarmKey != nil {
+		cfg.SwarmKey = o.SwarmKey
+	}
+	return cfg
+}
+
+// Resolve fills in the defaults and checks every address
+func (cfg NetworkConfig) Resolve() (NetworkConfig, error) {
+	if cfg.Port < 0 || cfg.Port > 65535 {
+		return cfg, fmt.Errorf("invalid port %d", cfg.Port)
+	}
+	if cfg.WebSocketPort < 0 || cfg.WebSocketPort > 65535 {
+		return cfg, fmt.Errorf("invalid WebSocket port %d", cfg.WebSocketPort)
+	}
+	if (cfg.TLSCert == "") != (cfg.TLSKey == "") {
+		return cfg, errors.New("a TLS certificate needs its key, and a key its certificate")
+	}
+	if cfg.DHTMode == "" {
+		cfg.DHTMode = DHTPublic
+	}
+	if cfg.DHTMode != DHTPublic && cfg.DHTMode != DHTIsolated && cfg.DHTMode != DHTBridge {
+		return cfg, fmt.Errorf("invalid DHT mode %q (use %s, %s or %s)", cfg.DHTMode, DHTPublic, DHTIsolated, DHTBridge)
+	}
+	if cfg.DHTPrefix == "" {
+		cfg.DHTPrefix = RecordProtocolPrefix
+	}
+	if !strings.HasPrefix(cfg.DHTPrefix, "/") || strings.HasSuffix(cfg.DHTPrefix, "/") || cfg.DHTPrefix == "/ipfs" {
+		return cfg, fmt.Errorf("invalid DHT prefix %q: it must look like /my-chat and cannot be /ipfs", cfg.DHTPrefix)
+	}
+
+	private := cfg.SwarmKey != nil
+	if cfg.Listen == nil {
+		defaults := defaultListenAddrs
+		if private {
+			defaults = defaults[:1]
+		}
+		for _, a := range defaults {
+			cfg.Listen = append(cfg.Listen, fmt.Sprintf(a, cfg.Port))
+		}
+		if cfg.WebSocketPort != 0 {
+			ws := webSocketListenAddr
+			if cfg.TLSCert != "" {
+				ws = webSocketTLSListenAddr
+			}
+			cfg.Listen = append(cfg.Listen, fmt.Sprintf(ws, cfg.WebSocketPort))
+		}
+		if cfg.WebTransport {
+			cfg.Listen = append(cfg.Listen, fmt.Sprintf(webTransportListenAddr, cfg.Port))
+		}
+	} else if cfg.Port != 0 || cfg.WebSocketPort != 0 || cfg.WebTransport {
+		return cfg, errors.New("ports and WebTransport apply to the default listen addresses and cannot be combined with listen addresses; put them in the addresses")
+	}
+	// The public nodes cannot be reached from a private network, and do not
+	// serve the chat DHT
+	if cfg.Bootstrap == nil {
+		cfg.Bootstrap = DefaultBootstrapPeers
+		if private || cfg.DHTMode == DHTIsolated {
+			cfg.Bootstrap = []string{}
+		}
+	}
+	if cfg.Relays == nil {
+		cfg.Relays = DefaultRelays
+		if private {
+			cfg.Relays = []string{}
+		}
+	}
+
+	for _, a := range append(append([]string(nil), cfg.Listen...), cfg.Announce...) {
+		addr, err := multiaddr.NewMultiaddr(a)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid address %q: %w", a, err)
+		}
+		if private {
+			for _, p := range privateUnsupported {
+				if _, err := addr.ValueForProtocol(p); err == nil {
+					return cfg, fmt.Errorf("address %q: private networks only support TCP and WebSocket", a)
+				}
+			}
+		}
+	}
+	// Secure WebSocket can only be served with a certificate
+	if cfg.TLSCert == "" {
+		for _, a := range cfg.Listen {
+			if secureWebSocket(multiaddr.StringCast(a)) {
+				return cfg, fmt.Errorf("address %q: listening on secure WebSocket needs a TLS certificate and key", a)
+			}
+		}
+	}
+	for _, a := range append(append([]string(nil), cfg.Bootstrap...), cfg.Relays...) {
+		if _, err := peer.AddrInfoFromString(a); err != nil {
+			return cfg, fmt.Errorf("invalid peer address %q (it needs a /p2p/<peer-id> part): %w", a, err)
+		}
+	}
+	return cfg, nil
+}
+
+// secureWebSocket reports whether addr is a wss address (/tls/ws or /wss)
+func secureWebSocket(addr multiaddr.Multiaddr) bool {
+	_, errTLS := addr.ValueForProtocol(multiaddr.P_TLS)
+	_, errWS := addr.ValueForProtocol(multiaddr.P_WS)
+	_, errWSS := addr.ValueForProtocol(multiaddr.P_WSS)
+	return (errTLS == nil && errWS == nil) || errWSS == nil
+}
+
+// parsePeerAddrs parses peer multiaddrs, merging the addresses of a peer
+// listed more than once
+func parsePeerAddrs(addrs []string) []peer.AddrInfo {
+	var infos []peer.AddrInfo
+	index := make(map[peer.ID]int)
+	for _, a := range addrs {
+		info, err := peer.AddrInfoFromString(a)
+		if err != nil {
+			continue
+		}
+		if i, ok := index[info.ID]; ok {
+			infos[i].Addrs = append(infos[i].Addrs, info.Addrs...)
+			continue
+		}
+		index[info.ID] = len(infos)
+		infos = append(infos, *info)
+	}
+	return infos
+}
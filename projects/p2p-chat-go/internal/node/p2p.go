@@ -2,10 +2,13 @@ package node
 
 import (
 	"context"
-	"crypto/rand"
+	"crypto/tls"
 	"fmt"
 	"time"
 
+	dhtstorage "github.com/geekp2p/p2p-chat-go/internal/dht"
+	"github.com/geekp2p/p2p-chat-go/internal/identity"
+
 	"github.com/libp2p/go-libp2p"
 	dht "github.com/libp2p/go-libp2p-kad-dht"
 	pubsub "github.com/libp2p/go-libp2p-pubsub"
@@ -13,21 +16,33 @@ import (
 	"github.com/libp2p/go-libp2p/core/host"
 	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	"github.com/libp2p/go-libp2p/core/routing"
 	"github.com/libp2p/go-libp2p/p2p/discovery/mdns"
 	drouting "github.com/libp2p/go-libp2p/p2p/discovery/routing"
 	"github.com/libp2p/go-libp2p/p2p/protocol/circuitv2/relay"
+	quic "github.com/libp2p/go-libp2p/p2p/transport/quic"
+	"github.com/libp2p/go-libp2p/p2p/transport/tcp"
+	ws "github.com/libp2p/go-libp2p/p2p/transport/websocket"
+	webtransport "github.com/libp2p/go-libp2p/p2p/transport/webtransport"
 	"github.com/multiformats/go-multiaddr"
 )
 
+// RecordProtocolPrefix is the default protocol prefix of the chat DHT
+const RecordProtocolPrefix = "/p2p-chat"
+
 // P2PNode represents a libp2p node with P2P capabilities
 type P2PNode struct {
-	Host         host.Host
-	DHT          *dht.IpfsDHT
-	PubSub       *pubsub.PubSub
-	Relay        *relay.Relay
-	RelayService interface{} // Will be set to *relayservice.RelayService
-	Router       interface{} // Will be set to *routing.SmartRouter
-	Verbose      bool        // Enable verbose logging for debugging
+	Host           host.Host
+	DHT            *dht.IpfsDHT           // Public IPFS DHT, or the chat DHT in isolated mode
+	RecordDHT      *dht.IpfsDHT           // Chat-only DHT holding signed /messages records
+	ContentRouting routing.ContentRouting // Where peers advertise and providers are announced
+	DHTMode        string                 // DHTPublic, DHTIsolated or DHTBridge
+	PubSub         *pubsub.PubSub
+	Relay          *relay.Relay
+	RelayService   interface{} // Will be set to *relayservice.RelayService
+	Router         interface{} // Will be set to *routing.SmartRouter
+	Verbose        bool        // Enable verbose logging for debugging
 }
 
 // discoveryNotifee implements mdns.Notifee for local peer discovery
@@ -50,31 +65,69 @@ func (n *discoveryNotifee) HandlePeerFound(pi peer.AddrInfo) {
 }
 
 // NewP2PNode creates a new P2P node with DHT and PubSub
-func NewP2PNode(ctx context.Context, verbose bool) (*P2PNode, error) {
-	// Generate a new keypair for this host
-	priv, _, err := crypto.GenerateKeyPairWithReader(crypto.Ed25519, 2048, rand.Reader)
+// The peer identity is loaded from (or created in) dataDir so that the
+// peer ID, and any room roles signed for it, survive restarts
+func NewP2PNode(ctx context.Context, dataDir string, cfg NetworkConfig, verbose bool) (*P2PNode, error) {
+	priv, err := identity.GetOrCreateIdentity(dataDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load identity: %w", err)
+	}
+	return NewP2PNodeWithIdentity(ctx, priv, cfg, verbose)
+}
+
+// NewP2PNodeWithIdentity creates a P2P node for the given private key
+func NewP2PNodeWithIdentity(ctx context.Context, priv crypto.PrivKey, cfg NetworkConfig, verbose bool) (*P2PNode, error) {
+	cfg, err := cfg.Resolve()
 	if err != nil {
-		return nil, fmt.Errorf("failed to generate keypair: %w", err)
+		return nil, fmt.Errorf("invalid network config: %w", err)
 	}
 
-	// Get static relay peers (will be populated after connecting to bootstrap)
-	staticRelays := getStaticRelayPeers()
+	// Static relays for peers behind NAT
+	staticRelays := parsePeerAddrs(cfg.Relays)
 
-	// Create a new libp2p Host with enhanced NAT traversal capabilities
-	h, err := libp2p.New(
+	transports, err := transportOptions(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := []libp2p.Option{
 		libp2p.Identity(priv),
-		// Listen on TCP and QUIC for better connectivity
-		libp2p.ListenAddrStrings(
-			"/ip4/0.0.0.0/tcp/0",
-			"/ip4/0.0.0.0/udp/0/quic-v1",
-		),
 		// Enable NAT traversal features
-		libp2p.NATPortMap(),       // UPnP and NAT-PMP port mapping
-		libp2p.EnableNATService(), // Help other peers detect their NAT status (includes AutoNAT)
-		libp2p.EnableAutoRelayWithStaticRelays(staticRelays), // Enable circuit relay v2 client with static relays
+		libp2p.NATPortMap(),         // UPnP and NAT-PMP port mapping
+		libp2p.EnableNATService(),   // Help other peers detect their NAT status (includes AutoNAT)
 		libp2p.EnableHolePunching(), // Enable DCUtR hole punching
 		libp2p.EnableRelay(),        // Allow being relayed through other peers
-	)
+		transports,
+	}
+	// Listen on TCP and QUIC for better connectivity, unless configured, plus
+	// WebSocket and WebTransport for browsers when enabled
+	if len(cfg.Listen) > 0 {
+		opts = append(opts, libp2p.ListenAddrStrings(cfg.Listen...))
+	} else {
+		opts = append(opts, libp2p.NoListenAddrs)
+	}
+	// Advertise fixed addresses, e.g. a firewall's public address
+	if len(cfg.Announce) > 0 {
+		announce := make([]multiaddr.Multiaddr, 0, len(cfg.Announce))
+		for _, a := range cfg.Announce {
+			announce = append(announce, multiaddr.StringCast(a))
+		}
+		opts = append(opts, libp2p.AddrsFactory(func([]multiaddr.Multiaddr) []multiaddr.Multiaddr {
+			return announce
+		}))
+	}
+	// Only talk to peers holding the same pre-shared key
+	if cfg.SwarmKey != nil {
+		opts = append(opts, libp2p.PrivateNetwork(cfg.SwarmKey))
+		fmt.Printf("🔒 Private network (swarm key %s)\n", SwarmKeyFingerprint(cfg.SwarmKey))
+	}
+	// Enable circuit relay v2 client with static relays
+	if len(staticRelays) > 0 {
+		opts = append(opts, libp2p.EnableAutoRelayWithStaticRelays(staticRelays))
+	}
+
+	// Create a new libp2p Host with enhanced NAT traversal capabilities
+	h, err := libp2p.New(opts...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create host: %w", err)
 	}
@@ -82,23 +135,81 @@ func NewP2PNode(ctx context.Context, verbose bool) (*P2PNode, error) {
 	// Print host information
 	fmt.Printf("Host created with ID: %s\n", h.ID())
 	fmt.Printf("Listening on:\n")
-	for _, addr := range h.Addrs() {
+	listening := h.Addrs()
+	if len(cfg.Announce) > 0 {
+		listening = h.Network().ListenAddresses() // h.Addrs() is what we announce
+	}
+	for _, addr := range listening {
 		fmt.Printf("  %s/p2p/%s\n", addr, h.ID())
 	}
+	if len(cfg.Announce) > 0 {
+		fmt.Printf("Announcing:\n")
+		for _, addr := range h.Addrs() {
+			fmt.Printf("  %s/p2p/%s\n", addr, h.ID())
+		}
+	}
 
-	// Create a new Kademlia DHT
-	kadDHT, err := dht.New(ctx, h, dht.Mode(dht.ModeAuto))
+	// DHT settings shared by the public and the chat DHT
+	bootstrapPeers := parsePeerAddrs(cfg.Bootstrap)
+	dhtOpts := []dht.Option{dht.Mode(dht.ModeAuto)}
+	if cfg.DHTServer {
+		dhtOpts = []dht.Option{dht.Mode(dht.ModeServer)}
+	}
+	if len(bootstrapPeers) > 0 {
+		// Refill an emptied routing table from the bootstrap peers
+		dhtOpts = append(dhtOpts, dht.BootstrapPeers(bootstrapPeers...))
+	}
+
+	// Join the public IPFS Amino DHT unless the chat runs its own
+	var kadDHT *dht.IpfsDHT
+	if cfg.DHTMode != DHTIsolated {
+		kadDHT, err = dht.New(ctx, h, dhtOpts...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create DHT: %w", err)
+		}
+
+		// Bootstrap the DHT
+		if err = kadDHT.Bootstrap(ctx); err != nil {
+			return nil, fmt.Errorf("failed to bootstrap DHT: %w", err)
+		}
+	}
+
+	// Create the chat DHT. The public /ipfs DHT only accepts its own /pk and
+	// /ipns records, so chat messages live in a DHT of chat peers under
+	// /messages/<cid>, accepted only when signed by their author and unexpired,
+	// next to the room history indexes under /roomlog and room metadata under
+	// /roommeta. In isolated mode it also carries discovery and providers
+	recordDHT, err := dht.New(ctx, h, append(dhtOpts,
+		dht.ProtocolPrefix(protocol.ID(cfg.DHTPrefix)),
+		dht.NamespacedValidator(dhtstorage.Namespace, dhtstorage.Validator{}),
+		dht.NamespacedValidator(dhtstorage.IndexNamespace, dhtstorage.IndexValidator{}),
+		dht.NamespacedValidator(dhtstorage.MetaNamespace, dhtstorage.MetaValidator{}),
+	)...)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create DHT: %w", err)
+		return nil, fmt.Errorf("failed to create record DHT: %w", err)
+	}
+	if err = recordDHT.Bootstrap(ctx); err != nil {
+		return nil, fmt.Errorf("failed to bootstrap record DHT: %w", err)
 	}
 
-	// Bootstrap the DHT
-	if err = kadDHT.Bootstrap(ctx); err != nil {
-		return nil, fmt.Errorf("failed to bootstrap DHT: %w", err)
+	var contentRouting routing.ContentRouting
+	switch cfg.DHTMode {
+	case DHTIsolated:
+		kadDHT = recordDHT
+		contentRouting = recordDHT
+		fmt.Printf("✓ Isolated DHT: peers meet on %s/kad/1.0.0, not the public IPFS DHT\n", cfg.DHTPrefix)
+		if len(bootstrapPeers) == 0 {
+			fmt.Println("  No bootstrap peers configured: only peers found on the LAN or added with /add are reachable")
+		}
+	case DHTBridge:
+		contentRouting = &bridgeRouting{dhts: []*dht.IpfsDHT{kadDHT, recordDHT}}
+		fmt.Printf("✓ Bridged DHT: peers are found on both the public IPFS DHT and %s\n", cfg.DHTPrefix)
+	default:
+		contentRouting = kadDHT
 	}
 
 	// Connect to bootstrap peers
-	if err := connectToBootstrapPeers(ctx, h, verbose); err != nil {
+	if err := connectToBootstrapPeers(ctx, h, bootstrapPeers, verbose); err != nil {
 		fmt.Printf("Warning: failed to connect to some bootstrap peers: %v\n", err)
 	}
 
@@ -113,7 +224,7 @@ func NewP2PNode(ctx context.Context, verbose bool) (*P2PNode, error) {
 	}
 
 	// Connect to public relay servers for NAT traversal
-	if err := connectToRelayServers(ctx, h, verbose); err != nil {
+	if err := connectToRelayServers(ctx, h, staticRelays, verbose); err != nil {
 		fmt.Printf("Warning: failed to connect to relay servers: %v\n", err)
 	}
 
@@ -185,63 +296,53 @@ func NewP2PNode(ctx context.Context, verbose bool) (*P2PNode, error) {
 
 	// Update the node with DHT, PubSub, and Relay
 	node.DHT = kadDHT
+	node.RecordDHT = recordDHT
+	node.ContentRouting = contentRouting
+	node.DHTMode = cfg.DHTMode
 	node.PubSub = ps
 	node.Relay = relayService
 
 	return node, nil
 }
 
-// getStaticRelayPeers returns a list of reliable relay peers
-func getStaticRelayPeers() []peer.AddrInfo {
-	// List of reliable public relay servers
-	relayAddrs := []string{
-		// libp2p public relays (updated addresses)
-		"/dnsaddr/bootstrap.libp2p.io/p2p/QmbLHAnMoJPWSCR5Zhtx6BHJX9KiKNN6tpvbUcqanj75Nb",
-		"/dnsaddr/bootstrap.libp2p.io/p2p/QmQCU2EcMqAqQPR2i9bChDtGNJchTbq5TbXJJ16u19uLTa",
-		// Additional circuit relay v2 servers
-		"/ip4/147.75.83.83/tcp/4001/p2p/QmbLHAnMoJPWSCR5Zhtx6BHJX9KiKNN6tpvbUcqanj75Nb",
-		"/ip4/147.75.77.187/tcp/4001/p2p/QmQCU2EcMqAqQPR2i9bChDtGNJchTbq5TbXJJ16u19uLTa",
-	}
-
-	var staticRelays []peer.AddrInfo
-	for _, addrStr := range relayAddrs {
-		addr, err := multiaddr.NewMultiaddr(addrStr)
-		if err != nil {
-			continue
-		}
-		peerInfo, err := peer.AddrInfoFromP2pAddr(addr)
+// transportOptions configures TCP, QUIC, WebSocket and WebTransport
+// A private network only supports TCP and WebSocket. With a TLS certificate
+// the WebSocket transport also serves and dials secure WebSocket
+func transportOptions(cfg NetworkConfig) (libp2p.Option, error) {
+	var wsOpts []interface{}
+	if cfg.TLSCert != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.TLSCert, cfg.TLSKey)
 		if err != nil {
-			continue
+			return nil, fmt.Errorf("failed to load TLS certificate: %w", err)
 		}
-		staticRelays = append(staticRelays, *peerInfo)
+		wsOpts = append(wsOpts, ws.WithTLSConfig(&tls.Config{Certificates: []tls.Certificate{cert}}))
 	}
 
-	return staticRelays
+	transports := []libp2p.Option{
+		libp2p.Transport(tcp.NewTCPTransport),
+		libp2p.Transport(ws.New, wsOpts...),
+	}
+	if cfg.SwarmKey == nil {
+		transports = append(transports,
+			libp2p.Transport(quic.NewTransport),
+			libp2p.Transport(webtransport.New),
+		)
+	}
+	return libp2p.ChainOptions(transports...), nil
 }
 
-// connectToBootstrapPeers connects to well-known bootstrap peers
-func connectToBootstrapPeers(ctx context.Context, h host.Host, verbose bool) error {
-	// These are IPFS bootstrap nodes
-	bootstrapPeers := []string{
-		"/dnsaddr/bootstrap.libp2p.io/p2p/QmNnooDu7bfjPFoTZYxMNLWUQJyrVwtbZg5gBMjTezGAJN",
-		"/dnsaddr/bootstrap.libp2p.io/p2p/QmQCU2EcMqAqQPR2i9bChDtGNJchTbq5TbXJJ16u19uLTa",
-		"/dnsaddr/bootstrap.libp2p.io/p2p/QmbLHAnMoJPWSCR5Zhtx6BHJX9KiKNN6tpvbUcqanj75Nb",
-		"/dnsaddr/bootstrap.libp2p.io/p2p/QmcZf59bWwK5XFi76CZX8cbJ4BhTzzA3gU1ZjYZcYW3dwt",
+// connectToBootstrapPeers connects to the configured bootstrap peers
+func connectToBootstrapPeers(ctx context.Context, h host.Host, bootstrapPeers []peer.AddrInfo, verbose bool) error {
+	if len(bootstrapPeers) == 0 {
+		if verbose {
+			fmt.Println("Note: No bootstrap peers configured")
+		}
+		return nil
 	}
 
 	connected := 0
-	for _, peerAddr := range bootstrapPeers {
-		addr, err := multiaddr.NewMultiaddr(peerAddr)
-		if err != nil {
-			continue
-		}
-
-		peerInfo, err := peer.AddrInfoFromP2pAddr(addr)
-		if err != nil {
-			continue
-		}
-
-		if err := h.Connect(ctx, *peerInfo); err != nil {
+	for _, peerInfo := range bootstrapPeers {
+		if err := h.Connect(ctx, peerInfo); err != nil {
 			if verbose {
 				fmt.Printf("Failed to connect to %s: %v\n", peerInfo.ID, err)
 			}
@@ -260,40 +361,11 @@ func connectToBootstrapPeers(ctx context.Context, h host.Host, verbose bool) err
 	return nil
 }
 
-// connectToRelayServers connects to public relay servers for NAT traversal
-func connectToRelayServers(ctx context.Context, h host.Host, verbose bool) error {
-	// Public relay servers (multiple sources for better reliability)
-	relayServers := []string{
-		// Official libp2p relay servers
-		"/ip4/147.75.83.83/tcp/4001/p2p/QmbLHAnMoJPWSCR5Zhtx6BHJX9KiKNN6tpvbUcqanj75Nb",
-		"/ip4/147.75.77.187/tcp/4001/p2p/QmQCU2EcMqAqQPR2i9bChDtGNJchTbq5TbXJJ16u19uLTa",
-		// DNS-based addresses for automatic failover
-		"/dnsaddr/bootstrap.libp2p.io/p2p/QmbLHAnMoJPWSCR5Zhtx6BHJX9KiKNN6tpvbUcqanj75Nb",
-		"/dnsaddr/bootstrap.libp2p.io/p2p/QmQCU2EcMqAqQPR2i9bChDtGNJchTbq5TbXJJ16u19uLTa",
-		"/dnsaddr/bootstrap.libp2p.io/p2p/QmcZf59bWwK5XFi76CZX8cbJ4BhTzzA3gU1ZjYZcYW3dwt",
-		// Additional bootstrap nodes that support relay
-		"/dnsaddr/bootstrap.libp2p.io/p2p/QmNnooDu7bfjPFoTZYxMNLWUQJyrVwtbZg5gBMjTezGAJN",
-	}
-
+// connectToRelayServers connects to the configured relay servers for NAT traversal
+func connectToRelayServers(ctx context.Context, h host.Host, relayServers []peer.AddrInfo, verbose bool) error {
 	connected := 0
-	for _, relayAddr := range relayServers {
-		addr, err := multiaddr.NewMultiaddr(relayAddr)
-		if err != nil {
-			if verbose {
-				fmt.Printf("Invalid relay address %s: %v\n", relayAddr, err)
-			}
-			continue
-		}
-
-		relayInfo, err := peer.AddrInfoFromP2pAddr(addr)
-		if err != nil {
-			if verbose {
-				fmt.Printf("Failed to parse relay address %s: %v\n", relayAddr, err)
-			}
-			continue
-		}
-
-		if err := h.Connect(ctx, *relayInfo); err != nil {
+	for _, relayInfo := range relayServers {
+		if err := h.Connect(ctx, relayInfo); err != nil {
 			if verbose {
 				fmt.Printf("Failed to connect to relay %s: %v\n", relayInfo.ID.ShortString(), err)
 			}
@@ -302,9 +374,6 @@ func connectToRelayServers(ctx context.Context, h host.Host, verbose bool) error
 			if verbose {
 				fmt.Printf("✓ Connected to relay server: %s\n", relayInfo.ID.ShortString())
 			}
-
-			// Reserve a slot on the relay for circuit connections
-			// This allows other peers to dial us through this relay
 		}
 	}
 
@@ -321,7 +390,7 @@ func connectToRelayServers(ctx context.Context, h host.Host, verbose bool) error
 
 // DiscoverPeers uses DHT to discover peers advertising the given namespace
 func (n *P2PNode) DiscoverPeers(ctx context.Context, namespace string) error {
-	routingDiscovery := drouting.NewRoutingDiscovery(n.DHT)
+	routingDiscovery := drouting.NewRoutingDiscovery(n.ContentRouting)
 
 	// Continuously advertise our presence (re-advertise every 5 minutes)
 	go func() {
@@ -493,8 +562,13 @@ func (n *P2PNode) Close() error {
 			fmt.Printf("Warning: failed to close relay: %v\n", err)
 		}
 	}
-	if err := n.DHT.Close(); err != nil {
+	if err := n.RecordDHT.Close(); err != nil {
 		return err
 	}
+	if n.DHT != n.RecordDHT {
+		if err := n.DHT.Close(); err != nil {
+			return err
+		}
+	}
 	return n.Host.Close()
 }
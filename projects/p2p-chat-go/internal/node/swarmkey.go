@@ -0,0 +1,86 @@
+package node
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/libp2p/go-libp2p/core/pnet"
+)
+
+// SwarmKeyFile is the name of the pre-shared key file in the data directory
+const SwarmKeyFile = "swarm.key"
+
+// swarmKeyHeader starts every key in swarm.key format
+const swarmKeyHeader = "/key/swarm/psk/1.0.0/\n/base16/\n"
+
+// LoadSwarmKey returns the pre-shared key of a private network, and where it
+// came from, or nil if the network is public
+// value is SWARM_KEY: the key in swarm.key format, its 64 hex digits or the
+// path of a key file. When it is empty, dataDir/swarm.key is used if present
+func LoadSwarmKey(value, dataDir string) (pnet.PSK, string, error) {
+	value = strings.TrimSpace(value)
+	switch {
+	case strings.HasPrefix(value, "/key/"):
+		psk, err := decodeSwarmKey([]byte(value))
+		return psk, "SWARM_KEY", err
+	case len(value) == 64 && isHex(value):
+		psk, err := decodeSwarmKey([]byte(swarmKeyHeader + value))
+		return psk, "SWARM_KEY", err
+	case value != "":
+		return readSwarmKey(value)
+	}
+
+	path := filepath.Join(dataDir, SwarmKeyFile)
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		return nil, "", nil
+	}
+	return readSwarmKey(path)
+}
+
+// readSwarmKey reads a swarm.key file
+func readSwarmKey(path string) (pnet.PSK, string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, path, fmt.Errorf("failed to read swarm key: %w", err)
+	}
+	psk, err := decodeSwarmKey(data)
+	return psk, path, err
+}
+
+// decodeSwarmKey decodes a key in swarm.key format
+func decodeSwarmKey(data []byte) (pnet.PSK, error) {
+	psk, err := pnet.DecodeV1PSK(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("invalid swarm key: %w", err)
+	}
+	return psk, nil
+}
+
+// isHex reports whether s only holds hex digits
+func isHex(s string) bool {
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+// GenerateSwarmKey returns a new random key in swarm.key format
+func GenerateSwarmKey() ([]byte, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("failed to generate swarm key: %w", err)
+	}
+	return []byte(swarmKeyHeader + hex.EncodeToString(key) + "\n"), nil
+}
+
+// SwarmKeyFingerprint identifies a key without revealing it, so peers can
+// check they share the same network
+func SwarmKeyFingerprint(psk pnet.PSK) string {
+	sum := sha256.Sum256(psk)
+	return hex.EncodeToString(sum[:8])
+}
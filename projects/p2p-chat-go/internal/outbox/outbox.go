@@ -0,0 +1,208 @@
+package outbox
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/geekp2p/p2p-chat-go/internal/messaging"
+)
+
+// flushInterval is how often the outbox checks for mesh peers
+const flushInterval = 2 * time.Second
+
+// Store persists queued messages
+type Store interface {
+	SaveOutboxEntry(id string, timestamp int64, data []byte, ttl time.Duration) error
+	GetOutboxEntries() ([][]byte, error)
+	DeleteOutboxEntry(id string, timestamp int64) error
+}
+
+// DeliveredFunc is called for each queued message once it has been published
+type DeliveredFunc func(msg *messaging.Message)
+
+// Outbox queues messages while the topic mesh is empty and republishes
+// them, with their original IDs and timestamps, once peers appear
+type Outbox struct {
+	ctx       context.Context
+	messaging *messaging.P2PMessaging
+	store     Store
+	verbose   bool
+
+	onDelivered DeliveredFunc
+
+	flushLock sync.Mutex // Serialises flushes so messages keep their order
+}
+
+// New creates an outbox and starts its flush loop
+func New(ctx context.Context, msg *messaging.P2PMessaging, store Store, verbose bool) *Outbox {
+	o := &Outbox{
+		ctx:       ctx,
+		messaging: msg,
+		store:     store,
+		verbose:   verbose,
+	}
+
+	go o.flushLoop()
+
+	return o
+}
+
+// SetDeliveredFunc sets the callback for queued messages that were sent
+func (o *Outbox) SetDeliveredFunc(f DeliveredFunc) {
+	o.flushLock.Lock()
+	defer o.flushLock.Unlock()
+	o.onDelivered = f
+}
+
+// Send publishes a prepared message, or queues it if nobody would receive it
+// It returns whether the message is pending in the outbox
+func (o *Outbox) Send(msg *messaging.Message) (bool, error) {
+	o.flushLock.Lock()
+	defer o.flushLock.Unlock()
+
+	// Keep ordering: if older messages are still queued, queue behind them
+	pending, err := o.Pending()
+	if err != nil {
+		return false, err
+	}
+
+	// Nobody would accept a disappearing message that already expired
+	if msg.Expired(time.Now()) {
+		return false, nil
+	}
+
+	if len(pending) == 0 && len(o.messaging.GetTopicPeers()) > 0 {
+		if err := o.messaging.Publish(msg); err != nil {
+			return false, err
+		}
+		return false, nil
+	}
+
+	if err := o.enqueue(msg); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// enqueue persists a message in the outbox
+// Disappearing messages are stored with their remaining lifetime, so the
+// store drops them on expiry even if the outbox never runs again
+func (o *Outbox) enqueue(msg *messaging.Message) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("failed to marshal message: %w", err)
+	}
+	var ttl time.Duration
+	if msg.Expires != 0 {
+		ttl = time.Until(time.Unix(msg.Expires, 0))
+	}
+	if err := o.store.SaveOutboxEntry(msg.ID, msg.Timestamp, data, ttl); err != nil {
+		return fmt.Errorf("failed to queue message: %w", err)
+	}
+	return nil
+}
+
+// Pending returns the queued messages, oldest first
+func (o *Outbox) Pending() ([]*messaging.Message, error) {
+	records, err := o.store.GetOutboxEntries()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read outbox: %w", err)
+	}
+
+	msgs := make([]*messaging.Message, 0, len(records))
+	for _, data := range records {
+		var msg messaging.Message
+		if err := json.Unmarshal(data, &msg); err != nil {
+			continue
+		}
+		msgs = append(msgs, &msg)
+	}
+	return msgs, nil
+}
+
+// DropExpired removes queued disappearing messages that have expired
+// It returns the number of messages dropped
+func (o *Outbox) DropExpired(now time.Time) (int, error) {
+	o.flushLock.Lock()
+	defer o.flushLock.Unlock()
+	return o.dropExpired(now)
+}
+
+// dropExpired removes expired messages; the caller holds flushLock
+func (o *Outbox) dropExpired(now time.Time) (int, error) {
+	pending, err := o.Pending()
+	if err != nil {
+		return 0, err
+	}
+
+	dropped := 0
+	for _, msg := range pending {
+		if !msg.Expired(now) {
+			continue
+		}
+		if err := o.store.DeleteOutboxEntry(msg.ID, msg.Timestamp); err != nil {
+			return dropped, fmt.Errorf("failed to dequeue message: %w", err)
+		}
+		dropped++
+	}
+	return dropped, nil
+}
+
+// Flush publishes queued messages if the mesh has peers
+// It returns the number of messages sent
+func (o *Outbox) Flush() (int, error) {
+	o.flushLock.Lock()
+	defer o.flushLock.Unlock()
+
+	// Disappearing messages that expired while queued are dropped, with or
+	// without peers to send the rest to
+	if _, err := o.dropExpired(time.Now()); err != nil {
+		return 0, err
+	}
+
+	if len(o.messaging.GetTopicPeers()) == 0 {
+		return 0, nil
+	}
+
+	pending, err := o.Pending()
+	if err != nil {
+		return 0, err
+	}
+
+	sent := 0
+	for _, msg := range pending {
+		if err := o.messaging.Publish(msg); err != nil {
+			return sent, err
+		}
+		if err := o.store.DeleteOutboxEntry(msg.ID, msg.Timestamp); err != nil {
+			return sent, fmt.Errorf("failed to dequeue message: %w", err)
+		}
+		sent++
+
+		if o.onDelivered != nil {
+			o.onDelivered(msg)
+		}
+	}
+
+	return sent, nil
+}
+
+// flushLoop periodically sends queued messages once peers are available
+func (o *Outbox) flushLoop() {
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if _, err := o.Flush(); err != nil && o.verbose {
+				fmt.Printf("Outbox flush failed: %v\n", err)
+			}
+		case <-o.ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,361 @@
+package roommeta
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	dhtstorage "github.com/geekp2p/p2p-chat-go/internal/dht"
+	"github.com/geekp2p/p2p-chat-go/internal/messaging"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// MessageType is the chat message type that carries signed room metadata
+const MessageType = "roommeta"
+
+// settingPrefix keys the latest known metadata of each room in the settings
+const settingPrefix = "roommeta:"
+
+// seqPrefix keys the sequence number of the last metadata we published
+const seqPrefix = "roommeta-seq:"
+
+// ErrNotAuthorized is returned when this node may not change the metadata
+var ErrNotAuthorized = errors.New("only room admins can change the room metadata")
+
+// ErrOutranked is returned when an admin edits metadata set by the owner
+var ErrOutranked = errors.New("the room owner set this metadata; only the owner can change it")
+
+// Authority decides who may publish a room's metadata
+// moderation.Manager implements it
+type Authority interface {
+	Owner() peer.ID
+	Admins() []peer.ID // Including the owner
+	IsAdmin(p peer.ID) bool
+}
+
+// Store persists the latest metadata so it is shown before any peer is reached,
+// and the sequence number of our own
+type Store interface {
+	GetSetting(key string) (string, error)
+	SetSetting(key, value string) error
+}
+
+// Publisher keeps metadata in the DHT; *dht.DistributedStorage implements it
+type Publisher interface {
+	PutRoomMeta(m *dhtstorage.RoomMeta) error
+	FetchRoomMeta(room string, publishers []peer.ID) ([]*dhtstorage.RoomMeta, error)
+}
+
+// Manager tracks the title, description, rules and pinned messages of a room
+//
+// Metadata is a signed record with a sequence number. Changes are broadcast
+// on the room topic for peers online now and stored in the DHT under the
+// publisher's key for peers that join later. Metadata of the owner wins over
+// that of admins; among records of the same rank the newest wins. Records of
+// peers that are no longer admins are dropped.
+type Manager struct {
+	ctx       context.Context
+	room      string
+	host      host.Host
+	priv      crypto.PrivKey
+	store     Store
+	messaging *messaging.P2PMessaging
+	auth      Authority // nil = anyone may publish
+	publisher Publisher // nil = topic only
+	verbose   bool
+
+	mu      sync.RWMutex
+	current *dhtstorage.RoomMeta
+}
+
+// NewManager creates a metadata manager for a room
+// It loads the saved metadata and registers a message validator
+func NewManager(ctx context.Context, h host.Host, msg *messaging.P2PMessaging, store Store, auth Authority, room string, verbose bool) (*Manager, error) {
+	priv := h.Peerstore().PrivKey(h.ID())
+	if priv == nil {
+		return nil, fmt.Errorf("no private key for local peer")
+	}
+
+	m := &Manager{
+		ctx:       ctx,
+		room:      room,
+		host:      h,
+		priv:      priv,
+		store:     store,
+		messaging: msg,
+		auth:      auth,
+		verbose:   verbose,
+	}
+
+	if err := m.load(); err != nil {
+		return nil, err
+	}
+
+	msg.AddValidator(m.validate)
+	go m.rebroadcastLoop()
+
+	return m, nil
+}
+
+// SetPublisher sets where metadata is kept for peers that join later
+func (m *Manager) SetPublisher(p Publisher) {
+	m.publisher = p
+}
+
+// load restores the saved metadata of the room
+func (m *Manager) load() error {
+	data, err := m.store.GetSetting(settingPrefix + m.room)
+	if err != nil {
+		return fmt.Errorf("failed to load room metadata: %w", err)
+	}
+	if data == "" {
+		return nil
+	}
+	meta, err := dhtstorage.ParseRoomMeta([]byte(data), time.Now())
+	if err != nil || meta.Room != m.room {
+		return nil // Ignore unreadable metadata; peers will send it again
+	}
+	m.current = meta
+	return nil
+}
+
+// Current returns a copy of the room's metadata, or nil if none is known
+// Metadata of a publisher who has lost admin rights no longer counts
+func (m *Manager) Current() *dhtstorage.RoomMeta {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.current == nil || m.rank(m.current.PublisherID()) == 0 {
+		return nil
+	}
+	meta := *m.current
+	meta.Pinned = append([]string(nil), m.current.Pinned...)
+	return &meta
+}
+
+// CanEdit reports whether this node may change the metadata
+func (m *Manager) CanEdit() bool {
+	return m.authorized(m.host.ID())
+}
+
+// authorized reports whether p may publish the metadata
+// Once moderation is in place only the owner and admins may; a room without
+// an owner has no one to publish it yet
+func (m *Manager) authorized(p peer.ID) bool {
+	if m.auth == nil {
+		return true
+	}
+	return m.auth.IsAdmin(p)
+}
+
+// rank orders publishers by moderation authority: the owner over admins
+// Peers that may not publish rank 0
+func (m *Manager) rank(p peer.ID) int {
+	switch {
+	case !m.authorized(p):
+		return 0
+	case m.auth != nil && p == m.auth.Owner():
+		return 2
+	default:
+		return 1
+	}
+}
+
+// supersedes reports whether meta replaces cur: the publisher with more
+// authority wins, then the newer record
+func (m *Manager) supersedes(meta, cur *dhtstorage.RoomMeta) bool {
+	if cur == nil {
+		return true
+	}
+	if r, c := m.rank(meta.PublisherID()), m.rank(cur.PublisherID()); r != c {
+		return r > c
+	}
+	return meta.Newer(cur)
+}
+
+// nextSeq returns the sequence number of the next metadata we publish
+// It follows both the saved number and cur, if we published it
+func (m *Manager) nextSeq(cur *dhtstorage.RoomMeta) (uint64, error) {
+	value, err := m.store.GetSetting(seqPrefix + m.room)
+	if err != nil {
+		return 0, fmt.Errorf("failed to load metadata sequence: %w", err)
+	}
+	seq, _ := strconv.ParseUint(value, 10, 64)
+	if cur != nil && cur.PublisherID() == m.host.ID() && cur.Seq > seq {
+		seq = cur.Seq
+	}
+	if seq == math.MaxUint64 {
+		return 0, errors.New("metadata sequence number is exhausted")
+	}
+	return seq + 1, nil
+}
+
+// Update changes the metadata with edit, signs it with the next sequence
+// number and publishes it on the room topic and in the DHT
+func (m *Manager) Update(edit func(meta *dhtstorage.RoomMeta) error) (*dhtstorage.RoomMeta, error) {
+	if !m.CanEdit() {
+		return nil, ErrNotAuthorized
+	}
+
+	meta := m.Current()
+	if meta == nil {
+		meta = &dhtstorage.RoomMeta{Room: m.room}
+	} else if m.rank(meta.PublisherID()) > m.rank(m.host.ID()) {
+		return nil, ErrOutranked
+	}
+	if err := edit(meta); err != nil {
+		return nil, err
+	}
+	seq, err := m.nextSeq(meta)
+	if err != nil {
+		return nil, err
+	}
+	meta.Seq = seq
+	if err := meta.Sign(m.priv); err != nil {
+		return nil, err
+	}
+	if err := meta.Verify(time.Now()); err != nil {
+		return nil, err
+	}
+	if !m.apply(meta) {
+		return nil, errors.New("the room metadata changed meanwhile, try again")
+	}
+	if err := m.store.SetSetting(seqPrefix+m.room, strconv.FormatUint(seq, 10)); err != nil {
+		return nil, fmt.Errorf("failed to save metadata sequence: %w", err)
+	}
+
+	if err := m.publish(meta); err != nil {
+		return meta, err
+	}
+	if m.publisher != nil {
+		go func() {
+			if err := m.publisher.PutRoomMeta(meta); err != nil && m.verbose {
+				fmt.Printf("Failed to store room metadata in the DHT: %v\n", err)
+			}
+		}()
+	}
+	return meta, nil
+}
+
+// Refresh looks up the metadata the owner and admins stored in the DHT
+// It returns true if newer metadata was found
+func (m *Manager) Refresh() (bool, error) {
+	if m.publisher == nil {
+		return false, nil
+	}
+
+	var publishers []peer.ID
+	if m.auth != nil {
+		publishers = m.auth.Admins()
+	} else if cur := m.Current(); cur != nil {
+		publishers = []peer.ID{cur.PublisherID()}
+	}
+	if len(publishers) == 0 {
+		return false, nil
+	}
+
+	found, err := m.publisher.FetchRoomMeta(m.room, publishers)
+	if err != nil {
+		return false, err
+	}
+	updated := false
+	for _, meta := range found {
+		if m.authorized(meta.PublisherID()) && m.apply(meta) {
+			updated = true
+		}
+	}
+	return updated, nil
+}
+
+// validate drops forged metadata and metadata of other rooms
+// Metadata from a peer we do not know as an admin is ignored, not rejected,
+// since the moderation event that made it one may not have reached us yet
+func (m *Manager) validate(author peer.ID, msg *messaging.Message) pubsub.ValidationResult {
+	if msg.Type != MessageType {
+		return pubsub.ValidationAccept
+	}
+	meta, err := dhtstorage.ParseRoomMeta([]byte(msg.Content), time.Now())
+	if err != nil || meta.Room != m.room {
+		return pubsub.ValidationReject
+	}
+	if !m.authorized(meta.PublisherID()) {
+		return pubsub.ValidationIgnore
+	}
+	return pubsub.ValidationAccept
+}
+
+// HandleMessage applies the metadata carried by a received message
+// It returns the metadata if it was newer than what we had
+func (m *Manager) HandleMessage(msg *messaging.Message) (*dhtstorage.RoomMeta, error) {
+	meta, err := dhtstorage.ParseRoomMeta([]byte(msg.Content), time.Now())
+	if err != nil {
+		return nil, err
+	}
+	if meta.Room != m.room {
+		return nil, fmt.Errorf("metadata of room %q", meta.Room)
+	}
+	if !m.authorized(meta.PublisherID()) {
+		return nil, ErrNotAuthorized
+	}
+	if !m.apply(meta) {
+		return nil, nil
+	}
+	return meta, nil
+}
+
+// apply records metadata if it supersedes the current metadata
+func (m *Manager) apply(meta *dhtstorage.RoomMeta) bool {
+	m.mu.Lock()
+	if !m.supersedes(meta, m.current) {
+		m.mu.Unlock()
+		return false
+	}
+	m.current = meta
+	m.mu.Unlock()
+
+	if data, err := json.Marshal(meta); err == nil {
+		if err := m.store.SetSetting(settingPrefix+m.room, string(data)); err != nil && m.verbose {
+			fmt.Printf("Warning: failed to save room metadata: %v\n", err)
+		}
+	}
+	return true
+}
+
+// publish sends signed metadata to the room
+func (m *Manager) publish(meta *dhtstorage.RoomMeta) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return fmt.Errorf("failed to marshal room metadata: %w", err)
+	}
+	_, err = m.messaging.PublishMessage(MessageType, string(data), "")
+	return err
+}
+
+// rebroadcastLoop periodically republishes the current metadata so that
+// peers who joined later and cannot reach the DHT learn it
+func (m *Manager) rebroadcastLoop() {
+	ticker := time.NewTicker(5 * time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			meta := m.Current()
+			if meta == nil || len(m.messaging.GetTopicPeers()) == 0 {
+				continue
+			}
+			if err := m.publish(meta); err != nil && m.verbose {
+				fmt.Printf("Failed to rebroadcast room metadata: %v\n", err)
+			}
+		case <-m.ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,267 @@
+package storage
+
+import (
+	"encoding/json"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v4"
+)
+
+// Store is a storage backend for everything a chat node keeps
+// MessageStore (badger, on disk) is the default; MemoryStore keeps nothing on
+// disk and serves ephemeral nodes and tests
+type Store interface {
+	Messages
+	Records
+	Contacts
+	Settings
+	DAG
+	Close() error
+}
+
+// Messages stores chat history
+type Messages interface {
+	SaveMessage(msg *Message) error
+	ImportMessage(msg *Message) (bool, error)
+	GetRecentMessages(room string, limit int) ([]*Message, error)
+	GetHistory(q HistoryQuery) (*HistoryPage, error)
+	GetMessagesInRange(room string, since, until int64) ([]*Message, error)
+	GetMessagesByAuthor(room, author string, limit int) ([]*Message, error)
+	GetThread(room, thread string, limit int) ([]*Message, error)
+	GetMessageRefs(room string, since int64) ([]MessageRef, error)
+	GetMessagesByID(room string, ids []string) ([]*Message, error)
+	StreamMessages(room string, since, until int64, fn func(msg *Message) error) error
+	Search(q SearchQuery) ([]*SearchResult, error)
+	Rooms() ([]string, error)
+	GetMessageCount() (int, error)
+
+	DeleteMessagesInRange(room string, since, until int64) (int, error)
+	TrimRoom(room string, keep int) (int, error)
+	ClearOldMessages(days int) (int, error)
+	ClearAllMessages() (int, error)
+	PurgeExpiredMessages(now time.Time) ([]string, error)
+	ApplyRetention(r Retention, now time.Time) (int, error)
+	CollectGarbage() (int, error)
+}
+
+// Records stores opaque records of the moderation log, mailbox, outbox, DHT
+// cache and DHT reprovider
+type Records interface {
+	SaveModerationEvent(room, id string, data []byte) error
+	GetModerationEvents(room string) ([][]byte, error)
+
+	PutMailboxEnvelope(recipient, id string, data []byte, ttl time.Duration) error
+	GetMailboxEnvelopes(recipient string) ([][]byte, error)
+	DeleteMailboxEnvelopes(recipient string, ids []string) error
+	SaveMailboxMember(room, peerID string, data []byte, ttl time.Duration) error
+	GetMailboxMembers(room string) ([][]byte, error)
+
+	SaveOutboxEntry(id string, timestamp int64, data []byte, ttl time.Duration) error
+	GetOutboxEntries() ([][]byte, error)
+	DeleteOutboxEntry(id string, timestamp int64) error
+
+	SaveCacheEntry(id string, data []byte, ttl time.Duration) error
+	GetCacheEntries() ([][]byte, error)
+	DeleteCacheEntries(ids []string) error
+
+	SaveProvideEntry(cid string, data []byte) error
+	GetProvideEntries() ([][]byte, error)
+	DeleteProvideEntries(cids []string) error
+}
+
+// Contact is a peer this node has seen in a room
+type Contact struct {
+	PeerID  string `json:"peer_id"`
+	Name    string `json:"name"`    // Last display name the peer used
+	Updated int64  `json:"updated"` // Unix time the name was recorded
+}
+
+// Contacts stores known peers and their display names
+type Contacts interface {
+	SaveContact(c *Contact) error
+	GetContact(peerID string) (*Contact, error) // nil if unknown
+	GetContacts() ([]*Contact, error)
+	DeleteContact(peerID string) error
+}
+
+// Settings stores local preferences as string key/value pairs
+type Settings interface {
+	GetSetting(key string) (string, error) // "" if not set
+	SetSetting(key, value string) error
+	DeleteSetting(key string) error
+}
+
+// Compile-time checks that both backends implement Store
+var (
+	_ Store = (*MessageStore)(nil)
+	_ Store = (*MemoryStore)(nil)
+)
+
+// Contact and setting keys
+const (
+	contactPrefix = "contact_"
+	settingPrefix = "setting_"
+)
+
+// SaveContact records or updates a known peer
+func (s *MessageStore) SaveContact(c *Contact) error {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte(contactPrefix+c.PeerID), data)
+	})
+}
+
+// GetContact returns a known peer, or nil if the peer is unknown
+func (s *MessageStore) GetContact(peerID string) (*Contact, error) {
+	var contact *Contact
+	err := s.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(contactPrefix + peerID))
+		if err == badger.ErrKeyNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return item.Value(func(val []byte) error {
+			contact = &Contact{}
+			return json.Unmarshal(val, contact)
+		})
+	})
+	return contact, err
+}
+
+// GetContacts returns every known peer, ordered by peer ID
+func (s *MessageStore) GetContacts() ([]*Contact, error) {
+	values, err := s.getPrefix(contactPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	contacts := make([]*Contact, 0, len(values))
+	for _, data := range values {
+		var c Contact
+		if err := json.Unmarshal(data, &c); err != nil {
+			continue // Skip unreadable entries
+		}
+		contacts = append(contacts, &c)
+	}
+	return contacts, nil
+}
+
+// DeleteContact forgets a peer
+func (s *MessageStore) DeleteContact(peerID string) error {
+	return s.db.Update(func(txn *badger.Txn) error {
+		return txn.Delete([]byte(contactPrefix + peerID))
+	})
+}
+
+// GetSetting returns a setting, or "" if it is not set
+func (s *MessageStore) GetSetting(key string) (string, error) {
+	var value string
+	err := s.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(settingPrefix + key))
+		if err == badger.ErrKeyNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		data, err := item.ValueCopy(nil)
+		value = string(data)
+		return err
+	})
+	return value, err
+}
+
+// SetSetting stores a setting
+func (s *MessageStore) SetSetting(key, value string) error {
+	return s.db.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte(settingPrefix+key), []byte(value))
+	})
+}
+
+// DeleteSetting removes a setting
+func (s *MessageStore) DeleteSetting(key string) error {
+	return s.db.Update(func(txn *badger.Txn) error {
+		return txn.Delete([]byte(settingPrefix + key))
+	})
+}
+
+// roomPruner is the part of a backend the shared cleanup helpers need
+type roomPruner interface {
+	Rooms() ([]string, error)
+	DeleteMessagesInRange(room string, since, until int64) (int, error)
+	TrimRoom(room string, keep int) (int, error)
+	PruneDAGTombstones(room string, before int64) (int, error)
+	dagRooms() ([]string, error)
+}
+
+// deleteFromAllRooms deletes the messages with since <= timestamp < until in
+// every room; until <= 0 means no upper bound
+func deleteFromAllRooms(s roomPruner, since, until int64) (int, error) {
+	rooms, err := s.Rooms()
+	if err != nil {
+		return 0, err
+	}
+
+	deletedCount := 0
+	for _, room := range rooms {
+		deleted, err := s.DeleteMessagesInRange(room, since, until)
+		deletedCount += deleted
+		if err != nil {
+			return deletedCount, err
+		}
+	}
+	return deletedCount, nil
+}
+
+// applyRetention enforces retention policies room by room
+func applyRetention(s roomPruner, r Retention, now time.Time) (int, error) {
+	if r.IsZero() {
+		return 0, nil
+	}
+
+	rooms, err := s.Rooms()
+	if err != nil {
+		return 0, err
+	}
+
+	deleted := 0
+	for _, room := range rooms {
+		policy := r.For(room)
+
+		if policy.MaxAge > 0 {
+			n, err := s.DeleteMessagesInRange(room, 0, now.Add(-policy.MaxAge).Unix())
+			deleted += n
+			if err != nil {
+				return deleted, err
+			}
+		}
+		if policy.MaxCount > 0 {
+			n, err := s.TrimRoom(room, policy.MaxCount)
+			deleted += n
+			if err != nil {
+				return deleted, err
+			}
+		}
+	}
+
+	// Tombstones outlive their messages by at most the room's age limit,
+	// including in rooms whose messages are all gone
+	dagRooms, err := s.dagRooms()
+	if err != nil {
+		return deleted, err
+	}
+	for _, room := range dagRooms {
+		if policy := r.For(room); policy.MaxAge > 0 {
+			if _, err := s.PruneDAGTombstones(room, now.Add(-policy.MaxAge).Unix()); err != nil {
+				return deleted, err
+			}
+		}
+	}
+
+	return deleted, nil
+}
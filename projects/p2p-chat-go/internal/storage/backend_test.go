@@ -0,0 +1,494 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+const testRoom = "test-room"
+
+// backends opens every storage backend, so each test checks that they agree
+var backends = []struct {
+	name string
+	open func(t *testing.T) Store
+}{
+	{"memory", func(t *testing.T) Store {
+		return NewMemoryStore()
+	}},
+	{"badger", func(t *testing.T) Store {
+		s, err := NewMessageStore(t.TempDir(), Options{DefaultRoom: testRoom})
+		if err != nil {
+			t.Fatalf("failed to open message store: %v", err)
+		}
+		t.Cleanup(func() { s.Close() })
+		return s
+	}},
+}
+
+// forEachBackend runs a test against every backend
+func forEachBackend(t *testing.T, test func(t *testing.T, s Store)) {
+	for _, b := range backends {
+		t.Run(b.name, func(t *testing.T) {
+			test(t, b.open(t))
+		})
+	}
+}
+
+// testMessage returns message n of a room, stamped n seconds after base
+func testMessage(n int, base int64) *Message {
+	return &Message{
+		ID:        fmt.Sprintf("m%02d", n),
+		Type:      "message",
+		Content:   fmt.Sprintf("message %d", n),
+		Username:  "alice",
+		Timestamp: base + int64(n),
+		From:      "peer-alice",
+		Room:      testRoom,
+	}
+}
+
+// fill saves messages 1..n stamped from base
+func fill(t *testing.T, s Store, n int, base int64) {
+	t.Helper()
+	for i := 1; i <= n; i++ {
+		if err := s.SaveMessage(testMessage(i, base)); err != nil {
+			t.Fatalf("SaveMessage(%d): %v", i, err)
+		}
+	}
+}
+
+// ids returns the IDs of messages in order
+func ids(msgs []*Message) string {
+	out := ""
+	for i, msg := range msgs {
+		if i > 0 {
+			out += ","
+		}
+		out += msg.ID
+	}
+	return out
+}
+
+// remaining returns the IDs of every message left in the test room
+func remaining(t *testing.T, s Store) string {
+	t.Helper()
+	msgs, err := s.GetMessagesInRange(testRoom, 0, 0)
+	if err != nil {
+		t.Fatalf("GetMessagesInRange: %v", err)
+	}
+	return ids(msgs)
+}
+
+func TestSaveAndImportMessage(t *testing.T) {
+	// Every case starts with m01 stored
+	tests := []struct {
+		name   string
+		run    func(s Store) (bool, error)
+		stored bool
+		err    error
+		want   string // IDs stored afterwards
+		m01    string // Content of m01 afterwards
+	}{
+		{
+			name:   "import new message",
+			run:    func(s Store) (bool, error) { return s.ImportMessage(testMessage(2, 1000)) },
+			stored: true,
+			want:   "m01,m02",
+			m01:    "message 1",
+		},
+		{
+			name: "import keeps the first copy",
+			run: func(s Store) (bool, error) {
+				msg := testMessage(1, 1000)
+				msg.Content = "forged"
+				return s.ImportMessage(msg)
+			},
+			want: "m01",
+			m01:  "message 1",
+		},
+		{
+			name: "import rejects another author",
+			run: func(s Store) (bool, error) {
+				msg := testMessage(1, 1000)
+				msg.From, msg.Content = "peer-mallory", "forged"
+				return s.ImportMessage(msg)
+			},
+			want: "m01",
+			m01:  "message 1",
+		},
+		{
+			name: "save lets the author edit",
+			run: func(s Store) (bool, error) {
+				msg := testMessage(1, 1000)
+				msg.Content = "edited"
+				return true, s.SaveMessage(msg)
+			},
+			stored: true,
+			want:   "m01",
+			m01:    "edited",
+		},
+		{
+			name: "save rejects another author",
+			run: func(s Store) (bool, error) {
+				msg := testMessage(1, 1000)
+				msg.From, msg.Content = "peer-mallory", "forged"
+				return false, s.SaveMessage(msg)
+			},
+			err:  ErrIDInUse,
+			want: "m01",
+			m01:  "message 1",
+		},
+		{
+			name: "import skips expired messages",
+			run: func(s Store) (bool, error) {
+				msg := testMessage(2, 1000)
+				msg.Expires = time.Now().Add(-time.Minute).Unix()
+				return s.ImportMessage(msg)
+			},
+			want: "m01",
+			m01:  "message 1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			forEachBackend(t, func(t *testing.T, s Store) {
+				fill(t, s, 1, 1000)
+
+				stored, err := tt.run(s)
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("error = %v, want %v", err, tt.err)
+				}
+				if stored != tt.stored {
+					t.Errorf("stored = %v, want %v", stored, tt.stored)
+				}
+
+				if got := remaining(t, s); got != tt.want {
+					t.Errorf("stored IDs = %s, want %s", got, tt.want)
+				}
+				msgs, err := s.GetMessagesByID(testRoom, []string{"m01"})
+				if err != nil || len(msgs) != 1 {
+					t.Fatalf("GetMessagesByID = %d message(s), %v", len(msgs), err)
+				}
+				if msgs[0].Content != tt.m01 {
+					t.Errorf("m01 content = %q, want %q", msgs[0].Content, tt.m01)
+				}
+			})
+		})
+	}
+}
+
+func TestGetHistoryCursors(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   HistoryQuery
+		want    string
+		hasMore bool
+	}{
+		{"newest page", HistoryQuery{Limit: 3}, "m08,m09,m10", true},
+		{"before cursor", HistoryQuery{Limit: 3, Before: "m08"}, "m05,m06,m07", true},
+		{"before reaches the start", HistoryQuery{Limit: 3, Before: "m03"}, "m01,m02", false},
+		{"after cursor", HistoryQuery{Limit: 3, After: "m02"}, "m03,m04,m05", true},
+		{"after reaches the end", HistoryQuery{Limit: 3, After: "m08"}, "m09,m10", false},
+		{"between cursors", HistoryQuery{Limit: 10, After: "m03", Before: "m07"}, "m04,m05,m06", false},
+		{"time range", HistoryQuery{Limit: 10, Since: 1004, Until: 1007}, "m04,m05,m06", false},
+		{"default page size", HistoryQuery{}, "m01,m02,m03,m04,m05,m06,m07,m08,m09,m10", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			forEachBackend(t, func(t *testing.T, s Store) {
+				fill(t, s, 10, 1000)
+
+				q := tt.query
+				q.Room = testRoom
+				page, err := s.GetHistory(q)
+				if err != nil {
+					t.Fatalf("GetHistory: %v", err)
+				}
+				if got := ids(page.Messages); got != tt.want {
+					t.Errorf("messages = %s, want %s", got, tt.want)
+				}
+				if page.HasMore != tt.hasMore {
+					t.Errorf("HasMore = %v, want %v", page.HasMore, tt.hasMore)
+				}
+			})
+		})
+	}
+
+	t.Run("unknown cursor", func(t *testing.T) {
+		forEachBackend(t, func(t *testing.T, s Store) {
+			fill(t, s, 3, 1000)
+			if _, err := s.GetHistory(HistoryQuery{Room: testRoom, Before: "nope"}); err == nil {
+				t.Error("expected an error for an unknown cursor")
+			}
+		})
+	})
+}
+
+func TestTrimRoom(t *testing.T) {
+	tests := []struct {
+		name    string
+		keep    int
+		deleted int
+		want    string
+	}{
+		{"keeps the newest", 3, 2, "m03,m04,m05"},
+		{"nothing to trim", 5, 0, "m01,m02,m03,m04,m05"},
+		{"keep none", 0, 5, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			forEachBackend(t, func(t *testing.T, s Store) {
+				fill(t, s, 5, 1000)
+
+				deleted, err := s.TrimRoom(testRoom, tt.keep)
+				if err != nil {
+					t.Fatalf("TrimRoom: %v", err)
+				}
+				if deleted != tt.deleted {
+					t.Errorf("deleted = %d, want %d", deleted, tt.deleted)
+				}
+				if got := remaining(t, s); got != tt.want {
+					t.Errorf("remaining = %s, want %s", got, tt.want)
+				}
+			})
+		})
+	}
+}
+
+func TestPurgeExpiredMessages(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, s Store) {
+		now := time.Now()
+		fill(t, s, 3, now.Unix()-100)
+
+		expiring := testMessage(4, now.Unix()-100)
+		expiring.Expires = now.Add(time.Minute).Unix()
+		if err := s.SaveMessage(expiring); err != nil {
+			t.Fatalf("SaveMessage: %v", err)
+		}
+
+		if purged, err := s.PurgeExpiredMessages(now); err != nil || len(purged) != 0 {
+			t.Fatalf("purged %v (%v) before expiry", purged, err)
+		}
+
+		purged, err := s.PurgeExpiredMessages(now.Add(2 * time.Minute))
+		if err != nil {
+			t.Fatalf("PurgeExpiredMessages: %v", err)
+		}
+		if len(purged) != 1 || purged[0] != "m04" {
+			t.Errorf("purged = %v, want [m04]", purged)
+		}
+		if got := remaining(t, s); got != "m01,m02,m03" {
+			t.Errorf("remaining = %s, want m01,m02,m03", got)
+		}
+	})
+}
+
+func TestOutboxEntryTTL(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, s Store) {
+		if err := s.SaveOutboxEntry("kept", 1, []byte("kept"), 0); err != nil {
+			t.Fatalf("SaveOutboxEntry: %v", err)
+		}
+		if err := s.SaveOutboxEntry("expiring", 2, []byte("expiring"), time.Second); err != nil {
+			t.Fatalf("SaveOutboxEntry: %v", err)
+		}
+		if entries, _ := s.GetOutboxEntries(); len(entries) != 2 {
+			t.Fatalf("got %d entries before expiry, want 2", len(entries))
+		}
+
+		// Badger stores expiry in whole seconds
+		time.Sleep(2 * time.Second)
+
+		entries, err := s.GetOutboxEntries()
+		if err != nil {
+			t.Fatalf("GetOutboxEntries: %v", err)
+		}
+		if len(entries) != 1 || string(entries[0]) != "kept" {
+			t.Errorf("entries after expiry = %q, want [kept]", entries)
+		}
+	})
+}
+
+func TestApplyRetention(t *testing.T) {
+	now := time.Now()
+	hour := int64(time.Hour / time.Second)
+
+	tests := []struct {
+		name      string
+		retention Retention
+		deleted   int
+		want      string
+	}{
+		{"no limits", Retention{}, 0, "m01,m02,m03,m04,m05,m06"},
+		{"global age", Retention{Global: RetentionPolicy{MaxAge: 3 * time.Hour}}, 3, "m04,m05,m06"},
+		{"global count", Retention{Global: RetentionPolicy{MaxCount: 2}}, 4, "m05,m06"},
+		{
+			name: "room override replaces the global limit",
+			retention: Retention{
+				Global: RetentionPolicy{MaxCount: 2},
+				Rooms:  map[string]RetentionPolicy{testRoom: {MaxCount: 4}},
+			},
+			deleted: 2,
+			want:    "m03,m04,m05,m06",
+		},
+		{
+			name: "other rooms are not affected",
+			retention: Retention{
+				Rooms: map[string]RetentionPolicy{"elsewhere": {MaxCount: 1}},
+			},
+			want: "m01,m02,m03,m04,m05,m06",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			forEachBackend(t, func(t *testing.T, s Store) {
+				// Message n is 7-n hours old: m01 is 6 hours old, m06 one hour
+				for i := 1; i <= 6; i++ {
+					msg := testMessage(i, 0)
+					msg.Timestamp = now.Unix() - int64(7-i)*hour
+					if err := s.SaveMessage(msg); err != nil {
+						t.Fatalf("SaveMessage(%d): %v", i, err)
+					}
+				}
+
+				deleted, err := s.ApplyRetention(tt.retention, now)
+				if err != nil {
+					t.Fatalf("ApplyRetention: %v", err)
+				}
+				if deleted != tt.deleted {
+					t.Errorf("deleted = %d, want %d", deleted, tt.deleted)
+				}
+				if got := remaining(t, s); got != tt.want {
+					t.Errorf("remaining = %s, want %s", got, tt.want)
+				}
+			})
+		})
+	}
+}
+
+// link adds the DAG node of a stored message, named after its ID
+func link(t *testing.T, s Store, msg *Message, parents ...string) {
+	t.Helper()
+	node := &DAGNode{
+		CID:       "cid-" + msg.ID,
+		MessageID: msg.ID,
+		Parents:   parents,
+		Timestamp: msg.Timestamp,
+		From:      msg.From,
+	}
+	if _, err := s.AddDAGNode(testRoom, node); err != nil {
+		t.Fatalf("AddDAGNode(%s): %v", msg.ID, err)
+	}
+}
+
+func TestDAGTombstones(t *testing.T) {
+	now := time.Now()
+
+	tests := []struct {
+		name   string
+		delete func(s Store) error
+	}{
+		{"trim", func(s Store) error {
+			_, err := s.TrimRoom(testRoom, 1)
+			return err
+		}},
+		{"delete range", func(s Store) error {
+			_, err := s.DeleteMessagesInRange(testRoom, 0, now.Unix())
+			return err
+		}},
+		{"clear", func(s Store) error {
+			_, err := s.ClearAllMessages()
+			return err
+		}},
+		{"expire", func(s Store) error {
+			_, err := s.PurgeExpiredMessages(now.Add(2 * time.Hour))
+			return err
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			forEachBackend(t, func(t *testing.T, s Store) {
+				old := testMessage(1, now.Unix()-100)
+				old.Expires = now.Add(time.Hour).Unix()
+				if err := s.SaveMessage(old); err != nil {
+					t.Fatalf("SaveMessage: %v", err)
+				}
+				link(t, s, old)
+				newer := testMessage(2, now.Unix())
+				if err := s.SaveMessage(newer); err != nil {
+					t.Fatalf("SaveMessage: %v", err)
+				}
+				link(t, s, newer, "cid-m01")
+
+				if err := tt.delete(s); err != nil {
+					t.Fatalf("delete: %v", err)
+				}
+
+				n, err := s.GetDAGNode(testRoom, "cid-m01")
+				if err != nil || n == nil {
+					t.Fatalf("GetDAGNode = %v, %v; want a tombstone", n, err)
+				}
+				if !n.IsTombstone() || n.From != "" || n.Timestamp != 0 || n.Deleted == 0 {
+					t.Errorf("node of a deleted message = %+v, want a tombstone", n)
+				}
+				if missing, _ := s.DAGMissing(testRoom); len(missing) != 0 {
+					t.Errorf("deleted message left a gap: %v", missing)
+				}
+			})
+		})
+	}
+
+	t.Run("editing keeps the node", func(t *testing.T) {
+		forEachBackend(t, func(t *testing.T, s Store) {
+			msg := testMessage(1, now.Unix())
+			if err := s.SaveMessage(msg); err != nil {
+				t.Fatalf("SaveMessage: %v", err)
+			}
+			link(t, s, msg)
+			msg.Content = "edited"
+			if err := s.SaveMessage(msg); err != nil {
+				t.Fatalf("SaveMessage: %v", err)
+			}
+			if n, _ := s.GetDAGNode(testRoom, "cid-m01"); n == nil || n.IsTombstone() {
+				t.Errorf("node after an edit = %+v, want it kept", n)
+			}
+		})
+	})
+
+	t.Run("retention prunes old tombstones", func(t *testing.T) {
+		forEachBackend(t, func(t *testing.T, s Store) {
+			msg := testMessage(1, now.Unix())
+			if err := s.SaveMessage(msg); err != nil {
+				t.Fatalf("SaveMessage: %v", err)
+			}
+			link(t, s, msg)
+			if _, err := s.ClearAllMessages(); err != nil {
+				t.Fatalf("ClearAllMessages: %v", err)
+			}
+
+			policy := Retention{Global: RetentionPolicy{MaxAge: time.Hour}}
+			if _, err := s.ApplyRetention(policy, now); err != nil {
+				t.Fatalf("ApplyRetention: %v", err)
+			}
+			if n, _ := s.GetDAGNode(testRoom, "cid-m01"); n == nil {
+				t.Fatal("a fresh tombstone was pruned")
+			}
+
+			if _, err := s.ApplyRetention(policy, now.Add(2*time.Hour)); err != nil {
+				t.Fatalf("ApplyRetention: %v", err)
+			}
+			if n, _ := s.GetDAGNode(testRoom, "cid-m01"); n != nil {
+				t.Errorf("tombstone older than the room's age limit = %+v, want it pruned", n)
+			}
+			if heads, _ := s.DAGHeads(testRoom); len(heads) != 0 {
+				t.Errorf("heads = %v, want the pruned tombstone gone", heads)
+			}
+		})
+	})
+}
@@ -0,0 +1,302 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+
+	badger "github.com/dgraph-io/badger/v4"
+)
+
+// Message DAG keyspace
+//
+//	dn:<room>\x00<cid>  -> DAGNode JSON
+//	dh:<room>\x00<cid>  -> (empty) node no stored node points to yet
+//	dm:<room>\x00<cid>  -> (empty) parent referenced but not stored: a gap
+//	dx:<room>\x00<id>   -> CID of the node of a stored message
+//
+// Deleting or expiring a message turns its node into a tombstone in the same
+// transaction: only the CID and parents are kept, so trimmed history is not
+// mistaken for a gap but nothing records who posted or when. Retention prunes
+// tombstones once they are older than the room's age limit.
+const (
+	dagNodePrefix    = "dn:"
+	dagHeadPrefix    = "dh:"
+	dagMissingPrefix = "dm:"
+	dagMessagePrefix = "dx:"
+)
+
+// DAGNode is a message's place in its room's hash-linked history
+type DAGNode struct {
+	CID       string   `json:"cid"`
+	MessageID string   `json:"message_id"`
+	Parents   []string `json:"parents,omitempty"` // CIDs of the heads the author had seen
+	Timestamp int64    `json:"timestamp"`
+	From      string   `json:"from"`
+	Deleted   int64    `json:"deleted,omitempty"` // Tombstones: Unix time the message was deleted
+}
+
+// Tombstone returns the node left behind once its message is deleted at now
+func (n *DAGNode) Tombstone(now int64) *DAGNode {
+	return &DAGNode{CID: n.CID, Parents: n.Parents, Deleted: now}
+}
+
+// IsTombstone reports whether the node's message has been deleted
+func (n *DAGNode) IsTombstone() bool {
+	return n.MessageID == ""
+}
+
+// DAG stores the hash-linked message log of each room
+type DAG interface {
+	// AddDAGNode stores a node and updates the room's heads and gaps
+	// It returns false if the node was already stored
+	AddDAGNode(room string, n *DAGNode) (bool, error)
+	GetDAGNode(room, cid string) (*DAGNode, error) // nil if unknown
+	GetDAGNodes(room string) ([]*DAGNode, error)
+	DAGHeads(room string) ([]string, error)   // Sorted
+	DAGMissing(room string) ([]string, error) // Sorted
+	// PruneDAGTombstones deletes the tombstones of messages deleted before
+	// the given Unix time and returns how many were removed
+	PruneDAGTombstones(room string, before int64) (int, error)
+}
+
+// dagKey builds a DAG key of a room
+func dagKey(prefix, room, cid string) []byte {
+	key := append([]byte(prefix+room), keySep)
+	return append(key, cid...)
+}
+
+// AddDAGNode stores a node and updates the room's heads and gaps
+func (s *MessageStore) AddDAGNode(room string, n *DAGNode) (bool, error) {
+	data, err := json.Marshal(n)
+	if err != nil {
+		return false, err
+	}
+
+	added := false
+	err = s.db.Update(func(txn *badger.Txn) error {
+		exists := func(prefix, cid string) (bool, error) {
+			_, err := txn.Get(dagKey(prefix, room, cid))
+			if err == badger.ErrKeyNotFound {
+				return false, nil
+			}
+			return err == nil, err
+		}
+
+		if ok, err := exists(dagNodePrefix, n.CID); ok || err != nil {
+			return err
+		}
+		added = true
+		if err := txn.Set(dagKey(dagNodePrefix, room, n.CID), data); err != nil {
+			return err
+		}
+		if !n.IsTombstone() {
+			if err := txn.Set(dagKey(dagMessagePrefix, room, n.MessageID), []byte(n.CID)); err != nil {
+				return err
+			}
+		}
+
+		// A node some child already referenced is neither a gap nor a head
+		hadChildren, err := exists(dagMissingPrefix, n.CID)
+		if err != nil {
+			return err
+		}
+		if hadChildren {
+			if err := txn.Delete(dagKey(dagMissingPrefix, room, n.CID)); err != nil {
+				return err
+			}
+		} else if err := txn.Set(dagKey(dagHeadPrefix, room, n.CID), nil); err != nil {
+			return err
+		}
+
+		for _, parent := range n.Parents {
+			stored, err := exists(dagNodePrefix, parent)
+			if err != nil {
+				return err
+			}
+			if stored {
+				err = txn.Delete(dagKey(dagHeadPrefix, room, parent))
+			} else {
+				err = txn.Set(dagKey(dagMissingPrefix, room, parent), nil)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return added, err
+}
+
+// GetDAGNode returns a node, or nil if it is not stored
+func (s *MessageStore) GetDAGNode(room, cid string) (*DAGNode, error) {
+	var node *DAGNode
+	err := s.db.View(func(txn *badger.Txn) error {
+		var err error
+		node, err = loadDAGNode(txn, room, cid)
+		return err
+	})
+	return node, err
+}
+
+// loadDAGNode reads a node, or nil if it is not stored
+func loadDAGNode(txn *badger.Txn, room, cid string) (*DAGNode, error) {
+	item, err := txn.Get(dagKey(dagNodePrefix, room, cid))
+	if err == badger.ErrKeyNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var node DAGNode
+	if err := item.Value(func(val []byte) error {
+		return json.Unmarshal(val, &node)
+	}); err != nil {
+		return nil, err
+	}
+	return &node, nil
+}
+
+// tombstoneDAGNode turns the node of a deleted message into a tombstone
+func tombstoneDAGNode(txn *badger.Txn, room, id string, now int64) error {
+	item, err := txn.Get(dagKey(dagMessagePrefix, room, id))
+	if err == badger.ErrKeyNotFound {
+		return nil // The message was never linked
+	}
+	if err != nil {
+		return err
+	}
+	cid, err := item.ValueCopy(nil)
+	if err != nil {
+		return err
+	}
+	if err := txn.Delete(dagKey(dagMessagePrefix, room, id)); err != nil {
+		return err
+	}
+
+	node, err := loadDAGNode(txn, room, string(cid))
+	if err != nil || node == nil {
+		return err
+	}
+	data, err := json.Marshal(node.Tombstone(now))
+	if err != nil {
+		return err
+	}
+	return txn.Set(dagKey(dagNodePrefix, room, node.CID), data)
+}
+
+// PruneDAGTombstones deletes the tombstones of messages deleted before the
+// given Unix time
+// Children of a pruned tombstone keep naming it, which is not a gap: a gap
+// is only recorded when a node is added
+func (s *MessageStore) PruneDAGTombstones(room string, before int64) (int, error) {
+	nodes, err := s.GetDAGNodes(room)
+	if err != nil {
+		return 0, err
+	}
+
+	var doomed []string
+	for _, n := range nodes {
+		if n.IsTombstone() && n.Deleted < before {
+			doomed = append(doomed, n.CID)
+		}
+	}
+
+	pruned := 0
+	for len(doomed) > 0 {
+		batch := doomed
+		if len(batch) > deleteBatchSize {
+			batch = batch[:deleteBatchSize]
+		}
+		err := s.db.Update(func(txn *badger.Txn) error {
+			for _, cid := range batch {
+				if err := txn.Delete(dagKey(dagNodePrefix, room, cid)); err != nil {
+					return err
+				}
+				if err := txn.Delete(dagKey(dagHeadPrefix, room, cid)); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return pruned, err
+		}
+		pruned += len(batch)
+		doomed = doomed[len(batch):]
+	}
+	return pruned, nil
+}
+
+// GetDAGNodes returns every node of a room, ordered by CID
+func (s *MessageStore) GetDAGNodes(room string) ([]*DAGNode, error) {
+	values, err := s.getPrefix(string(dagKey(dagNodePrefix, room, "")))
+	if err != nil {
+		return nil, err
+	}
+
+	nodes := make([]*DAGNode, 0, len(values))
+	for _, data := range values {
+		var n DAGNode
+		if err := json.Unmarshal(data, &n); err != nil {
+			continue // Skip unreadable entries
+		}
+		nodes = append(nodes, &n)
+	}
+	return nodes, nil
+}
+
+// dagRooms returns the rooms that have DAG nodes
+func (s *MessageStore) dagRooms() ([]string, error) {
+	var rooms []string
+	err := s.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		p := []byte(dagNodePrefix)
+		for it.Seek(p); it.ValidForPrefix(p); {
+			rest := it.Item().Key()[len(p):]
+			sep := bytes.IndexByte(rest, keySep)
+			if sep < 0 {
+				it.Next()
+				continue
+			}
+			room := string(rest[:sep])
+			rooms = append(rooms, room)
+			it.Seek(prefixEnd(dagKey(dagNodePrefix, room, ""))) // Skip to the next room
+		}
+		return nil
+	})
+	return rooms, err
+}
+
+// DAGHeads returns the CIDs of the room's nodes that nothing points to yet
+func (s *MessageStore) DAGHeads(room string) ([]string, error) {
+	return s.dagKeys(dagHeadPrefix, room)
+}
+
+// DAGMissing returns the CIDs of parents referenced but never received
+func (s *MessageStore) DAGMissing(room string) ([]string, error) {
+	return s.dagKeys(dagMissingPrefix, room)
+}
+
+// dagKeys lists the CIDs under a DAG prefix of a room
+func (s *MessageStore) dagKeys(prefix, room string) ([]string, error) {
+	var cids []string
+	err := s.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		p := dagKey(prefix, room, "")
+		for it.Seek(p); it.ValidForPrefix(p); it.Next() {
+			cids = append(cids, string(it.Item().Key()[len(p):]))
+		}
+		return nil
+	})
+	sort.Strings(cids)
+	return cids, err
+}
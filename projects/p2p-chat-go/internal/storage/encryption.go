@@ -0,0 +1,801 @@
+package storage
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v4"
+	"golang.org/x/crypto/argon2"
+)
+
+// Encryption at rest
+//
+// Badger encrypts every table and value log with a 256-bit data key (its
+// "encryption key"). The data key itself is stored in KeyFileName, wrapped
+// with AES-GCM under a key-encryption key derived from either a passphrase
+// (argon2id) or a keyfile. Changing the passphrase only rewraps the data key;
+// rotating the data key re-encrypts badger's key registry.
+const (
+	// KeyFileName holds the wrapped data key, inside the data dir
+	KeyFileName = "db.key"
+
+	// indexCacheSize bounds memory for table indexes; badger requires an
+	// index cache when encryption is on
+	indexCacheSize = 64 << 20
+
+	dataKeySize = 32
+	keyWrapAAD  = "p2p-chat-db-key-v1"
+
+	wrapPassphrase = "passphrase"
+	wrapKeyFile    = "keyfile"
+
+	// encryptTmpDir receives the encrypted copy of a plaintext store
+	encryptTmpDir = ".encrypting"
+	// plaintextOldDir holds the plaintext files while they are swapped out
+	plaintextOldDir = ".plaintext"
+)
+
+// ErrKeyRequired is returned when opening an encrypted store without a key source
+var ErrKeyRequired = errors.New("message store is encrypted but no passphrase or keyfile was given")
+
+// KeySource is the secret that wraps the database key
+// Set at most one field; an empty KeySource leaves the store unencrypted
+type KeySource struct {
+	Passphrase string
+	KeyFile    string // Path of a keyfile created with GenerateKeyFile
+}
+
+// Enabled reports whether a secret is configured
+func (k KeySource) Enabled() bool {
+	return k.Passphrase != "" || k.KeyFile != ""
+}
+
+// keyRecord is the JSON content of KeyFileName
+type keyRecord struct {
+	Version   int    `json:"version"`
+	Wrap      string `json:"wrap"` // wrapPassphrase or wrapKeyFile
+	Salt      []byte `json:"salt"`
+	Time      uint32 `json:"time,omitempty"` // argon2id parameters for passphrases
+	Memory    uint32 `json:"memory,omitempty"`
+	Threads   uint8  `json:"threads,omitempty"`
+	Key       []byte `json:"key"`                // Wrapped data key: nonce || ciphertext
+	Previous  []byte `json:"previous,omitempty"` // Data key being rotated out
+	Encrypted bool   `json:"encrypted"`          // Database files use the data key
+	Created   int64  `json:"created"`
+	Rotated   int64  `json:"rotated,omitempty"`
+}
+
+// newKeyRecord wraps dataKey under a fresh key-encryption key from src
+func newKeyRecord(src KeySource, dataKey []byte) (*keyRecord, error) {
+	rec := &keyRecord{
+		Version: 1,
+		Salt:    make([]byte, 16),
+		Created: time.Now().Unix(),
+	}
+	if _, err := rand.Read(rec.Salt); err != nil {
+		return nil, err
+	}
+
+	if src.Passphrase != "" {
+		rec.Wrap = wrapPassphrase
+		rec.Time, rec.Memory, rec.Threads = 3, 64*1024, 4
+	} else {
+		rec.Wrap = wrapKeyFile
+	}
+
+	kek, err := rec.kek(src)
+	if err != nil {
+		return nil, err
+	}
+	if rec.Key, err = wrapKey(kek, dataKey); err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
+
+// kek derives the key-encryption key of a record from src
+func (r *keyRecord) kek(src KeySource) ([]byte, error) {
+	switch r.Wrap {
+	case wrapPassphrase:
+		if src.Passphrase == "" {
+			return nil, fmt.Errorf("the database key is protected by a passphrase, but none was given")
+		}
+		return argon2.IDKey([]byte(src.Passphrase), r.Salt, r.Time, r.Memory, r.Threads, 32), nil
+
+	case wrapKeyFile:
+		if src.KeyFile == "" {
+			return nil, fmt.Errorf("the database key is protected by a keyfile, but none was given")
+		}
+		secret, err := os.ReadFile(src.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read keyfile: %w", err)
+		}
+		secret = []byte(strings.TrimSpace(string(secret)))
+		if len(secret) < 32 {
+			return nil, fmt.Errorf("keyfile %s is too short", src.KeyFile)
+		}
+		h := sha256.New()
+		h.Write(r.Salt)
+		h.Write(secret)
+		return h.Sum(nil), nil
+	}
+	return nil, fmt.Errorf("unknown key wrapping %q", r.Wrap)
+}
+
+// unwrap returns the data key wrapped in data
+func (r *keyRecord) unwrap(src KeySource, data []byte) ([]byte, error) {
+	kek, err := r.kek(src)
+	if err != nil {
+		return nil, err
+	}
+	return unwrapKey(kek, data)
+}
+
+// wrapKey seals a data key with AES-GCM
+func wrapKey(kek, dataKey []byte) ([]byte, error) {
+	aead, err := newGCM(kek)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, dataKey, []byte(keyWrapAAD)), nil
+}
+
+// unwrapKey opens a data key sealed by wrapKey
+func unwrapKey(kek, wrapped []byte) ([]byte, error) {
+	aead, err := newGCM(kek)
+	if err != nil {
+		return nil, err
+	}
+	if len(wrapped) < aead.NonceSize() {
+		return nil, fmt.Errorf("wrapped database key is corrupt")
+	}
+	key, err := aead.Open(nil, wrapped[:aead.NonceSize()], wrapped[aead.NonceSize():], []byte(keyWrapAAD))
+	if err != nil {
+		return nil, fmt.Errorf("wrong passphrase or keyfile")
+	}
+	return key, nil
+}
+
+// newGCM returns AES-256-GCM for key
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// readKeyRecord loads the key record of a data dir, or nil if there is none
+func readKeyRecord(dataDir string) (*keyRecord, error) {
+	data, err := os.ReadFile(filepath.Join(dataDir, KeyFileName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var rec keyRecord
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", KeyFileName, err)
+	}
+	return &rec, nil
+}
+
+// writeKeyRecord atomically replaces the key record of a data dir
+func writeKeyRecord(dataDir string, rec *keyRecord) error {
+	data, err := json.MarshalIndent(rec, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(dataDir, KeyFileName)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// openDataKey returns the data key of a data dir, creating one on first use
+// It returns a nil key for unencrypted stores
+func openDataKey(dataDir string, src KeySource) ([]byte, *keyRecord, error) {
+	rec, err := readKeyRecord(dataDir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if rec == nil {
+		if !src.Enabled() {
+			return nil, nil, nil
+		}
+
+		dataKey := make([]byte, dataKeySize)
+		if _, err := rand.Read(dataKey); err != nil {
+			return nil, nil, err
+		}
+		if rec, err = newKeyRecord(src, dataKey); err != nil {
+			return nil, nil, err
+		}
+		// A new store is created encrypted; an existing one is migrated first
+		rec.Encrypted = !hasBadgerFiles(dataDir)
+
+		if err := os.MkdirAll(dataDir, 0700); err != nil {
+			return nil, nil, err
+		}
+		if err := writeKeyRecord(dataDir, rec); err != nil {
+			return nil, nil, fmt.Errorf("failed to save database key: %w", err)
+		}
+		return dataKey, rec, nil
+	}
+
+	if !src.Enabled() {
+		return nil, nil, ErrKeyRequired
+	}
+
+	dataKey, err := rec.unwrap(src, rec.Key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if rec.Previous != nil {
+		// A rotation was interrupted; keep whichever key the registry uses
+		if dataKey, err = finishRotation(dataDir, src, rec, dataKey); err != nil {
+			return nil, nil, err
+		}
+	}
+	return dataKey, rec, nil
+}
+
+// finishRotation settles an interrupted rotation on the key the registry uses
+func finishRotation(dataDir string, src KeySource, rec *keyRecord, dataKey []byte) ([]byte, error) {
+	reg, err := badger.OpenKeyRegistry(badger.KeyRegistryOptions{
+		Dir:           dataDir,
+		ReadOnly:      true,
+		EncryptionKey: dataKey,
+	})
+	if err == nil {
+		reg.Close()
+	} else {
+		// The registry was not rewritten yet: roll back to the old key
+		if dataKey, err = rec.unwrap(src, rec.Previous); err != nil {
+			return nil, err
+		}
+		rec.Key = rec.Previous
+	}
+
+	rec.Previous = nil
+	return dataKey, writeKeyRecord(dataDir, rec)
+}
+
+// RotateDataKey replaces the database key with a new random key
+// Badger's key registry is re-encrypted under the new key; the chat must not
+// be running. Backups taken before the rotation keep needing the old key
+func RotateDataKey(dataDir string, src KeySource) error {
+	oldKey, rec, err := openDataKey(dataDir, src)
+	if err != nil {
+		return err
+	}
+	if rec == nil {
+		return fmt.Errorf("message store is not encrypted")
+	}
+	if !rec.Encrypted {
+		return fmt.Errorf("message store has not been encrypted yet; start the chat once first")
+	}
+
+	// Fail early if another process holds the store
+	db, err := badger.Open(encryptedOptions(dataDir, oldKey))
+	if err != nil {
+		return fmt.Errorf("failed to open database: %w", err)
+	}
+	if err := db.Close(); err != nil {
+		return err
+	}
+
+	newKey := make([]byte, dataKeySize)
+	if _, err := rand.Read(newKey); err != nil {
+		return err
+	}
+	kek, err := rec.kek(src)
+	if err != nil {
+		return err
+	}
+	wrapped, err := wrapKey(kek, newKey)
+	if err != nil {
+		return err
+	}
+
+	// Record both keys first, so a crash at any point can be settled
+	rec.Previous, rec.Key = rec.Key, wrapped
+	if err := writeKeyRecord(dataDir, rec); err != nil {
+		return err
+	}
+
+	opt := badger.KeyRegistryOptions{Dir: dataDir, ReadOnly: true, EncryptionKey: oldKey}
+	reg, err := badger.OpenKeyRegistry(opt)
+	if err != nil {
+		return fmt.Errorf("failed to open key registry: %w", err)
+	}
+	opt.EncryptionKey = newKey
+	if err := badger.WriteKeyRegistry(reg, opt); err != nil {
+		reg.Close()
+		return fmt.Errorf("failed to re-encrypt key registry: %w", err)
+	}
+	reg.Close()
+
+	rec.Previous = nil
+	rec.Rotated = time.Now().Unix()
+	return writeKeyRecord(dataDir, rec)
+}
+
+// RewrapDataKey protects the database key with a new passphrase or keyfile
+func RewrapDataKey(dataDir string, oldSrc, newSrc KeySource) error {
+	if !newSrc.Enabled() {
+		return fmt.Errorf("no new passphrase or keyfile given")
+	}
+
+	dataKey, rec, err := openDataKey(dataDir, oldSrc)
+	if err != nil {
+		return err
+	}
+	if rec == nil {
+		return fmt.Errorf("message store is not encrypted")
+	}
+
+	next, err := newKeyRecord(newSrc, dataKey)
+	if err != nil {
+		return err
+	}
+	next.Encrypted = rec.Encrypted
+	next.Created = rec.Created
+	next.Rotated = rec.Rotated
+	return writeKeyRecord(dataDir, next)
+}
+
+// GenerateKeyFile writes a new random keyfile; it never overwrites a file
+func GenerateKeyFile(path string) error {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintln(f, hex.EncodeToString(secret)); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// encryptedOptions returns badger options for a store encrypted with key
+func encryptedOptions(dir string, key []byte) badger.Options {
+	opts := badger.DefaultOptions(dir)
+	opts.Logger = nil
+	if key != nil {
+		opts = opts.WithEncryptionKey(key).WithIndexCacheSize(indexCacheSize)
+	}
+	return opts
+}
+
+// HasStore reports whether dataDir already holds a message store
+func HasStore(dataDir string) bool {
+	return hasBadgerFiles(dataDir)
+}
+
+// hasBadgerFiles reports whether dir already holds a badger database
+func hasBadgerFiles(dir string) bool {
+	_, err := os.Stat(filepath.Join(dir, "MANIFEST"))
+	return err == nil
+}
+
+// badgerFiles lists the files badger owns in dir
+func badgerFiles(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []string
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() {
+			continue
+		}
+		switch {
+		case name == "MANIFEST", name == "KEYREGISTRY", name == "DISCARD", name == "LOCK",
+			strings.HasSuffix(name, ".sst"), strings.HasSuffix(name, ".vlog"), strings.HasSuffix(name, ".mem"):
+			files = append(files, name)
+		}
+	}
+	return files, nil
+}
+
+// moveBadgerFiles moves badger's files from one directory to another
+func moveBadgerFiles(from, to string) error {
+	files, err := badgerFiles(from)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(to, 0700); err != nil {
+		return err
+	}
+	for _, name := range files {
+		if err := os.Rename(filepath.Join(from, name), filepath.Join(to, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encryptExisting rewrites a plaintext store into an encrypted one in place
+// The data is copied into a temporary encrypted database, then the files are
+// swapped; a crash during the swap is finished on the next open
+func encryptExisting(dataDir string, key []byte) error {
+	tmp := filepath.Join(dataDir, encryptTmpDir)
+	old := filepath.Join(dataDir, plaintextOldDir)
+
+	if _, err := os.Stat(old); err == nil {
+		// Interrupted swap: the encrypted copy is complete
+		if err := moveBadgerFiles(tmp, dataDir); err != nil {
+			return err
+		}
+		os.RemoveAll(tmp)
+		return os.RemoveAll(old)
+	}
+
+	if err := os.RemoveAll(tmp); err != nil {
+		return err
+	}
+
+	src, err := badger.Open(encryptedOptions(dataDir, nil))
+	if err != nil {
+		return fmt.Errorf("failed to open plaintext database: %w", err)
+	}
+	dst, err := badger.Open(encryptedOptions(tmp, key))
+	if err != nil {
+		src.Close()
+		return fmt.Errorf("failed to create encrypted database: %w", err)
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		_, err := src.Backup(pw, 0)
+		pw.CloseWithError(err)
+	}()
+	loadErr := dst.Load(pr, 256)
+	pr.Close()
+
+	dstErr := dst.Close()
+	srcErr := src.Close()
+	for _, err := range []error{loadErr, dstErr, srcErr} {
+		if err != nil {
+			os.RemoveAll(tmp)
+			return fmt.Errorf("failed to encrypt database: %w", err)
+		}
+	}
+
+	if err := moveBadgerFiles(dataDir, old); err != nil {
+		return err
+	}
+	if err := moveBadgerFiles(tmp, dataDir); err != nil {
+		return err
+	}
+	os.RemoveAll(tmp)
+	return os.RemoveAll(old)
+}
+
+// sealPlaintextBackups encrypts the pre-migration backups written while the
+// store was still plaintext, so no readable copy of the history is left
+// Each backup is sealed with the data key like those of an encrypted store,
+// then the plaintext is overwritten and removed. Overwriting is best effort:
+// SSDs and copy-on-write filesystems may keep the old blocks
+func sealPlaintextBackups(dataDir string, key []byte) error {
+	matches, err := filepath.Glob(filepath.Join(dataDir, backupDir, "pre-migration-*.bak"))
+	if err != nil {
+		return err
+	}
+	for _, path := range matches {
+		if err := sealFile(path, path+".enc", key); err != nil {
+			return fmt.Errorf("failed to encrypt backup %s: %w", filepath.Base(path), err)
+		}
+		if err := shred(path); err != nil {
+			return fmt.Errorf("failed to delete plaintext backup %s: %w", filepath.Base(path), err)
+		}
+	}
+	return nil
+}
+
+// sealFile writes a sealed copy of src to dst
+func sealFile(src, dst string, key []byte) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	// Written under a name no backup glob matches until it is complete
+	tmp := filepath.Join(filepath.Dir(dst), ".sealing-"+filepath.Base(dst))
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	sw, err := newSealWriter(out, key)
+	if err == nil {
+		if _, err = io.Copy(sw, in); err == nil {
+			err = sw.Close()
+		}
+	}
+	if err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, dst)
+}
+
+// shred overwrites a file with zeros before removing it
+func shred(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	zeros := make([]byte, sealChunkSize)
+	for left := info.Size(); left > 0; {
+		n := int64(len(zeros))
+		if left < n {
+			n = left
+		}
+		if _, err := f.Write(zeros[:n]); err != nil {
+			f.Close()
+			return err
+		}
+		left -= n
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// Encrypted reports whether the store is encrypted at rest
+func (s *MessageStore) Encrypted() bool {
+	return s.dataKey != nil
+}
+
+// Backup streams every entry with a version above since to w and returns the
+// highest version written; pass it as since for an incremental backup
+// (badger's stream skips versions <= since despite its doc comment).
+// The stream of an encrypted store is sealed with its data key
+func (s *MessageStore) Backup(w io.Writer, since uint64) (uint64, error) {
+	if s.dataKey == nil {
+		return s.db.Backup(w, since)
+	}
+
+	sw, err := newSealWriter(w, s.dataKey)
+	if err != nil {
+		return 0, err
+	}
+	version, err := s.db.Backup(sw, since)
+	if err != nil {
+		return 0, err
+	}
+	return version, sw.Close()
+}
+
+// Load applies a stream written by Backup to the store
+// A sealed stream, from an encrypted store, can only be loaded into a store
+// with the same data key
+func (s *MessageStore) Load(r io.Reader, sealed bool) error {
+	if sealed {
+		if s.dataKey == nil {
+			return ErrKeyRequired
+		}
+		sr, err := newSealReader(r, s.dataKey)
+		if err != nil {
+			return err
+		}
+		r = sr
+	}
+	return s.db.Load(r, 256)
+}
+
+// Sealed streams encrypt backups of an encrypted store with its data key:
+//
+//	magic | 4-byte nonce prefix | chunks of (4-byte length | AES-GCM ciphertext)
+//
+// Each chunk's nonce is the prefix plus a counter, and its additional data
+// marks the final chunk, so reordering and truncation are detected.
+const (
+	sealMagic     = "P2PCSEL1"
+	sealChunkSize = 64 * 1024
+)
+
+// sealWriter encrypts everything written to it; Close writes the final chunk
+type sealWriter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	prefix  []byte
+	counter uint64
+	buf     []byte
+}
+
+// newSealWriter starts a sealed stream on w
+func newSealWriter(w io.Writer, key []byte) (*sealWriter, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := make([]byte, 4)
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(append([]byte(sealMagic), prefix...)); err != nil {
+		return nil, err
+	}
+
+	return &sealWriter{w: w, aead: aead, prefix: prefix, buf: make([]byte, 0, sealChunkSize)}, nil
+}
+
+func (s *sealWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := copy(s.buf[len(s.buf):cap(s.buf)], p)
+		s.buf = s.buf[:len(s.buf)+n]
+		p = p[n:]
+		written += n
+
+		if len(s.buf) == cap(s.buf) {
+			if err := s.flush(false); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// Close seals the remaining data as the final chunk
+func (s *sealWriter) Close() error {
+	return s.flush(true)
+}
+
+// flush seals and writes the buffered chunk
+func (s *sealWriter) flush(final bool) error {
+	ct := s.aead.Seal(nil, s.nonce(), s.buf, chunkAAD(final))
+	s.counter++
+	s.buf = s.buf[:0]
+
+	var size [4]byte
+	binary.BigEndian.PutUint32(size[:], uint32(len(ct)))
+	if _, err := s.w.Write(size[:]); err != nil {
+		return err
+	}
+	_, err := s.w.Write(ct)
+	return err
+}
+
+func (s *sealWriter) nonce() []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, s.prefix)
+	binary.BigEndian.PutUint64(nonce[4:], s.counter)
+	return nonce
+}
+
+// sealReader decrypts a sealed stream
+type sealReader struct {
+	r       io.Reader
+	aead    cipher.AEAD
+	prefix  []byte
+	counter uint64
+	buf     []byte
+	done    bool
+}
+
+// newSealReader opens a sealed stream written with the same key
+func newSealReader(r io.Reader, key []byte) (*sealReader, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, len(sealMagic)+4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("failed to read sealed header: %w", err)
+	}
+	if string(header[:len(sealMagic)]) != sealMagic {
+		return nil, fmt.Errorf("not an encrypted backup")
+	}
+
+	return &sealReader{r: r, aead: aead, prefix: header[len(sealMagic):]}, nil
+}
+
+func (s *sealReader) Read(p []byte) (int, error) {
+	for len(s.buf) == 0 {
+		if s.done {
+			return 0, io.EOF
+		}
+		if err := s.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, s.buf)
+	s.buf = s.buf[n:]
+	return n, nil
+}
+
+// next reads and decrypts the next chunk
+func (s *sealReader) next() error {
+	var size [4]byte
+	if _, err := io.ReadFull(s.r, size[:]); err != nil {
+		return fmt.Errorf("encrypted backup is truncated: %w", err)
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n > sealChunkSize+uint32(s.aead.Overhead()) {
+		return fmt.Errorf("encrypted backup is corrupt")
+	}
+
+	ct := make([]byte, n)
+	if _, err := io.ReadFull(s.r, ct); err != nil {
+		return fmt.Errorf("encrypted backup is truncated: %w", err)
+	}
+
+	nonce := make([]byte, 12)
+	copy(nonce, s.prefix)
+	binary.BigEndian.PutUint64(nonce[4:], s.counter)
+	s.counter++
+
+	// Try the chunk as a middle chunk first, then as the final one
+	if pt, err := s.aead.Open(nil, nonce, ct, chunkAAD(false)); err == nil {
+		s.buf = pt
+		return nil
+	}
+	pt, err := s.aead.Open(nil, nonce, ct, chunkAAD(true))
+	if err != nil {
+		return fmt.Errorf("encrypted backup is corrupt or was made with another key")
+	}
+	s.buf = pt
+	s.done = true
+	return nil
+}
+
+// chunkAAD marks whether a chunk is the last of a sealed stream
+func chunkAAD(final bool) []byte {
+	if final {
+		return []byte{1}
+	}
+	return []byte{0}
+}
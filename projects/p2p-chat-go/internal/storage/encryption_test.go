@@ -0,0 +1,173 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"testing"
+)
+
+// testKey returns a random data key
+func testKey(t *testing.T) []byte {
+	t.Helper()
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	return key
+}
+
+// sealed returns data sealed with key
+func sealed(t *testing.T, key, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	sw, err := newSealWriter(&buf, key)
+	if err != nil {
+		t.Fatalf("newSealWriter: %v", err)
+	}
+	if _, err := sw.Write(data); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := sw.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// unseal reads a sealed stream back
+func unseal(stream, key []byte) ([]byte, error) {
+	sr, err := newSealReader(bytes.NewReader(stream), key)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(sr)
+}
+
+// chunks splits a sealed stream into its header and chunks
+func chunks(t *testing.T, stream []byte) (header []byte, parts [][]byte) {
+	t.Helper()
+	header, rest := stream[:len(sealMagic)+4], stream[len(sealMagic)+4:]
+	for len(rest) > 0 {
+		n := 4 + int(binary.BigEndian.Uint32(rest[:4]))
+		parts = append(parts, rest[:n])
+		rest = rest[n:]
+	}
+	return header, parts
+}
+
+func TestSealStreamRoundTrip(t *testing.T) {
+	key := testKey(t)
+	for _, size := range []int{0, 1, sealChunkSize - 1, sealChunkSize, 3*sealChunkSize + 7} {
+		data := make([]byte, size)
+		rand.Read(data)
+
+		got, err := unseal(sealed(t, key, data), key)
+		if err != nil {
+			t.Fatalf("%d bytes: %v", size, err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("%d bytes: round trip changed the data", size)
+		}
+	}
+}
+
+func TestSealStreamHidesPlaintext(t *testing.T) {
+	data := bytes.Repeat([]byte("secret history "), 100)
+	if bytes.Contains(sealed(t, testKey(t), data), []byte("secret history")) {
+		t.Error("sealed stream contains the plaintext")
+	}
+}
+
+func TestSealStreamRejectsTampering(t *testing.T) {
+	key := testKey(t)
+	data := make([]byte, 3*sealChunkSize+7)
+	rand.Read(data)
+
+	tests := []struct {
+		name   string
+		tamper func(stream []byte) []byte
+		key    []byte
+	}{
+		{
+			name: "wrong key",
+			tamper: func(stream []byte) []byte {
+				return stream
+			},
+			key: testKey(t),
+		},
+		{
+			name: "flipped byte",
+			tamper: func(stream []byte) []byte {
+				stream[len(stream)/2] ^= 1
+				return stream
+			},
+		},
+		{
+			name: "final chunk dropped",
+			tamper: func(stream []byte) []byte {
+				header, parts := chunks(t, stream)
+				return bytes.Join(append([][]byte{header}, parts[:len(parts)-1]...), nil)
+			},
+		},
+		{
+			name: "cut mid-chunk",
+			tamper: func(stream []byte) []byte {
+				return stream[:len(stream)-10]
+			},
+		},
+		{
+			name: "chunks reordered",
+			tamper: func(stream []byte) []byte {
+				header, parts := chunks(t, stream)
+				parts[0], parts[1] = parts[1], parts[0]
+				return bytes.Join(append([][]byte{header}, parts...), nil)
+			},
+		},
+		{
+			name: "nonce prefix changed",
+			tamper: func(stream []byte) []byte {
+				stream[len(sealMagic)] ^= 1
+				return stream
+			},
+		},
+		{
+			name: "not sealed",
+			tamper: func(stream []byte) []byte {
+				return data
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			openKey := key
+			if tt.key != nil {
+				openKey = tt.key
+			}
+			if _, err := unseal(tt.tamper(sealed(t, key, data)), openKey); err == nil {
+				t.Error("tampered stream was opened")
+			}
+		})
+	}
+}
+
+func TestWrappedKeyNeedsTheRightKEK(t *testing.T) {
+	kek, dataKey := testKey(t), testKey(t)
+	wrapped, err := wrapKey(kek, dataKey)
+	if err != nil {
+		t.Fatalf("wrapKey: %v", err)
+	}
+
+	got, err := unwrapKey(kek, wrapped)
+	if err != nil || !bytes.Equal(got, dataKey) {
+		t.Fatalf("unwrapKey = %v, want the data key", err)
+	}
+	if _, err := unwrapKey(testKey(t), wrapped); err == nil {
+		t.Error("unwrapped with another key")
+	}
+	wrapped[len(wrapped)-1] ^= 1
+	if _, err := unwrapKey(kek, wrapped); err == nil {
+		t.Error("unwrapped a tampered key")
+	}
+}
@@ -0,0 +1,186 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	badger "github.com/dgraph-io/badger/v4"
+)
+
+// DefaultPageSize is the number of messages in a history page by default
+const DefaultPageSize = 20
+
+// HistoryQuery selects one page of a room's history
+// Before and After are cursors: message IDs taken from a previous page. With
+// After the page holds the oldest matching messages newer than the cursor;
+// otherwise it holds the newest matching messages, older than Before if set
+type HistoryQuery struct {
+	Room   string
+	Limit  int      // Page size (0 = DefaultPageSize)
+	Before string   // Only messages older than this message ID
+	After  string   // Only messages newer than this message ID
+	Since  int64    // Unix time, inclusive (0 = no lower bound)
+	Until  int64    // Unix time, exclusive (0 = no upper bound)
+	Author string   // Username (case-insensitive) or peer ID of the sender
+	Types  []string // Message types to include (empty = all)
+}
+
+// HistoryPage is one page of history, oldest first
+// The IDs of the first and last message are the cursors of the pages around it
+type HistoryPage struct {
+	Messages []*Message
+	HasMore  bool // More messages match beyond this page, in the direction paged
+}
+
+// GetHistory returns one page of a room's history
+func (s *MessageStore) GetHistory(q HistoryQuery) (*HistoryPage, error) {
+	if q.Limit <= 0 {
+		q.Limit = DefaultPageSize
+	}
+
+	page := &HistoryPage{}
+	err := s.db.View(func(txn *badger.Txn) error {
+		// A peer ID has author index entries; a nickname is matched by scanning
+		prefix := roomKeyPrefix(q.Room)
+		indexed := false
+		if q.Author != "" && hasKeyPrefix(txn, authorKeyPrefix(q.Room, q.Author)) {
+			prefix = authorKeyPrefix(q.Room, q.Author)
+			indexed = true
+		}
+
+		// Bounds over the <time><id> suffix shared by room and index keys
+		lower := timeBytes(q.Since)
+		var upper []byte
+		if q.Until > 0 {
+			upper = timeBytes(q.Until)
+		}
+		if q.After != "" {
+			suffix, err := cursorSuffix(txn, q.Room, q.After)
+			if err != nil {
+				return err
+			}
+			if bytes.Compare(suffix, lower) >= 0 {
+				lower = append(suffix, 0) // First key after the cursor
+			}
+		}
+		if q.Before != "" {
+			suffix, err := cursorSuffix(txn, q.Room, q.Before)
+			if err != nil {
+				return err
+			}
+			if upper == nil || bytes.Compare(suffix, upper) < 0 {
+				upper = suffix
+			}
+		}
+
+		lowerKey := append(append([]byte{}, prefix...), lower...)
+		upperKey := prefixEnd(prefix)
+		if upper != nil {
+			upperKey = append(append([]byte{}, prefix...), upper...)
+		}
+
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = !indexed
+		opts.Reverse = q.After == ""
+
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		if opts.Reverse {
+			it.Seek(upperKey)
+		} else {
+			it.Seek(lowerKey)
+		}
+
+		for ; it.ValidForPrefix(prefix); it.Next() {
+			key := it.Item().Key()
+			if bytes.Compare(key, lowerKey) < 0 || bytes.Compare(key, upperKey) >= 0 {
+				if opts.Reverse && bytes.Equal(key, upperKey) {
+					continue // Reverse seek lands on the exclusive bound itself
+				}
+				break
+			}
+
+			msgKey := key
+			if indexed {
+				msgKey = indexSuffix(q.Room, key, prefix)
+			}
+			msg, err := loadMessage(txn, msgKey)
+			if err != nil {
+				return err
+			}
+			if msg == nil || !q.matches(msg) {
+				continue
+			}
+
+			if len(page.Messages) == q.Limit {
+				page.HasMore = true
+				break
+			}
+			page.Messages = append(page.Messages, msg)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if q.After == "" {
+		// Collected newest first
+		msgs := page.Messages
+		for i, j := 0, len(msgs)-1; i < j; i, j = i+1, j-1 {
+			msgs[i], msgs[j] = msgs[j], msgs[i]
+		}
+	}
+	return page, nil
+}
+
+// matches applies the filters that are not part of the key range
+func (q *HistoryQuery) matches(msg *Message) bool {
+	if q.Author != "" && !strings.EqualFold(msg.Username, q.Author) && msg.From != q.Author {
+		return false
+	}
+	if len(q.Types) == 0 {
+		return true
+	}
+	for _, t := range q.Types {
+		if msg.Type == t {
+			return true
+		}
+	}
+	return false
+}
+
+// cursorSuffix returns the <time><id> key suffix of a message used as a cursor
+func cursorSuffix(txn *badger.Txn, room, id string) ([]byte, error) {
+	item, err := txn.Get(idKey(id))
+	if err == badger.ErrKeyNotFound {
+		return nil, fmt.Errorf("unknown message ID %q", id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	key, err := item.ValueCopy(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := roomKeyPrefix(room)
+	if !bytes.HasPrefix(key, prefix) {
+		return nil, fmt.Errorf("message %q is not in room %s", id, room)
+	}
+	return key[len(prefix):], nil
+}
+
+// hasKeyPrefix reports whether any key starts with prefix
+func hasKeyPrefix(txn *badger.Txn, prefix []byte) bool {
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+
+	it := txn.NewIterator(opts)
+	defer it.Close()
+
+	it.Seek(prefix)
+	return it.ValidForPrefix(prefix)
+}
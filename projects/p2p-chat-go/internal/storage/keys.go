@@ -0,0 +1,217 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+
+	badger "github.com/dgraph-io/badger/v4"
+)
+
+// Message keyspace (schema migration 1)
+//
+//	m2:<room>\x00<time><id>                  -> message JSON
+//	mi:<id>                                  -> message key
+//	ma:<room>\x00<author>\x00<time><id>      -> (empty) author index
+//	mt:<room>\x00<thread>\x00<time><id>      -> (empty) thread index
+//
+// <time> is the Unix timestamp as 8 big-endian bytes, so keys of a room sort
+// chronologically and messages in the same second are kept apart by their ID.
+// Time-range queries and deletes are plain key scans.
+const (
+	msgPrefix    = "m2:"
+	idPrefix     = "mi:"
+	authorPrefix = "ma:"
+	threadPrefix = "mt:"
+
+	// legacyPrefix is the original key layout: msg_<decimal timestamp>_<peer ID>
+	legacyPrefix = "msg_"
+
+	// keySep separates variable-length key parts
+	keySep = 0x00
+)
+
+// timeBytes encodes a timestamp so that byte order matches numeric order
+func timeBytes(ts int64) []byte {
+	if ts < 0 {
+		ts = 0
+	}
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(ts))
+	return b
+}
+
+// roomKeyPrefix returns the prefix of all message keys of a room
+func roomKeyPrefix(room string) []byte {
+	return append([]byte(msgPrefix+room), keySep)
+}
+
+// messageKey builds the primary key of a message
+func messageKey(room string, ts int64, id string) []byte {
+	key := roomKeyPrefix(room)
+	key = append(key, timeBytes(ts)...)
+	return append(key, id...)
+}
+
+// idKey builds the ID lookup key of a message
+func idKey(id string) []byte {
+	return []byte(idPrefix + id)
+}
+
+// authorKeyPrefix returns the prefix of an author's index entries in a room
+func authorKeyPrefix(room, author string) []byte {
+	key := append([]byte(authorPrefix+room), keySep)
+	key = append(key, author...)
+	return append(key, keySep)
+}
+
+// authorKey builds the author index key of a message
+func authorKey(msg *Message) []byte {
+	key := authorKeyPrefix(msg.Room, msg.From)
+	key = append(key, timeBytes(msg.Timestamp)...)
+	return append(key, msg.ID...)
+}
+
+// threadKeyPrefix returns the prefix of a thread's index entries in a room
+func threadKeyPrefix(room, thread string) []byte {
+	key := append([]byte(threadPrefix+room), keySep)
+	key = append(key, thread...)
+	return append(key, keySep)
+}
+
+// threadKey builds the thread index key of a message
+func threadKey(msg *Message) []byte {
+	key := threadKeyPrefix(msg.Room, msg.Thread)
+	key = append(key, timeBytes(msg.Timestamp)...)
+	return append(key, msg.ID...)
+}
+
+// indexSuffix returns the message key an index entry points to
+// Index keys end in <time><id>, just like the message key of their room
+func indexSuffix(room string, indexKey, prefix []byte) []byte {
+	return append(roomKeyPrefix(room), indexKey[len(prefix):]...)
+}
+
+// splitMessageKey decodes the room, timestamp and ID of a message key
+func splitMessageKey(key []byte) (room string, ts int64, id string, ok bool) {
+	if !bytes.HasPrefix(key, []byte(msgPrefix)) {
+		return "", 0, "", false
+	}
+	rest := key[len(msgPrefix):]
+	sep := bytes.IndexByte(rest, keySep)
+	if sep < 0 || len(rest) < sep+1+8 {
+		return "", 0, "", false
+	}
+	room = string(rest[:sep])
+	ts = int64(binary.BigEndian.Uint64(rest[sep+1 : sep+9]))
+	id = string(rest[sep+9:])
+	return room, ts, id, true
+}
+
+// prefixEnd returns the first key after every key starting with prefix
+func prefixEnd(prefix []byte) []byte {
+	end := append([]byte{}, prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil // Prefix is all 0xff; nothing sorts after it
+}
+
+// legacyID derives a stable ID for messages stored before IDs existed
+// Every peer derives the same ID for the same message, so history sync
+// still deduplicates upgraded messages
+func legacyID(msg *Message) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%d|%s|%s|%s", msg.Timestamp, msg.From, msg.Username, msg.Content)))
+	return hex.EncodeToString(sum[:16])
+}
+
+// upgradeBatchSize bounds how many messages are rewritten per transaction
+const upgradeBatchSize = 500
+
+// upgradeKeyspace rewrites messages stored with legacy keys into the room keyspace
+// Messages that do not record a room are filed under defaultRoom. Each batch
+// is committed on its own, so an interrupted upgrade resumes where it stopped.
+// It returns the number of messages upgraded
+func (s *MessageStore) upgradeKeyspace(defaultRoom string, report func(done, total int)) (int, error) {
+	type legacy struct {
+		key []byte
+		msg Message
+	}
+
+	total, err := s.countPrefix(legacyPrefix)
+	if err != nil {
+		return 0, err
+	}
+
+	upgraded := 0
+	for {
+		var batch []legacy
+		err := s.db.View(func(txn *badger.Txn) error {
+			it := txn.NewIterator(badger.DefaultIteratorOptions)
+			defer it.Close()
+
+			prefix := []byte(legacyPrefix)
+			for it.Seek(prefix); it.ValidForPrefix(prefix) && len(batch) < upgradeBatchSize; it.Next() {
+				l := legacy{key: it.Item().KeyCopy(nil)}
+				err := it.Item().Value(func(val []byte) error {
+					return json.Unmarshal(val, &l.msg)
+				})
+				if err != nil {
+					l.msg = Message{} // Unreadable; the key is dropped below
+				}
+				batch = append(batch, l)
+			}
+			return nil
+		})
+		if err != nil {
+			return upgraded, err
+		}
+		if len(batch) == 0 {
+			return upgraded, nil
+		}
+
+		err = s.db.Update(func(txn *badger.Txn) error {
+			for _, l := range batch {
+				oldKey := string(l.key)
+				msg := l.msg
+
+				if err := txn.Delete(l.key); err != nil {
+					return err
+				}
+				if err := unindexMessage(txn, oldKey, &msg); err != nil {
+					return err
+				}
+				if msg.Expires != 0 {
+					if err := txn.Delete(expiryKey(msg.Expires, oldKey)); err != nil {
+						return err
+					}
+				}
+				if msg.Type == "" {
+					continue
+				}
+
+				if msg.Room == "" {
+					msg.Room = defaultRoom
+				}
+				if msg.ID == "" {
+					msg.ID = legacyID(&msg)
+				}
+				if err := saveMessage(txn, &msg); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return upgraded, fmt.Errorf("failed to upgrade messages: %w", err)
+		}
+		upgraded += len(batch)
+		report(upgraded, total)
+	}
+}
@@ -0,0 +1,911 @@
+package storage
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryStore keeps everything in memory and nothing on disk
+// It serves ephemeral nodes and tests. Messages are kept per room in the same
+// order as the badger keyspace (timestamp, then ID), so both backends return
+// the same results for the same queries
+type MemoryStore struct {
+	mu       sync.RWMutex
+	rooms    map[string][]*Message // Sorted by timestamp, then ID
+	byID     map[string]*Message
+	records  map[string]memoryRecord // Moderation, mailbox and outbox entries
+	contacts map[string]Contact
+	settings map[string]string
+	dags     map[string]*memoryDAG
+}
+
+// memoryDAG is the message DAG of one room
+type memoryDAG struct {
+	nodes     map[string]*DAGNode
+	heads     map[string]bool
+	missing   map[string]bool
+	byMessage map[string]string // CIDs of the nodes of stored messages
+}
+
+// memoryRecord is an opaque record with an optional expiry
+type memoryRecord struct {
+	data    []byte
+	expires time.Time // Zero = keep
+}
+
+// NewMemoryStore creates an empty in-memory store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		rooms:    make(map[string][]*Message),
+		byID:     make(map[string]*Message),
+		records:  make(map[string]memoryRecord),
+		contacts: make(map[string]Contact),
+		settings: make(map[string]string),
+		dags:     make(map[string]*memoryDAG),
+	}
+}
+
+// messageLess orders messages like their badger keys
+func messageLess(a, b *Message) bool {
+	if a.Timestamp != b.Timestamp {
+		return a.Timestamp < b.Timestamp
+	}
+	return a.ID < b.ID
+}
+
+// copyMessage returns a copy so callers cannot modify stored messages
+func copyMessage(msg *Message) *Message {
+	c := *msg
+	return &c
+}
+
+// expired reports whether a disappearing message has expired
+func expired(msg *Message, now int64) bool {
+	return msg.Expires != 0 && msg.Expires <= now
+}
+
+// SaveMessage saves a local message, replacing one by the same author
+// stored under the same ID
+func (s *MemoryStore) SaveMessage(msg *Message) error {
+	if msg.ID == "" {
+		msg.ID = legacyID(msg)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if old, ok := s.byID[msg.ID]; ok && old.From != msg.From {
+		return ErrIDInUse
+	}
+	s.save(msg)
+	return nil
+}
+
+// save stores a copy of msg; the caller holds the write lock
+func (s *MemoryStore) save(msg *Message) {
+	if expired(msg, time.Now().Unix()) {
+		return // Already expired, nothing to keep
+	}
+	if old, ok := s.byID[msg.ID]; ok {
+		s.remove(old)
+	}
+
+	stored := copyMessage(msg)
+	msgs := s.rooms[stored.Room]
+	i := sort.Search(len(msgs), func(i int) bool { return !messageLess(msgs[i], stored) })
+	msgs = append(msgs, nil)
+	copy(msgs[i+1:], msgs[i:])
+	msgs[i] = stored
+
+	s.rooms[stored.Room] = msgs
+	s.byID[stored.ID] = stored
+}
+
+// remove deletes a stored message; the caller holds the write lock
+func (s *MemoryStore) remove(msg *Message) {
+	msgs := s.rooms[msg.Room]
+	if i := s.position(msg); i >= 0 {
+		msgs = append(msgs[:i], msgs[i+1:]...)
+	}
+	if len(msgs) == 0 {
+		delete(s.rooms, msg.Room)
+	} else {
+		s.rooms[msg.Room] = msgs
+	}
+	delete(s.byID, msg.ID)
+}
+
+// forget deletes a message for good and turns its DAG node into a tombstone;
+// the caller holds the write lock
+func (s *MemoryStore) forget(msg *Message, now int64) {
+	s.remove(msg)
+
+	d, ok := s.dags[msg.Room]
+	if !ok {
+		return
+	}
+	cid, ok := d.byMessage[msg.ID]
+	if !ok {
+		return
+	}
+	delete(d.byMessage, msg.ID)
+	if n, ok := d.nodes[cid]; ok {
+		d.nodes[cid] = n.Tombstone(now)
+	}
+}
+
+// position returns the index of a stored message in its room, or -1
+func (s *MemoryStore) position(msg *Message) int {
+	msgs := s.rooms[msg.Room]
+	i := sort.Search(len(msgs), func(i int) bool { return !messageLess(msgs[i], msg) })
+	if i < len(msgs) && msgs[i].ID == msg.ID {
+		return i
+	}
+	return -1
+}
+
+// live returns the unexpired messages of a room, oldest first
+// The caller holds the read lock
+func (s *MemoryStore) live(room string) []*Message {
+	now := time.Now().Unix()
+	msgs := s.rooms[room]
+
+	out := make([]*Message, 0, len(msgs))
+	for _, msg := range msgs {
+		if !expired(msg, now) {
+			out = append(out, msg)
+		}
+	}
+	return out
+}
+
+// ImportMessage stores msg unless a message with its ID is already stored
+func (s *MemoryStore) ImportMessage(msg *Message) (bool, error) {
+	if msg.ID == "" {
+		msg.ID = legacyID(msg)
+	}
+	if expired(msg, time.Now().Unix()) {
+		return false, nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.byID[msg.ID]; ok {
+		return false, nil
+	}
+	s.save(msg)
+	return true, nil
+}
+
+// GetRecentMessages returns up to limit of the newest messages of a room, oldest first
+func (s *MemoryStore) GetRecentMessages(room string, limit int) ([]*Message, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	msgs := s.live(room)
+	if len(msgs) > limit {
+		msgs = msgs[len(msgs)-limit:]
+	}
+	return copyMessages(msgs), nil
+}
+
+// GetHistory returns one page of a room's history
+func (s *MemoryStore) GetHistory(q HistoryQuery) (*HistoryPage, error) {
+	if q.Limit <= 0 {
+		q.Limit = DefaultPageSize
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	msgs := s.live(q.Room)
+	lo, hi := 0, len(msgs)
+	if q.Since > 0 {
+		lo = sort.Search(len(msgs), func(i int) bool { return msgs[i].Timestamp >= q.Since })
+	}
+	if q.Until > 0 {
+		hi = sort.Search(len(msgs), func(i int) bool { return msgs[i].Timestamp >= q.Until })
+	}
+	if q.After != "" {
+		i, err := s.cursor(msgs, q.Room, q.After)
+		if err != nil {
+			return nil, err
+		}
+		if i < len(msgs) && msgs[i].ID == q.After {
+			i++ // The cursor itself is excluded
+		}
+		if i > lo {
+			lo = i
+		}
+	}
+	if q.Before != "" {
+		i, err := s.cursor(msgs, q.Room, q.Before)
+		if err != nil {
+			return nil, err
+		}
+		if i < hi {
+			hi = i
+		}
+	}
+
+	page := &HistoryPage{}
+	take := func(msg *Message) bool {
+		if !q.matches(msg) {
+			return true
+		}
+		if len(page.Messages) == q.Limit {
+			page.HasMore = true
+			return false
+		}
+		page.Messages = append(page.Messages, copyMessage(msg))
+		return true
+	}
+
+	if q.After != "" {
+		for i := lo; i < hi && take(msgs[i]); i++ {
+		}
+	} else {
+		for i := hi - 1; i >= lo && take(msgs[i]); i-- {
+		}
+		for i, j := 0, len(page.Messages)-1; i < j; i, j = i+1, j-1 {
+			page.Messages[i], page.Messages[j] = page.Messages[j], page.Messages[i]
+		}
+	}
+	return page, nil
+}
+
+// cursor returns the index in msgs of the message used as a cursor, or of the
+// first message after it if the cursor has expired
+func (s *MemoryStore) cursor(msgs []*Message, room, id string) (int, error) {
+	msg, ok := s.byID[id]
+	if !ok {
+		return 0, fmt.Errorf("unknown message ID %q", id)
+	}
+	if msg.Room != room {
+		return 0, fmt.Errorf("message %q is not in room %s", id, room)
+	}
+	i := sort.Search(len(msgs), func(i int) bool { return !messageLess(msgs[i], msg) })
+	return i, nil
+}
+
+// GetMessagesInRange returns the messages of a room with since <= timestamp < until,
+// oldest first; until <= 0 means no upper bound
+func (s *MemoryStore) GetMessagesInRange(room string, since, until int64) ([]*Message, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return copyMessages(inRange(s.live(room), since, until)), nil
+}
+
+// inRange returns the messages with since <= timestamp < until
+func inRange(msgs []*Message, since, until int64) []*Message {
+	lo := sort.Search(len(msgs), func(i int) bool { return msgs[i].Timestamp >= since })
+	hi := len(msgs)
+	if until > 0 {
+		hi = sort.Search(len(msgs), func(i int) bool { return msgs[i].Timestamp >= until })
+	}
+	if lo > hi {
+		return nil
+	}
+	return msgs[lo:hi]
+}
+
+// GetMessagesByAuthor returns up to limit of the newest messages a peer sent to a room,
+// oldest first
+func (s *MemoryStore) GetMessagesByAuthor(room, author string, limit int) ([]*Message, error) {
+	return s.newestWhere(room, limit, func(msg *Message) bool { return msg.From == author })
+}
+
+// GetThread returns up to limit of the newest replies in a thread, oldest first
+func (s *MemoryStore) GetThread(room, thread string, limit int) ([]*Message, error) {
+	return s.newestWhere(room, limit, func(msg *Message) bool { return msg.Thread == thread })
+}
+
+// newestWhere returns up to limit of the newest matching messages, oldest first
+func (s *MemoryStore) newestWhere(room string, limit int, match func(msg *Message) bool) ([]*Message, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var messages []*Message
+	msgs := s.live(room)
+	for i := len(msgs) - 1; i >= 0 && len(messages) < limit; i-- {
+		if match(msgs[i]) {
+			messages = append(messages, copyMessage(msgs[i]))
+		}
+	}
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+	return messages, nil
+}
+
+// GetMessageRefs returns references to all messages of a room newer than since
+func (s *MemoryStore) GetMessageRefs(room string, since int64) ([]MessageRef, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var refs []MessageRef
+	for _, msg := range inRange(s.live(room), since, 0) {
+		refs = append(refs, MessageRef{ID: msg.ID, Timestamp: msg.Timestamp})
+	}
+	return refs, nil
+}
+
+// GetMessagesByID returns the stored messages of a room with the given IDs
+func (s *MemoryStore) GetMessagesByID(room string, ids []string) ([]*Message, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	now := time.Now().Unix()
+	var messages []*Message
+	for _, id := range ids {
+		if msg, ok := s.byID[id]; ok && msg.Room == room && !expired(msg, now) {
+			messages = append(messages, copyMessage(msg))
+		}
+	}
+	return messages, nil
+}
+
+// StreamMessages calls fn for the messages of a room with since <= timestamp < until,
+// oldest first; an empty room streams every room
+func (s *MemoryStore) StreamMessages(room string, since, until int64, fn func(msg *Message) error) error {
+	rooms := []string{room}
+	if room == "" {
+		var err error
+		if rooms, err = s.Rooms(); err != nil {
+			return err
+		}
+	}
+
+	for _, r := range rooms {
+		// Copy the range first so fn may use the store
+		msgs, err := s.GetMessagesInRange(r, since, until)
+		if err != nil {
+			return err
+		}
+		for _, msg := range msgs {
+			if err := fn(msg); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Search returns the messages matching q, best match first
+// Scoring matches the badger index: TF-IDF with length dampening
+func (s *MemoryStore) Search(q SearchQuery) ([]*SearchResult, error) {
+	terms, phrases := queryTerms(q)
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	now := time.Now().Unix()
+	total := len(s.byID)
+
+	// Document frequency of each term over the whole store
+	df := make(map[string]int)
+	if len(terms) > 0 {
+		for _, msg := range s.byID {
+			for term := range termFrequencies(msg) {
+				if terms[term] {
+					df[term]++
+				}
+			}
+		}
+	}
+
+	var results []*SearchResult
+	for _, msg := range s.byID {
+		if !q.matches(msg, now) {
+			continue
+		}
+		if len(terms) == 0 {
+			results = append(results, &SearchResult{Message: copyMessage(msg)})
+			continue
+		}
+
+		freqs := termFrequencies(msg)
+		score := 0.0
+		for term := range terms {
+			tf, ok := freqs[term]
+			if !ok {
+				score = -1
+				break
+			}
+			score += float64(tf) * inverseFrequency(total, df[term])
+		}
+		if score < 0 {
+			continue
+		}
+
+		tokens := tokenize(msg.Content)
+		if !containsPhrases(tokens, phrases) {
+			continue
+		}
+		results = append(results, &SearchResult{
+			Message: copyMessage(msg),
+			Score:   lengthNormalized(score, len(tokens)),
+		})
+	}
+
+	return rankResults(results, q.Limit), nil
+}
+
+// Rooms returns the rooms that have stored messages, in key order
+func (s *MemoryStore) Rooms() ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	rooms := make([]string, 0, len(s.rooms))
+	for room := range s.rooms {
+		rooms = append(rooms, room)
+	}
+	sort.Strings(rooms)
+	return rooms, nil
+}
+
+// GetMessageCount returns the total number of messages in the store
+func (s *MemoryStore) GetMessageCount() (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return len(s.byID), nil
+}
+
+// DeleteMessagesInRange deletes the messages of a room with since <= timestamp < until
+func (s *MemoryStore) DeleteMessagesInRange(room string, since, until int64) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	doomed := append([]*Message(nil), inRange(s.rooms[room], since, until)...)
+	now := time.Now().Unix()
+	for _, msg := range doomed {
+		s.forget(msg, now)
+	}
+	return len(doomed), nil
+}
+
+// TrimRoom deletes the oldest messages of a room until at most keep remain
+func (s *MemoryStore) TrimRoom(room string, keep int) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	msgs := s.rooms[room]
+	if len(msgs) <= keep {
+		return 0, nil
+	}
+	doomed := append([]*Message(nil), msgs[:len(msgs)-keep]...)
+	now := time.Now().Unix()
+	for _, msg := range doomed {
+		s.forget(msg, now)
+	}
+	return len(doomed), nil
+}
+
+// ClearOldMessages removes messages older than the specified number of days
+func (s *MemoryStore) ClearOldMessages(days int) (int, error) {
+	if days <= 0 {
+		return 0, fmt.Errorf("days must be greater than 0")
+	}
+	return deleteFromAllRooms(s, 0, time.Now().AddDate(0, 0, -days).Unix())
+}
+
+// ClearAllMessages removes every message; other records are kept
+func (s *MemoryStore) ClearAllMessages() (int, error) {
+	return deleteFromAllRooms(s, 0, 0)
+}
+
+// PurgeExpiredMessages deletes disappearing messages that expired before now
+// It returns the IDs of the purged messages
+func (s *MemoryStore) PurgeExpiredMessages(now time.Time) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var purged []string
+	for _, msg := range s.byID {
+		if expired(msg, now.Unix()) {
+			purged = append(purged, msg.ID)
+		}
+	}
+	for _, id := range purged {
+		s.forget(s.byID[id], now.Unix())
+	}
+
+	// Expired records are dropped here too; badger does that on its own
+	for key, rec := range s.records {
+		if !rec.expires.IsZero() && !rec.expires.After(now) {
+			delete(s.records, key)
+		}
+	}
+	return purged, nil
+}
+
+// ApplyRetention deletes the messages each room's policy no longer allows
+func (s *MemoryStore) ApplyRetention(r Retention, now time.Time) (int, error) {
+	return applyRetention(s, r, now)
+}
+
+// CollectGarbage is a no-op: memory is reclaimed by the Go runtime
+func (s *MemoryStore) CollectGarbage() (int, error) {
+	return 0, nil
+}
+
+// copyMessages copies a slice of stored messages
+func copyMessages(msgs []*Message) []*Message {
+	out := make([]*Message, len(msgs))
+	for i, msg := range msgs {
+		out[i] = copyMessage(msg)
+	}
+	return out
+}
+
+// Records use the same keys as the badger backend, so prefix queries return
+// entries in the same order
+
+// putRecord stores a record with an optional ttl
+func (s *MemoryStore) putRecord(key string, data []byte, ttl time.Duration) {
+	rec := memoryRecord{data: append([]byte(nil), data...)}
+	if ttl > 0 {
+		rec.expires = time.Now().Add(ttl)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records[key] = rec
+}
+
+// deleteRecords removes records by key
+func (s *MemoryStore) deleteRecords(keys ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, key := range keys {
+		delete(s.records, key)
+	}
+}
+
+// getPrefix returns copies of the unexpired records whose keys start with prefix
+func (s *MemoryStore) getPrefix(prefix string) [][]byte {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var keys []string
+	for key := range s.records {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	now := time.Now()
+	var values [][]byte
+	for _, key := range keys {
+		rec := s.records[key]
+		if !rec.expires.IsZero() && !rec.expires.After(now) {
+			continue
+		}
+		values = append(values, append([]byte(nil), rec.data...))
+	}
+	return values
+}
+
+// SaveModerationEvent persists a signed moderation event for a room
+func (s *MemoryStore) SaveModerationEvent(room, id string, data []byte) error {
+	s.putRecord(fmt.Sprintf("mod_%s_%s", room, id), data, 0)
+	return nil
+}
+
+// GetModerationEvents returns all moderation events for a room
+func (s *MemoryStore) GetModerationEvents(room string) ([][]byte, error) {
+	return s.getPrefix(fmt.Sprintf("mod_%s_", room)), nil
+}
+
+// PutMailboxEnvelope stores an envelope held for an offline recipient
+func (s *MemoryStore) PutMailboxEnvelope(recipient, id string, data []byte, ttl time.Duration) error {
+	s.putRecord(fmt.Sprintf("mbox_%s_%s", recipient, id), data, ttl)
+	return nil
+}
+
+// GetMailboxEnvelopes returns all envelopes held for a recipient
+func (s *MemoryStore) GetMailboxEnvelopes(recipient string) ([][]byte, error) {
+	return s.getPrefix(fmt.Sprintf("mbox_%s_", recipient)), nil
+}
+
+// DeleteMailboxEnvelopes removes delivered envelopes for a recipient
+func (s *MemoryStore) DeleteMailboxEnvelopes(recipient string, ids []string) error {
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = fmt.Sprintf("mbox_%s_%s", recipient, id)
+	}
+	s.deleteRecords(keys...)
+	return nil
+}
+
+// SaveMailboxMember records a peer registered with this node's mailbox
+func (s *MemoryStore) SaveMailboxMember(room, peerID string, data []byte, ttl time.Duration) error {
+	s.putRecord(fmt.Sprintf("mbmember_%s_%s", room, peerID), data, ttl)
+	return nil
+}
+
+// GetMailboxMembers returns all peers registered with this node's mailbox for a room
+func (s *MemoryStore) GetMailboxMembers(room string) ([][]byte, error) {
+	return s.getPrefix(fmt.Sprintf("mbmember_%s_", room)), nil
+}
+
+// SaveOutboxEntry queues an unsent message until mesh peers are available
+// A ttl > 0 drops the entry once it has passed, 0 keeps it until sent
+func (s *MemoryStore) SaveOutboxEntry(id string, timestamp int64, data []byte, ttl time.Duration) error {
+	s.putRecord(string(outboxKey(id, timestamp)), data, ttl)
+	return nil
+}
+
+// GetOutboxEntries returns queued messages, oldest first
+func (s *MemoryStore) GetOutboxEntries() ([][]byte, error) {
+	return s.getPrefix("outbox_"), nil
+}
+
+// DeleteOutboxEntry removes a message from the outbox once it has been sent
+func (s *MemoryStore) DeleteOutboxEntry(id string, timestamp int64) error {
+	s.deleteRecords(string(outboxKey(id, timestamp)))
+	return nil
+}
+
+// SaveCacheEntry keeps a DHT cache entry until ttl has passed
+func (s *MemoryStore) SaveCacheEntry(id string, data []byte, ttl time.Duration) error {
+	s.putRecord("dhtcache_"+id, data, ttl)
+	return nil
+}
+
+// GetCacheEntries returns all unexpired DHT cache entries
+func (s *MemoryStore) GetCacheEntries() ([][]byte, error) {
+	return s.getPrefix("dhtcache_"), nil
+}
+
+// DeleteCacheEntries removes evicted or forgotten DHT cache entries
+func (s *MemoryStore) DeleteCacheEntries(ids []string) error {
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = "dhtcache_" + id
+	}
+	s.deleteRecords(keys...)
+	return nil
+}
+
+// SaveContact records or updates a known peer
+func (s *MemoryStore) SaveContact(c *Contact) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.contacts[c.PeerID] = *c
+	return nil
+}
+
+// GetContact returns a known peer, or nil if the peer is unknown
+func (s *MemoryStore) GetContact(peerID string) (*Contact, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	c, ok := s.contacts[peerID]
+	if !ok {
+		return nil, nil
+	}
+	return &c, nil
+}
+
+// GetContacts returns every known peer, ordered by peer ID
+func (s *MemoryStore) GetContacts() ([]*Contact, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	contacts := make([]*Contact, 0, len(s.contacts))
+	for _, c := range s.contacts {
+		c := c
+		contacts = append(contacts, &c)
+	}
+	sort.Slice(contacts, func(i, j int) bool { return contacts[i].PeerID < contacts[j].PeerID })
+	return contacts, nil
+}
+
+// DeleteContact forgets a peer
+func (s *MemoryStore) DeleteContact(peerID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.contacts, peerID)
+	return nil
+}
+
+// GetSetting returns a setting, or "" if it is not set
+func (s *MemoryStore) GetSetting(key string) (string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.settings[key], nil
+}
+
+// SetSetting stores a setting
+func (s *MemoryStore) SetSetting(key, value string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.settings[key] = value
+	return nil
+}
+
+// DeleteSetting removes a setting
+func (s *MemoryStore) DeleteSetting(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.settings, key)
+	return nil
+}
+
+// Close releases the store; its contents are lost
+func (s *MemoryStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.rooms = make(map[string][]*Message)
+	s.byID = make(map[string]*Message)
+	s.records = make(map[string]memoryRecord)
+	s.contacts = make(map[string]Contact)
+	s.settings = make(map[string]string)
+	return nil
+}
+
+// SaveProvideEntry keeps an entry of the DHT reprovider
+func (s *MemoryStore) SaveProvideEntry(cid string, data []byte) error {
+	s.putRecord("provide_"+cid, data, 0)
+	return nil
+}
+
+// GetProvideEntries returns all entries of the DHT reprovider
+func (s *MemoryStore) GetProvideEntries() ([][]byte, error) {
+	return s.getPrefix("provide_"), nil
+}
+
+// DeleteProvideEntries removes content the DHT reprovider no longer announces
+func (s *MemoryStore) DeleteProvideEntries(cids []string) error {
+	keys := make([]string, len(cids))
+	for i, cid := range cids {
+		keys[i] = "provide_" + cid
+	}
+	s.deleteRecords(keys...)
+	return nil
+}
+
+// AddDAGNode stores a node and updates the room's heads and gaps
+func (s *MemoryStore) AddDAGNode(room string, n *DAGNode) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	d, ok := s.dags[room]
+	if !ok {
+		d = &memoryDAG{
+			nodes:     make(map[string]*DAGNode),
+			heads:     make(map[string]bool),
+			missing:   make(map[string]bool),
+			byMessage: make(map[string]string),
+		}
+		s.dags[room] = d
+	}
+	if _, ok := d.nodes[n.CID]; ok {
+		return false, nil
+	}
+
+	node := *n
+	node.Parents = append([]string(nil), n.Parents...)
+	d.nodes[n.CID] = &node
+	if !n.IsTombstone() {
+		d.byMessage[n.MessageID] = n.CID
+	}
+
+	// A node some child already referenced is neither a gap nor a head
+	if d.missing[n.CID] {
+		delete(d.missing, n.CID)
+	} else {
+		d.heads[n.CID] = true
+	}
+	for _, parent := range n.Parents {
+		if _, ok := d.nodes[parent]; ok {
+			delete(d.heads, parent)
+		} else {
+			d.missing[parent] = true
+		}
+	}
+	return true, nil
+}
+
+// GetDAGNode returns a node, or nil if it is not stored
+func (s *MemoryStore) GetDAGNode(room, cid string) (*DAGNode, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	d, ok := s.dags[room]
+	if !ok || d.nodes[cid] == nil {
+		return nil, nil
+	}
+	node := *d.nodes[cid]
+	return &node, nil
+}
+
+// GetDAGNodes returns every node of a room, ordered by CID
+func (s *MemoryStore) GetDAGNodes(room string) ([]*DAGNode, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	d, ok := s.dags[room]
+	if !ok {
+		return nil, nil
+	}
+	nodes := make([]*DAGNode, 0, len(d.nodes))
+	for _, n := range d.nodes {
+		node := *n
+		nodes = append(nodes, &node)
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].CID < nodes[j].CID })
+	return nodes, nil
+}
+
+// PruneDAGTombstones deletes the tombstones of messages deleted before the
+// given Unix time
+func (s *MemoryStore) PruneDAGTombstones(room string, before int64) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	d, ok := s.dags[room]
+	if !ok {
+		return 0, nil
+	}
+	pruned := 0
+	for cid, n := range d.nodes {
+		if n.IsTombstone() && n.Deleted < before {
+			delete(d.nodes, cid)
+			delete(d.heads, cid)
+			pruned++
+		}
+	}
+	return pruned, nil
+}
+
+// dagRooms returns the rooms that have DAG nodes
+func (s *MemoryStore) dagRooms() ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	rooms := make([]string, 0, len(s.dags))
+	for room, d := range s.dags {
+		if len(d.nodes) > 0 {
+			rooms = append(rooms, room)
+		}
+	}
+	sort.Strings(rooms)
+	return rooms, nil
+}
+
+// DAGHeads returns the CIDs of the room's nodes that nothing points to yet
+func (s *MemoryStore) DAGHeads(room string) ([]string, error) {
+	return s.dagSet(room, func(d *memoryDAG) map[string]bool { return d.heads }), nil
+}
+
+// DAGMissing returns the CIDs of parents referenced but never received
+func (s *MemoryStore) DAGMissing(room string) ([]string, error) {
+	return s.dagSet(room, func(d *memoryDAG) map[string]bool { return d.missing }), nil
+}
+
+// dagSet returns the sorted members of one of a room's DAG sets
+func (s *MemoryStore) dagSet(room string, set func(d *memoryDAG) map[string]bool) []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	d, ok := s.dags[room]
+	if !ok {
+		return nil
+	}
+	var cids []string
+	for cid := range set(d) {
+		cids = append(cids, cid)
+	}
+	sort.Strings(cids)
+	return cids
+}
@@ -0,0 +1,301 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v4"
+)
+
+// Schema bookkeeping keys
+const (
+	schemaVersionKey = "meta_schema_version"
+	// migratingKey records the migration in progress so a crash resumes it
+	// instead of taking a second backup of a half-migrated store
+	migratingKey = "meta_migrating"
+)
+
+// backupDir is where pre-migration backups are written, inside the data dir
+const backupDir = "backups"
+
+// Migration upgrades the store from Version-1 to Version
+// Migrations must be idempotent and commit in batches, so that running one
+// again after a crash finishes the work instead of redoing or corrupting it
+type Migration struct {
+	Version     int
+	Description string
+	Apply       func(s *MessageStore, m *MigrationRun) error
+}
+
+// MigrationProgress reports how far a migration has come
+type MigrationProgress struct {
+	Version     int
+	Description string
+	Done        int
+	Total       int // 0 when unknown
+}
+
+// ProgressFunc receives migration progress updates
+type ProgressFunc func(p MigrationProgress)
+
+// MigrationRun carries the options and progress reporting of one migration
+type MigrationRun struct {
+	migration   *Migration
+	defaultRoom string
+	progress    ProgressFunc
+}
+
+// Report publishes progress of the running migration
+func (r *MigrationRun) Report(done, total int) {
+	if r.progress != nil {
+		r.progress(MigrationProgress{
+			Version:     r.migration.Version,
+			Description: r.migration.Description,
+			Done:        done,
+			Total:       total,
+		})
+	}
+}
+
+// migrations lists every schema change in order; append, never reorder
+var migrations = []Migration{
+	{
+		Version:     1,
+		Description: "Move messages to the per-room sortable keyspace",
+		Apply: func(s *MessageStore, r *MigrationRun) error {
+			_, err := s.upgradeKeyspace(r.defaultRoom, r.Report)
+			return err
+		},
+	},
+	{
+		Version:     2,
+		Description: "Index messages for full-text search",
+		Apply: func(s *MessageStore, r *MigrationRun) error {
+			return s.buildSearchIndex(r.Report)
+		},
+	},
+}
+
+// LatestSchemaVersion is the schema version this build writes
+func LatestSchemaVersion() int {
+	return migrations[len(migrations)-1].Version
+}
+
+// SchemaStatus describes the schema of an open store
+type SchemaStatus struct {
+	Version    int         // Version recorded in the store
+	Latest     int         // Version this build writes
+	Pending    []Migration // Migrations still to run, in order
+	Resuming   int         // Version of an interrupted migration, 0 if none
+	Messages   int
+	Rooms      []string
+	LastBackup string // Path of the newest pre-migration backup, if any
+	Encrypted  bool   // Files are encrypted at rest
+}
+
+// SchemaStatus reports the schema version and pending migrations
+func (s *MessageStore) SchemaStatus() (*SchemaStatus, error) {
+	version, err := s.schemaVersion()
+	if err != nil {
+		return nil, err
+	}
+	resuming, err := s.readInt(migratingKey)
+	if err != nil {
+		return nil, err
+	}
+
+	status := &SchemaStatus{
+		Version:   version,
+		Latest:    LatestSchemaVersion(),
+		Resuming:  resuming,
+		Encrypted: s.dataKey != nil,
+	}
+	for _, m := range migrations {
+		if m.Version > version {
+			status.Pending = append(status.Pending, m)
+		}
+	}
+
+	if status.Messages, err = s.GetMessageCount(); err != nil {
+		return nil, err
+	}
+	legacy, err := s.countPrefix(legacyPrefix)
+	if err != nil {
+		return nil, err
+	}
+	status.Messages += legacy // Not yet moved by migration 1
+	if status.Rooms, err = s.Rooms(); err != nil {
+		return nil, err
+	}
+	status.LastBackup = s.lastBackup()
+
+	return status, nil
+}
+
+// Migrate runs all pending migrations in order
+// The store is backed up before the first migration touches existing data;
+// an interrupted run resumes with the migration that was in progress.
+// It returns the migrations that were applied
+func (s *MessageStore) Migrate(defaultRoom string, progress ProgressFunc) ([]Migration, error) {
+	version, err := s.schemaVersion()
+	if err != nil {
+		return nil, err
+	}
+	if version > LatestSchemaVersion() {
+		return nil, fmt.Errorf("database schema v%d is newer than this build (v%d); please update", version, LatestSchemaVersion())
+	}
+	if version == LatestSchemaVersion() {
+		return nil, nil
+	}
+
+	resuming, err := s.readInt(migratingKey)
+	if err != nil {
+		return nil, err
+	}
+	if resuming == 0 {
+		empty, err := s.isEmpty()
+		if err != nil {
+			return nil, err
+		}
+		if empty {
+			// A new store is created in the latest layout; nothing to migrate
+			return nil, s.writeInt(schemaVersionKey, LatestSchemaVersion())
+		}
+		if _, err := s.backup(version); err != nil {
+			return nil, fmt.Errorf("failed to back up before migrating: %w", err)
+		}
+	}
+
+	var applied []Migration
+	for i := range migrations {
+		m := &migrations[i]
+		if m.Version <= version {
+			continue
+		}
+
+		if err := s.writeInt(migratingKey, m.Version); err != nil {
+			return applied, err
+		}
+
+		run := &MigrationRun{migration: m, defaultRoom: defaultRoom, progress: progress}
+		run.Report(0, 0)
+		if err := m.Apply(s, run); err != nil {
+			return applied, fmt.Errorf("migration v%d (%s) failed: %w", m.Version, m.Description, err)
+		}
+
+		if err := s.writeInt(schemaVersionKey, m.Version); err != nil {
+			return applied, err
+		}
+		applied = append(applied, *m)
+	}
+
+	return applied, s.db.Update(func(txn *badger.Txn) error {
+		return txn.Delete([]byte(migratingKey))
+	})
+}
+
+// schemaVersion returns the recorded schema version, 0 for unversioned stores
+func (s *MessageStore) schemaVersion() (int, error) {
+	return s.readInt(schemaVersionKey)
+}
+
+// readInt reads a decimal metadata value, 0 if it is not set
+func (s *MessageStore) readInt(key string) (int, error) {
+	var n int
+	err := s.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(key))
+		if err == badger.ErrKeyNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return item.Value(func(val []byte) error {
+			n, err = strconv.Atoi(string(val))
+			return err
+		})
+	})
+	return n, err
+}
+
+// writeInt stores a decimal metadata value
+func (s *MessageStore) writeInt(key string, n int) error {
+	return s.db.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte(key), []byte(strconv.Itoa(n)))
+	})
+}
+
+// isEmpty reports whether the store holds no keys at all
+func (s *MessageStore) isEmpty() (bool, error) {
+	empty := true
+	err := s.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		it.Rewind()
+		empty = !it.Valid()
+		return nil
+	})
+	return empty, err
+}
+
+// backup writes a full badger backup of the store before migrating from version
+// Backups of an encrypted store are sealed with its data key
+func (s *MessageStore) backup(version int) (string, error) {
+	dir := filepath.Join(s.dir, backupDir)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+
+	name := fmt.Sprintf("pre-migration-v%d-%s.bak", version, time.Now().Format("20060102-150405"))
+	if s.dataKey != nil {
+		name += ".enc"
+	}
+	path := filepath.Join(dir, name)
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return "", err
+	}
+
+	if err := s.writeBackup(f); err != nil {
+		f.Close()
+		os.Remove(path)
+		return "", err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return "", err
+	}
+	return path, f.Close()
+}
+
+// writeBackup streams a full backup to w, sealed if the store is encrypted
+func (s *MessageStore) writeBackup(w io.Writer) error {
+	_, err := s.Backup(w, 0)
+	return err
+}
+
+// lastBackup returns the newest pre-migration backup, or "" if there is none
+func (s *MessageStore) lastBackup() string {
+	matches, err := filepath.Glob(filepath.Join(s.dir, backupDir, "pre-migration-*.bak*"))
+	if err != nil || len(matches) == 0 {
+		return ""
+	}
+
+	newest, newestTime := "", time.Time{}
+	for _, path := range matches {
+		info, err := os.Stat(path)
+		if err == nil && info.ModTime().After(newestTime) {
+			newest, newestTime = path, info.ModTime()
+		}
+	}
+	return newest
+}
@@ -0,0 +1,245 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v4"
+)
+
+// RetentionPolicy limits how much history a room keeps; zero fields mean no limit
+type RetentionPolicy struct {
+	MaxAge   time.Duration // Delete messages older than this
+	MaxCount int           // Keep only the newest MaxCount messages
+}
+
+// IsZero reports whether the policy keeps everything
+func (p RetentionPolicy) IsZero() bool {
+	return p.MaxAge <= 0 && p.MaxCount <= 0
+}
+
+// String describes the policy, e.g. "30d, 1000 messages"
+func (p RetentionPolicy) String() string {
+	var parts []string
+	if p.MaxAge > 0 {
+		parts = append(parts, formatAge(p.MaxAge))
+	}
+	if p.MaxCount > 0 {
+		parts = append(parts, fmt.Sprintf("%d messages", p.MaxCount))
+	}
+	if len(parts) == 0 {
+		return "keep everything"
+	}
+	return strings.Join(parts, ", ")
+}
+
+// Retention is the global retention policy with per-room overrides
+// The global policy applies to every room; a room's own limits replace the
+// global ones field by field
+type Retention struct {
+	Global RetentionPolicy
+	Rooms  map[string]RetentionPolicy
+}
+
+// For returns the effective policy of a room
+func (r Retention) For(room string) RetentionPolicy {
+	policy := r.Global
+	if override, ok := r.Rooms[room]; ok {
+		if override.MaxAge > 0 {
+			policy.MaxAge = override.MaxAge
+		}
+		if override.MaxCount > 0 {
+			policy.MaxCount = override.MaxCount
+		}
+	}
+	return policy
+}
+
+// IsZero reports whether no retention limits are configured
+func (r Retention) IsZero() bool {
+	if !r.Global.IsZero() {
+		return false
+	}
+	for _, p := range r.Rooms {
+		if !p.IsZero() {
+			return false
+		}
+	}
+	return true
+}
+
+// String describes the configured policies
+func (r Retention) String() string {
+	parts := []string{"global: " + r.Global.String()}
+
+	rooms := make([]string, 0, len(r.Rooms))
+	for room := range r.Rooms {
+		rooms = append(rooms, room)
+	}
+	sort.Strings(rooms)
+	for _, room := range rooms {
+		parts = append(parts, fmt.Sprintf("%s: %s", room, r.For(room)))
+	}
+	return strings.Join(parts, "; ")
+}
+
+// ParseRetention parses a comma-separated retention spec
+// Each entry is an age (90m, 12h, 30d, 4w) or a message count, optionally
+// prefixed with "<room>=" to apply to that room only, for example
+// "30d,10000,ops=7d,ops=500"
+func ParseRetention(spec string) (Retention, error) {
+	r := Retention{Rooms: make(map[string]RetentionPolicy)}
+
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		room, value := "", entry
+		if i := strings.LastIndex(entry, "="); i >= 0 {
+			room, value = entry[:i], entry[i+1:]
+			if room == "" {
+				return r, fmt.Errorf("retention %q: missing room name", entry)
+			}
+		}
+
+		policy := r.Global
+		if room != "" {
+			policy = r.Rooms[room]
+		}
+
+		if n, err := strconv.Atoi(value); err == nil {
+			if n <= 0 {
+				return r, fmt.Errorf("retention %q: count must be greater than 0", entry)
+			}
+			policy.MaxCount = n
+		} else {
+			age, err := ParseAge(value)
+			if err != nil {
+				return r, fmt.Errorf("retention %q: %w", entry, err)
+			}
+			policy.MaxAge = age
+		}
+
+		if room != "" {
+			r.Rooms[room] = policy
+		} else {
+			r.Global = policy
+		}
+	}
+
+	return r, nil
+}
+
+// ParseAge parses a positive duration, also accepting days (30d) and weeks (4w)
+func ParseAge(value string) (time.Duration, error) {
+	var d time.Duration
+	if n := len(value); n > 1 && (value[n-1] == 'd' || value[n-1] == 'w') {
+		count, err := strconv.Atoi(value[:n-1])
+		if err != nil {
+			return 0, fmt.Errorf("invalid age %q (use e.g. 12h, 30d, 4w)", value)
+		}
+		d = time.Duration(count) * 24 * time.Hour
+		if value[n-1] == 'w' {
+			d *= 7
+		}
+	} else {
+		var err error
+		if d, err = time.ParseDuration(value); err != nil {
+			return 0, fmt.Errorf("invalid age %q (use e.g. 12h, 30d, 4w)", value)
+		}
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("age %q must be greater than 0", value)
+	}
+	return d, nil
+}
+
+// formatAge prints an age in the units ParseAge accepts
+func formatAge(d time.Duration) string {
+	day := 24 * time.Hour
+	switch {
+	case d%(7*day) == 0:
+		return fmt.Sprintf("%dw", d/(7*day))
+	case d%day == 0:
+		return fmt.Sprintf("%dd", d/day)
+	}
+	return d.String()
+}
+
+// ApplyRetention deletes the messages each room's policy no longer allows
+// It returns the number of messages deleted
+func (s *MessageStore) ApplyRetention(r Retention, now time.Time) (int, error) {
+	return applyRetention(s, r, now)
+}
+
+// TrimRoom deletes the oldest messages of a room until at most keep remain
+// It returns the number of messages deleted
+func (s *MessageStore) TrimRoom(room string, keep int) (int, error) {
+	count, err := s.countPrefix(string(roomKeyPrefix(room)))
+	if err != nil {
+		return 0, err
+	}
+
+	type doomed struct {
+		key []byte
+		msg *Message
+	}
+
+	deletedCount := 0
+	for excess := count - keep; excess > 0; {
+		var batch []doomed
+		err := s.scanRange(room, 0, 0, func(key []byte, msg *Message) bool {
+			batch = append(batch, doomed{key: key, msg: msg})
+			return len(batch) < excess && len(batch) < deleteBatchSize
+		})
+		if err != nil {
+			return deletedCount, err
+		}
+		if len(batch) == 0 {
+			break
+		}
+
+		now := time.Now().Unix()
+		err = s.db.Update(func(txn *badger.Txn) error {
+			for _, d := range batch {
+				if err := removeMessage(txn, d.key, d.msg, now); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return deletedCount, err
+		}
+		deletedCount += len(batch)
+		excess -= len(batch)
+	}
+
+	return deletedCount, nil
+}
+
+// gcDiscardRatio is the share of stale data that makes a value log worth rewriting
+const gcDiscardRatio = 0.5
+
+// CollectGarbage rewrites value log files that are mostly stale, so deleted
+// and expired messages actually free disk space
+// It returns the number of files rewritten
+func (s *MessageStore) CollectGarbage() (int, error) {
+	rewritten := 0
+	for {
+		err := s.db.RunValueLogGC(gcDiscardRatio)
+		if errors.Is(err, badger.ErrNoRewrite) || errors.Is(err, badger.ErrRejected) {
+			return rewritten, nil
+		}
+		if err != nil {
+			return rewritten, err
+		}
+		rewritten++
+	}
+}
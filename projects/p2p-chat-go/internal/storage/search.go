@@ -0,0 +1,532 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	badger "github.com/dgraph-io/badger/v4"
+)
+
+// Search index layout
+//
+//	idx_<term>_<message key> -> term frequency
+//
+// Terms only contain letters and digits, so the prefix idx_<term>_ never
+// matches another term.
+const (
+	indexPrefix = "idx_"
+	// indexReadyKey marked indexed stores before schema versions existed
+	indexReadyKey = "meta_search_index"
+)
+
+// DefaultSearchLimit is the number of results returned when no limit is set
+const DefaultSearchLimit = 20
+
+// SearchQuery describes a full-text search
+// Messages must contain every word and every phrase and match all other
+// non-empty fields
+type SearchQuery struct {
+	Words   []string // Individual words, matched case-insensitively
+	Phrases []string // Exact word sequences
+	Author  string   // Username (case-insensitive) or peer ID of the sender
+	Room    string   // Room the message was posted in
+	Since   int64    // Unix time, inclusive (0 = no lower bound)
+	Until   int64    // Unix time, exclusive (0 = no upper bound)
+	Limit   int      // Maximum results (0 = DefaultSearchLimit)
+}
+
+// SearchResult is a matching message and its relevance score
+type SearchResult struct {
+	Message *Message
+	Score   float64
+}
+
+// Search returns the messages matching q, best match first
+// Text queries are ranked by TF-IDF; queries without text return the newest
+// matching messages first
+func (s *MessageStore) Search(q SearchQuery) ([]*SearchResult, error) {
+	terms, phrases := queryTerms(q)
+
+	var results []*SearchResult
+	var err error
+	if len(terms) == 0 {
+		results, err = s.scanMatches(q)
+	} else {
+		results, err = s.indexMatches(q, terms, phrases)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return rankResults(results, q.Limit), nil
+}
+
+// queryTerms returns the index terms of a query and its tokenized phrases
+func queryTerms(q SearchQuery) (map[string]bool, [][]string) {
+	var phrases [][]string
+	terms := make(map[string]bool)
+	for _, w := range q.Words {
+		for _, t := range tokenize(w) {
+			terms[t] = true
+		}
+	}
+	for _, p := range q.Phrases {
+		tokens := tokenize(p)
+		if len(tokens) == 0 {
+			continue
+		}
+		phrases = append(phrases, tokens)
+		for _, t := range tokens {
+			terms[t] = true
+		}
+	}
+	return terms, phrases
+}
+
+// rankResults orders results best first, newest first among equal scores,
+// and applies the result limit
+func rankResults(results []*SearchResult, limit int) []*SearchResult {
+	if limit <= 0 {
+		limit = DefaultSearchLimit
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		return results[i].Message.Timestamp > results[j].Message.Timestamp
+	})
+
+	if len(results) > limit {
+		results = results[:limit]
+	}
+	return results
+}
+
+// indexMatches looks terms up in the inverted index and scores the messages
+// containing all of them
+func (s *MessageStore) indexMatches(q SearchQuery, terms map[string]bool, phrases [][]string) ([]*SearchResult, error) {
+	total, err := s.GetMessageCount()
+	if err != nil {
+		return nil, err
+	}
+
+	var results []*SearchResult
+	err = s.db.View(func(txn *badger.Txn) error {
+		// Message key -> accumulated score; only keys holding every term survive
+		var scores map[string]float64
+
+		for term := range terms {
+			postings, err := termPostings(txn, term)
+			if err != nil {
+				return err
+			}
+			if len(postings) == 0 {
+				return nil // A required term matches nothing
+			}
+
+			idf := inverseFrequency(total, len(postings))
+			next := make(map[string]float64)
+			for key, tf := range postings {
+				if scores != nil {
+					prev, ok := scores[key]
+					if !ok {
+						continue
+					}
+					next[key] = prev + float64(tf)*idf
+				} else {
+					next[key] = float64(tf) * idf
+				}
+			}
+			scores = next
+			if len(scores) == 0 {
+				return nil
+			}
+		}
+
+		now := time.Now().Unix()
+		for key, score := range scores {
+			msg, err := loadMessage(txn, []byte(key))
+			if err != nil {
+				return err
+			}
+			if msg == nil {
+				continue // Posting outlived its message
+			}
+			if !q.matches(msg, now) {
+				continue
+			}
+
+			tokens := tokenize(msg.Content)
+			if !containsPhrases(tokens, phrases) {
+				continue
+			}
+
+			results = append(results, &SearchResult{
+				Message: msg,
+				Score:   lengthNormalized(score, len(tokens)),
+			})
+		}
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// inverseFrequency weighs a term found in df of total messages
+func inverseFrequency(total, df int) float64 {
+	return math.Log(1 + float64(total)/float64(df))
+}
+
+// lengthNormalized dampens long messages so a passing mention ranks below a
+// focused one
+func lengthNormalized(score float64, tokens int) float64 {
+	return score / math.Sqrt(float64(tokens))
+}
+
+// scanMatches walks messages for queries that only filter by metadata
+// A room query only scans that room's time range
+func (s *MessageStore) scanMatches(q SearchQuery) ([]*SearchResult, error) {
+	now := time.Now().Unix()
+
+	var results []*SearchResult
+	collect := func(msg *Message) bool {
+		if q.matches(msg, now) {
+			results = append(results, &SearchResult{Message: msg})
+		}
+		return true
+	}
+
+	var err error
+	if q.Room != "" {
+		err = s.scanRange(q.Room, q.Since, q.Until, func(_ []byte, msg *Message) bool {
+			return collect(msg)
+		})
+	} else {
+		err = s.forEachMessage(collect)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// matches applies the non-text filters of a query
+func (q SearchQuery) matches(msg *Message, now int64) bool {
+	if msg.Type != "message" {
+		return false
+	}
+	if msg.Expires != 0 && msg.Expires <= now {
+		return false
+	}
+	if q.Since != 0 && msg.Timestamp < q.Since {
+		return false
+	}
+	if q.Until != 0 && msg.Timestamp >= q.Until {
+		return false
+	}
+	if q.Room != "" && msg.Room != q.Room {
+		return false
+	}
+	if q.Author != "" && !strings.EqualFold(msg.Username, q.Author) && msg.From != q.Author {
+		return false
+	}
+	return true
+}
+
+// termPostings returns message key -> term frequency for a term
+func termPostings(txn *badger.Txn, term string) (map[string]int, error) {
+	postings := make(map[string]int)
+
+	it := txn.NewIterator(badger.DefaultIteratorOptions)
+	defer it.Close()
+
+	prefix := []byte(indexPrefix + term + "_")
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		item := it.Item()
+		key := string(item.Key()[len(prefix):])
+		err := item.Value(func(val []byte) error {
+			tf, err := strconv.Atoi(string(val))
+			if err != nil {
+				tf = 1
+			}
+			postings[key] = tf
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return postings, nil
+}
+
+// indexMessage writes the postings of a message stored under msgKey
+// Postings of disappearing messages expire together with the message
+func indexMessage(txn *badger.Txn, msgKey string, msg *Message, ttl time.Duration) error {
+	for term, tf := range termFrequencies(msg) {
+		e := badger.NewEntry(postingKey(term, msgKey), []byte(strconv.Itoa(tf)))
+		if ttl > 0 {
+			e = e.WithTTL(ttl)
+		}
+		if err := txn.SetEntry(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unindexMessage deletes the postings of a message stored under msgKey
+func unindexMessage(txn *badger.Txn, msgKey string, msg *Message) error {
+	for term := range termFrequencies(msg) {
+		if err := txn.Delete(postingKey(term, msgKey)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// postingKey builds the index key of a term for a message key
+func postingKey(term, msgKey string) []byte {
+	return []byte(indexPrefix + term + "_" + msgKey)
+}
+
+// buildSearchIndex writes postings for every stored message
+// Rewriting a posting is harmless, so an interrupted build simply runs again
+func (s *MessageStore) buildSearchIndex(report func(done, total int)) error {
+	type stored struct {
+		key string
+		msg Message
+	}
+	var pending []stored
+
+	err := s.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		prefix := []byte(msgPrefix)
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			var msg Message
+			err := it.Item().Value(func(val []byte) error {
+				return json.Unmarshal(val, &msg)
+			})
+			if err != nil {
+				continue
+			}
+			pending = append(pending, stored{key: string(it.Item().KeyCopy(nil)), msg: msg})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// A write batch splits the postings into as many transactions as needed
+	wb := s.db.NewWriteBatch()
+	defer wb.Cancel()
+
+	now := time.Now()
+	for i, p := range pending {
+		var ttl time.Duration
+		if p.msg.Expires != 0 {
+			if ttl = time.Unix(p.msg.Expires, 0).Sub(now); ttl <= 0 {
+				continue
+			}
+		}
+		for term, tf := range termFrequencies(&p.msg) {
+			e := badger.NewEntry(postingKey(term, p.key), []byte(strconv.Itoa(tf)))
+			if ttl > 0 {
+				e = e.WithTTL(ttl)
+			}
+			if err := wb.SetEntry(e); err != nil {
+				return fmt.Errorf("failed to index message: %w", err)
+			}
+		}
+		if (i+1)%upgradeBatchSize == 0 {
+			report(i+1, len(pending))
+		}
+	}
+
+	// Stores indexed before versioned migrations carry a marker key
+	if err := wb.Delete([]byte(indexReadyKey)); err != nil {
+		return err
+	}
+	if err := wb.Flush(); err != nil {
+		return err
+	}
+	if len(pending) > 0 {
+		report(len(pending), len(pending))
+	}
+	return nil
+}
+
+// termFrequencies counts the indexed terms of a message
+// Only chat messages are indexed; join and leave notices are not searchable
+func termFrequencies(msg *Message) map[string]int {
+	freqs := make(map[string]int)
+	if msg.Type != "message" {
+		return freqs
+	}
+	for _, t := range tokenize(msg.Content) {
+		freqs[t]++
+	}
+	return freqs
+}
+
+// maxTermLength keeps pathological tokens out of the index
+const maxTermLength = 64
+
+// tokenize lowercases text and splits it into words of letters and digits
+func tokenize(text string) []string {
+	fields := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+
+	tokens := fields[:0]
+	for _, f := range fields {
+		if len(f) <= maxTermLength {
+			tokens = append(tokens, f)
+		}
+	}
+	return tokens
+}
+
+// containsPhrases reports whether tokens contain every phrase as a consecutive run
+func containsPhrases(tokens []string, phrases [][]string) bool {
+	for _, phrase := range phrases {
+		found := false
+		for i := 0; i+len(phrase) <= len(tokens) && !found; i++ {
+			found = true
+			for j, t := range phrase {
+				if tokens[i+j] != t {
+					found = false
+					break
+				}
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// ParseSearchQuery parses the /search syntax:
+//
+//	word "exact phrase" from:<author> room:<room> since:<when> until:<when> limit:<n>
+//
+// A time is a duration ago (90m, 2h, 3d, 1w), a date (2006-01-02) or RFC 3339
+func ParseSearchQuery(input string, now time.Time) (SearchQuery, error) {
+	var q SearchQuery
+
+	for _, field := range splitQuery(input) {
+		if field.quoted {
+			q.Phrases = append(q.Phrases, field.text)
+			continue
+		}
+
+		name, value, ok := strings.Cut(field.text, ":")
+		if !ok || value == "" {
+			q.Words = append(q.Words, field.text)
+			continue
+		}
+
+		switch strings.ToLower(name) {
+		case "from":
+			q.Author = value
+		case "room":
+			q.Room = value
+		case "since":
+			t, err := ParseTime(value, now)
+			if err != nil {
+				return q, err
+			}
+			q.Since = t
+		case "until":
+			t, err := ParseTime(value, now)
+			if err != nil {
+				return q, err
+			}
+			q.Until = t
+		case "limit":
+			n, err := strconv.Atoi(value)
+			if err != nil || n <= 0 {
+				return q, fmt.Errorf("invalid limit: %s", value)
+			}
+			q.Limit = n
+		default:
+			q.Words = append(q.Words, field.text)
+		}
+	}
+
+	return q, nil
+}
+
+// queryField is one whitespace-separated or quoted part of a query
+type queryField struct {
+	text   string
+	quoted bool
+}
+
+// splitQuery splits a query on whitespace, keeping quoted phrases together
+func splitQuery(input string) []queryField {
+	var fields []queryField
+	var current strings.Builder
+	quoted := false
+
+	flush := func(wasQuoted bool) {
+		if current.Len() > 0 {
+			fields = append(fields, queryField{text: current.String(), quoted: wasQuoted})
+			current.Reset()
+		}
+	}
+
+	for _, r := range input {
+		switch {
+		case r == '"':
+			flush(quoted)
+			quoted = !quoted
+		case unicode.IsSpace(r) && !quoted:
+			flush(false)
+		default:
+			current.WriteRune(r)
+		}
+	}
+	flush(quoted)
+
+	return fields
+}
+
+// ParseTime parses a point in time given as a duration ago (90m, 2h, 3d, 1w),
+// a date (2006-01-02) or RFC 3339, and returns it as Unix time
+func ParseTime(value string, now time.Time) (int64, error) {
+	if n := len(value); n > 1 {
+		if days, err := strconv.Atoi(value[:n-1]); err == nil {
+			switch value[n-1] {
+			case 'd':
+				return now.AddDate(0, 0, -days).Unix(), nil
+			case 'w':
+				return now.AddDate(0, 0, -7*days).Unix(), nil
+			}
+		}
+	}
+	if d, err := time.ParseDuration(value); err == nil {
+		return now.Add(-d).Unix(), nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", value, time.Local); err == nil {
+		return t.Unix(), nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t.Unix(), nil
+	}
+	return 0, fmt.Errorf("invalid time %q (use e.g. 2h, 3d, 2006-01-02)", value)
+}
@@ -1,9 +1,10 @@
 package storage
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"sort"
 	"time"
 
 	badger "github.com/dgraph-io/badger/v4"
@@ -11,45 +12,301 @@ import (
 
 // Message represents a stored message
 type Message struct {
-	Type      string `json:"type"`
-	Content   string `json:"content"`
-	Username  string `json:"username"`
-	Timestamp int64  `json:"timestamp"`
-	From      string `json:"from"`
+	ID        string   `json:"id,omitempty"`
+	Type      string   `json:"type"`
+	Content   string   `json:"content"`
+	Username  string   `json:"username"`
+	Timestamp int64    `json:"timestamp"`
+	From      string   `json:"from"`
+	Room      string   `json:"room,omitempty"`
+	Thread    string   `json:"thread,omitempty"`  // ID of the message this one replies to
+	Expires   int64    `json:"expires,omitempty"` // Unix time, 0 = keep
+	Parents   []string `json:"parents,omitempty"` // CIDs of the room heads the author had seen
+	Record    []byte   `json:"record,omitempty"`  // Signed pubsub record, lets peers verify the author
+}
+
+// ErrIDInUse is returned when saving a message under the ID of another
+// author's message
+var ErrIDInUse = errors.New("message ID is in use by another author")
+
+// MessageRef identifies a stored message by ID and timestamp
+type MessageRef struct {
+	ID        string
+	Timestamp int64
 }
 
 // MessageStore handles message persistence
 type MessageStore struct {
-	db *badger.DB
+	db      *badger.DB
+	dir     string
+	dataKey []byte // nil when the store is not encrypted
 }
 
-// NewMessageStore creates a new message store
-func NewMessageStore(dataDir string) (*MessageStore, error) {
-	opts := badger.DefaultOptions(dataDir)
-	opts.Logger = nil // Disable badger logging
+// Options configures how a message store is opened
+type Options struct {
+	DefaultRoom    string       // Room of messages saved before rooms were recorded
+	Progress       ProgressFunc // Receives migration progress (optional)
+	SkipMigrations bool         // Open without migrating, e.g. to report status
+	Encryption     KeySource    // Encrypts the store at rest when set
+}
+
+// NewMessageStore opens the message store and migrates it to the latest schema
+// With an encryption key source, a plaintext store is encrypted on first open
+func NewMessageStore(dataDir string, options Options) (*MessageStore, error) {
+	dataKey, rec, err := openDataKey(dataDir, options.Encryption)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unlock database: %w", err)
+	}
+	if rec != nil && !rec.Encrypted {
+		if err := encryptExisting(dataDir, dataKey); err != nil {
+			return nil, err
+		}
+		rec.Encrypted = true
+		if err := writeKeyRecord(dataDir, rec); err != nil {
+			return nil, err
+		}
+	}
+	if dataKey != nil {
+		// Also finishes the job if an earlier start was interrupted
+		if err := sealPlaintextBackups(dataDir, dataKey); err != nil {
+			return nil, err
+		}
+	}
 
-	db, err := badger.Open(opts)
+	db, err := badger.Open(encryptedOptions(dataDir, dataKey))
 	if err != nil {
+		if errors.Is(err, badger.ErrEncryptionKeyMismatch) {
+			return nil, fmt.Errorf("failed to open database: %s does not match the database", KeyFileName)
+		}
 		return nil, fmt.Errorf("failed to open database: %w", err)
 	}
 
-	return &MessageStore{db: db}, nil
+	s := &MessageStore{db: db, dir: dataDir, dataKey: dataKey}
+	if !options.SkipMigrations {
+		if _, err := s.Migrate(options.DefaultRoom, options.Progress); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+
+	return s, nil
 }
 
-// SaveMessage saves a message to the store
+// SaveMessage saves a local message to the store and updates its indexes
+// A message already stored under the same ID is replaced, but only by the
+// same author; messages from the network go through ImportMessage, where the
+// first copy wins. Disappearing messages are written with a badger TTL and
+// an expiry index entry so the janitor can delete them by key scan once they
+// expire
 func (s *MessageStore) SaveMessage(msg *Message) error {
+	if msg.ID == "" {
+		msg.ID = legacyID(msg)
+	}
 	return s.db.Update(func(txn *badger.Txn) error {
-		key := fmt.Sprintf("msg_%d_%s", msg.Timestamp, msg.From)
-		data, err := json.Marshal(msg)
+		_, old, err := loadByID(txn, msg.ID)
 		if err != nil {
 			return err
 		}
-		return txn.Set([]byte(key), data)
+		if old != nil && old.From != msg.From {
+			return ErrIDInUse
+		}
+		return saveMessage(txn, msg)
 	})
 }
 
-// GetRecentMessages returns the N most recent messages
-func (s *MessageStore) GetRecentMessages(limit int) ([]*Message, error) {
+// saveMessage writes a message and all of its index entries
+func saveMessage(txn *badger.Txn, msg *Message) error {
+	var ttl time.Duration
+	if msg.Expires != 0 {
+		if ttl = time.Until(time.Unix(msg.Expires, 0)); ttl <= 0 {
+			return nil // Already expired, nothing to keep
+		}
+	}
+
+	// Replace an earlier copy of the message, wherever it was filed
+	if err := deleteByID(txn, msg.ID); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	key := messageKey(msg.Room, msg.Timestamp, msg.ID)
+	entries := []*badger.Entry{
+		badger.NewEntry(key, data),
+		badger.NewEntry(idKey(msg.ID), key),
+		badger.NewEntry(authorKey(msg), nil),
+	}
+	if msg.Thread != "" {
+		entries = append(entries, badger.NewEntry(threadKey(msg), nil))
+	}
+	for _, e := range entries {
+		if ttl > 0 {
+			e = e.WithTTL(ttl)
+		}
+		if err := txn.SetEntry(e); err != nil {
+			return err
+		}
+	}
+
+	if err := indexMessage(txn, string(key), msg, ttl); err != nil {
+		return err
+	}
+	if msg.Expires != 0 {
+		return txn.Set(expiryKey(msg.Expires, string(key)), []byte(msg.ID))
+	}
+	return nil
+}
+
+// deleteByID deletes the message stored under an ID, if any
+func deleteByID(txn *badger.Txn, id string) error {
+	key, msg, err := loadByID(txn, id)
+	if err != nil || key == nil {
+		return err
+	}
+	if msg == nil {
+		return txn.Delete(idKey(id)) // Dangling lookup entry
+	}
+	return deleteMessage(txn, key, msg)
+}
+
+// loadByID returns the key of the message stored under an ID and the
+// message, or nil if there is none
+func loadByID(txn *badger.Txn, id string) ([]byte, *Message, error) {
+	item, err := txn.Get(idKey(id))
+	if err == badger.ErrKeyNotFound {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := item.ValueCopy(nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	msg, err := loadMessage(txn, key)
+	return key, msg, err
+}
+
+// deleteMessage removes a message and all of its index entries
+func deleteMessage(txn *badger.Txn, key []byte, msg *Message) error {
+	keys := [][]byte{key, idKey(msg.ID), authorKey(msg)}
+	if msg.Thread != "" {
+		keys = append(keys, threadKey(msg))
+	}
+	if msg.Expires != 0 {
+		keys = append(keys, expiryKey(msg.Expires, string(key)))
+	}
+	for _, k := range keys {
+		if err := txn.Delete(k); err != nil {
+			return err
+		}
+	}
+	return unindexMessage(txn, string(key), msg)
+}
+
+// removeMessage deletes a message for good: unlike a replacement, it also
+// turns the message's DAG node into a tombstone
+func removeMessage(txn *badger.Txn, key []byte, msg *Message, now int64) error {
+	if err := deleteMessage(txn, key, msg); err != nil {
+		return err
+	}
+	return tombstoneDAGNode(txn, msg.Room, msg.ID, now)
+}
+
+// loadMessage reads the message stored under key, or nil if there is none
+func loadMessage(txn *badger.Txn, key []byte) (*Message, error) {
+	item, err := txn.Get(key)
+	if err == badger.ErrKeyNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var msg Message
+	if err := item.Value(func(val []byte) error {
+		return json.Unmarshal(val, &msg)
+	}); err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+// PurgeExpiredMessages deletes disappearing messages that expired before now
+// It returns the IDs of the purged messages
+func (s *MessageStore) PurgeExpiredMessages(now time.Time) ([]string, error) {
+	var purged []string
+
+	err := s.db.Update(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		prefix := []byte("exp_")
+		type expired struct {
+			indexKey []byte
+			msgKey   []byte
+		}
+		var found []expired
+
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			key := it.Item().KeyCopy(nil)
+
+			// Key layout: exp_<20-digit expiry>_<message key>
+			var expires int64
+			if _, err := fmt.Sscanf(string(key[len("exp_"):len("exp_")+20]), "%d", &expires); err != nil {
+				continue
+			}
+			if expires > now.Unix() {
+				break // Index is sorted by expiry
+			}
+
+			id, err := it.Item().ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			purged = append(purged, string(id))
+			found = append(found, expired{indexKey: key, msgKey: key[len("exp_")+21:]})
+		}
+
+		for _, e := range found {
+			msg, err := loadMessage(txn, e.msgKey)
+			if err != nil {
+				return err
+			}
+			if msg != nil {
+				if err := removeMessage(txn, e.msgKey, msg, now.Unix()); err != nil {
+					return err
+				}
+			} else if room, _, id, ok := splitMessageKey(e.msgKey); ok {
+				if err := tombstoneDAGNode(txn, room, id, now.Unix()); err != nil {
+					return err
+				}
+			}
+			// Index entries of a message badger already expired share its TTL
+			if err := txn.Delete(e.indexKey); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return purged, nil
+}
+
+// expiryKey builds the expiry index key for a message key
+func expiryKey(expires int64, msgKey string) []byte {
+	return []byte(fmt.Sprintf("exp_%020d_%s", expires, msgKey))
+}
+
+// GetRecentMessages returns the N most recent messages of a room, oldest first
+func (s *MessageStore) GetRecentMessages(room string, limit int) ([]*Message, error) {
 	var messages []*Message
 
 	err := s.db.View(func(txn *badger.Txn) error {
@@ -59,23 +316,15 @@ func (s *MessageStore) GetRecentMessages(limit int) ([]*Message, error) {
 		it := txn.NewIterator(opts)
 		defer it.Close()
 
-		prefix := []byte("msg_")
-		count := 0
-
-		for it.Seek([]byte("msg_~")); it.ValidForPrefix(prefix) && count < limit; it.Next() {
-			item := it.Item()
-			err := item.Value(func(val []byte) error {
-				var msg Message
-				if err := json.Unmarshal(val, &msg); err != nil {
-					return err
-				}
-				messages = append(messages, &msg)
-				return nil
-			})
-			if err != nil {
+		prefix := roomKeyPrefix(room)
+		for it.Seek(prefixEnd(prefix)); it.ValidForPrefix(prefix) && len(messages) < limit; it.Next() {
+			var msg Message
+			if err := it.Item().Value(func(val []byte) error {
+				return json.Unmarshal(val, &msg)
+			}); err != nil {
 				return err
 			}
-			count++
+			messages = append(messages, &msg)
 		}
 		return nil
 	})
@@ -85,92 +334,360 @@ func (s *MessageStore) GetRecentMessages(limit int) ([]*Message, error) {
 	}
 
 	// Reverse to get chronological order
-	sort.Slice(messages, func(i, j int) bool {
-		return messages[i].Timestamp < messages[j].Timestamp
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+
+	return messages, nil
+}
+
+// GetMessagesInRange returns the messages of a room with since <= timestamp < until,
+// oldest first; until <= 0 means no upper bound
+func (s *MessageStore) GetMessagesInRange(room string, since, until int64) ([]*Message, error) {
+	var messages []*Message
+
+	err := s.scanRange(room, since, until, func(key []byte, msg *Message) bool {
+		messages = append(messages, msg)
+		return true
 	})
 
+	if err != nil {
+		return nil, err
+	}
+
 	return messages, nil
 }
 
-// Clear removes all messages from the store
-func (s *MessageStore) Clear() error {
-	return s.db.DropAll()
+// GetMessagesByAuthor returns up to limit of the newest messages a peer sent to a room,
+// oldest first
+func (s *MessageStore) GetMessagesByAuthor(room, author string, limit int) ([]*Message, error) {
+	return s.getIndexed(room, authorKeyPrefix(room, author), limit)
 }
 
-// ClearAllMessages removes all messages from the store (alias for Clear)
-func (s *MessageStore) ClearAllMessages() (int, error) {
-	count, err := s.GetMessageCount()
+// GetThread returns up to limit of the newest replies in a thread, oldest first
+func (s *MessageStore) GetThread(room, thread string, limit int) ([]*Message, error) {
+	return s.getIndexed(room, threadKeyPrefix(room, thread), limit)
+}
+
+// getIndexed resolves the newest entries of a secondary index to messages
+func (s *MessageStore) getIndexed(room string, prefix []byte, limit int) ([]*Message, error) {
+	var messages []*Message
+
+	err := s.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		opts.Reverse = true
+
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Seek(prefixEnd(prefix)); it.ValidForPrefix(prefix) && len(messages) < limit; it.Next() {
+			msg, err := loadMessage(txn, indexSuffix(room, it.Item().Key(), prefix))
+			if err != nil {
+				return err
+			}
+			if msg != nil {
+				messages = append(messages, msg)
+			}
+		}
+		return nil
+	})
+
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
 
-	if err := s.Clear(); err != nil {
-		return 0, err
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
 	}
 
-	return count, nil
+	return messages, nil
 }
 
-// ClearOldMessages removes messages older than the specified number of days
-func (s *MessageStore) ClearOldMessages(days int) (int, error) {
-	if days <= 0 {
-		return 0, fmt.Errorf("days must be greater than 0")
-	}
-
-	cutoffTime := time.Now().AddDate(0, 0, -days).Unix()
-	deletedCount := 0
+// GetMessageRefs returns references to all messages of a room newer than since
+// Refs are decoded from keys alone; no message values are read
+func (s *MessageStore) GetMessageRefs(room string, since int64) ([]MessageRef, error) {
+	var refs []MessageRef
 
-	err := s.db.Update(func(txn *badger.Txn) error {
+	err := s.db.View(func(txn *badger.Txn) error {
 		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+
 		it := txn.NewIterator(opts)
 		defer it.Close()
 
-		prefix := []byte("msg_")
-		var keysToDelete [][]byte
+		prefix := roomKeyPrefix(room)
+		for it.Seek(messageKey(room, since, "")); it.ValidForPrefix(prefix); it.Next() {
+			if _, ts, id, ok := splitMessageKey(it.Item().Key()); ok {
+				refs = append(refs, MessageRef{ID: id, Timestamp: ts})
+			}
+		}
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
 
-		// Collect keys to delete
-		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
-			item := it.Item()
-			key := item.Key()
+	return refs, nil
+}
 
-			// Get the message to check timestamp
-			err := item.Value(func(val []byte) error {
-				var msg Message
-				if err := json.Unmarshal(val, &msg); err != nil {
-					return err
-				}
+// GetMessagesByID returns the stored messages of a room with the given IDs
+// IDs that are not in the store, or belong to another room, are skipped
+func (s *MessageStore) GetMessagesByID(room string, ids []string) ([]*Message, error) {
+	var messages []*Message
 
-				// If message is older than cutoff, mark for deletion
-				if msg.Timestamp < cutoffTime {
-					keysToDelete = append(keysToDelete, append([]byte{}, key...))
-				}
-				return nil
-			})
+	err := s.db.View(func(txn *badger.Txn) error {
+		prefix := roomKeyPrefix(room)
+		for _, id := range ids {
+			item, err := txn.Get(idKey(id))
+			if err == badger.ErrKeyNotFound {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			key, err := item.ValueCopy(nil)
 			if err != nil {
 				return err
 			}
+			if !bytes.HasPrefix(key, prefix) {
+				continue
+			}
+
+			msg, err := loadMessage(txn, key)
+			if err != nil {
+				return err
+			}
+			if msg != nil {
+				messages = append(messages, msg)
+			}
+		}
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return messages, nil
+}
+
+// scanRange calls fn for the messages of a room with since <= timestamp < until,
+// oldest first, until fn returns false; until <= 0 means no upper bound
+func (s *MessageStore) scanRange(room string, since, until int64, fn func(key []byte, msg *Message) bool) error {
+	return s.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		prefix := roomKeyPrefix(room)
+		var end []byte
+		if until > 0 {
+			end = messageKey(room, until, "")
+		}
+
+		for it.Seek(messageKey(room, since, "")); it.ValidForPrefix(prefix); it.Next() {
+			key := it.Item().KeyCopy(nil)
+			if end != nil && bytes.Compare(key, end) >= 0 {
+				break
+			}
+
+			var msg Message
+			if err := it.Item().Value(func(val []byte) error {
+				return json.Unmarshal(val, &msg)
+			}); err != nil {
+				return err
+			}
+			if !fn(key, &msg) {
+				return nil
+			}
 		}
+		return nil
+	})
+}
+
+// StreamMessages calls fn for the messages of a room with since <= timestamp < until,
+// oldest first, without loading them all into memory; an empty room streams
+// every room and until <= 0 means no upper bound. An error from fn stops the
+// scan and is returned
+func (s *MessageStore) StreamMessages(room string, since, until int64, fn func(msg *Message) error) error {
+	rooms := []string{room}
+	if room == "" {
+		var err error
+		if rooms, err = s.Rooms(); err != nil {
+			return err
+		}
+	}
+
+	for _, r := range rooms {
+		var fnErr error
+		err := s.scanRange(r, since, until, func(_ []byte, msg *Message) bool {
+			fnErr = fn(msg)
+			return fnErr == nil
+		})
+		if err != nil {
+			return err
+		}
+		if fnErr != nil {
+			return fnErr
+		}
+	}
+	return nil
+}
+
+// ImportMessage stores a message unless one with the same ID already exists
+// It returns whether the message was stored
+func (s *MessageStore) ImportMessage(msg *Message) (bool, error) {
+	if msg.ID == "" {
+		msg.ID = legacyID(msg)
+	}
+	if msg.Expires != 0 && msg.Expires <= time.Now().Unix() {
+		return false, nil
+	}
+
+	stored := false
+	err := s.db.Update(func(txn *badger.Txn) error {
+		_, err := txn.Get(idKey(msg.ID))
+		if err == nil {
+			return nil // Duplicate
+		}
+		if err != badger.ErrKeyNotFound {
+			return err
+		}
+		stored = true
+		return saveMessage(txn, msg)
+	})
+
+	if err != nil {
+		return false, err
+	}
+	return stored, nil
+}
+
+// forEachMessage calls fn for every stored message, room by room, until fn returns false
+func (s *MessageStore) forEachMessage(fn func(msg *Message) bool) error {
+	return s.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
 
-		// Delete collected keys
-		for _, key := range keysToDelete {
-			if err := txn.Delete(key); err != nil {
+		prefix := []byte(msgPrefix)
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			var msg Message
+			err := it.Item().Value(func(val []byte) error {
+				return json.Unmarshal(val, &msg)
+			})
+			if err != nil {
 				return err
 			}
-			deletedCount++
+			if !fn(&msg) {
+				return nil
+			}
 		}
+		return nil
+	})
+}
+
+// Rooms returns the rooms that have stored messages
+// The scan jumps from room to room instead of reading every key
+func (s *MessageStore) Rooms() ([]string, error) {
+	var rooms []string
 
+	err := s.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		prefix := []byte(msgPrefix)
+		for it.Seek(prefix); it.ValidForPrefix(prefix); {
+			room, _, _, ok := splitMessageKey(it.Item().Key())
+			if !ok {
+				it.Next()
+				continue
+			}
+			rooms = append(rooms, room)
+			it.Seek(prefixEnd(roomKeyPrefix(room)))
+		}
 		return nil
 	})
 
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
 
-	return deletedCount, nil
+	return rooms, nil
+}
+
+// Clear removes all messages from the store
+func (s *MessageStore) Clear() error {
+	_, err := s.ClearAllMessages()
+	return err
+}
+
+// ClearAllMessages removes every message and its index entries
+// Other data in the database (moderation log, mailbox, outbox, schema
+// version) is kept. It returns the number of messages deleted
+func (s *MessageStore) ClearAllMessages() (int, error) {
+	return deleteFromAllRooms(s, 0, 0)
+}
+
+// ClearOldMessages removes messages older than the specified number of days
+func (s *MessageStore) ClearOldMessages(days int) (int, error) {
+	if days <= 0 {
+		return 0, fmt.Errorf("days must be greater than 0")
+	}
+	return deleteFromAllRooms(s, 0, time.Now().AddDate(0, 0, -days).Unix())
+}
+
+// deleteBatchSize bounds how many messages are deleted per transaction
+const deleteBatchSize = 1000
+
+// DeleteMessagesInRange deletes the messages of a room with since <= timestamp < until
+// until <= 0 means no upper bound. It returns the number of messages deleted
+func (s *MessageStore) DeleteMessagesInRange(room string, since, until int64) (int, error) {
+	type doomed struct {
+		key []byte
+		msg *Message
+	}
+
+	deletedCount := 0
+	for {
+		var batch []doomed
+		err := s.scanRange(room, since, until, func(key []byte, msg *Message) bool {
+			batch = append(batch, doomed{key: key, msg: msg})
+			return len(batch) < deleteBatchSize
+		})
+		if err != nil {
+			return deletedCount, err
+		}
+		if len(batch) == 0 {
+			return deletedCount, nil
+		}
+
+		now := time.Now().Unix()
+		err = s.db.Update(func(txn *badger.Txn) error {
+			for _, d := range batch {
+				if err := removeMessage(txn, d.key, d.msg, now); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return deletedCount, err
+		}
+		deletedCount += len(batch)
+	}
 }
 
 // GetMessageCount returns the total number of messages in the store
 func (s *MessageStore) GetMessageCount() (int, error) {
+	return s.countPrefix(msgPrefix)
+}
+
+// countPrefix counts the keys starting with prefix
+func (s *MessageStore) countPrefix(prefix string) (int, error) {
 	count := 0
 
 	err := s.db.View(func(txn *badger.Txn) error {
@@ -180,8 +697,8 @@ func (s *MessageStore) GetMessageCount() (int, error) {
 		it := txn.NewIterator(opts)
 		defer it.Close()
 
-		prefix := []byte("msg_")
-		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		p := []byte(prefix)
+		for it.Seek(p); it.ValidForPrefix(p); it.Next() {
 			count++
 		}
 		return nil
@@ -194,6 +711,162 @@ func (s *MessageStore) GetMessageCount() (int, error) {
 	return count, nil
 }
 
+// SaveModerationEvent persists a signed moderation event for a room
+func (s *MessageStore) SaveModerationEvent(room, id string, data []byte) error {
+	return s.db.Update(func(txn *badger.Txn) error {
+		key := fmt.Sprintf("mod_%s_%s", room, id)
+		return txn.Set([]byte(key), data)
+	})
+}
+
+// GetModerationEvents returns all persisted moderation events for a room
+func (s *MessageStore) GetModerationEvents(room string) ([][]byte, error) {
+	return s.getPrefix(fmt.Sprintf("mod_%s_", room))
+}
+
+// PutMailboxEnvelope stores an envelope held for an offline recipient
+// Badger expires the entry on its own once ttl has passed
+func (s *MessageStore) PutMailboxEnvelope(recipient, id string, data []byte, ttl time.Duration) error {
+	return s.db.Update(func(txn *badger.Txn) error {
+		key := fmt.Sprintf("mbox_%s_%s", recipient, id)
+		return txn.SetEntry(badger.NewEntry([]byte(key), data).WithTTL(ttl))
+	})
+}
+
+// GetMailboxEnvelopes returns all envelopes held for a recipient
+func (s *MessageStore) GetMailboxEnvelopes(recipient string) ([][]byte, error) {
+	return s.getPrefix(fmt.Sprintf("mbox_%s_", recipient))
+}
+
+// DeleteMailboxEnvelopes removes delivered envelopes for a recipient
+func (s *MessageStore) DeleteMailboxEnvelopes(recipient string, ids []string) error {
+	return s.db.Update(func(txn *badger.Txn) error {
+		for _, id := range ids {
+			key := fmt.Sprintf("mbox_%s_%s", recipient, id)
+			if err := txn.Delete([]byte(key)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// SaveMailboxMember records a peer registered with this node's mailbox
+func (s *MessageStore) SaveMailboxMember(room, peerID string, data []byte, ttl time.Duration) error {
+	return s.db.Update(func(txn *badger.Txn) error {
+		key := fmt.Sprintf("mbmember_%s_%s", room, peerID)
+		return txn.SetEntry(badger.NewEntry([]byte(key), data).WithTTL(ttl))
+	})
+}
+
+// GetMailboxMembers returns all peers registered with this node's mailbox for a room
+func (s *MessageStore) GetMailboxMembers(room string) ([][]byte, error) {
+	return s.getPrefix(fmt.Sprintf("mbmember_%s_", room))
+}
+
+// SaveOutboxEntry queues an unsent message until mesh peers are available
+// A ttl > 0 drops the entry once it has passed, 0 keeps it until sent
+func (s *MessageStore) SaveOutboxEntry(id string, timestamp int64, data []byte, ttl time.Duration) error {
+	return s.db.Update(func(txn *badger.Txn) error {
+		e := badger.NewEntry(outboxKey(id, timestamp), data)
+		if ttl > 0 {
+			e = e.WithTTL(ttl)
+		}
+		return txn.SetEntry(e)
+	})
+}
+
+// GetOutboxEntries returns queued messages, oldest first
+func (s *MessageStore) GetOutboxEntries() ([][]byte, error) {
+	return s.getPrefix("outbox_")
+}
+
+// DeleteOutboxEntry removes a message from the outbox once it has been sent
+func (s *MessageStore) DeleteOutboxEntry(id string, timestamp int64) error {
+	return s.db.Update(func(txn *badger.Txn) error {
+		return txn.Delete(outboxKey(id, timestamp))
+	})
+}
+
+// SaveCacheEntry persists a DHT cache entry until ttl has passed
+func (s *MessageStore) SaveCacheEntry(id string, data []byte, ttl time.Duration) error {
+	return s.db.Update(func(txn *badger.Txn) error {
+		return txn.SetEntry(badger.NewEntry([]byte("dhtcache_"+id), data).WithTTL(ttl))
+	})
+}
+
+// GetCacheEntries returns all unexpired DHT cache entries
+func (s *MessageStore) GetCacheEntries() ([][]byte, error) {
+	return s.getPrefix("dhtcache_")
+}
+
+// DeleteCacheEntries removes evicted or forgotten DHT cache entries
+func (s *MessageStore) DeleteCacheEntries(ids []string) error {
+	return s.db.Update(func(txn *badger.Txn) error {
+		for _, id := range ids {
+			if err := txn.Delete([]byte("dhtcache_" + id)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// SaveProvideEntry persists an entry of the DHT reprovider
+func (s *MessageStore) SaveProvideEntry(cid string, data []byte) error {
+	return s.db.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte("provide_"+cid), data)
+	})
+}
+
+// GetProvideEntries returns all entries of the DHT reprovider
+func (s *MessageStore) GetProvideEntries() ([][]byte, error) {
+	return s.getPrefix("provide_")
+}
+
+// DeleteProvideEntries removes content the DHT reprovider no longer announces
+func (s *MessageStore) DeleteProvideEntries(cids []string) error {
+	return s.db.Update(func(txn *badger.Txn) error {
+		for _, cid := range cids {
+			if err := txn.Delete([]byte("provide_" + cid)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// outboxKey builds a zero-padded key so entries iterate in send order
+func outboxKey(id string, timestamp int64) []byte {
+	return []byte(fmt.Sprintf("outbox_%020d_%s", timestamp, id))
+}
+
+// getPrefix returns copies of all values whose keys start with prefix
+func (s *MessageStore) getPrefix(prefix string) ([][]byte, error) {
+	var values [][]byte
+
+	err := s.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		p := []byte(prefix)
+		for it.Seek(p); it.ValidForPrefix(p); it.Next() {
+			data, err := it.Item().ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			values = append(values, data)
+		}
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return values, nil
+}
+
 // Close closes the database
 func (s *MessageStore) Close() error {
 	return s.db.Close()
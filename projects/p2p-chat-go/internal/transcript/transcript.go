@@ -0,0 +1,276 @@
+package transcript
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/geekp2p/p2p-chat-go/internal/storage"
+)
+
+// Format is a transcript file format
+type Format string
+
+// Supported formats
+const (
+	FormatJSONL    Format = "jsonl" // One stored message per line; can be imported
+	FormatMarkdown Format = "md"    // Readable transcript for postmortems
+	FormatHTML     Format = "html"  // Self-contained page
+)
+
+// ParseFormat validates a format name
+func ParseFormat(name string) (Format, error) {
+	switch f := Format(strings.ToLower(name)); f {
+	case FormatJSONL, FormatMarkdown, FormatHTML:
+		return f, nil
+	case "markdown":
+		return FormatMarkdown, nil
+	}
+	return "", fmt.Errorf("unknown format %q (use jsonl, md or html)", name)
+}
+
+// Ext returns the file extension of a format
+func (f Format) Ext() string {
+	return string(f)
+}
+
+// Store is the part of the message store used for export and import
+type Store interface {
+	StreamMessages(room string, since, until int64, fn func(msg *storage.Message) error) error
+	ImportMessage(msg *storage.Message) (bool, error)
+}
+
+// ExportOptions selects the messages to export
+type ExportOptions struct {
+	Room   string // Empty exports every room
+	Since  int64  // Unix time, inclusive (0 = from the beginning)
+	Until  int64  // Unix time, exclusive (0 = up to now)
+	Format Format
+}
+
+// Export streams the selected messages to w and returns how many were written
+func Export(store Store, w io.Writer, opts ExportOptions) (int, error) {
+	bw := bufio.NewWriter(w)
+	enc := newEncoder(bw, opts)
+
+	if err := enc.begin(); err != nil {
+		return 0, err
+	}
+
+	count := 0
+	err := store.StreamMessages(opts.Room, opts.Since, opts.Until, func(msg *storage.Message) error {
+		count++
+		return enc.message(msg)
+	})
+	if err != nil {
+		return count, err
+	}
+
+	if err := enc.end(count); err != nil {
+		return count, err
+	}
+	return count, bw.Flush()
+}
+
+// ImportResult summarises an import
+type ImportResult struct {
+	Imported  int // New messages stored
+	Duplicate int // Messages already in the store
+	Invalid   int // Lines that were not valid messages
+}
+
+// maxLineSize bounds a single JSONL line
+const maxLineSize = 1 << 20
+
+// Import reads a JSONL transcript and stores messages not yet in the store
+// Messages without a room are filed under defaultRoom
+func Import(store Store, r io.Reader, defaultRoom string) (*ImportResult, error) {
+	result := &ImportResult{}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxLineSize)
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		var msg storage.Message
+		if err := json.Unmarshal([]byte(line), &msg); err != nil || msg.Type == "" || msg.Timestamp == 0 {
+			result.Invalid++
+			continue
+		}
+		if msg.Room == "" {
+			msg.Room = defaultRoom
+		}
+
+		stored, err := store.ImportMessage(&msg)
+		if err != nil {
+			return result, fmt.Errorf("failed to import message %s: %w", msg.ID, err)
+		}
+		if stored {
+			result.Imported++
+		} else {
+			result.Duplicate++
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return result, fmt.Errorf("failed to read transcript: %w", err)
+	}
+	return result, nil
+}
+
+// encoder writes one transcript format
+type encoder interface {
+	begin() error
+	message(msg *storage.Message) error
+	end(count int) error
+}
+
+// newEncoder returns the encoder for opts.Format
+func newEncoder(w *bufio.Writer, opts ExportOptions) encoder {
+	switch opts.Format {
+	case FormatMarkdown:
+		return &markdownEncoder{w: w, opts: opts}
+	case FormatHTML:
+		return &htmlEncoder{w: w, opts: opts}
+	default:
+		return &jsonlEncoder{enc: json.NewEncoder(w)}
+	}
+}
+
+// jsonlEncoder writes stored messages verbatim, one per line
+type jsonlEncoder struct {
+	enc *json.Encoder
+}
+
+func (e *jsonlEncoder) begin() error                       { return nil }
+func (e *jsonlEncoder) message(msg *storage.Message) error { return e.enc.Encode(msg) }
+func (e *jsonlEncoder) end(int) error                      { return nil }
+
+// markdownEncoder writes a readable transcript
+type markdownEncoder struct {
+	w    *bufio.Writer
+	opts ExportOptions
+	day  string
+}
+
+func (e *markdownEncoder) begin() error {
+	_, err := fmt.Fprintf(e.w, "# Chat transcript: %s\n\n%s\n", title(e.opts), describeRange(e.opts))
+	return err
+}
+
+func (e *markdownEncoder) message(msg *storage.Message) error {
+	t := time.Unix(msg.Timestamp, 0)
+
+	// Group messages under a heading per day
+	if day := t.Format("2006-01-02"); day != e.day {
+		e.day = day
+		if _, err := fmt.Fprintf(e.w, "\n## %s\n\n", day); err != nil {
+			return err
+		}
+	}
+
+	var err error
+	switch msg.Type {
+	case "message":
+		_, err = fmt.Fprintf(e.w, "- `%s` **%s**: %s\n", t.Format("15:04:05"), escapeMarkdown(msg.Username), escapeMarkdown(msg.Content))
+	default:
+		_, err = fmt.Fprintf(e.w, "- `%s` _%s_\n", t.Format("15:04:05"), escapeMarkdown(msg.Content))
+	}
+	return err
+}
+
+func (e *markdownEncoder) end(count int) error {
+	_, err := fmt.Fprintf(e.w, "\n---\n%d message(s), exported %s\n", count, time.Now().Format(time.RFC3339))
+	return err
+}
+
+// htmlEncoder writes a self-contained HTML page
+type htmlEncoder struct {
+	w    *bufio.Writer
+	opts ExportOptions
+}
+
+func (e *htmlEncoder) begin() error {
+	name := html.EscapeString(title(e.opts))
+	_, err := fmt.Fprintf(e.w, `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Chat transcript: %s</title>
+<style>
+body { font-family: sans-serif; max-width: 900px; margin: 2em auto; color: #222; }
+table { border-collapse: collapse; width: 100%%; }
+td { padding: 4px 8px; vertical-align: top; border-bottom: 1px solid #eee; }
+td.time { color: #888; white-space: nowrap; font-family: monospace; }
+td.user { font-weight: bold; white-space: nowrap; }
+tr.event td { color: #888; font-style: italic; }
+</style>
+</head>
+<body>
+<h1>Chat transcript: %s</h1>
+<p>%s</p>
+<table>
+`, name, name, html.EscapeString(describeRange(e.opts)))
+	return err
+}
+
+func (e *htmlEncoder) message(msg *storage.Message) error {
+	ts := time.Unix(msg.Timestamp, 0).Format("2006-01-02 15:04:05")
+
+	var err error
+	switch msg.Type {
+	case "message":
+		_, err = fmt.Fprintf(e.w, "<tr><td class=\"time\">%s</td><td class=\"user\" title=\"%s\">%s</td><td>%s</td></tr>\n",
+			ts, html.EscapeString(msg.From), html.EscapeString(msg.Username), html.EscapeString(msg.Content))
+	default:
+		_, err = fmt.Fprintf(e.w, "<tr class=\"event\"><td class=\"time\">%s</td><td></td><td>%s</td></tr>\n",
+			ts, html.EscapeString(msg.Content))
+	}
+	return err
+}
+
+func (e *htmlEncoder) end(count int) error {
+	_, err := fmt.Fprintf(e.w, "</table>\n<p>%d message(s), exported %s</p>\n</body>\n</html>\n",
+		count, time.Now().Format(time.RFC3339))
+	return err
+}
+
+// title names the exported room(s)
+func title(opts ExportOptions) string {
+	if opts.Room == "" {
+		return "all rooms"
+	}
+	return opts.Room
+}
+
+// describeRange describes the exported time range
+func describeRange(opts ExportOptions) string {
+	from := "the beginning"
+	if opts.Since != 0 {
+		from = time.Unix(opts.Since, 0).Format("2006-01-02 15:04")
+	}
+	to := "now"
+	if opts.Until != 0 {
+		to = time.Unix(opts.Until, 0).Format("2006-01-02 15:04")
+	}
+	return fmt.Sprintf("Messages from %s to %s.", from, to)
+}
+
+// markdownReplacer keeps message text from being rendered as markup
+var markdownReplacer = strings.NewReplacer(
+	"\\", "\\\\", "*", "\\*", "_", "\\_", "`", "\\`", "[", "\\[", "]", "\\]",
+	"<", "&lt;", ">", "&gt;", "#", "\\#", "\n", " ",
+)
+
+// escapeMarkdown escapes characters with a meaning in Markdown
+func escapeMarkdown(s string) string {
+	return markdownReplacer.Replace(s)
+}
@@ -6,24 +6,86 @@ import (
 	"fmt"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strconv"
 	"syscall"
 	"time"
 
+	"github.com/geekp2p/p2p-chat-go/internal/backup"
 	"github.com/geekp2p/p2p-chat-go/internal/cli"
+	"github.com/geekp2p/p2p-chat-go/internal/dag"
 	dhtstorage "github.com/geekp2p/p2p-chat-go/internal/dht"
+	"github.com/geekp2p/p2p-chat-go/internal/history"
+	"github.com/geekp2p/p2p-chat-go/internal/identity"
+	"github.com/geekp2p/p2p-chat-go/internal/janitor"
+	"github.com/geekp2p/p2p-chat-go/internal/mailbox"
 	"github.com/geekp2p/p2p-chat-go/internal/messaging"
+	"github.com/geekp2p/p2p-chat-go/internal/moderation"
 	"github.com/geekp2p/p2p-chat-go/internal/node"
+	"github.com/geekp2p/p2p-chat-go/internal/outbox"
 	relayservice "github.com/geekp2p/p2p-chat-go/internal/relay"
+	"github.com/geekp2p/p2p-chat-go/internal/roommeta"
 	"github.com/geekp2p/p2p-chat-go/internal/routing"
 	"github.com/geekp2p/p2p-chat-go/internal/storage"
 	"github.com/geekp2p/p2p-chat-go/internal/updater"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
 )
 
 func main() {
+	// Maintenance subcommands run instead of the chat
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "db":
+			os.Exit(runDB(os.Args[2:]))
+		case "export":
+			os.Exit(runExport(os.Args[2:]))
+		case "import":
+			os.Exit(runImport(os.Args[2:]))
+		case "backup":
+			os.Exit(runBackup(os.Args[2:]))
+		case "restore":
+			os.Exit(runRestore(os.Args[2:]))
+		case "swarm-key":
+			os.Exit(runSwarmKey(os.Args[2:]))
+		}
+	}
+
 	// Parse command-line flags
 	versionFlag := flag.Bool("version", false, "Show version information")
+	mailboxFlag := flag.Bool("mailbox", false, "Hold encrypted messages for offline room members")
+	mailboxTTL := flag.Duration("mailbox-ttl", mailbox.DefaultConfig().TTL, "How long the mailbox holds a message")
+	mailboxQuota := flag.Int("mailbox-quota", mailbox.DefaultConfig().MaxMessages, "Maximum messages held per offline member")
+	syncWindow := flag.Duration("sync-window", 7*24*time.Hour, "How far back to synchronise history with peers")
+	roomTTL := flag.Duration("room-ttl", 0, "Make every message in the room disappear after this long (0 = keep)")
+	ephemeralFlag := flag.Bool("ephemeral", false, "Keep identity and history in memory only; nothing is written to disk")
+	dhtCacheEntries := flag.Int("dht-cache-entries", dhtstorage.DefaultCacheConfig().MaxEntries, "Most messages kept in the DHT cache (0 = no limit)")
+	dhtCacheMB := flag.Int64("dht-cache-mb", dhtstorage.DefaultCacheConfig().MaxBytes>>20, "Most megabytes kept in the DHT cache (0 = no limit)")
+	reprovideInterval := flag.Duration("reprovide-interval", dhtstorage.DefaultReproviderConfig().Interval, "How often provided content is re-announced to the DHT (0 = only with /dht reprovide)")
+	reprovideMaxAge := flag.Duration("reprovide-max-age", dhtstorage.DefaultReproviderConfig().MaxAge, "Stop re-announcing unpinned content tracked longer ago than this (0 = never)")
+	persistDHTCache := flag.Bool("persist-dht-cache", true, "Keep the DHT cache in the message store across restarts")
+	retentionFlag := flag.String("retention", os.Getenv("RETENTION"), "History to keep: ages and counts, optionally per room (e.g. 30d,10000,ops=7d)")
+	networkConfigFlag := flag.String("network-config", os.Getenv("NETWORK_CONFIG"), "JSON file with the network settings (default DATA_DIR/network.json if present)")
+	listenFlag := flag.String("listen", os.Getenv("LISTEN_ADDRS"), "Comma-separated multiaddrs to listen on, or 'none' (default: TCP and QUIC on all interfaces)")
+	announceFlag := flag.String("announce", os.Getenv("ANNOUNCE_ADDRS"), "Comma-separated multiaddrs to advertise instead of the listen addresses")
+	portFlag := flag.Int("port", envInt("P2P_PORT"), "Fixed TCP and QUIC port of the default listen addresses (0 = random)")
+	bootstrapFlag := flag.String("bootstrap", os.Getenv("BOOTSTRAP_PEERS"), "Comma-separated bootstrap peer multiaddrs, or 'none' (default: public IPFS nodes)")
+	relaysFlag := flag.String("relays", os.Getenv("STATIC_RELAYS"), "Comma-separated static relay multiaddrs, or 'none' (default: public libp2p relays)")
+	dhtModeFlag := flag.String("dht", os.Getenv("DHT_MODE"), "DHT to join: public, isolated (chat DHT only) or bridge (both, while migrating) (default public)")
+	dhtPrefixFlag := flag.String("dht-prefix", os.Getenv("DHT_PREFIX"), "Protocol prefix of the chat DHT (default "+node.RecordProtocolPrefix+")")
+	dhtServerFlag := flag.Bool("dht-server", envBool("DHT_SERVER"), "Always act as a DHT server, for well-connected team servers")
+	wsPortFlag := flag.Int("ws-port", envInt("WS_PORT"), "Also accept WebSocket connections on this TCP port, e.g. for browsers (0 = off)")
+	webTransportFlag := flag.Bool("webtransport", envBool("WEBTRANSPORT"), "Also accept WebTransport connections on the QUIC port")
+	tlsCertFlag := flag.String("tls-cert", os.Getenv("TLS_CERT"), "PEM certificate to serve secure WebSocket (wss) with")
+	tlsKeyFlag := flag.String("tls-key", os.Getenv("TLS_KEY"), "PEM private key of --tls-cert")
 	flag.Parse()
 
+	retention, err := storage.ParseRetention(*retentionFlag)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "--retention: %v\n", err)
+		os.Exit(2)
+	}
+
 	// Handle --version flag
 	if *versionFlag {
 		fmt.Println(updater.GetVersionInfo())
@@ -35,14 +97,35 @@ func main() {
 	fmt.Println()
 
 	// Get configuration from environment variables
-	chatTopic := os.Getenv("CHAT_TOPIC")
-	if chatTopic == "" {
-		chatTopic = "p2p-chat-default"
+	chatTopic, dataDir := envConfig()
+
+	// A swarm key makes the network private
+	swarmKey, swarmKeySource, err := node.LoadSwarmKey(os.Getenv("SWARM_KEY"), dataDir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", swarmKeySource, err)
+		os.Exit(2)
 	}
 
-	dataDir := os.Getenv("DATA_DIR")
-	if dataDir == "" {
-		dataDir = "./data"
+	// Network addresses: the config file, overridden by flags and environment
+	networkCfg, err := networkConfig(dataDir, *networkConfigFlag, node.NetworkConfig{
+		Listen:    node.ParseAddrList(*listenFlag),
+		Announce:  node.ParseAddrList(*announceFlag),
+		Port:      *portFlag,
+		Bootstrap: node.ParseAddrList(*bootstrapFlag),
+		Relays:    node.ParseAddrList(*relaysFlag),
+		DHTMode:   *dhtModeFlag,
+		DHTPrefix: *dhtPrefixFlag,
+		DHTServer: *dhtServerFlag,
+
+		WebSocketPort: *wsPortFlag,
+		WebTransport:  *webTransportFlag,
+		TLSCert:       *tlsCertFlag,
+		TLSKey:        *tlsKeyFlag,
+		SwarmKey:      swarmKey,
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(2)
 	}
 
 	// Create context that can be cancelled
@@ -60,7 +143,18 @@ func main() {
 
 	// Initialize P2P node (verbose mode off by default)
 	fmt.Println("Initializing P2P node...")
-	p2pNode, err := node.NewP2PNode(ctx, false)
+	var p2pNode *node.P2PNode
+	if *ephemeralFlag {
+		var priv crypto.PrivKey
+		priv, err = identity.NewEphemeralIdentity()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to create identity: %v\n", err)
+			os.Exit(1)
+		}
+		p2pNode, err = node.NewP2PNodeWithIdentity(ctx, priv, networkCfg, false)
+	} else {
+		p2pNode, err = node.NewP2PNode(ctx, dataDir, networkCfg, false)
+	}
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Failed to create P2P node: %v\n", err)
 		os.Exit(1)
@@ -86,18 +180,62 @@ func main() {
 
 	// Initialize distributed storage
 	fmt.Println("Initializing distributed storage (DHT-based)...")
-	dhtStorage := dhtstorage.NewDistributedStorage(ctx, p2pNode.Host, p2pNode.DHT, p2pNode.Verbose)
-	defer dhtStorage.Close()
+	dhtStorage := dhtstorage.NewDistributedStorage(ctx, p2pNode.Host, p2pNode.ContentRouting, p2pNode.RecordDHT, p2pNode.Verbose)
+	if err := dhtStorage.SetCacheLimits(dhtstorage.CacheConfig{
+		MaxEntries: *dhtCacheEntries,
+		MaxBytes:   *dhtCacheMB << 20,
+	}); err != nil {
+		fmt.Printf("Warning: Failed to apply DHT cache limits: %v\n", err)
+	}
 
 	// Initialize message store
-	fmt.Printf("Initializing message store at: %s\n", dataDir)
-	store, err := storage.NewMessageStore(dataDir)
+	var store storage.Store
+	if *ephemeralFlag {
+		fmt.Println("Using in-memory message store (ephemeral: nothing is written to disk)")
+		store = storage.NewMemoryStore()
+	} else {
+		fmt.Printf("Initializing message store at: %s\n", dataDir)
+		store, err = storage.NewMessageStore(dataDir, storage.Options{
+			DefaultRoom: chatTopic,
+			Progress:    printMigrationProgress,
+			Encryption:  keySource(),
+		})
+	}
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Failed to create message store: %v\n", err)
 		os.Exit(1)
 	}
 	defer store.Close()
 
+	// Keep the DHT cache in the message store so it survives restarts
+	// (deferred after the store, so the cache stops writing before it closes)
+	if *persistDHTCache && !*ephemeralFlag {
+		if n, err := dhtStorage.PersistCache(store); err != nil {
+			fmt.Printf("Warning: Failed to load the DHT cache: %v\n", err)
+		} else if n > 0 {
+			fmt.Printf("✓ Loaded %d cached DHT message(s)\n", n)
+		}
+	}
+	defer dhtStorage.Close()
+
+	// Re-announce provided messages and index chunks before their provider
+	// records expire (closed before the store, like the cache)
+	reprovider, err := dhtstorage.NewReprovider(ctx, p2pNode.ContentRouting, store, dhtstorage.ReproviderConfig{
+		Interval: *reprovideInterval,
+		MaxAge:   *reprovideMaxAge,
+	}, p2pNode.Verbose)
+	if err != nil {
+		fmt.Printf("Warning: DHT reprovider not started: %v\n", err)
+	} else {
+		dhtStorage.SetReprovider(reprovider)
+		defer reprovider.Close()
+	}
+
+	// Purge disappearing messages, enforce retention and reclaim disk space
+	msgJanitor := janitor.New(ctx, store, janitor.DefaultInterval, p2pNode.Verbose)
+	msgJanitor.AddCache(dhtStorage)
+	msgJanitor.SetRetention(retention)
+
 	// Initialize messaging
 	fmt.Printf("Joining chat topic: %s\n", chatTopic)
 	msg, err := messaging.NewP2PMessaging(ctx, p2pNode.PubSub, chatTopic, p2pNode.Host.ID())
@@ -107,12 +245,88 @@ func main() {
 	}
 	defer msg.Close()
 
+	// Initialize room moderation (bans, mutes and admin roles)
+	modMgr, err := moderation.NewManager(ctx, p2pNode.Host, msg, store, chatTopic, p2pNode.Verbose)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to initialize moderation: %v\n", err)
+		os.Exit(1)
+	}
+	if owner := os.Getenv("ROOM_OWNER"); owner != "" {
+		ownerID, err := peer.Decode(owner)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid ROOM_OWNER peer ID: %v\n", err)
+			os.Exit(1)
+		}
+		if err := modMgr.SetOwner(ownerID); err != nil {
+			fmt.Fprintf(os.Stderr, "ROOM_OWNER: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	// Room title, description, rules and pins, editable by admins
+	roomMeta, err := roommeta.NewManager(ctx, p2pNode.Host, msg, store, modMgr, chatTopic, p2pNode.Verbose)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to initialize room metadata: %v\n", err)
+		os.Exit(1)
+	}
+	roomMeta.SetPublisher(dhtStorage)
+
 	// Start peer discovery
 	fmt.Println("Starting peer discovery...")
 	if err := p2pNode.DiscoverPeers(ctx, chatTopic); err != nil {
 		fmt.Fprintf(os.Stderr, "Warning: peer discovery failed: %v\n", err)
 	}
 
+	// Messages synced or fetched from peers must come from authors who may post
+	mayPost := func(m *storage.Message) bool {
+		author, err := peer.Decode(m.From)
+		if err != nil || modMgr.IsBanned(author) {
+			return false
+		}
+		return m.Type != "message" || !modMgr.IsMuted(author)
+	}
+
+	// Serve and request history synchronisation for late joiners; synced
+	// messages are checked like pubsub messages, bans and mutes included
+	historySync := history.NewService(ctx, p2pNode.Host, store, chatTopic, *syncWindow, p2pNode.Verbose)
+	historySync.SetVerifier(msg.VerifyRecord)
+	historySync.SetRetention(retention.For(chatTopic))
+	historySync.SetFilter(mayPost)
+
+	// Link room messages into a hash-linked DAG; gaps are filled from peers,
+	// then from message records in the DHT. Either way only messages signed
+	// by their author are stored
+	roomDAG := dag.New(ctx, p2pNode.Host, store, chatTopic, p2pNode.Verbose)
+	roomDAG.SetVerifier(msg.VerifyRecord)
+	roomDAG.SetFilter(mayPost)
+	roomDAG.SetFetcher(func(c string) (*storage.Message, error) {
+		m, err := dhtStorage.GetSignedMessage(c)
+		if err != nil {
+			return nil, err
+		}
+		return m.Message(chatTopic), nil
+	})
+
+	// Run a store-and-forward mailbox for offline members if requested
+	var mailboxSrv *mailbox.Server
+	if *mailboxFlag {
+		mbConfig := mailbox.DefaultConfig()
+		mbConfig.TTL = *mailboxTTL
+		mbConfig.MaxMessages = *mailboxQuota
+		mailboxSrv = mailbox.NewServer(ctx, p2pNode.Host, msg, store, chatTopic, mbConfig, p2pNode.Verbose)
+		mailboxSrv.SetMemberFilter(func(p peer.ID) bool {
+			return !modMgr.IsBanned(p)
+		})
+		defer mailboxSrv.Close()
+		fmt.Printf("✓ Mailbox enabled (TTL: %v, quota: %d messages per member)\n", mbConfig.TTL, mbConfig.MaxMessages)
+	}
+
+	// Mailbox client drains mailboxes that held messages while we were offline
+	mailboxClient, err := mailbox.NewClient(ctx, p2pNode.Host, msg, chatTopic, p2pNode.Verbose)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: mailbox client unavailable: %v\n", err)
+	}
+
 	// Wait for peers to connect and mesh to stabilize
 	fmt.Println("Waiting for GossipSub mesh to form...")
 	waitForMesh(msg, 30) // Wait up to 30 seconds for mesh to form
@@ -127,6 +341,27 @@ func main() {
 	chatCLI.SetRouter(router)
 	chatCLI.SetRelayService(relaySvc)
 	chatCLI.SetDHTStorage(dhtStorage)
+	chatCLI.SetModeration(modMgr)
+	chatCLI.SetRoomMeta(roomMeta)
+	chatCLI.SetMailbox(mailboxClient, mailboxSrv)
+	chatCLI.SetHistorySync(historySync)
+	chatCLI.SetDAG(roomDAG)
+	msgOutbox := outbox.New(ctx, msg, store, p2pNode.Verbose)
+	msgJanitor.AddQueue(msgOutbox)
+	msgJanitor.Start()
+	chatCLI.SetOutbox(msgOutbox)
+	chatCLI.SetRoomTTL(*roomTTL)
+	chatCLI.SetJanitor(msgJanitor)
+	chatCLI.SetExportDir(filepath.Join(dataDir, "exports"))
+	if diskStore, ok := store.(*storage.MessageStore); ok {
+		chatCLI.SetBackup(filepath.Join(dataDir, "backups"), func(path string, incremental bool) (*backup.Manifest, error) {
+			opts, err := backupOptions(dataDir, incremental, backupPassphrase() == "")
+			if err != nil {
+				return nil, err
+			}
+			return backup.Create(diskStore, path, opts)
+		})
+	}
 
 	if err := chatCLI.Start(); err != nil {
 		fmt.Fprintf(os.Stderr, "CLI error: %v\n", err)
@@ -134,6 +369,60 @@ func main() {
 	}
 }
 
+// envConfig returns the chat topic and data directory from the environment
+func envConfig() (chatTopic, dataDir string) {
+	chatTopic = os.Getenv("CHAT_TOPIC")
+	if chatTopic == "" {
+		chatTopic = "p2p-chat-default"
+	}
+
+	dataDir = os.Getenv("DATA_DIR")
+	if dataDir == "" {
+		dataDir = "./data"
+	}
+
+	return chatTopic, dataDir
+}
+
+// envBool reports whether an environment variable is set to a true value
+func envBool(name string) bool {
+	on, _ := strconv.ParseBool(os.Getenv(name))
+	return on
+}
+
+// envInt returns an integer environment variable, or 0 if it is not set
+func envInt(name string) int {
+	n, _ := strconv.Atoi(os.Getenv(name))
+	return n
+}
+
+// networkConfig loads the network config file and applies the settings given
+// by flags and environment variables on top of it
+// Without an explicit path, DATA_DIR/network.json is read if it exists
+func networkConfig(dataDir, path string, overrides node.NetworkConfig) (node.NetworkConfig, error) {
+	required := path != ""
+	if path == "" {
+		path = filepath.Join(dataDir, "network.json")
+	}
+	cfg, err := node.LoadNetworkConfig(path, required)
+	if err != nil {
+		return cfg, err
+	}
+	cfg = cfg.Override(overrides)
+	if _, err := cfg.Resolve(); err != nil {
+		return cfg, fmt.Errorf("invalid network config: %w", err)
+	}
+	return cfg, nil
+}
+
+// keySource returns the secret that encrypts the message store, if configured
+func keySource() storage.KeySource {
+	return storage.KeySource{
+		Passphrase: os.Getenv("IDENTITY_PASSPHRASE"),
+		KeyFile:    os.Getenv("DB_KEYFILE"),
+	}
+}
+
 // waitForMesh waits for the GossipSub mesh to form (with timeout)
 func waitForMesh(msg *messaging.P2PMessaging, maxSeconds int) {
 	startTime := time.Now()
@@ -168,7 +457,7 @@ func waitForMesh(msg *messaging.P2PMessaging, maxSeconds int) {
 	} else {
 		fmt.Println("⚠ No mesh peers found yet")
 		fmt.Println("  This is normal if you're the first peer.")
-		fmt.Println("  Messages will be delivered as other peers join.")
+		fmt.Println("  Messages will be queued and delivered as other peers join.")
 		fmt.Println("  Use /mesh to check mesh status.")
 	}
 }
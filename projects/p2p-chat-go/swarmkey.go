@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/geekp2p/p2p-chat-go/internal/node"
+)
+
+// runSwarmKey handles `p2p-chat swarm-key generate [file]` and returns the
+// exit code
+func runSwarmKey(args []string) int {
+	if len(args) < 1 || len(args) > 2 || args[0] != "generate" {
+		fmt.Fprintln(os.Stderr, "Usage: p2p-chat swarm-key generate [file]")
+		fmt.Fprintln(os.Stderr, "  Writes a new pre-shared key to DATA_DIR/swarm.key (or file; - for stdout).")
+		fmt.Fprintln(os.Stderr, "  Only peers holding the same key can connect to each other.")
+		return 2
+	}
+
+	key, err := node.GenerateSwarmKey()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "❌ %v\n", err)
+		return 1
+	}
+
+	var path string
+	if len(args) == 2 {
+		path = args[1]
+	} else {
+		_, dataDir := envConfig()
+		if err := os.MkdirAll(dataDir, 0700); err != nil {
+			fmt.Fprintf(os.Stderr, "❌ Failed to create data directory: %v\n", err)
+			return 1
+		}
+		path = filepath.Join(dataDir, node.SwarmKeyFile)
+	}
+	if path == "-" {
+		os.Stdout.Write(key)
+		return 0
+	}
+
+	// Never replace a key: peers still using it would be cut off
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if errors.Is(err, os.ErrExist) {
+		fmt.Fprintf(os.Stderr, "❌ %s already exists; remove it first to create a new network\n", path)
+		return 1
+	}
+	if err == nil {
+		_, err = f.Write(key)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "❌ Failed to write swarm key: %v\n", err)
+		return 1
+	}
+
+	psk, _, err := node.LoadSwarmKey(path, "")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "❌ %v\n", err)
+		return 1
+	}
+	fmt.Printf("✓ Swarm key written to %s (fingerprint %s)\n", path, node.SwarmKeyFingerprint(psk))
+	fmt.Println("  Copy it to DATA_DIR/swarm.key of every peer, or set SWARM_KEY, to join this private network.")
+	return 0
+}